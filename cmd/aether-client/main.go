@@ -68,6 +68,8 @@ type clientOptions struct {
 	psk         string
 	listenAddr  string
 	dialAddr    string
+	sni         string
+	host        string
 	rotateAfter time.Duration
 	maxPadding  uint16
 	autoIP      bool
@@ -81,6 +83,8 @@ func main() {
 	flag.StringVar(&opts.psk, "psk", "", "pre-shared key for metadata encryption")
 	flag.StringVar(&opts.listenAddr, "listen", "127.0.0.1:1080", "local SOCKS5 listen address")
 	flag.StringVar(&opts.dialAddr, "dial-addr", "", "override dial address for QUIC (e.g. 203.0.113.10:443)")
+	flag.StringVar(&opts.sni, "sni", "", "override TLS server name (SNI) presented to the gateway")
+	flag.StringVar(&opts.host, "host", "", "override host (:authority) of the WebTransport CONNECT request")
 	flag.DurationVar(&opts.rotateAfter, "rotate", 20*time.Minute, "session rotation interval")
 	var maxPadding uint
 	flag.UintVar(&maxPadding, "max-padding", 128, "maximum random padding per record")
@@ -119,6 +123,8 @@ func main() {
 	defer cancel()
 	manager.startRotation(ctx)
 
+	// go-socks5 only serves CONNECT; UDP ASSOCIATE is out of scope for this
+	// client (aetherd relays UDP, see internal/core/udp_relay.go).
 	socksConf := &socks5.Config{
 		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
 			host, portStr, err := net.SplitHostPort(addr)
@@ -195,13 +201,11 @@ func (ng *nonceGenerator) getSessionID() [4]byte {
 }
 
 func newSessionManager(opts clientOptions) (*sessionManager, error) {
-	parsed, err := url.Parse(opts.serverURL)
+	ep, err := core.ResolveEndpoint(opts.serverURL, opts.dialAddr, opts.sni, opts.host)
 	if err != nil {
 		return nil, err
 	}
-	if parsed.Scheme != "https" {
-		return nil, fmt.Errorf("url must be https")
-	}
+	log.Printf("Endpoint: %s", ep)
 
 	// V5.2: Apply window profile
 	windowCfg, err := core.ResolveQUICWindowConfig(opts.windowProfile)
@@ -222,15 +226,19 @@ func newSessionManager(opts clientOptions) (*sessionManager, error) {
 
 	dialer := &webtransport.Dialer{
 		TLSClientConfig: (&tlsConfig{
-			serverName: parsed.Hostname(),
+			serverName: ep.SNI,
 			skipVerify: opts.skipVerify,
 		}).toTLSConfig(),
 		QUICConfig: quicConfig,
+		// The CONNECT URL carries the authority; always dial the endpoint's address.
+		DialAddr: func(ctx context.Context, _ string, tlsCfg *tls.Config, cfg *quic.Config) (*quic.Conn, error) {
+			return quic.DialAddrEarly(ctx, ep.DialAddr, tlsCfg, cfg)
+		},
 	}
 
 	return &sessionManager{
 		opts:        opts,
-		url:         parsed,
+		url:         ep.URL,
 		dialer:      dialer,
 		closeSignal: make(chan struct{}),
 	}, nil
@@ -316,28 +324,21 @@ func (m *sessionManager) dialSession(ctx context.Context) (*webtransport.Session
 	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
 	defer cancel()
 
-	// Determine the URL to dial
+	// The URL's host is the CONNECT authority; the dialer dials the
+	// endpoint's dial address (see newSessionManager).
 	dialURL := m.url.String()
 
-	// If dialAddr is specified, construct URL with override address
-	if m.opts.dialAddr != "" {
-		// Parse dialAddr to ensure it has port
-		host, port, err := net.SplitHostPort(m.opts.dialAddr)
-		if err != nil {
-			// If no port specified, add default 443
-			if strings.Contains(err.Error(), "missing port in address") {
-				m.opts.dialAddr = net.JoinHostPort(m.opts.dialAddr, "443")
-			}
-			host, port, _ = net.SplitHostPort(m.opts.dialAddr)
-		}
-
-		// Construct new URL with override host:port
-		parsedCopy := *m.url
-		parsedCopy.Host = net.JoinHostPort(host, port)
-		dialURL = parsedCopy.String()
+	// The gateway only upgrades CONNECT requests carrying a valid auth token.
+	tokenPath := m.url.Path
+	if tokenPath == "" {
+		tokenPath = "/"
+	}
+	header := http.Header{}
+	if err := core.SetAuthToken(header, m.opts.psk, tokenPath, time.Now()); err != nil {
+		return nil, err
 	}
 
-	_, sess, err := m.dialer.Dial(ctx, dialURL, nil)
+	_, sess, err := m.dialer.Dial(ctx, dialURL, header)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"aether-rea/internal/core"
+	"aether-rea/internal/gateway"
+)
+
+// settings is the gateway configuration resolved from flags, environment
+// variables and the optional config file (-config/CONFIG_FILE), which takes
+// precedence.
+type settings struct {
+	listen     string
+	hopPorts   string
+	secretPath string
+
+	certFile      string
+	keyFile       string
+	domain        string
+	echKeyFile    string
+	echPublicName string
+
+	psk               string
+	pskSecondary      []core.PSKKey
+	usersFile         string
+	users             []core.User
+	authTokenOptional bool
+
+	decoyRoot     string
+	windowProfile string
+	scheduler     gateway.SchedulerConfig
+}
+
+// settingsFromFlags resolves flags and environment variables.
+func settingsFromFlags() (settings, error) {
+	s := settings{
+		listen:        *listenAddr,
+		hopPorts:      *hopPorts,
+		secretPath:    *secretPath,
+		certFile:      *certFile,
+		keyFile:       *keyFile,
+		domain:        os.Getenv("DOMAIN"),
+		echKeyFile:    *echKeyFile,
+		echPublicName: *echPublic,
+		psk:           *psk,
+		usersFile:     *usersFile,
+		decoyRoot:     *decoyRoot,
+		windowProfile: os.Getenv("WINDOW_PROFILE"),
+		scheduler:     schedulerConfigFromEnv(),
+	}
+
+	// Support $PORT or $LISTEN_ADDR environment variables
+	if envPort := os.Getenv("PORT"); envPort != "" {
+		s.listen = "0.0.0.0:" + envPort
+		log.Printf("Config: Using PORT environment variable: %s", s.listen)
+	} else if envAddr := os.Getenv("LISTEN_ADDR"); envAddr != "" {
+		s.listen = envAddr
+		log.Printf("Config: Using LISTEN_ADDR environment variable: %s", s.listen)
+	}
+
+	// Support $PSK environment variable
+	if envPSK := os.Getenv("PSK"); envPSK != "" && s.psk == "" {
+		s.psk = envPSK
+	}
+	// Support $SSL_CERT_FILE and $SSL_KEY_FILE for platform managed certs
+	if envCert := os.Getenv("SSL_CERT_FILE"); envCert != "" {
+		s.certFile = envCert
+	}
+	if envKey := os.Getenv("SSL_KEY_FILE"); envKey != "" {
+		s.keyFile = envKey
+	}
+	if envDecoy := os.Getenv("DECOY_ROOT"); envDecoy != "" {
+		s.decoyRoot = envDecoy
+	}
+	if envUsers := os.Getenv("USERS_FILE"); envUsers != "" && s.usersFile == "" {
+		s.usersFile = envUsers
+	}
+	if envECHKey := os.Getenv("ECH_KEY_FILE"); envECHKey != "" && s.echKeyFile == "" {
+		s.echKeyFile = envECHKey
+	}
+	if envECHPublic := os.Getenv("ECH_PUBLIC_NAME"); envECHPublic != "" && s.echPublicName == "" {
+		s.echPublicName = envECHPublic
+	}
+	if envHopPorts := os.Getenv("UDP_HOP_PORTS"); envHopPorts != "" && s.hopPorts == "" {
+		s.hopPorts = envHopPorts
+	}
+	// Tokens are required by default. AUTH_TOKEN=optional admits clients that
+	// predate CONNECT auth tokens during a migration; invalid tokens are
+	// rejected either way.
+	s.authTokenOptional = os.Getenv("AUTH_TOKEN") == "optional"
+
+	secondary := *pskSecondary
+	if envSecondary := os.Getenv("PSK_SECONDARY"); envSecondary != "" && secondary == "" {
+		secondary = envSecondary
+	}
+	keys, err := parseSecondaryKeys(secondary)
+	if err != nil {
+		return s, fmt.Errorf("invalid PSK_SECONDARY: %w", err)
+	}
+	s.pskSecondary = keys
+	return s, nil
+}
+
+// loadSettings applies the config file at path, if any, to base.
+func loadSettings(base settings, path string) (settings, error) {
+	if path == "" {
+		return base, nil
+	}
+	fc, err := gateway.LoadFileConfig(path)
+	if err != nil {
+		return base, err
+	}
+	return base.withFile(fc), nil
+}
+
+// withFile returns s overridden by the fields set in fc.
+func (s settings) withFile(fc *gateway.FileConfig) settings {
+	set := func(dst *string, v string) {
+		if v != "" {
+			*dst = v
+		}
+	}
+	set(&s.listen, fc.Listen)
+	set(&s.hopPorts, fc.HopPorts)
+	set(&s.secretPath, fc.SecretPath)
+	set(&s.certFile, fc.TLS.Cert)
+	set(&s.keyFile, fc.TLS.Key)
+	set(&s.domain, fc.TLS.Domain)
+	set(&s.echKeyFile, fc.TLS.ECHKey)
+	set(&s.echPublicName, fc.TLS.ECHPublicName)
+	if fc.PSK != "" {
+		s.psk = fc.PSK
+		s.pskSecondary = fc.PSKSecondary
+	}
+	set(&s.usersFile, fc.UsersFile)
+	s.users = fc.Users
+	if fc.AuthToken != "" {
+		s.authTokenOptional = fc.AuthToken == "optional"
+	}
+	set(&s.decoyRoot, fc.DecoyRoot)
+	set(&s.windowProfile, fc.WindowProfile)
+	s.scheduler = fc.Scheduler.Apply(s.scheduler)
+	return s
+}
+
+// listenAddr returns the listen address, binding all interfaces when only a
+// port is given.
+func (s settings) listenAddr() string {
+	if strings.HasPrefix(s.listen, ":") {
+		return "0.0.0.0" + s.listen
+	}
+	return s.listen
+}
+
+// echPublic returns the public name of a generated ECH config.
+func (s settings) echPublic() string {
+	if s.echPublicName != "" {
+		return s.echPublicName
+	}
+	return s.domain
+}
+
+// obfsKey returns the QUIC obfuscation key, or "" when QUIC_OBFS is off.
+// Without QUIC_OBFS_KEY the key is the PSK.
+func (s settings) obfsKey() string {
+	if os.Getenv("QUIC_OBFS") != "1" {
+		return ""
+	}
+	if key := os.Getenv("QUIC_OBFS_KEY"); key != "" {
+		return key
+	}
+	return strings.TrimSpace(s.psk)
+}
+
+// restartRequired lists the config keys whose values differ in next but
+// only take effect after a restart.
+func (s settings) restartRequired(next settings) []string {
+	var keys []string
+	for _, f := range []struct {
+		key       string
+		cur, next string
+	}{
+		{"listen", s.listenAddr(), next.listenAddr()},
+		{"hop_ports", s.hopPorts, next.hopPorts},
+		{"secret_path", s.secretPath, next.secretPath},
+		{"tls.cert", s.certFile, next.certFile},
+		{"tls.key", s.keyFile, next.keyFile},
+		{"tls.domain", s.domain, next.domain},
+		{"tls.ech_key", s.echKeyFile, next.echKeyFile},
+		{"tls.ech_public_name", s.echPublic(), next.echPublic()},
+		{"window_profile", s.windowProfile, next.windowProfile},
+		// The obfuscator keeps the key it started with, so a PSK it was
+		// derived from cannot change on reload.
+		{"psk", s.obfsKey(), next.obfsKey()},
+	} {
+		if f.cur != f.next {
+			keys = append(keys, f.key)
+		}
+	}
+	return keys
+}
+
+// runtimeConfig builds the server settings that Server.Reload can change.
+func (s settings) runtimeConfig() (gateway.Config, error) {
+	psk := strings.TrimSpace(s.psk)
+	if psk == "" && s.usersFile == "" && len(s.users) == 0 {
+		return gateway.Config{}, errors.New("PSK is required. Please set -psk flag, PSK environment variable, psk in the config file or a users file")
+	}
+	users, err := loadUserTable(psk, s.pskSecondary, s.usersFile, s.users)
+	if err != nil {
+		return gateway.Config{}, fmt.Errorf("failed to load users: %w", err)
+	}
+	return gateway.Config{
+		Users:              users,
+		AuthTokenOptional:  s.authTokenOptional,
+		DecoyRoot:          s.decoyRoot,
+		Negotiation:        negotiationLimitsFromEnv(),
+		Scheduler:          s.scheduler,
+		RekeyThreshold:     rekeyThresholdFromEnv(),
+		UDPFlowIdleTimeout: envDurationSec("UDP_FLOW_IDLE_SEC", 60*time.Second),
+		UDPMaxFlows:        envPositiveInt("UDP_MAX_FLOWS", 256),
+	}, nil
+}
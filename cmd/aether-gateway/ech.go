@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+
+	"aether-rea/internal/core"
+)
+
+// loadECHKeySet reads the ECH key set at path (-ech-key/ECH_KEY_FILE), or
+// generates one for publicName and saves it there so the published config
+// survives restarts.
+func loadECHKeySet(path, publicName string) (*core.ECHKeySet, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		keys, err := core.ParseECHKeySetPEM(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		log.Printf("Config: ECH key set loaded from %s", path)
+		return keys, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	if publicName == "" {
+		return nil, errors.New("ECH_PUBLIC_NAME (or DOMAIN) is required to generate an ECH key set")
+	}
+	keys, err := core.GenerateECHKeySet(publicName)
+	if err != nil {
+		return nil, err
+	}
+	pemData, err := keys.MarshalPEM()
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, pemData, 0o600); err != nil {
+		return nil, fmt.Errorf("save ECH key set: %w", err)
+	}
+	log.Printf("Config: generated ECH key set (public name %s) and saved it to %s", publicName, path)
+	return keys, nil
+}
+
+// logECHConfig publishes the ECHConfigList clients put in ech_config_list.
+func logECHConfig(keys *core.ECHKeySet) {
+	log.Printf("[INFO] ECH config list (ech_config_list): %s", base64.StdEncoding.EncodeToString(keys.ConfigList()))
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"aether-rea/internal/core"
+	"aether-rea/internal/gateway"
+)
+
+// negotiationLimitsFromEnv bounds per-stream options accepted from clients.
+// RECORD_PAYLOAD_MAX_BYTES caps proposals; PADDING_MAX_BUDGET caps the
+// padding overhead (percent) a client may request.
+func negotiationLimitsFromEnv() core.NegotiationLimits {
+	limits := core.DefaultNegotiationLimits()
+	limits.MaxRecordPayload = envPositiveInt("RECORD_PAYLOAD_MAX_BYTES", limits.MaxRecordPayload)
+	limits.DisableCompression = os.Getenv("DATA_COMPRESSION") == "0"
+	limits.DisablePadding = os.Getenv("DATA_PADDING") == "0"
+	limits.MaxPaddingBudget = envPositiveInt("PADDING_MAX_BUDGET", 0)
+	return limits
+}
+
+// schedulerConfigFromEnv reads the TCP_TO_WT_* scheduler tuning.
+func schedulerConfigFromEnv() gateway.SchedulerConfig {
+	cfg := gateway.DefaultSchedulerConfig()
+	if n, err := strconv.Atoi(os.Getenv("TCP_TO_WT_QUEUE_SIZE")); err == nil && n >= 16 && n <= 4096 {
+		cfg.QueueSize = n
+	}
+	if v := os.Getenv("TCP_TO_WT_ADAPTIVE"); v != "" {
+		cfg.DisableAdaptive = v != "1" && !strings.EqualFold(v, "true")
+	}
+	if n, err := strconv.Atoi(os.Getenv("TCP_TO_WT_SCHED_MIN_CHUNK")); err == nil {
+		cfg.MinChunk = n
+	}
+	if n, err := strconv.Atoi(os.Getenv("TCP_TO_WT_SCHED_MAX_CHUNK")); err == nil {
+		cfg.MaxChunk = n
+	}
+	if n, err := strconv.Atoi(os.Getenv("TCP_TO_WT_FLUSH_THRESHOLD")); err == nil {
+		cfg.FlushThreshold = n
+	}
+	if n, err := strconv.Atoi(os.Getenv("TCP_TO_WT_COALESCE_MS")); err == nil {
+		cfg.CoalesceWait = gateway.CoalesceWaitMs(n)
+	}
+	if n, err := strconv.Atoi(os.Getenv("TCP_TO_WT_SCHED_TARGET_WRITE_US")); err == nil {
+		cfg.TargetWrite = time.Duration(n) * time.Microsecond
+	}
+	return cfg
+}
+
+// rekeyThresholdFromEnv reads REKEY_THRESHOLD, the counter value at which the
+// gateway rolls a session's generator on its own.
+func rekeyThresholdFromEnv() uint64 {
+	if v := os.Getenv("REKEY_THRESHOLD"); v != "" {
+		if n, err := strconv.ParseUint(v, 10, 64); err == nil && n > 0 && n <= core.MaxCounterValue {
+			return n
+		}
+	}
+	return core.DefaultRekeyThreshold
+}
+
+// perfIntervalFromEnv returns the [PERF-GW] log interval, or 0 unless
+// PERF_DIAG_ENABLE=1.
+func perfIntervalFromEnv() time.Duration {
+	if os.Getenv("PERF_DIAG_ENABLE") != "1" {
+		return 0
+	}
+	return envDurationSec("PERF_DIAG_INTERVAL_SEC", 10*time.Second)
+}
+
+func envDurationSec(name string, def time.Duration) time.Duration {
+	if v := os.Getenv(name); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			return time.Duration(n) * time.Second
+		}
+	}
+	return def
+}
+
+func envPositiveInt(name string, def int) int {
+	if v := os.Getenv(name); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			return n
+		}
+	}
+	return def
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+
+	"aether-rea/internal/core"
+)
+
+// udpBufferSize absorbs ISP bursts so the kernel does not drop packets
+// during token bucket refills.
+const udpBufferSize = 32 * 1024 * 1024 // 32MB
+
+// setUDPBuffers enlarges the send and receive buffers of conn.
+func setUDPBuffers(conn *net.UDPConn) error {
+	if err := conn.SetReadBuffer(udpBufferSize); err != nil {
+		return fmt.Errorf("read buffer: %w", err)
+	}
+	if err := conn.SetWriteBuffer(udpBufferSize); err != nil {
+		return fmt.Errorf("write buffer: %w", err)
+	}
+	return nil
+}
+
+// listenHopPorts opens one socket per port of spec (-hop-ports/UDP_HOP_PORTS)
+// on the host of main, skipping main's own port, for clients that hop
+// between ports (see core/hopping.go).
+func listenHopPorts(main *net.UDPAddr, spec string) ([]*net.UDPConn, error) {
+	ports, err := core.ParsePortRange(spec)
+	if err != nil {
+		return nil, err
+	}
+	var conns []*net.UDPConn
+	var bufErr error
+	for _, port := range ports {
+		if port == main.Port {
+			continue
+		}
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: main.IP, Port: port, Zone: main.Zone})
+		if err != nil {
+			for _, c := range conns {
+				c.Close()
+			}
+			return nil, fmt.Errorf("hop port %d: %w", port, err)
+		}
+		if err := setUDPBuffers(conn); err != nil && bufErr == nil {
+			bufErr = err
+		}
+		conns = append(conns, conn)
+	}
+	if bufErr != nil {
+		log.Printf("Warning: Failed to set UDP buffers on hop ports: %v", bufErr)
+	}
+	if len(conns) > 0 {
+		log.Printf("Port hopping: listening on %d extra UDP ports (%s)", len(conns), spec)
+	}
+	return conns, nil
+}
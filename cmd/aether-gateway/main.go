@@ -2,38 +2,28 @@ package main
 
 import (
 	"bufio"
-	"bytes"
 	"context"
-	"crypto/rand"
-	"crypto/rsa"
 	"crypto/tls"
-	"crypto/x509"
-	"crypto/x509/pkix"
-	"encoding/pem"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
-	"math/big"
 	mathrand "math/rand"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
-	"strconv"
 	"strings"
-	"sync"
-	"sync/atomic"
 	"syscall"
 	"time"
 
 	"aether-rea/internal/core"
+	"aether-rea/internal/gateway"
 
 	"github.com/quic-go/quic-go"
-	"github.com/quic-go/quic-go/http3"
 	"github.com/quic-go/quic-go/qlog"
 	"github.com/quic-go/quic-go/qlogwriter"
-	"github.com/quic-go/webtransport-go"
 )
 
 // BufferedWriteCloser buffers writes and flushes on close
@@ -57,294 +47,93 @@ func (b *BufferedWriteCloser) Close() error {
 }
 
 var (
-	listenAddr = flag.String("listen", ":8080", "Listen address")
-	certFile   = flag.String("cert", "cert.pem", "TLS certificate file")
-	keyFile    = flag.String("key", "key.pem", "TLS key file")
-	psk        = flag.String("psk", "", "Pre-shared key")
-	secretPath = flag.String("path", "/v1/api/sync", "Secret path for WebTransport")
-	decoyRoot  = flag.String("decoy", "", "Path to the decoy/masquerade static website root")
+	listenAddr   = flag.String("listen", ":8080", "Listen address")
+	certFile     = flag.String("cert", "cert.pem", "TLS certificate file")
+	keyFile      = flag.String("key", "key.pem", "TLS key file")
+	psk          = flag.String("psk", "", "Pre-shared key")
+	usersFile    = flag.String("users", "", "JSON user table with per-user PSKs")
+	pskSecondary = flag.String("psk-secondary", "", "Secondary PSKs still accepted until expiry (psk@RFC3339,...)")
+	secretPath   = flag.String("path", gateway.DefaultSecretPath, "Secret path for WebTransport")
+	decoyRoot    = flag.String("decoy", "", "Path to the decoy/masquerade static website root")
+	echKeyFile   = flag.String("ech-key", "", "ECH key set file (PEM); generated if missing")
+	echPublic    = flag.String("ech-public-name", "", "Public name of a generated ECH config (default: $DOMAIN)")
+	hopPorts     = flag.String("hop-ports", "", "Extra UDP ports for client port hopping (e.g. 20000-20099)")
+	configFile   = flag.String("config", "", "JSON config file; reloaded on SIGHUP")
 )
 
-type gatewayPerfStats struct {
-	wtToTCPBytes atomic.Uint64
-	wtToTCPWrites atomic.Uint64
-	wtToTCPWriteNanos atomic.Uint64
-
-	tcpToWTBytes atomic.Uint64
-	tcpToWTWrites atomic.Uint64
-	tcpToWTWriteNanos atomic.Uint64
-
-	tcpToWTReadWaitCalls atomic.Uint64
-	tcpToWTReadWaitNanos atomic.Uint64
-	tcpToWTBuildCalls atomic.Uint64
-	tcpToWTBuildNanos atomic.Uint64
-	tcpToWTFlushCalls atomic.Uint64
-	tcpToWTFlushBytes atomic.Uint64
-	tcpToWTChunkCapBytes atomic.Uint64
-	tcpToWTCoalesceWaitMicros atomic.Uint64
-}
-
-var gwPerf gatewayPerfStats
-
-func (s *gatewayPerfStats) observeWTToTCP(bytes int, d time.Duration) {
-	if bytes <= 0 {
-		return
-	}
-	s.wtToTCPBytes.Add(uint64(bytes))
-	s.wtToTCPWrites.Add(1)
-	s.wtToTCPWriteNanos.Add(uint64(d.Nanoseconds()))
-}
-
-func (s *gatewayPerfStats) observeTCPToWT(bytes int, d time.Duration) {
-	if bytes <= 0 {
-		return
-	}
-	s.tcpToWTBytes.Add(uint64(bytes))
-	s.tcpToWTWrites.Add(1)
-	s.tcpToWTWriteNanos.Add(uint64(d.Nanoseconds()))
-}
-
-func (s *gatewayPerfStats) observeTCPReadWait(d time.Duration) {
-	s.tcpToWTReadWaitCalls.Add(1)
-	s.tcpToWTReadWaitNanos.Add(uint64(d.Nanoseconds()))
-}
-
-func (s *gatewayPerfStats) observeTCPBuild(d time.Duration) {
-	s.tcpToWTBuildCalls.Add(1)
-	s.tcpToWTBuildNanos.Add(uint64(d.Nanoseconds()))
-}
-
-func (s *gatewayPerfStats) observeTCPFlush(bytes int) {
-	if bytes <= 0 {
-		return
-	}
-	s.tcpToWTFlushCalls.Add(1)
-	s.tcpToWTFlushBytes.Add(uint64(bytes))
-}
-
-func (s *gatewayPerfStats) observeTCPAdaptive(chunkCap int, coalesceWait time.Duration) {
-	if chunkCap > 0 {
-		s.tcpToWTChunkCapBytes.Add(uint64(chunkCap))
-	}
-	if coalesceWait > 0 {
-		s.tcpToWTCoalesceWaitMicros.Add(uint64(coalesceWait.Microseconds()))
-	}
-}
-
-func startGatewayPerfReporter() {
-	if os.Getenv("PERF_DIAG_ENABLE") != "1" {
-		return
-	}
-
-	interval := 10 * time.Second
-	if v := os.Getenv("PERF_DIAG_INTERVAL_SEC"); v != "" {
-		if sec, err := strconv.Atoi(v); err == nil && sec > 0 {
-			interval = time.Duration(sec) * time.Second
-		}
-	}
-
-	log.Printf("[PERF-GW] enabled=true interval=%s", interval)
-	go func() {
-		ticker := time.NewTicker(interval)
-		defer ticker.Stop()
-
-		var prevWTToTCPBytes, prevWTToTCPWrites, prevWTToTCPNanos uint64
-		var prevTCPToWTBytes, prevTCPToWTWrites, prevTCPToWTNanos uint64
-		var prevTCPReadWaitCalls, prevTCPReadWaitNanos uint64
-		var prevTCPBuildCalls, prevTCPBuildNanos uint64
-		var prevTCPFlushCalls, prevTCPFlushBytes uint64
-		var prevTCPChunkCapBytes, prevTCPCoalesceWaitMicros uint64
-
-		for range ticker.C {
-			curWTToTCPBytes := gwPerf.wtToTCPBytes.Load()
-			curWTToTCPWrites := gwPerf.wtToTCPWrites.Load()
-			curWTToTCPNanos := gwPerf.wtToTCPWriteNanos.Load()
-			curTCPToWTBytes := gwPerf.tcpToWTBytes.Load()
-			curTCPToWTWrites := gwPerf.tcpToWTWrites.Load()
-			curTCPToWTNanos := gwPerf.tcpToWTWriteNanos.Load()
-			curTCPReadWaitCalls := gwPerf.tcpToWTReadWaitCalls.Load()
-			curTCPReadWaitNanos := gwPerf.tcpToWTReadWaitNanos.Load()
-			curTCPBuildCalls := gwPerf.tcpToWTBuildCalls.Load()
-			curTCPBuildNanos := gwPerf.tcpToWTBuildNanos.Load()
-			curTCPFlushCalls := gwPerf.tcpToWTFlushCalls.Load()
-			curTCPFlushBytes := gwPerf.tcpToWTFlushBytes.Load()
-			curTCPChunkCapBytes := gwPerf.tcpToWTChunkCapBytes.Load()
-			curTCPCoalesceWaitMicros := gwPerf.tcpToWTCoalesceWaitMicros.Load()
-
-			dWTToTCPBytes := curWTToTCPBytes - prevWTToTCPBytes
-			dWTToTCPWrites := curWTToTCPWrites - prevWTToTCPWrites
-			dWTToTCPNanos := curWTToTCPNanos - prevWTToTCPNanos
-			dTCPToWTBytes := curTCPToWTBytes - prevTCPToWTBytes
-			dTCPToWTWrites := curTCPToWTWrites - prevTCPToWTWrites
-			dTCPToWTNanos := curTCPToWTNanos - prevTCPToWTNanos
-			dTCPReadWaitCalls := curTCPReadWaitCalls - prevTCPReadWaitCalls
-			dTCPReadWaitNanos := curTCPReadWaitNanos - prevTCPReadWaitNanos
-			dTCPBuildCalls := curTCPBuildCalls - prevTCPBuildCalls
-			dTCPBuildNanos := curTCPBuildNanos - prevTCPBuildNanos
-			dTCPFlushCalls := curTCPFlushCalls - prevTCPFlushCalls
-			dTCPFlushBytes := curTCPFlushBytes - prevTCPFlushBytes
-			dTCPChunkCapBytes := curTCPChunkCapBytes - prevTCPChunkCapBytes
-			dTCPCoalesceWaitMicros := curTCPCoalesceWaitMicros - prevTCPCoalesceWaitMicros
-
-			prevWTToTCPBytes, prevWTToTCPWrites, prevWTToTCPNanos = curWTToTCPBytes, curWTToTCPWrites, curWTToTCPNanos
-			prevTCPToWTBytes, prevTCPToWTWrites, prevTCPToWTNanos = curTCPToWTBytes, curTCPToWTWrites, curTCPToWTNanos
-			prevTCPReadWaitCalls, prevTCPReadWaitNanos = curTCPReadWaitCalls, curTCPReadWaitNanos
-			prevTCPBuildCalls, prevTCPBuildNanos = curTCPBuildCalls, curTCPBuildNanos
-			prevTCPFlushCalls, prevTCPFlushBytes = curTCPFlushCalls, curTCPFlushBytes
-			prevTCPChunkCapBytes, prevTCPCoalesceWaitMicros = curTCPChunkCapBytes, curTCPCoalesceWaitMicros
-
-			sec := interval.Seconds()
-			ulMbps := float64(dWTToTCPBytes*8) / 1_000_000.0 / sec
-			dlMbps := float64(dTCPToWTBytes*8) / 1_000_000.0 / sec
-
-			ulWriteUs := 0.0
-			if dWTToTCPWrites > 0 {
-				ulWriteUs = (float64(dWTToTCPNanos) / float64(dWTToTCPWrites)) / 1000.0
-			}
-			dlWriteUs := 0.0
-			if dTCPToWTWrites > 0 {
-				dlWriteUs = (float64(dTCPToWTNanos) / float64(dTCPToWTWrites)) / 1000.0
-			}
-
-			log.Printf(
-				"[PERF-GW] window=%s dl{mbps=%.2f writes=%d write_us=%.1f} ul{mbps=%.2f writes=%d write_us=%.1f}",
-				interval, dlMbps, dTCPToWTWrites, dlWriteUs, ulMbps, dWTToTCPWrites, ulWriteUs,
-			)
-
-			readWaitUs := 0.0
-			if dTCPReadWaitCalls > 0 {
-				readWaitUs = (float64(dTCPReadWaitNanos) / float64(dTCPReadWaitCalls)) / 1000.0
-			}
-			buildUs := 0.0
-			if dTCPBuildCalls > 0 {
-				buildUs = (float64(dTCPBuildNanos) / float64(dTCPBuildCalls)) / 1000.0
-			}
-			flushAvgBytes := 0.0
-			if dTCPFlushCalls > 0 {
-				flushAvgBytes = float64(dTCPFlushBytes) / float64(dTCPFlushCalls)
-			}
-			chunkCapAvgBytes := 0.0
-			coalesceWaitAvgUs := 0.0
-			if dTCPFlushCalls > 0 {
-				chunkCapAvgBytes = float64(dTCPChunkCapBytes) / float64(dTCPFlushCalls)
-				coalesceWaitAvgUs = float64(dTCPCoalesceWaitMicros) / float64(dTCPFlushCalls)
-			}
-			log.Printf(
-				"[PERF-GW2] window=%s dl_stage{read_wait_us=%.1f reads=%d build_us=%.1f builds=%d write_block_us=%.1f writes=%d flush_avg_bytes=%.1f flushes=%d chunk_cap_avg_bytes=%.1f coalesce_wait_avg_us=%.1f}",
-				interval,
-				readWaitUs, dTCPReadWaitCalls,
-				buildUs, dTCPBuildCalls,
-				dlWriteUs, dTCPToWTWrites,
-				flushAvgBytes, dTCPFlushCalls,
-				chunkCapAvgBytes, coalesceWaitAvgUs,
-			)
-		}
-	}()
-}
-
 func main() {
 	flag.Parse()
 	mathrand.Seed(time.Now().UnixNano())
-	startGatewayPerfReporter()
 
 	log.Printf("Aether Gateway 3.2.0 starting")
 
-	// Support $PORT or $LISTEN_ADDR environment variables
-	if envPort := os.Getenv("PORT"); envPort != "" {
-		*listenAddr = "0.0.0.0:" + envPort
-		log.Printf("Config: Using PORT environment variable: %s", *listenAddr)
-	} else if envAddr := os.Getenv("LISTEN_ADDR"); envAddr != "" {
-		*listenAddr = envAddr
-		log.Printf("Config: Using LISTEN_ADDR environment variable: %s", *listenAddr)
-	} else {
-		// Ensure we bind to all interfaces if just a port is provided or default
-		if strings.HasPrefix(*listenAddr, ":") {
-			*listenAddr = "0.0.0.0" + *listenAddr
-		}
-		log.Printf("Config: Using default/flag listen address: %s", *listenAddr)
-	}
-
-	// Support $PSK and $DOMAIN environment variables
-	if envPSK := os.Getenv("PSK"); envPSK != "" && *psk == "" {
-		*psk = envPSK
+	base, err := settingsFromFlags()
+	if err != nil {
+		log.Fatalf("Invalid config: %v", err)
 	}
-	domainEnv := os.Getenv("DOMAIN")
-
-	// Support $SSL_CERT_FILE and $SSL_KEY_FILE for platform managed certs
-	if envCert := os.Getenv("SSL_CERT_FILE"); envCert != "" {
-		*certFile = envCert
+	if envConfig := os.Getenv("CONFIG_FILE"); envConfig != "" && *configFile == "" {
+		*configFile = envConfig
 	}
-	if envKey := os.Getenv("SSL_KEY_FILE"); envKey != "" {
-		*keyFile = envKey
+	cfg, err := loadSettings(base, *configFile)
+	if err != nil {
+		log.Fatalf("Invalid config file: %v", err)
 	}
-	if envDecoy := os.Getenv("DECOY_ROOT"); envDecoy != "" {
-		*decoyRoot = envDecoy
+	if *configFile != "" {
+		log.Printf("Config: Loaded config file %s", *configFile)
 	}
+	listen := cfg.listenAddr()
+	log.Printf("Config: Listen address: %s", listen)
 
-	if *psk == "" {
-		log.Println("ERROR: PSK is required. Please set -psk flag or PSK environment variable.")
-		os.Exit(1)
+	runtimeCfg, err := cfg.runtimeConfig()
+	if err != nil {
+		log.Fatalf("ERROR: %v", err)
 	}
 	// Normalize PSK (Trim whitespace to avoid common config issues)
-	*psk = strings.TrimSpace(*psk)
-	if len(*psk) > 4 {
-		log.Printf("Config: PSK loaded (Length: %d, Prefix: %s...)", len(*psk), (*psk)[:4])
-	} else {
-		log.Printf("Config: PSK loaded (Length: %d)", len(*psk))
+	if p := strings.TrimSpace(cfg.psk); len(p) > 4 {
+		log.Printf("Config: PSK loaded (Length: %d, Prefix: %s...)", len(p), p[:4])
+	} else if p != "" {
+		log.Printf("Config: PSK loaded (Length: %d)", len(p))
+	}
+	log.Printf("Config: %d user(s) loaded (default user: %v)", len(runtimeCfg.Users.Users()), runtimeCfg.Users.Fallback() != nil)
+	log.Printf("Config: CONNECT auth token required=%v", !runtimeCfg.AuthTokenOptional)
+	warnAuthTokenOptional(runtimeCfg)
+	// QUIC_OBFS=1 obfuscates every UDP packet (see core/obfs.go); browsers
+	// cannot reach the gateway over HTTP/3 while it is on.
+	obfsKey := cfg.obfsKey()
+	if os.Getenv("QUIC_OBFS") == "1" {
+		if obfsKey == "" {
+			log.Fatalf("QUIC_OBFS requires QUIC_OBFS_KEY or PSK")
+		}
+		log.Printf("Config: QUIC packet obfuscation enabled (HTTP/3 unavailable to browsers)")
 	}
 
 	// Initialize Certificate Loader for hot-reloading
-	certLoader, err := NewCertificateLoader(*certFile, *keyFile)
+	certLoader, err := gateway.NewCertificateLoader(cfg.certFile, cfg.keyFile)
 	if err != nil {
 		// Fallback to self-signed if loading failed
 		// V5: We always generate a 10-year self-signed cert if the provided path is missing
 		log.Printf("TLS certificates not found or invalid (%v). Generating 10-year self-signed certificate...", err)
-		certs, err := generateSelfSignedCert(domainEnv)
+		certLoader, err = gateway.NewSelfSignedCertificateLoader(cfg.domain, cfg.certFile, cfg.keyFile)
 		if err != nil {
 			log.Fatalf("Failed to generate self-signed cert: %v", err)
 		}
-		certLoader = &CertificateLoader{cert: &certs, certFile: *certFile, keyFile: *keyFile}
+		log.Printf("[WARNING] The self-signed certificate is regenerated on every start; save a certificate to %s/%s to keep client pins valid", cfg.certFile, cfg.keyFile)
 	} else {
-		log.Printf("TLS certificates loaded successfully from %s", *certFile)
-	}
-
-	tlsConfig := &tls.Config{
-		GetCertificate: certLoader.GetCertificate,
-		// QUIC listener should advertise only HTTP/3 ALPN.
-		// Mixing legacy h3 drafts or HTTP/1.1 here can cause capability negotiation ambiguity.
-		NextProtos: []string{http3.NextProtoH3},
-		MinVersion:     tls.VersionTLS13,                    // Enforce TLS 1.3 for security
+		log.Printf("TLS certificates loaded successfully from %s", cfg.certFile)
 	}
 
-	var tracer func(context.Context, bool, quic.ConnectionID) qlogwriter.Trace
-	if os.Getenv("QLOG") == "1" {
-		log.Println("Config: QLOG tracing enabled")
-		tracer = func(ctx context.Context, isClient bool, connID quic.ConnectionID) qlogwriter.Trace {
-			perspective := "server"
-			if isClient {
-				perspective = "client"
-			}
-			filename := fmt.Sprintf("%s_%x.qlog", perspective, connID)
-			f, err := os.Create(filename)
-			if err != nil {
-				log.Printf("Failed to create qlog file: %v", err)
-				return nil
-			}
-			log.Printf("Writing qlog to %s", filename)
-			fileSeq := qlogwriter.NewConnectionFileSeq(
-				NewBufferedWriteCloser(bufio.NewWriter(f), f),
-				isClient,
-				connID,
-				[]string{qlog.EventSchema},
-			)
-			go fileSeq.Run()
-			return fileSeq
+	tlsConfig := &tls.Config{GetCertificate: certLoader.GetCertificate}
+	if cfg.echKeyFile != "" {
+		echKeys, err := loadECHKeySet(cfg.echKeyFile, cfg.echPublic())
+		if err != nil {
+			log.Fatalf("Failed to load ECH keys: %v", err)
 		}
+		tlsConfig.EncryptedClientHelloKeys = echKeys.ServerKeys()
+		logECHConfig(echKeys)
 	}
 
 	// V5.2: Profile defaults + optional explicit QUIC window overrides.
-	profile := os.Getenv("WINDOW_PROFILE")
-	windowCfg, err := core.ResolveQUICWindowConfig(profile)
+	windowCfg, err := core.ResolveQUICWindowConfig(cfg.windowProfile)
 	if err != nil {
 		log.Fatalf("Invalid QUIC window config: %v", err)
 	}
@@ -367,741 +156,146 @@ func main() {
 			windowCfg.MaxConnectionReceiveWindow,
 		)
 	}
-
-	quicConfig := &quic.Config{
-		EnableDatagrams:                true,
-		EnableStreamResetPartialDelivery: true,
-		MaxIdleTimeout:                 30 * time.Second,
-		KeepAlivePeriod:                10 * time.Second,
-		Allow0RTT:                      true,
-		MaxIncomingStreams:             2000,
-		InitialStreamReceiveWindow:     windowCfg.InitialStreamReceiveWindow,
-		InitialConnectionReceiveWindow: windowCfg.InitialConnectionReceiveWindow,
-		MaxStreamReceiveWindow:         windowCfg.MaxStreamReceiveWindow,
-		MaxConnectionReceiveWindow:     windowCfg.MaxConnectionReceiveWindow,
-		Tracer:                         tracer,
-	}
-
-	server := webtransport.Server{
-		H3: &http3.Server{
-			Addr:            *listenAddr,
-			TLSConfig:       tlsConfig,
-			QUICConfig:      quicConfig,
-			EnableDatagrams: true,
-		},
-		CheckOrigin: func(r *http.Request) bool { return true },
-	}
-	// Ensure HTTP/3 SETTINGS always advertise WebTransport capabilities.
-	// This is required for clients that validate SETTINGS before sending CONNECT.
-	webtransport.ConfigureHTTP3Server(server.H3)
-	log.Printf("WebTransport capability: H3 datagrams enabled=%v, QUIC datagrams enabled=%v", server.H3.EnableDatagrams, quicConfig.EnableDatagrams)
-	// V5: ReplayCache removed - using counter-based anti-replay
-
-	// Serve decoy content in a way that minimizes path-based fingerprinting/oracles.
-	// - If decoyRoot has index.html, serve static files (same behavior as "/").
-	// - Otherwise, serve an nginx-like 403 page with aligned headers.
-	serveDecoyOrForbidden := func(w http.ResponseWriter, r *http.Request) {
-		// If decoyRoot is specified and index.html exists, serve static files.
-		if *decoyRoot != "" {
-			index := fmt.Sprintf("%s/index.html", strings.TrimSuffix(*decoyRoot, "/"))
-			if _, err := os.Stat(index); err == nil {
-				http.FileServer(http.Dir(*decoyRoot)).ServeHTTP(w, r)
-				return
-			}
-		}
-
-		// Fallback: Nginx 403 Forbidden Simulation
-		// CRITICAL: Align Status Code and Headers to prevent fingerprinting
-		w.Header().Set("Server", "nginx/1.18.0 (Ubuntu)")
-		w.Header().Set("Content-Type", "text/html")
-		w.Header().Set("Connection", "keep-alive")
-		w.WriteHeader(http.StatusForbidden)
-		w.Write([]byte(`<html>
-<head><title>403 Forbidden</title></head>
-<body bgcolor="white">
-<center><h1>403 Forbidden</h1></center>
-<hr><center>nginx/1.18.0 (Ubuntu)</center>
-</body>
-</html>`))
-	}
-
-	http.HandleFunc(*secretPath, func(w http.ResponseWriter, r *http.Request) {
-		// Log every attempt to the secret path
-		log.Printf("[DEBUG] connection attempt from %s to %s (Method: %s)", r.RemoteAddr, r.URL.Path, r.Method)
-
-		session, err := server.Upgrade(w, r)
-		if err != nil {
-			log.Printf("[DEBUG] WebTransport upgrade failed (likely non-WT request): %v", err)
-			// Non-protocol requests must be indistinguishable from normal decoy traffic.
-			serveDecoyOrForbidden(w, r)
-			return
-		}
-
-		state := session.SessionState().ConnectionState.TLS
-		log.Printf("[INFO] WebTransport session upgraded for %s (ALPN: %s)", r.RemoteAddr, state.NegotiatedProtocol)
-		// V5: Create NonceGenerator per session for counter-based nonce
-		ng, err := core.NewNonceGenerator()
-		if err != nil {
-			log.Printf("[ERROR] Failed to create NonceGenerator: %v", err)
-			return
-		}
-		handleSession(session, *psk, ng)
-	})
-
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		serveDecoyOrForbidden(w, r)
-	})
-
-	http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
-		// Health check must return 200 OK for load balancers
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte("OK"))
-	})
-
-	// 1. Start HTTP/3 (UDP) Server for WebTransport
-	go func() {
-		log.Printf("Starting HTTP/3 (UDP) server on %s", *listenAddr)
-
-		udpAddr, err := net.ResolveUDPAddr("udp", *listenAddr)
-		if err != nil {
-			log.Fatalf("Failed to resolve UDP addr: %v", err)
-		}
-
-		conn, err := net.ListenUDP("udp", udpAddr)
-		if err != nil {
-			log.Fatalf("Failed to listen UDP: %v", err)
-		}
-
-		// V5.1 Performance Fix: Increase UDP buffers to 32MB to absorb ISP bursts
-		// This prevents kernel-level packet drops during token bucket refills
-		const bufSize = 32 * 1024 * 1024 // 32MB
-		if err := conn.SetReadBuffer(bufSize); err != nil {
-			log.Printf("Warning: Failed to set UDP read buffer: %v", err)
-		}
-		if err := conn.SetWriteBuffer(bufSize); err != nil {
-			log.Printf("Warning: Failed to set UDP write buffer: %v", err)
-		}
-		log.Printf("UDP Send/Recv buffers set to %d bytes", bufSize)
-
-		if err := server.Serve(conn); err != nil {
-			log.Fatalf("HTTP/3 server failed: %v", err)
-		}
-	}()
-
-	// 2. Start HTTP/1.1 (TCP) Server for Health Checks & Alt-Svc
-	// This is CRITICAL for PaaS health checks which use TCP
-	httpServer := &http.Server{
-		Addr: *listenAddr,
-		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			// Add Alt-Svc header to advertise HTTP/3 capability
-			// This tells clients "I speak H3 on this same port"
-			port := "443"
-			if _, p, err := net.SplitHostPort(*listenAddr); err == nil {
-				port = p
-			}
-			w.Header().Set("Alt-Svc", fmt.Sprintf(`h3=":%s"; ma=2592000`, port))
-
-			// Delegate to default mux (handles /health, /, /v1/api/sync)
-			http.DefaultServeMux.ServeHTTP(w, r)
-		}),
-	}
-
-	// Create a TCP listener explicitly to get the actual bound port
-	tcpListener, err := net.Listen("tcp", *listenAddr)
+	quicConfig := gateway.DefaultQUICConfig(windowCfg)
+	if os.Getenv("QLOG") == "1" {
+		log.Println("Config: QLOG tracing enabled")
+		quicConfig.Tracer = qlogTracer
+	}
+	log.Printf("WebTransport capability: H3 datagrams enabled=true, QUIC datagrams enabled=%v", quicConfig.EnableDatagrams)
+
+	serverCfg := runtimeCfg
+	serverCfg.SecretPath = cfg.secretPath
+	serverCfg.TLSConfig = tlsConfig
+	serverCfg.QUICConfig = quicConfig
+	serverCfg.ObfsKey = obfsKey
+	serverCfg.ReplayWindow = envPositiveInt("REPLAY_WINDOW", core.DefaultReplayWindowSize)
+	serverCfg.ReplaySessions = envPositiveInt("REPLAY_SESSIONS", core.DefaultReplaySessions)
+	serverCfg.PerfInterval = perfIntervalFromEnv()
+	server, err := gateway.NewServer(serverCfg)
 	if err != nil {
-		log.Fatalf("Failed to listen on TCP %s: %v", *listenAddr, err)
-	}
-	log.Printf("HTTP/1.1 (TCP+TLS) server listening on %s", tcpListener.Addr().String())
-
-	// Clone TLS config for TCP, setting correct ALPN for HTTP/1.1 and HTTP/2
-	tcpTLSConfig := tlsConfig.Clone()
-	tcpTLSConfig.NextProtos = []string{"h2", "http/1.1"}
-
-	// Enable TLS on TCP listener using the tcp specific config
-	tlsListener := tls.NewListener(tcpListener, tcpTLSConfig)
-
-	if err := httpServer.Serve(tlsListener); err != nil {
-		log.Fatalf("TCP server failed: %v", err)
-	}
-}
-
-// handleSession processes incoming streams for a WebTransport session.
-// V5: Uses NonceGenerator for counter-based nonce instead of ReplayCache.
-func handleSession(session *webtransport.Session, psk string, ng *core.NonceGenerator) {
-	log.Println("New session established")
-	var streamID uint64
-
-	for {
-		stream, err := session.AcceptStream(context.Background())
-		if err != nil {
-			log.Printf("AcceptStream failed: %v", err)
-			break
-		}
-
-		streamID++
-		go handleStream(stream, psk, streamID, ng)
+		log.Fatalf("Invalid gateway config: %v", err)
 	}
-}
-
-// handleStream processes a single bidirectional stream.
-// V5: Uses counter-based anti-replay with per-stream lastCounter tracking.
-func handleStream(stream *webtransport.Stream, psk string, streamID uint64, ng *core.NonceGenerator) {
-	defer stream.Close()
+	go reloadOnSIGHUP(server, certLoader, base, cfg, *configFile)
 
-	reader := core.NewRecordReader(stream)
-	var lastCounter uint64 = 0 // V5: Per-stream counter tracking
-
-	// Read Metadata
-	readTimeout := jitterDuration(4*time.Second, 6*time.Second)
-	if err := stream.SetReadDeadline(time.Now().Add(readTimeout)); err != nil {
-		log.Printf("[SECURITY] [Stream %d] Failed to set metadata read deadline: %v", streamID, err)
-		return
-	}
-	record, err := reader.ReadNextRecord()
-	_ = stream.SetReadDeadline(time.Time{})
+	// 1. UDP socket for HTTP/3 WebTransport
+	udpAddr, err := net.ResolveUDPAddr("udp", listen)
 	if err != nil {
-		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-			handleHandshakeFailure(stream, streamID, "Metadata read timed out")
-			return
-		}
-		handleHandshakeFailure(stream, streamID, fmt.Sprintf("Failed to read metadata record: %v", err))
-		return
-	}
-
-	if record.Type == core.TypePing {
-		// V5: BuildPongRecord requires NonceGenerator
-		pongRecord, err := core.BuildPongRecord(ng)
-		if err != nil {
-			return
-		}
-		_, _ = stream.Write(pongRecord)
-		return
+		log.Fatalf("Failed to resolve UDP addr: %v", err)
 	}
-
-	if record.Type != core.TypeMetadata {
-		handleHandshakeFailure(stream, streamID, fmt.Sprintf("Invalid record type: %d", record.Type))
-		return
-	}
-
-	if !core.IsTimestampValid(record.TimestampNano, time.Now(), core.DefaultReplayWindow) {
-		handleHandshakeFailure(stream, streamID, "Timestamp outside allowed window")
-		return
+	udpConn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		log.Fatalf("Failed to listen UDP: %v", err)
 	}
-
-	// V5: Counter-based anti-replay (first record counter must be 0 or strictly increasing)
-	if record.Counter != 0 && record.Counter <= lastCounter {
-		handleHandshakeFailure(stream, streamID, "Counter not strictly increasing")
-		return
+	// V5.1 Performance Fix: Increase UDP buffers to 32MB to absorb ISP bursts
+	if err := setUDPBuffers(udpConn); err != nil {
+		log.Printf("Warning: Failed to set UDP %v", err)
 	}
-	lastCounter = record.Counter
+	log.Printf("UDP Send/Recv buffers set to %d bytes", udpBufferSize)
 
-	meta, err := core.DecryptMetadata(record, psk)
+	// Port hopping: every extra port serves the same WebTransport server.
+	hopConns, err := listenHopPorts(udpAddr, cfg.hopPorts)
 	if err != nil {
-		handleHandshakeFailure(stream, streamID, fmt.Sprintf("Decrypt failed: %v", err))
-		return
+		log.Fatalf("Failed to listen on hop ports: %v", err)
+	}
+	for _, hc := range hopConns {
+		go func(hc *net.UDPConn) {
+			if err := server.ServePacketConn(hc); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				log.Fatalf("HTTP/3 server failed on %s: %v", hc.LocalAddr(), err)
+			}
+		}(hc)
 	}
 
-	targetAddr := fmt.Sprintf("%s:%d", meta.Host, meta.Port)
-	log.Printf("[Stream %d] Connecting to %s", streamID, targetAddr)
-
-	conn, err := net.DialTimeout("tcp", targetAddr, 10*time.Second)
+	// 2. TCP listener for Health Checks, Alt-Svc, the decoy site and the
+	// WebSocket fallback. This is CRITICAL for PaaS health checks which use TCP
+	tcpListener, err := net.Listen("tcp", listen)
 	if err != nil {
-		log.Printf("[Stream %d] Connect failed: %v", streamID, err)
-		// V5: writeError now requires NonceGenerator
-		writeError(stream, 0x0004, "connect failed", ng)
-		return
+		log.Fatalf("Failed to listen on TCP %s: %v", listen, err)
 	}
-	defer conn.Close()
 
-	// Bidirectional pipe
-	errCh := make(chan error, 2)
-
-	// WebTransport -> TCP
+	shutdownDone := make(chan struct{})
 	go func() {
-		buf := make([]byte, 512*1024)
-		for {
-			n, err := reader.Read(buf)
-			if n > 0 {
-				writeStart := time.Now()
-				if _, wErr := conn.Write(buf[:n]); wErr != nil {
-					errCh <- wErr
-					return
-				}
-				gwPerf.observeWTToTCP(n, time.Since(writeStart))
-			}
-			if err != nil {
-				if err != io.EOF {
-					errCh <- err
-				} else {
-					errCh <- nil
-				}
-				return
-			}
-		}
+		shutdownOnSignal(server)
+		close(shutdownDone)
 	}()
+	if err := server.Serve(udpConn, tcpListener); !errors.Is(err, http.ErrServerClosed) {
+		log.Fatalf("Gateway failed: %v", err)
+	}
+	<-shutdownDone
+}
 
-	// TCP -> WebTransport
-	go func() {
-		type tcpToWTChunk struct {
-			data []byte
-			err  error
-		}
-		readBuf := make([]byte, 512*1024)
-		queueSize := 256
-		if v := os.Getenv("TCP_TO_WT_QUEUE_SIZE"); v != "" {
-			if parsed, pErr := strconv.Atoi(v); pErr == nil && parsed >= 16 && parsed <= 4096 {
-				queueSize = parsed
-			}
-		}
-		chunkCh := make(chan tcpToWTChunk, queueSize)
-		stageCtx, stageCancel := context.WithCancel(context.Background())
-		defer stageCancel()
-
-		// Stage A: read from TCP continuously and enqueue chunks.
-		go func() {
-			defer close(chunkCh)
-			for {
-				readStart := time.Now()
-				n, err := conn.Read(readBuf)
-				gwPerf.observeTCPReadWait(time.Since(readStart))
-
-				if n > 0 {
-					chunk := make([]byte, n)
-					copy(chunk, readBuf[:n])
-					select {
-					case chunkCh <- tcpToWTChunk{data: chunk}:
-					case <-stageCtx.Done():
-						return
-					}
-				}
-
-				if err != nil {
-					select {
-					case chunkCh <- tcpToWTChunk{err: err}:
-					case <-stageCtx.Done():
-					}
-					return
-				}
-			}
-		}()
-
-		maxPayload := core.GetMaxRecordPayload()
-		adaptiveEnabled := true
-		if v := os.Getenv("TCP_TO_WT_ADAPTIVE"); v != "" {
-			adaptiveEnabled = v == "1" || strings.EqualFold(v, "true")
-		}
-		parseIntEnv := func(name string, fallback, min, max int) int {
-			v := os.Getenv(name)
-			if v == "" {
-				return fallback
-			}
-			parsed, err := strconv.Atoi(v)
-			if err != nil {
-				return fallback
-			}
-			if parsed < min {
-				return min
-			}
-			if parsed > max {
-				return max
-			}
-			return parsed
-		}
-		parseDurMs := func(name string, fallback, min, max time.Duration) time.Duration {
-			v := os.Getenv(name)
-			if v == "" {
-				return fallback
-			}
-			parsed, err := strconv.Atoi(v)
-			if err != nil {
-				return fallback
-			}
-			d := time.Duration(parsed) * time.Millisecond
-			if d < min {
-				return min
-			}
-			if d > max {
-				return max
-			}
-			return d
-		}
-		const (
-			defaultTargetWriteUs = 20000.0
-		)
-		minChunkCap := parseIntEnv("TCP_TO_WT_SCHED_MIN_CHUNK", 16384, 8192, maxPayload)
-		maxChunkCap := parseIntEnv("TCP_TO_WT_SCHED_MAX_CHUNK", maxPayload, minChunkCap, maxPayload)
-		baseCoalesceWait := parseDurMs("TCP_TO_WT_COALESCE_MS", 3*time.Millisecond, 0, 200*time.Millisecond)
-		targetWriteUs := defaultTargetWriteUs
-		if v := os.Getenv("TCP_TO_WT_SCHED_TARGET_WRITE_US"); v != "" {
-			if parsed, err := strconv.Atoi(v); err == nil {
-				if parsed < 3000 {
-					parsed = 3000
-				}
-				if parsed > 200000 {
-					parsed = 200000
-				}
-				targetWriteUs = float64(parsed)
-			}
-		}
-		flushThreshold := parseIntEnv("TCP_TO_WT_FLUSH_THRESHOLD", maxChunkCap, minChunkCap, core.MaxRecordSize-core.RecordHeaderLength)
-		if flushThreshold > maxChunkCap {
-			flushThreshold = maxChunkCap
-		}
-		type schedState string
-		const (
-			schedNormal    schedState = "normal"
-			schedRecovery  schedState = "recovery"
-			schedCongested schedState = "congested"
-		)
-		type sendScheduler struct {
-			state        schedState
-			targetWrite  float64
-			ewmaWriteUs  float64
-			chunkCap     int
-			flushTarget  int
-			coalesceWait time.Duration
-		}
-		sched := &sendScheduler{
-			state:        schedNormal,
-			targetWrite:  targetWriteUs,
-			chunkCap:     flushThreshold,
-			flushTarget:  flushThreshold,
-			coalesceWait: baseCoalesceWait,
-		}
-		if !adaptiveEnabled {
-			sched.chunkCap = flushThreshold
-			sched.flushTarget = flushThreshold
-			sched.coalesceWait = baseCoalesceWait
-		}
-		clampChunk := func(v int) int {
-			if v < minChunkCap {
-				return minChunkCap
-			}
-			if v > maxChunkCap {
-				return maxChunkCap
-			}
-			return v
-		}
-		adjustScheduler := func(writeDur time.Duration, chunkSize int) {
-			writeUs := float64(writeDur.Nanoseconds()) / 1000.0
-			if sched.ewmaWriteUs == 0 {
-				sched.ewmaWriteUs = writeUs
-			} else {
-				const alpha = 0.20
-				sched.ewmaWriteUs = sched.ewmaWriteUs*(1-alpha) + writeUs*alpha
-			}
-			if !adaptiveEnabled {
-				return
-			}
-
-			switch {
-			case sched.ewmaWriteUs > sched.targetWrite*2.0:
-				sched.state = schedCongested
-				sched.chunkCap = clampChunk(sched.chunkCap - 2048)
-				sched.flushTarget = sched.chunkCap
-				sched.coalesceWait = 2 * time.Millisecond
-			case sched.ewmaWriteUs > sched.targetWrite*1.2:
-				sched.state = schedRecovery
-				sched.chunkCap = clampChunk(sched.chunkCap - 1024)
-				sched.flushTarget = sched.chunkCap
-				if sched.coalesceWait > 2*time.Millisecond {
-					sched.coalesceWait -= 1 * time.Millisecond
-				}
-			case sched.ewmaWriteUs < sched.targetWrite*0.7:
-				sched.state = schedNormal
-				if chunkSize >= sched.chunkCap/2 {
-					sched.chunkCap = clampChunk(sched.chunkCap + 512)
-				}
-				sched.flushTarget = sched.chunkCap
-				if sched.coalesceWait < baseCoalesceWait+2*time.Millisecond {
-					sched.coalesceWait += 1 * time.Millisecond
-				}
-			default:
-				// keep current state and tune
-			}
-			if sched.coalesceWait < 2*time.Millisecond {
-				sched.coalesceWait = 2 * time.Millisecond
-			}
-			if sched.coalesceWait > 20*time.Millisecond {
-				sched.coalesceWait = 20 * time.Millisecond
-			}
-		}
-		pending := make([]byte, 0, maxPayload*2)
-		flushTimer := time.NewTimer(time.Hour)
-		if !flushTimer.Stop() {
-			select {
-			case <-flushTimer.C:
-			default:
-			}
-		}
-		timerArmed := false
-		var readErr error
-
-		flushPending := func() error {
-			for len(pending) > 0 {
-				chunkSize := len(pending)
-				// Always use maxPayload (16KB) as the per-record limit.
-				// The adaptive scheduler controls WHEN to flush, not HOW BIG each record is.
-				chunkCap := maxPayload
-				if chunkSize > chunkCap {
-					chunkSize = chunkCap
-				}
-				chunk := pending[:chunkSize]
-				gwPerf.observeTCPFlush(chunkSize)
-				gwPerf.observeTCPAdaptive(chunkCap, sched.coalesceWait)
-				buildStart := time.Now()
-				recordBytes, buildErr := core.BuildDataRecord(chunk, meta.Options.MaxPadding, ng)
-				if buildErr != nil {
-					return buildErr
-				}
-				gwPerf.observeTCPBuild(time.Since(buildStart))
-				writeStart := time.Now()
-				if _, wErr := stream.Write(recordBytes); wErr != nil {
-					core.PutBuffer(recordBytes)
-					return wErr
-				}
-				writeDur := time.Since(writeStart)
-				gwPerf.observeTCPToWT(len(recordBytes), writeDur)
-				adjustScheduler(writeDur, chunkSize)
-				core.PutBuffer(recordBytes)
-				pending = pending[chunkSize:]
-			}
-			pending = pending[:0]
-			return nil
-		}
-
-		resetFlushTimer := func() {
-			if timerArmed {
-				if !flushTimer.Stop() {
-					select {
-					case <-flushTimer.C:
-					default:
-					}
-				}
-			}
-			flushTimer.Reset(sched.coalesceWait)
-			timerArmed = true
+// reloadOnSIGHUP reloads TLS certificates, the users file and the config
+// file on every SIGHUP (standard reload signal). running holds the settings
+// the gateway started with; changes that need a restart are reported.
+func reloadOnSIGHUP(server *gateway.Server, l *gateway.CertificateLoader, base, running settings, configPath string) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	for range c {
+		log.Println("[INFO] Received SIGHUP, reloading TLS certificates and configuration...")
+		if err := l.Reload(); err != nil {
+			log.Printf("[ERROR] Failed to reload certificate on signal: %v", err)
 		}
-
-		stopFlushTimer := func() {
-			if !timerArmed {
-				return
-			}
-			if !flushTimer.Stop() {
-				select {
-				case <-flushTimer.C:
-				default:
-				}
-			}
-			timerArmed = false
+		next, err := loadSettings(base, configPath)
+		if err != nil {
+			log.Printf("[ERROR] Config reload failed, keeping the current settings: %v", err)
+			continue
 		}
-
-		for {
-			if len(pending) > 0 && !timerArmed {
-				resetFlushTimer()
-			}
-			select {
-			case item, ok := <-chunkCh:
-				if !ok {
-					stopFlushTimer()
-					if len(pending) > 0 {
-						if fErr := flushPending(); fErr != nil {
-							errCh <- fErr
-							return
-						}
-					}
-					if readErr != nil && readErr != io.EOF {
-						// Ignore "use of closed network connection" if caused by other side closing
-						if !strings.Contains(readErr.Error(), "closed network connection") {
-							errCh <- readErr
-						} else {
-							errCh <- nil
-						}
-					} else {
-						errCh <- nil
-					}
-					return
-				}
-
-				if item.err != nil {
-					readErr = item.err
-					continue
-				}
-				if len(item.data) == 0 {
-					continue
-				}
-
-				pending = append(pending, item.data...)
-				if len(pending) >= sched.flushTarget {
-					stopFlushTimer()
-					if fErr := flushPending(); fErr != nil {
-						errCh <- fErr
-						return
-					}
-				} else {
-					resetFlushTimer()
-				}
-			case <-flushTimer.C:
-				timerArmed = false
-				if len(pending) > 0 {
-					if fErr := flushPending(); fErr != nil {
-						errCh <- fErr
-						return
-					}
-				}
-			case <-stageCtx.Done():
-				return
-			}
+		cfg, err := next.runtimeConfig()
+		if err == nil {
+			err = server.Reload(cfg)
 		}
-	}()
-
-	select {
-	case err := <-errCh:
 		if err != nil {
-			log.Printf("[Stream %d] Stream error: %v", streamID, err)
+			log.Printf("[ERROR] Config reload failed, keeping the current settings: %v", err)
+			continue
+		}
+		log.Printf("[INFO] Config reloaded: %d user(s), auth token required=%v", len(cfg.Users.Users()), !cfg.AuthTokenOptional)
+		warnAuthTokenOptional(cfg)
+		if restart := running.restartRequired(next); len(restart) > 0 {
+			log.Printf("[WARNING] Config: %s changed; restart the gateway to apply", strings.Join(restart, ", "))
 		}
 	}
-	// Cleanup happens via defer stream.Close() and defer conn.Close()
-}
-
-// V5: writeError now requires NonceGenerator
-func writeError(w io.Writer, code uint16, msg string, ng *core.NonceGenerator) {
-	record, _ := core.BuildErrorRecord(code, msg, ng)
-	w.Write(record)
-}
-
-func handleHandshakeFailure(stream *webtransport.Stream, streamID uint64, reason string) {
-	log.Printf("[SECURITY] [Stream %d] %s", streamID, reason)
-	time.Sleep(jitterDuration(100*time.Millisecond, 1000*time.Millisecond))
-	decoyLen, err := randomIntRange(32, 128)
-	if err != nil {
-		decoyLen = 64
-	}
-	decoy := make([]byte, decoyLen)
-	if _, err := rand.Read(decoy); err == nil {
-		_, _ = stream.Write(decoy)
-	}
-}
-
-func randomIntRange(min, max int) (int, error) {
-	if min < 0 || max < min {
-		return 0, fmt.Errorf("invalid range: %d-%d", min, max)
-	}
-	if min == max {
-		return min, nil
-	}
-	n, err := rand.Int(rand.Reader, big.NewInt(int64(max-min+1)))
-	if err != nil {
-		return 0, err
-	}
-	return min + int(n.Int64()), nil
 }
 
-func jitterDuration(min, max time.Duration) time.Duration {
-	if max <= min {
-		return min
+// warnAuthTokenOptional reports that requests without a CONNECT auth token
+// are upgraded, so probes can obtain sessions.
+func warnAuthTokenOptional(cfg gateway.Config) {
+	if cfg.AuthTokenOptional {
+		log.Printf("[WARNING] AUTH_TOKEN=optional: requests without a CONNECT auth token get a WebTransport session; use it only while migrating old clients")
 	}
-	diff := max - min
-	return min + time.Duration(mathrand.Int63n(int64(diff)+1))
 }
 
-func generateSelfSignedCert(domain string) (tls.Certificate, error) {
-	priv, err := rsa.GenerateKey(rand.Reader, 2048)
-	if err != nil {
-		return tls.Certificate{}, err
-	}
-
-	subject := pkix.Name{
-		Organization: []string{"Aether Edge Relay Self-Signed"},
-	}
-	if domain != "" {
-		subject.CommonName = domain
-	}
-
-	template := x509.Certificate{
-		SerialNumber: big.NewInt(1),
-		Subject:      subject,
-		NotBefore:    time.Now(),
-		NotAfter:     time.Now().Add(time.Hour * 24 * 365 * 10), // V5: 10 Years Validity
-
-		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
-		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
-		BasicConstraintsValid: true,
-		DNSNames:              []string{domain},
-	}
-	if domain == "" {
-		template.DNSNames = []string{"localhost"}
-	}
-
-	derBytes, err := x509.CreateCertificate(rand.Reader, &template, &template, &priv.PublicKey, priv)
-	if err != nil {
-		return tls.Certificate{}, err
+// shutdownOnSignal lets active streams finish for up to 10s on SIGINT or
+// SIGTERM.
+func shutdownOnSignal(server *gateway.Server) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-c
+	log.Printf("[INFO] Received %s, shutting down", sig)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("[WARNING] Shutdown: %v", err)
 	}
-
-	certBuf := &bytes.Buffer{}
-	pem.Encode(certBuf, &pem.Block{Type: "CERTIFICATE", Bytes: derBytes})
-
-	keyBuf := &bytes.Buffer{}
-	pem.Encode(keyBuf, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(priv)})
-
-	return tls.X509KeyPair(certBuf.Bytes(), keyBuf.Bytes())
-}
-
-// CertificateLoader handles dynamic reloading of TLS certificates via signal
-type CertificateLoader struct {
-	certFile string
-	keyFile  string
-	cert     *tls.Certificate
-	mu       sync.RWMutex
 }
 
-func NewCertificateLoader(certFile, keyFile string) (*CertificateLoader, error) {
-	loader := &CertificateLoader{
-		certFile: certFile,
-		keyFile:  keyFile,
-	}
-	// Initial load
-	if err := loader.forceReload(); err != nil {
-		return nil, err
+// qlogTracer writes one qlog file per connection (QLOG=1).
+func qlogTracer(ctx context.Context, isClient bool, connID quic.ConnectionID) qlogwriter.Trace {
+	perspective := "server"
+	if isClient {
+		perspective = "client"
 	}
-
-	// Start signal listener
-	go loader.listenForSignal()
-
-	return loader, nil
-}
-
-func (l *CertificateLoader) listenForSignal() {
-	// Listen for SIGHUP (standard reload signal)
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, syscall.SIGHUP)
-
-	go func() {
-		for range c {
-			log.Println("[INFO] Received SIGHUP, reloading TLS certificates...")
-			if err := l.forceReload(); err != nil {
-				log.Printf("[ERROR] Failed to reload certificate on signal: %v", err)
-			}
-		}
-	}()
-}
-
-func (l *CertificateLoader) forceReload() error {
-	kp, err := tls.LoadX509KeyPair(l.certFile, l.keyFile)
+	filename := fmt.Sprintf("%s_%x.qlog", perspective, connID)
+	f, err := os.Create(filename)
 	if err != nil {
-		return err
-	}
-	l.mu.Lock()
-	l.cert = &kp
-	l.mu.Unlock()
-	log.Printf("[INFO] Reloaded TLS certificate from %s", l.certFile)
-	return nil
+		log.Printf("Failed to create qlog file: %v", err)
+		return nil
+	}
+	log.Printf("Writing qlog to %s", filename)
+	fileSeq := qlogwriter.NewConnectionFileSeq(
+		NewBufferedWriteCloser(bufio.NewWriter(f), f),
+		isClient,
+		connID,
+		[]string{qlog.EventSchema},
+	)
+	go fileSeq.Run()
+	return fileSeq
 }
-
-// GetCertificate implements tls.Config.GetCertificate
-func (l *CertificateLoader) GetCertificate(clientHello *tls.ClientHelloInfo) (*tls.Certificate, error) {
-	l.mu.RLock()
-	defer l.mu.RUnlock()
-	return l.cert, nil
-}
-
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"aether-rea/internal/core"
+)
+
+// defaultUserID names the user backing -psk/PSK. It also authenticates
+// clients that send no key hint.
+const defaultUserID = "default"
+
+// loadUserTable builds the user table from the users file (-users/USERS_FILE),
+// the users of the config file and the single PSK with its secondary keys,
+// any of which may be empty.
+func loadUserTable(psk string, secondary []core.PSKKey, path string, inline []core.User) (*core.UserTable, error) {
+	var users []core.User
+	if path != "" {
+		loaded, err := core.LoadUsers(path)
+		if err != nil {
+			return nil, err
+		}
+		users = loaded
+	}
+	users = append(users, inline...)
+	fallback := ""
+	if psk != "" {
+		users = append(users, core.User{ID: defaultUserID, PSK: psk, Enabled: true, Secondary: secondary})
+		fallback = defaultUserID
+	}
+	if len(users) == 0 {
+		return nil, errors.New("no users configured")
+	}
+	table, err := core.NewUserTable(users, fallback)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	for _, u := range table.Users() {
+		for i, k := range u.Secondary {
+			state := "valid until " + k.Expires.Format(time.RFC3339)
+			if k.Expires.IsZero() {
+				state = "no expiry"
+			} else if !k.Valid(now) {
+				state = "expired " + k.Expires.Format(time.RFC3339)
+			}
+			log.Printf("Config: user %s %s key %s", u.ID, core.KeyName(i+1), state)
+		}
+	}
+	return table, nil
+}
+
+// parseSecondaryKeys parses PSK_SECONDARY: comma-separated "psk@expiry"
+// entries with an RFC 3339 expiry. The last '@' separates the expiry, so
+// PSKs may themselves contain '@'.
+func parseSecondaryKeys(spec string) ([]core.PSKKey, error) {
+	var keys []core.PSKKey
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		at := strings.LastIndex(entry, "@")
+		if at <= 0 {
+			return nil, fmt.Errorf("secondary key %d: missing @expiry", len(keys)+1)
+		}
+		expires, err := time.Parse(time.RFC3339, entry[at+1:])
+		if err != nil {
+			return nil, fmt.Errorf("secondary key %d: %w", len(keys)+1, err)
+		}
+		keys = append(keys, core.PSKKey{PSK: entry[:at], Expires: expires})
+	}
+	return keys, nil
+}
@@ -13,7 +13,9 @@ export type CoreEventType =
   | 'core.stateChanged'
   | 'session.established'
   | 'session.rotating'
+  | 'session.rekeyed'
   | 'session.closed'
+  | 'transport.changed'
   | 'stream.opened'
   | 'stream.closed'
   | 'stream.error'
@@ -38,6 +40,9 @@ export interface SessionEstablishedEvent extends CoreEvent {
   sessionId: string;
   localAddr: string;
   remoteAddr: string;
+  dialAddr?: string;
+  sni?: string;
+  host?: string;
 }
 
 export interface SessionRotatingEvent extends CoreEvent {
@@ -45,6 +50,13 @@ export interface SessionRotatingEvent extends CoreEvent {
   oldSessionId: string;
 }
 
+export interface SessionRekeyedEvent extends CoreEvent {
+  type: 'session.rekeyed';
+  sessionId: string;
+  epoch: number;
+  counter: number;
+}
+
 export interface SessionClosedEvent extends CoreEvent {
   type: 'session.closed';
   sessionId: string;
@@ -52,6 +64,13 @@ export interface SessionClosedEvent extends CoreEvent {
   errorCode?: string;
 }
 
+export interface TransportChangedEvent extends CoreEvent {
+  type: 'transport.changed';
+  transport: 'webtransport' | 'websocket';
+  previous?: 'webtransport' | 'websocket';
+  reason?: string;
+}
+
 export interface StreamOpenedEvent extends CoreEvent {
   type: 'stream.opened';
   streamId: string;
@@ -68,6 +87,12 @@ export interface StreamClosedEvent extends CoreEvent {
   bytesReceived: number;
 }
 
+export interface StreamErrorEvent extends CoreEvent {
+  type: 'stream.error';
+  streamId: string;
+  code: string; // ERR_* name, e.g. ERR_CONN_REFUSED
+}
+
 export interface CoreErrorEvent extends CoreEvent {
   type: 'core.error';
   code: string;
@@ -103,9 +128,11 @@ export type AnyCoreEvent =
   | StateChangedEvent
   | SessionEstablishedEvent
   | SessionRotatingEvent
+  | SessionRekeyedEvent
   | SessionClosedEvent
   | StreamOpenedEvent
   | StreamClosedEvent
+  | StreamErrorEvent
   | CoreErrorEvent
   | MetricsSnapshotEvent
   | RotationScheduledEvent
@@ -117,6 +144,7 @@ export interface StreamInfo {
   targetPort: number;
   openedAt: number;
   state: 'opening' | 'active' | 'closing' | 'closed';
+  remoteAddr?: string;
   bytesSent: number;
   bytesReceived: number;
 }
@@ -124,12 +152,27 @@ export interface StreamInfo {
 export interface CoreConfig {
   url: string;
   psk: string;
+  next_psk?: string;
+  next_psk_at?: string;
   listen_addr: string;
   http_proxy_addr: string;
   dial_addr?: string;
+  sni?: string;
+  host?: string;
   max_padding: number;
+  padding?: 'none' | 'random' | 'bucketed' | 'tls';
+  padding_budget?: number;
   record_payload_bytes?: number;
+  connect_timeout_ms?: number;
+  compression?: 'none' | 'deflate';
+  forward_secrecy?: boolean;
   allow_insecure?: boolean;
+  server_proof?: boolean;
+  pinned_sha256?: string[];
+  ech_config_list?: string;
+  ech_fallback?: 'fail-closed' | 'retry-without-ech';
+  quic_obfs?: boolean;
+  quic_obfs_key?: string;
   session_pool_min?: number;
   session_pool_max?: number;
   perf_capture_enabled?: boolean;
@@ -141,6 +184,12 @@ export interface CoreConfig {
     max_interval_ms: number;
     pre_warm_ms: number;
   };
+  port_hopping?: {
+    ports?: string;
+    min_interval_ms?: number;
+    max_interval_ms?: number;
+  };
+  transport?: 'auto' | 'webtransport' | 'websocket';
   bypass_cn?: boolean;
   block_ads?: boolean;
   window_profile?: 'conservative' | 'normal' | 'aggressive';
@@ -2,10 +2,13 @@ package core
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"hash/fnv"
 	"io"
 	"log"
+	"net"
+	"os"
 	"sync"
 	"time"
 
@@ -18,18 +21,37 @@ import (
 type SessionConfig struct {
 	URL            string         `json:"url"`                // https://host/path
 	PSK            string         `json:"psk"`                // Pre-shared key
+	NextPSK        string         `json:"next_psk,omitempty"`    // PSK to switch to at NextPSKAt
+	NextPSKAt      string         `json:"next_psk_at,omitempty"` // RFC 3339 switch time for NextPSK
 	ListenAddr     string         `json:"listen_addr"`         // SOCKS5 listen address
 	HttpProxyAddr  string         `json:"http_proxy_addr"`      // HTTP proxy listen address
 	DialAddr       string         `json:"dial_addr,omitempty"` // Override dial address (optional)
+	SNI            string         `json:"sni,omitempty"`       // Override TLS server name (optional)
+	Host           string         `json:"host,omitempty"`      // Override CONNECT :authority (optional)
 	MaxPadding     int            `json:"max_padding,omitempty"` // 0-65535, default 0
+	Padding        string         `json:"padding,omitempty"`     // Data record padding: none, random, bucketed, tls
+	PaddingBudget  int            `json:"padding_budget,omitempty"` // Padding overhead cap in percent (0 = scheme default)
+	DataAEAD       bool           `json:"data_aead,omitempty"`   // Encrypt and authenticate data records
+	ForwardSecrecy bool           `json:"forward_secrecy,omitempty"` // Ephemeral X25519 key exchange per session
+	RekeyThreshold uint64         `json:"rekey_threshold,omitempty"` // Counter value that triggers in-session rekey (0 = default)
+	Compression    string         `json:"compression,omitempty"` // Data record compression: none, deflate
 	RecordPayloadBytes int        `json:"record_payload_bytes,omitempty"` // data record payload size in bytes
-	AllowInsecure  bool           `json:"allow_insecure"`        // Skip TLS verification
+	ConnectTimeoutMs int          `json:"connect_timeout_ms,omitempty"` // Wait for the gateway's connected reply (0 = default)
+	AllowInsecure  bool           `json:"allow_insecure"`        // Skip TLS verification (implies ServerProof)
+	ServerProof    bool           `json:"server_proof,omitempty"` // Require the gateway to prove the PSK before metadata
+	PinnedSHA256   []string       `json:"pinned_sha256,omitempty"` // Accepted leaf or SPKI SHA-256 pins, replacing CA validation
+	ECHConfigList  string         `json:"ech_config_list,omitempty"` // Base64 ECHConfigList published by the gateway
+	ECHFallback    string         `json:"ech_fallback,omitempty"` // fail-closed (default) or retry-without-ech
+	QUICObfs       bool           `json:"quic_obfs,omitempty"`     // Obfuscate UDP packets; the gateway needs QUIC_OBFS
+	QUICObfsKey    string         `json:"quic_obfs_key,omitempty"` // Obfuscation key (default: PSK)
 	SessionPoolMin int            `json:"session_pool_min,omitempty"` // Pre-warmed WT sessions
 	SessionPoolMax int            `json:"session_pool_max,omitempty"` // Reserved max WT sessions
 	PerfCaptureEnabled bool       `json:"perf_capture_enabled,omitempty"` // Write [PERF] logs to file
 	PerfCaptureOnConnect bool     `json:"perf_capture_on_connect,omitempty"` // Capture only when Active
 	PerfLogPath    string         `json:"perf_log_path,omitempty"` // Perf log file path
 	Rotation       RotationConfig `json:"rotation,omitempty"`   // Session rotation policy
+	PortHopping    PortHoppingConfig `json:"port_hopping,omitempty"` // Move between gateway UDP ports
+	Transport      string         `json:"transport,omitempty"` // auto (default), webtransport or websocket (fallback over TCP; "h2" is an alias)
 	BypassCN       bool           `json:"bypass_cn"`             // Bypass China sites
 	BlockAds       bool           `json:"block_ads"`             // Block advertisement
 	WindowProfile  string         `json:"window_profile,omitempty"` // conservative, normal, aggressive
@@ -45,7 +67,8 @@ type TargetAddress struct {
 
 // StreamHandle is an opaque identifier for an open stream.
 type StreamHandle struct {
-	ID string `json:"id"`
+	ID         string `json:"id"`
+	RemoteAddr string `json:"remoteAddr,omitempty"` // Target address resolved by the gateway, if reported
 }
 
 // StreamInfo represents information about an active stream
@@ -55,6 +78,7 @@ type StreamInfo struct {
 	TargetPort    int    `json:"targetPort"`
 	OpenedAt      int64  `json:"openedAt"`
 	State         string `json:"state"`
+	RemoteAddr    string `json:"remoteAddr,omitempty"`
 	BytesSent     uint64 `json:"bytesSent"`
 	BytesReceived uint64 `json:"bytesReceived"`
 }
@@ -92,8 +116,10 @@ type Core struct {
 	// Internal components (not exposed)
 	sessionMgr   *sessionManager
 	sessionPool  []*sessionManager
+	transport    Transport // nil: the transports of SessionConfig.Transport
 	socksServer  *socks5Server
 	httpProxyServer *HttpProxyServer
+	udpRelay     *udpRelay
 	metrics      *Metrics
 	metricsCollector *MetricsCollector
 	streams      map[string]*StreamInfo
@@ -105,6 +131,7 @@ type Core struct {
 	cancel       context.CancelFunc
 	configManager *ConfigManager
 	lastError     error
+	pskTimer      *time.Timer // Pending switch to config.NextPSK
 }
 
 // New creates a new Core instance.
@@ -124,6 +151,8 @@ func New() *Core {
 		configManager: cm,
 	}
 	
+	c.udpRelay = newUDPRelay(c)
+
 	c.stateMachine = NewStateMachine(func(from, to CoreState) {
 		c.emit(NewStateChangedEvent(from, to))
 	})
@@ -162,6 +191,17 @@ func (c *Core) Start(config SessionConfig) error {
 		return fmt.Errorf("cannot start from state %s", c.stateMachine.State())
 	}
 	
+	// A PSK switch that came due while stopped applies before dialing.
+	switched, err := config.applyDuePSKSwitch(time.Now())
+	if err != nil {
+		return err
+	}
+	if switched && c.configManager != nil {
+		if err := c.configManager.Save(&config); err != nil {
+			log.Printf("[ERROR] Failed to save config after PSK switch: %v", err)
+		}
+	}
+
 	c.mu.Lock()
 	c.config = &config
 	c.mu.Unlock()
@@ -182,10 +222,22 @@ func (c *Core) Start(config SessionConfig) error {
 	}
 	
 	log.Printf("[DEBUG] Initialize success, transitioning to Active")
+	if err := c.schedulePSKSwitch(); err != nil {
+		log.Printf("[ERROR] PSK switch not scheduled: %v", err)
+	}
 	c.setLastError(nil)
 	return c.stateMachine.Transition(StateActive)
 }
 
+// SetTransport makes sessions dial t instead of the transports selected by
+// SessionConfig.Transport, e.g. a PipeTransport to an in-process gateway. It
+// applies from the next Start; nil restores the default.
+func (c *Core) SetTransport(t Transport) {
+	c.mu.Lock()
+	c.transport = t
+	c.mu.Unlock()
+}
+
 // Rotate manually triggers session rotation (Active -> Rotating -> Active).
 func (c *Core) Rotate() error {
 	if !c.stateMachine.CanTransition(StateRotating) {
@@ -366,6 +418,9 @@ func (c *Core) UpdateConfig(config SessionConfig) error {
 			c.Close()
 			return c.Start(config)
 		}
+		if err := c.schedulePSKSwitch(); err != nil {
+			return err
+		}
 		// If only other params changed, just rotate session
 		if c.sessionMgr != nil {
 			go c.Rotate()
@@ -558,6 +613,7 @@ func (c *Core) initialize() error {
 	c.sessionPool = make([]*sessionManager, 0, poolMin)
 	for i := 0; i < poolMin; i++ {
 		sm := newSessionManager(c.config, c.emit, c.metrics)
+		sm.transport = c.transport
 		if err := sm.initialize(); err != nil {
 			return err
 		}
@@ -592,6 +648,7 @@ func (c *Core) initialize() error {
 			if err := sm.connect(); err != nil {
 				return fmt.Errorf("session pool connect failed on index %d: %w", idx, err)
 			}
+			sm.startPortHopping()
 		}
 	}
 
@@ -613,6 +670,10 @@ func (c *Core) cleanup() {
 	if c.metricsCollector != nil {
 		c.metricsCollector.Stop()
 	}
+	if c.pskTimer != nil {
+		c.pskTimer.Stop()
+		c.pskTimer = nil
+	}
 
 	if c.socksServer != nil {
 		c.socksServer.stop()
@@ -681,7 +742,52 @@ func (c *Core) openStreamInternal(target TargetAddress, options map[string]inter
 		maxPadding = uint16(v)
 	}
 
-	metaRecord, err := BuildMetadataRecord(target.Host, uint16(target.Port), maxPadding, c.config.PSK, sm.nonceGen)
+	dataAEAD := c.config.DataAEAD
+	if v, ok := options["dataAEAD"].(bool); ok {
+		dataAEAD = v
+	}
+
+	recordPayload := c.config.RecordPayloadBytes
+	if v, ok := options["recordPayloadBytes"].(float64); ok {
+		recordPayload = int(v)
+	}
+	if recordPayload <= 0 {
+		recordPayload = GetMaxRecordPayload()
+	}
+
+	compressionName := c.config.Compression
+	if v, ok := options["compression"].(string); ok {
+		compressionName = v
+	}
+	compression, err := ParseCompression(compressionName)
+	if err != nil {
+		log.Printf("[DEBUG] %v, sending uncompressed", err)
+	}
+
+	paddingName := c.config.Padding
+	if v, ok := options["padding"].(string); ok {
+		paddingName = v
+	}
+	padding, err := ParsePaddingScheme(paddingName)
+	if err != nil {
+		log.Printf("[DEBUG] %v, sending unpadded", err)
+	}
+	paddingBudget := c.config.PaddingBudget
+	if v, ok := options["paddingBudget"].(float64); ok {
+		paddingBudget = int(v)
+	}
+	paddingBudget = max(0, min(paddingBudget, 255))
+
+	metaOpts := Options{
+		MaxPadding:    maxPadding,
+		DataAEAD:      dataAEAD,
+		RecordPayload: uint32(clampRecordPayload(recordPayload)),
+		Padding:       padding,
+		PaddingBudget: uint8(paddingBudget),
+		Compression:   compression,
+	}
+	psk := sm.psk()
+	metaRecord, err := BuildMetadataRecordWithOptions(target.Host, uint16(target.Port), metaOpts, psk, sm.nonceGen)
 	if err != nil {
 		stream.Close()
 		return StreamHandle{}, err
@@ -695,16 +801,43 @@ func (c *Core) openStreamInternal(target TargetAddress, options map[string]inter
 	// Wrap the stream in a RecordReadWriter to handle data-phase encapsulation
 	// V5: Pass NonceGenerator for counter-based nonce
 	wrappedStream := NewRecordReadWriter(stream, maxPadding, sm.nonceGen)
+	wrappedStream.SetCodec(sm.codec)
+	wrappedStream.Negotiate(metaOpts, psk, metaRecord[4:4+RecordHeaderLength])
+	if dataAEAD {
+		up, down, err := NewStreamDataAEADs(psk, metaRecord[4:4+RecordHeaderLength])
+		if err != nil {
+			stream.Close()
+			return StreamHandle{}, err
+		}
+		wrappedStream.SetDataAEAD(up, down)
+	}
 
 	id := fmt.Sprintf("str-%d-%d", streamID, time.Now().UnixNano())
 	handle := StreamHandle{ID: id}
 
+	// Gateways that confirmed a protocol version answer the metadata with a
+	// connected (Accept) or Error record; wait for it so local clients only
+	// see success once the target is reachable.
+	if sm.awaitConnect {
+		remote, err := c.waitConnected(stream, wrappedStream)
+		if err != nil {
+			stream.Close()
+			log.Printf("[DEBUG] Connect to %s:%d failed: %v", target.Host, target.Port, err)
+			c.emit(NewStreamErrorEvent(id, ErrorCodeOf(err).String()))
+			return StreamHandle{}, err
+		}
+		if remote != nil {
+			handle.RemoteAddr = remote.String()
+		}
+	}
+
 	info := &StreamInfo{
 		ID:         id,
 		TargetHost: target.Host,
 		TargetPort: target.Port,
 		OpenedAt:   time.Now().UnixMilli(),
 		State:      "Open",
+		RemoteAddr: handle.RemoteAddr,
 	}
 
 	c.mu.Lock()
@@ -721,6 +854,26 @@ func (c *Core) openStreamInternal(target TargetAddress, options map[string]inter
 	return handle, nil
 }
 
+// DefaultConnectTimeout bounds the wait for the gateway's connected reply.
+// It exceeds the gateway's own 10s dial timeout so its error arrives first.
+const DefaultConnectTimeout = 15 * time.Second
+
+// waitConnected waits for the gateway's reply to a stream's metadata.
+func (c *Core) waitConnected(stream interface{ SetReadDeadline(time.Time) error }, rw *RecordReadWriter) (*net.TCPAddr, error) {
+	timeout := DefaultConnectTimeout
+	if c.config.ConnectTimeoutMs > 0 {
+		timeout = time.Duration(c.config.ConnectTimeoutMs) * time.Millisecond
+	}
+	_ = stream.SetReadDeadline(time.Now().Add(timeout))
+	defer stream.SetReadDeadline(time.Time{})
+
+	remote, err := rw.WaitConnected()
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return nil, NewStreamError(CodeTimeout, fmt.Sprintf("no connect reply within %s", timeout))
+	}
+	return remote, err
+}
+
 // closeStreamInternal closes a stream.
 func (c *Core) closeStreamInternal(handle StreamHandle) error {
 	c.mu.Lock()
@@ -0,0 +1,102 @@
+package core
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Protocol version negotiation.
+//
+// The client lists the wire versions it speaks, newest first, as WebTransport
+// application protocols (WT-Available-Protocols); the gateway picks the first
+// one it supports and echoes it in WT-Protocol. Each version has a Codec that
+// parses its record framing, so one gateway can serve several client
+// generations side by side. Peers that predate negotiation send or echo no
+// protocol and are treated as V5.
+
+// ProtocolV5 is the application protocol name of the V5 wire format.
+const ProtocolV5 = ProtocolLabel
+
+var (
+	// ErrUnsupportedProtocol is returned for an application protocol without a codec.
+	ErrUnsupportedProtocol = errors.New("unsupported protocol")
+	// ErrUnsupportedVersion is returned for records with an unknown version byte.
+	ErrUnsupportedVersion = errors.New("unsupported protocol version")
+)
+
+// Codec parses the records of one wire protocol version.
+type Codec interface {
+	// Protocol is the WebTransport application protocol name.
+	Protocol() string
+	// Version is the version byte carried in every record header.
+	Version() byte
+	// HeaderLength is the fixed record header size.
+	HeaderLength() int
+	// DecodeRecord parses a record body (without length prefix) into r,
+	// slicing Header, SessionID, Payload and Padding from record.
+	DecodeRecord(record []byte, r *Record) error
+}
+
+// codecs lists the supported versions, newest first.
+var codecs = []Codec{V5Codec{}}
+
+// SupportedProtocols returns the application protocols to offer or accept,
+// newest first.
+func SupportedProtocols() []string {
+	protocols := make([]string, 0, len(codecs))
+	for _, c := range codecs {
+		protocols = append(protocols, c.Protocol())
+	}
+	return protocols
+}
+
+// CodecForProtocol returns the codec of a negotiated application protocol.
+// An empty name means the peer predates negotiation and speaks V5.
+func CodecForProtocol(protocol string) (Codec, error) {
+	if protocol == "" {
+		return V5Codec{}, nil
+	}
+	for _, c := range codecs {
+		if c.Protocol() == protocol {
+			return c, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s", ErrUnsupportedProtocol, protocol)
+}
+
+// V5Codec parses the V5 record format (30-byte header, SessionID || Counter nonce).
+type V5Codec struct{}
+
+func (V5Codec) Protocol() string  { return ProtocolV5 }
+func (V5Codec) Version() byte     { return ProtocolVersion }
+func (V5Codec) HeaderLength() int { return RecordHeaderLength }
+
+// DecodeRecord implements Codec.
+func (V5Codec) DecodeRecord(record []byte, r *Record) error {
+	if len(record) < RecordHeaderLength {
+		return errors.New("invalid record length")
+	}
+	version := record[headerVersionOffset]
+	if version != ProtocolVersion {
+		return fmt.Errorf("%w: 0x%02x (expected 0x%02x)", ErrUnsupportedVersion, version, ProtocolVersion)
+	}
+
+	payloadLength := binary.BigEndian.Uint32(record[headerPayloadLenOffset : headerPayloadLenOffset+4])
+	paddingLength := binary.BigEndian.Uint32(record[headerPaddingLenOffset : headerPaddingLenOffset+4])
+	if uint64(RecordHeaderLength)+uint64(payloadLength)+uint64(paddingLength) != uint64(len(record)) {
+		return errors.New("invalid payload length")
+	}
+
+	r.Version = version
+	r.Type = record[headerTypeOffset]
+	r.TimestampNano = binary.BigEndian.Uint64(record[headerTimestampOffset : headerTimestampOffset+headerTimestampSize])
+	r.PayloadLength = payloadLength
+	r.PaddingLength = paddingLength
+	r.Header = record[:RecordHeaderLength]
+	r.SessionID = record[headerSessionIDOffset : headerSessionIDOffset+headerSessionIDLength]
+	r.Counter = binary.BigEndian.Uint64(record[headerCounterOffset : headerCounterOffset+headerCounterLength])
+	r.Payload = record[RecordHeaderLength : RecordHeaderLength+int(payloadLength)]
+	r.Padding = record[RecordHeaderLength+int(payloadLength):]
+	return nil
+}
@@ -0,0 +1,46 @@
+package core
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// TestCodecForProtocol verifies negotiated protocol names map to codecs and
+// peers that predate negotiation fall back to V5.
+func TestCodecForProtocol(t *testing.T) {
+	for _, protocol := range []string{"", ProtocolV5} {
+		codec, err := CodecForProtocol(protocol)
+		if err != nil {
+			t.Fatalf("CodecForProtocol(%q): %v", protocol, err)
+		}
+		if codec.Version() != ProtocolVersion {
+			t.Errorf("CodecForProtocol(%q): version 0x%02x, want 0x%02x", protocol, codec.Version(), ProtocolVersion)
+		}
+	}
+	if _, err := CodecForProtocol("aether-realist-v3"); !errors.Is(err, ErrUnsupportedProtocol) {
+		t.Errorf("CodecForProtocol(v3): got %v, want ErrUnsupportedProtocol", err)
+	}
+	if got := SupportedProtocols(); len(got) == 0 || got[0] != ProtocolV5 {
+		t.Errorf("SupportedProtocols: got %v", got)
+	}
+}
+
+// TestRecordReaderUnsupportedVersion verifies records of another version are
+// reported as such rather than as a decryption failure.
+func TestRecordReaderUnsupportedVersion(t *testing.T) {
+	ng, err := NewNonceGenerator()
+	if err != nil {
+		t.Fatalf("NewNonceGenerator: %v", err)
+	}
+	record, err := BuildDataRecord([]byte("hello"), 0, ng)
+	if err != nil {
+		t.Fatalf("BuildDataRecord: %v", err)
+	}
+	record[4+headerVersionOffset] = 0x06
+
+	_, err = NewRecordReader(bytes.NewReader(record)).ReadNextRecord()
+	if !errors.Is(err, ErrUnsupportedVersion) {
+		t.Errorf("ReadNextRecord: got %v, want ErrUnsupportedVersion", err)
+	}
+}
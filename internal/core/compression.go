@@ -0,0 +1,226 @@
+package core
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/cipher"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sync"
+)
+
+// Compressed data records (TypeDataCompressed) carry
+//
+//	Algorithm(u8) || compressed bytes
+//
+// as their payload, sealed like a normal data record when DataAEAD is on.
+// Every record is compressed independently, so records stay self-contained.
+// The sender falls back to plain TypeData whenever compression does not pay.
+const (
+	// compressionMinPayload skips records too small to benefit.
+	compressionMinPayload = 256
+	// compressionSampleRecords is how many records are sampled for entropy
+	// before deciding whether a stream is compressible at all.
+	compressionSampleRecords = 8
+	// compressionEntropyLimit (bits/byte) marks data as incompressible.
+	compressionEntropyLimit = 7.5
+)
+
+// ErrDecompressedTooLarge guards against decompression bombs.
+var ErrDecompressedTooLarge = errors.New("decompressed record exceeds max record size")
+
+var (
+	flateWriterPool = sync.Pool{
+		New: func() interface{} {
+			w, _ := flate.NewWriter(nil, flate.BestSpeed)
+			return w
+		},
+	}
+	flateReaderPool = sync.Pool{
+		New: func() interface{} {
+			return flate.NewReader(bytes.NewReader(nil))
+		},
+	}
+)
+
+// DataRecordEncoder builds the data records of one stream direction, applying
+// the negotiated compression, optional AEAD sealing and padding. It keeps
+// per-stream state and must not be shared between streams.
+type DataRecordEncoder struct {
+	opts       Options
+	aead       cipher.AEAD
+	compressor *dataCompressor
+	padder     *dataPadder
+}
+
+// NewDataRecordEncoder creates an encoder for the accepted options.
+// aead may be nil when DataAEAD is off.
+func NewDataRecordEncoder(opts Options, aead cipher.AEAD) *DataRecordEncoder {
+	e := &DataRecordEncoder{opts: opts, aead: aead, padder: newDataPadder(opts)}
+	if opts.Compression != CompressionNone {
+		e.compressor = &dataCompressor{algo: opts.Compression}
+	}
+	return e
+}
+
+// Options returns the options this encoder applies.
+func (e *DataRecordEncoder) Options() Options {
+	return e.opts
+}
+
+// Build returns a pooled record buffer for payload; release it with PutBuffer.
+func (e *DataRecordEncoder) Build(payload []byte, ng *NonceGenerator) ([]byte, error) {
+	recordType := byte(TypeData)
+	body := payload
+	if compressed, ok := e.compressor.compress(payload); ok {
+		recordType = TypeDataCompressed
+		body = compressed
+	}
+	if e.compressor != nil {
+		perfObserveUpCompress(len(payload), len(body))
+	}
+	wireLen := len(body)
+	if e.aead != nil {
+		wireLen += e.aead.Overhead()
+	}
+	padding := e.padder.padding(wireLen)
+	if e.padder != nil {
+		perfObserveUpPadding(wireLen, padding)
+	}
+	if e.aead != nil {
+		return sealDataRecord(recordType, body, padding, e.aead, ng)
+	}
+	return buildDataRecord(recordType, body, padding, ng)
+}
+
+// PaddingOverhead returns the padding bytes sent so far as a fraction of the
+// payload bytes; it never exceeds the accepted budget.
+func (e *DataRecordEncoder) PaddingOverhead() float64 {
+	return e.padder.overhead()
+}
+
+// dataCompressor compresses records for one stream and turns itself off when
+// the first records look incompressible (already compressed or encrypted).
+type dataCompressor struct {
+	algo       Compression
+	buf        bytes.Buffer
+	sampled    int
+	entropySum float64
+	disabled   bool
+}
+
+// compress returns the compressed payload (including the algorithm byte) and
+// true, or false when the record should be sent uncompressed.
+func (dc *dataCompressor) compress(payload []byte) ([]byte, bool) {
+	if dc == nil || dc.disabled || len(payload) < compressionMinPayload {
+		return nil, false
+	}
+	if dc.sampled < compressionSampleRecords {
+		entropy := byteEntropy(payload)
+		dc.sampled++
+		dc.entropySum += entropy
+		if dc.sampled == compressionSampleRecords && dc.entropySum/compressionSampleRecords > compressionEntropyLimit {
+			dc.disabled = true
+			return nil, false
+		}
+		if entropy > compressionEntropyLimit {
+			return nil, false
+		}
+	}
+
+	dc.buf.Reset()
+	dc.buf.WriteByte(byte(dc.algo))
+	w := flateWriterPool.Get().(*flate.Writer)
+	w.Reset(&dc.buf)
+	_, err := w.Write(payload)
+	if err == nil {
+		err = w.Close()
+	}
+	flateWriterPool.Put(w)
+	if err != nil || dc.buf.Len() >= len(payload) {
+		return nil, false
+	}
+	return dc.buf.Bytes(), true
+}
+
+// byteEntropy returns the Shannon entropy of b in bits per byte.
+func byteEntropy(b []byte) float64 {
+	var counts [256]int
+	for _, c := range b {
+		counts[c]++
+	}
+	total := float64(len(b))
+	entropy := 0.0
+	for _, n := range counts {
+		if n == 0 {
+			continue
+		}
+		p := float64(n) / total
+		entropy -= p * math.Log2(p)
+	}
+	return entropy
+}
+
+// inflateDataRecord decompresses a TypeDataCompressed record into a new
+// buffer and rewrites it as a plain TypeData record. The output starts as a
+// pooled buffer; once grown it is no longer pool-sized and PutBuffer drops it.
+func inflateDataRecord(record *Record) error {
+	if len(record.Payload) < 1 {
+		return errors.New("empty compressed record")
+	}
+	if Compression(record.Payload[0]) != CompressionDeflate {
+		return fmt.Errorf("unsupported compression: %d", record.Payload[0])
+	}
+	compressed := record.Payload[1:]
+
+	// Keep the header in front of the payload so Header/SessionID stay valid
+	// once the original buffer is released.
+	out := GetBuffer()
+	out = append(out, record.Header...)
+
+	r := flateReaderPool.Get().(io.ReadCloser)
+	defer flateReaderPool.Put(r)
+	if err := r.(flate.Resetter).Reset(bytes.NewReader(compressed), nil); err != nil {
+		PutBuffer(out)
+		return err
+	}
+	for {
+		if len(out) == cap(out) {
+			if cap(out) >= MaxRecordSize {
+				PutBuffer(out)
+				return ErrDecompressedTooLarge
+			}
+			grown := make([]byte, len(out), 2*cap(out))
+			copy(grown, out)
+			out = grown
+		}
+		n, err := r.Read(out[len(out):cap(out)])
+		out = out[:len(out)+n]
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			PutBuffer(out)
+			return fmt.Errorf("decompress failed: %w", err)
+		}
+	}
+	if len(out)-RecordHeaderLength > MaxRecordSize {
+		PutBuffer(out)
+		return ErrDecompressedTooLarge
+	}
+	perfObserveDownDecompress(len(record.Payload), len(out)-RecordHeaderLength)
+
+	if record.RawBuffer != nil {
+		PutBuffer(record.RawBuffer)
+	}
+	record.Type = TypeData
+	record.Header = out[:RecordHeaderLength]
+	record.SessionID = out[headerSessionIDOffset : headerSessionIDOffset+headerSessionIDLength]
+	record.Payload = out[RecordHeaderLength:]
+	record.PayloadLength = uint32(len(record.Payload))
+	record.PaddingLength = 0
+	record.RawBuffer = out
+	return nil
+}
@@ -0,0 +1,117 @@
+package core
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"io"
+	"strings"
+	"testing"
+)
+
+// TestCompressedRecordRoundTrip verifies compressible payloads are sent as
+// compressed records and read back transparently, with and without AEAD.
+func TestCompressedRecordRoundTrip(t *testing.T) {
+	ng, err := NewNonceGenerator()
+	if err != nil {
+		t.Fatalf("NewNonceGenerator: %v", err)
+	}
+	sid := ng.SessionID()
+	aead, err := NewDataAEAD("test-psk", sid[:], 0, DataDirUpstream)
+	if err != nil {
+		t.Fatalf("NewDataAEAD: %v", err)
+	}
+	payload := []byte(strings.Repeat(`{"level":"info","msg":"request served","status":200}`+"\n", 200))
+
+	for _, tc := range []struct {
+		name string
+		seal cipher.AEAD
+	}{{"plain", nil}, {"aead", aead}} {
+		encoder := NewDataRecordEncoder(Options{Compression: CompressionDeflate}, tc.seal)
+		record, err := encoder.Build(payload, ng)
+		if err != nil {
+			t.Fatalf("%s: Build: %v", tc.name, err)
+		}
+		if record[4+headerTypeOffset] != TypeDataCompressed {
+			t.Errorf("%s: record type %d, want compressed", tc.name, record[4+headerTypeOffset])
+		}
+		if len(record) >= len(payload) {
+			t.Errorf("%s: record %d bytes not smaller than payload %d", tc.name, len(record), len(payload))
+		}
+
+		// Without negotiated compression the reader refuses to inflate.
+		reader := NewRecordReader(bytes.NewReader(record))
+		reader.SetDataAEAD(tc.seal)
+		if _, err := reader.ReadNextRecord(); err == nil {
+			t.Errorf("%s: compressed record accepted without negotiated compression", tc.name)
+		}
+
+		reader = NewRecordReader(bytes.NewReader(record))
+		reader.SetDataAEAD(tc.seal)
+		reader.SetCompression(CompressionDeflate)
+		got, err := io.ReadAll(reader)
+		if err != nil {
+			t.Fatalf("%s: ReadAll: %v", tc.name, err)
+		}
+		if !bytes.Equal(got, payload) {
+			t.Errorf("%s: payload mismatch (got %d bytes)", tc.name, len(got))
+		}
+		PutBuffer(record)
+	}
+}
+
+// TestCompressionAutoDisable verifies incompressible streams stop being
+// compressed after the entropy sample.
+func TestCompressionAutoDisable(t *testing.T) {
+	ng, err := NewNonceGenerator()
+	if err != nil {
+		t.Fatalf("NewNonceGenerator: %v", err)
+	}
+	encoder := NewDataRecordEncoder(Options{Compression: CompressionDeflate}, nil)
+	payload := make([]byte, 4096)
+	for i := 0; i < compressionSampleRecords; i++ {
+		rand.Read(payload)
+		record, err := encoder.Build(payload, ng)
+		if err != nil {
+			t.Fatalf("Build: %v", err)
+		}
+		if record[4+headerTypeOffset] != TypeData {
+			t.Errorf("record %d: random data was compressed", i)
+		}
+		PutBuffer(record)
+	}
+	if !encoder.compressor.disabled {
+		t.Error("compressor still enabled after incompressible sample")
+	}
+}
+
+// TestInflateLargeRecordPool verifies that a record inflated past the pool
+// buffer size is not returned to the pool.
+func TestInflateLargeRecordPool(t *testing.T) {
+	ng, err := NewNonceGenerator()
+	if err != nil {
+		t.Fatalf("NewNonceGenerator: %v", err)
+	}
+	payload := bytes.Repeat([]byte("a"), 4*GetPoolBufferSize())
+	encoder := NewDataRecordEncoder(Options{Compression: CompressionDeflate, RecordPayload: uint32(len(payload))}, nil)
+	record, err := encoder.Build(payload, ng)
+	if err != nil {
+		t.Fatalf("Build: %v", err)
+	}
+	reader := NewRecordReader(bytes.NewReader(record))
+	reader.SetCompression(CompressionDeflate)
+	parsed, err := reader.ReadNextRecord()
+	if err != nil {
+		t.Fatalf("ReadNextRecord: %v", err)
+	}
+	if !bytes.Equal(parsed.Payload, payload) {
+		t.Fatalf("payload mismatch (got %d bytes)", len(parsed.Payload))
+	}
+	if cap(parsed.RawBuffer) == GetPoolBufferSize() {
+		t.Fatal("expected inflated buffer to outgrow the pool size")
+	}
+	PutBuffer(parsed.RawBuffer)
+	if got := cap(GetBuffer()); got != GetPoolBufferSize() {
+		t.Errorf("pool returned buffer of cap %d, want %d", got, GetPoolBufferSize())
+	}
+}
@@ -0,0 +1,180 @@
+package core
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Data AEAD directions. Each direction of a stream is sealed under its own key,
+// so the client and gateway NonceGenerators never need to coordinate.
+const (
+	DataDirUpstream   byte = 0x01 // client -> gateway
+	DataDirDownstream byte = 0x02 // gateway -> client
+)
+
+// NewDataAEAD derives the AES-GCM instance protecting one direction of a stream.
+// The HKDF salt is the stream's metadata nonce (SessionID || Counter) followed by
+// the direction byte, so every stream and direction gets an independent key.
+func NewDataAEAD(psk string, sessionID []byte, counter uint64, dir byte) (cipher.AEAD, error) {
+	if len(sessionID) != headerSessionIDLength {
+		return nil, fmt.Errorf("invalid SessionID length: %d", len(sessionID))
+	}
+	salt := make([]byte, nonceLength+1)
+	copy(salt[0:4], sessionID)
+	binary.BigEndian.PutUint64(salt[4:12], counter)
+	salt[nonceLength] = dir
+
+	key, err := deriveKey(psk, salt)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// NewStreamDataAEADs derives the upstream and downstream data AEADs from the
+// 30-byte header of the stream's metadata record.
+func NewStreamDataAEADs(psk string, metadataHeader []byte) (up, down cipher.AEAD, err error) {
+	if len(metadataHeader) != RecordHeaderLength {
+		return nil, nil, fmt.Errorf("invalid header length: %d", len(metadataHeader))
+	}
+	sessionID := metadataHeader[headerSessionIDOffset : headerSessionIDOffset+headerSessionIDLength]
+	counter := binary.BigEndian.Uint64(metadataHeader[headerCounterOffset : headerCounterOffset+headerCounterLength])
+
+	up, err = NewDataAEAD(psk, sessionID, counter, DataDirUpstream)
+	if err != nil {
+		return nil, nil, err
+	}
+	down, err = NewDataAEAD(psk, sessionID, counter, DataDirDownstream)
+	if err != nil {
+		return nil, nil, err
+	}
+	return up, down, nil
+}
+
+// BuildSealedDataRecord creates a data record whose payload is sealed with aead.
+// Nonce = SessionID || Counter, AAD = the full 30-byte header.
+func BuildSealedDataRecord(payload []byte, aead cipher.AEAD, ng *NonceGenerator) ([]byte, error) {
+	return sealDataRecord(TypeData, payload, 0, aead, ng)
+}
+
+// BuildSealedFinRecord creates a FIN record sealed like a data record, so an
+// on-path hop cannot truncate an AEAD stream by injecting one.
+func BuildSealedFinRecord(aead cipher.AEAD, ng *NonceGenerator) ([]byte, error) {
+	return sealDataRecord(TypeFin, nil, 0, aead, ng)
+}
+
+// BuildSealedErrorRecord creates an error record sealed like a data record.
+func BuildSealedErrorRecord(code ErrorCode, message string, aead cipher.AEAD, ng *NonceGenerator) ([]byte, error) {
+	return sealDataRecord(TypeError, buildErrorPayload(code, message), 0, aead, ng)
+}
+
+// isSealedType reports whether records of recordType are sealed in AEAD data
+// mode: data records and the Fin/Error records that end a stream.
+func isSealedType(recordType byte) bool {
+	switch recordType {
+	case TypeData, TypeDataCompressed, TypeFin, TypeError:
+		return true
+	}
+	return false
+}
+
+// sealDataRecord builds a sealed data-phase record of recordType.
+func sealDataRecord(recordType byte, payload []byte, paddingLength int, aead cipher.AEAD, ng *NonceGenerator) ([]byte, error) {
+	nonce, counter, err := ng.Next()
+	if err != nil {
+		return nil, err
+	}
+	sessionID := nonce[0:4]
+
+	sealedLen := len(payload) + aead.Overhead()
+	totalLength := RecordHeaderLength + sealedLen + paddingLength
+	buf := GetBuffer()
+	if cap(buf) < 4+totalLength {
+		buf = make([]byte, 4+totalLength)
+	} else {
+		buf = buf[:4+totalLength]
+	}
+
+	binary.BigEndian.PutUint32(buf[0:4], uint32(totalLength))
+	header := buf[4 : 4+RecordHeaderLength]
+	if err := buildHeaderInto(header, recordType, sealedLen, paddingLength, sessionID, counter); err != nil {
+		PutBuffer(buf)
+		return nil, err
+	}
+	aead.Seal(buf[4+RecordHeaderLength:4+RecordHeaderLength], nonce[:], payload, header)
+	clear(buf[4+RecordHeaderLength+sealedLen:])
+	return buf, nil
+}
+
+// openDataRecord authenticates and decrypts a sealed record in place.
+func openDataRecord(record *Record, aead cipher.AEAD) error {
+	var nonce [12]byte
+	copy(nonce[0:4], record.SessionID)
+	binary.BigEndian.PutUint64(nonce[4:12], record.Counter)
+
+	decryptStart := time.Now()
+	plaintext, err := aead.Open(record.Payload[:0], nonce[:], record.Payload, record.Header)
+	perfObserveDownDecrypt(time.Since(decryptStart))
+	if err != nil {
+		return fmt.Errorf("data record authentication failed: %w", err)
+	}
+	record.Payload = plaintext
+	record.PayloadLength = uint32(len(plaintext))
+	return nil
+}
+
+// ErrDataRecordOrder is returned for a sealed record whose counter does not
+// follow the previous one, i.e. a replayed, duplicated or reordered record.
+var ErrDataRecordOrder = errors.New("sealed record out of order")
+
+// maxRetiredEpochs bounds the SessionIDs a sealedSequence remembers after
+// the sender rekeys.
+const maxRetiredEpochs = 16
+
+// sealedSequence enforces strictly increasing counters on the sealed records
+// of one stream direction. A sender's counter restarts at zero when it rolls
+// to a new SessionID (Rekey); earlier SessionIDs are retired and rejected.
+type sealedSequence struct {
+	started   bool
+	sessionID [4]byte
+	counter   uint64
+	retired   [][4]byte
+}
+
+// accept records (sessionID, counter) if it follows the previous record.
+// Call it only after the record authenticated.
+func (s *sealedSequence) accept(sessionID []byte, counter uint64) error {
+	var id [4]byte
+	copy(id[:], sessionID)
+	if !s.started {
+		s.started = true
+		s.sessionID, s.counter = id, counter
+		return nil
+	}
+	if id == s.sessionID {
+		if counter <= s.counter {
+			return ErrDataRecordOrder
+		}
+		s.counter = counter
+		return nil
+	}
+	for _, old := range s.retired {
+		if old == id {
+			return ErrDataRecordOrder
+		}
+	}
+	if len(s.retired) == maxRetiredEpochs {
+		s.retired = s.retired[1:]
+	}
+	s.retired = append(s.retired, s.sessionID)
+	s.sessionID, s.counter = id, counter
+	return nil
+}
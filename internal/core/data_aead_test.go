@@ -0,0 +1,252 @@
+package core
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// TestSealedDataRecordRoundTrip verifies that a sealed data record is opened
+// transparently by a RecordReader configured with the matching AEAD.
+func TestSealedDataRecordRoundTrip(t *testing.T) {
+	ng, err := NewNonceGenerator()
+	if err != nil {
+		t.Fatalf("NewNonceGenerator: %v", err)
+	}
+	meta, err := BuildMetadataRecordWithOptions("example.com", 443, Options{DataAEAD: true}, "test-psk", ng)
+	if err != nil {
+		t.Fatalf("BuildMetadataRecordWithOptions: %v", err)
+	}
+	up, down, err := NewStreamDataAEADs("test-psk", meta[4:4+RecordHeaderLength])
+	if err != nil {
+		t.Fatalf("NewStreamDataAEADs: %v", err)
+	}
+
+	payload := []byte("secret tunneled bytes")
+	record, err := BuildSealedDataRecord(payload, up, ng)
+	if err != nil {
+		t.Fatalf("BuildSealedDataRecord: %v", err)
+	}
+	defer PutBuffer(record)
+
+	if bytes.Contains(record, payload) {
+		t.Fatal("sealed record contains plaintext payload")
+	}
+
+	reader := NewRecordReader(bytes.NewReader(record))
+	reader.SetDataAEAD(up)
+	parsed, err := reader.ReadNextRecord()
+	if err != nil {
+		t.Fatalf("ReadNextRecord: %v", err)
+	}
+	if !bytes.Equal(parsed.Payload, payload) {
+		t.Errorf("Payload: got %q, want %q", parsed.Payload, payload)
+	}
+
+	// The downstream key must not open upstream records.
+	wrongDir := NewRecordReader(bytes.NewReader(record))
+	wrongDir.SetDataAEAD(down)
+	if _, err := wrongDir.ReadNextRecord(); err == nil {
+		t.Fatal("expected downstream key to reject upstream record")
+	}
+}
+
+// TestSealedDataRecordTamper verifies that modified ciphertext, modified headers
+// and downgraded plaintext records are all rejected.
+func TestSealedDataRecordTamper(t *testing.T) {
+	ng, err := NewNonceGenerator()
+	if err != nil {
+		t.Fatalf("NewNonceGenerator: %v", err)
+	}
+	sid := ng.SessionID()
+	aead, err := NewDataAEAD("test-psk", sid[:], 0, DataDirUpstream)
+	if err != nil {
+		t.Fatalf("NewDataAEAD: %v", err)
+	}
+
+	record, err := BuildSealedDataRecord([]byte("payload"), aead, ng)
+	if err != nil {
+		t.Fatalf("BuildSealedDataRecord: %v", err)
+	}
+
+	flipped := append([]byte(nil), record...)
+	flipped[len(flipped)-1] ^= 0x01
+	reader := NewRecordReader(bytes.NewReader(flipped))
+	reader.SetDataAEAD(aead)
+	if _, err := reader.ReadNextRecord(); err == nil {
+		t.Error("expected error for tampered ciphertext")
+	}
+
+	counterTampered := append([]byte(nil), record...)
+	counterTampered[4+headerCounterOffset+headerCounterLength-1] ^= 0x01
+	reader = NewRecordReader(bytes.NewReader(counterTampered))
+	reader.SetDataAEAD(aead)
+	if _, err := reader.ReadNextRecord(); err == nil {
+		t.Error("expected error for tampered header")
+	}
+
+	plain, err := BuildDataRecord([]byte("payload"), 0, ng)
+	if err != nil {
+		t.Fatalf("BuildDataRecord: %v", err)
+	}
+	reader = NewRecordReader(bytes.NewReader(plain))
+	reader.SetDataAEAD(aead)
+	if _, err := reader.ReadNextRecord(); err == nil {
+		t.Error("expected error for plaintext record in AEAD mode")
+	}
+}
+
+// TestSealedDataRecordOrder verifies that a replayed or reordered sealed
+// record is rejected even though it authenticates.
+func TestSealedDataRecordOrder(t *testing.T) {
+	ng, err := NewNonceGenerator()
+	if err != nil {
+		t.Fatalf("NewNonceGenerator: %v", err)
+	}
+	sid := ng.SessionID()
+	aead, err := NewDataAEAD("test-psk", sid[:], 0, DataDirUpstream)
+	if err != nil {
+		t.Fatalf("NewDataAEAD: %v", err)
+	}
+	var records [][]byte
+	for _, p := range []string{"one", "two", "three"} {
+		record, err := BuildSealedDataRecord([]byte(p), aead, ng)
+		if err != nil {
+			t.Fatalf("BuildSealedDataRecord: %v", err)
+		}
+		records = append(records, append([]byte(nil), record...))
+		PutBuffer(record)
+	}
+
+	tests := []struct {
+		name  string
+		order []int
+	}{
+		{"replayed", []int{0, 1, 1}},
+		{"reordered", []int{0, 2, 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stream bytes.Buffer
+			for _, i := range tt.order {
+				stream.Write(records[i])
+			}
+			reader := NewRecordReader(&stream)
+			reader.SetDataAEAD(aead)
+			for i := 0; i < 2; i++ {
+				if _, err := reader.ReadNextRecord(); err != nil {
+					t.Fatalf("record %d: %v", i, err)
+				}
+			}
+			if _, err := reader.ReadNextRecord(); !errors.Is(err, ErrDataRecordOrder) {
+				t.Fatalf("expected ErrDataRecordOrder, got %v", err)
+			}
+		})
+	}
+}
+
+// TestSealedDataRecordRekey verifies that counters restart with a new
+// SessionID and that records of a retired SessionID are rejected.
+func TestSealedDataRecordRekey(t *testing.T) {
+	ng, err := NewNonceGenerator()
+	if err != nil {
+		t.Fatalf("NewNonceGenerator: %v", err)
+	}
+	sid := ng.SessionID()
+	aead, err := NewDataAEAD("test-psk", sid[:], 0, DataDirUpstream)
+	if err != nil {
+		t.Fatalf("NewDataAEAD: %v", err)
+	}
+	old, err := BuildSealedDataRecord([]byte("old epoch"), aead, ng)
+	if err != nil {
+		t.Fatalf("BuildSealedDataRecord: %v", err)
+	}
+	var stream bytes.Buffer
+	stream.Write(old)
+	if err := ng.Rekey(); err != nil {
+		t.Fatalf("Rekey: %v", err)
+	}
+	fresh, err := BuildSealedDataRecord([]byte("new epoch"), aead, ng)
+	if err != nil {
+		t.Fatalf("BuildSealedDataRecord: %v", err)
+	}
+	stream.Write(fresh)
+	stream.Write(old)
+
+	reader := NewRecordReader(&stream)
+	reader.SetDataAEAD(aead)
+	for i := 0; i < 2; i++ {
+		if _, err := reader.ReadNextRecord(); err != nil {
+			t.Fatalf("record %d: %v", i, err)
+		}
+	}
+	if _, err := reader.ReadNextRecord(); !errors.Is(err, ErrDataRecordOrder) {
+		t.Fatalf("expected retired epoch to be rejected, got %v", err)
+	}
+}
+
+// TestSealedControlRecords verifies that Fin and Error records are sealed in
+// AEAD data mode and that injected plaintext ones are rejected.
+func TestSealedControlRecords(t *testing.T) {
+	ng, err := NewNonceGenerator()
+	if err != nil {
+		t.Fatalf("NewNonceGenerator: %v", err)
+	}
+	sid := ng.SessionID()
+	aead, err := NewDataAEAD("test-psk", sid[:], 0, DataDirDownstream)
+	if err != nil {
+		t.Fatalf("NewDataAEAD: %v", err)
+	}
+
+	errRecord, err := BuildSealedErrorRecord(CodeConnRefused, "refused", aead, ng)
+	if err != nil {
+		t.Fatalf("BuildSealedErrorRecord: %v", err)
+	}
+	finRecord, err := BuildSealedFinRecord(aead, ng)
+	if err != nil {
+		t.Fatalf("BuildSealedFinRecord: %v", err)
+	}
+	var stream bytes.Buffer
+	stream.Write(errRecord)
+	stream.Write(finRecord)
+	reader := NewRecordReader(&stream)
+	reader.SetDataAEAD(aead)
+	parsed, err := reader.ReadNextRecord()
+	if err != nil {
+		t.Fatalf("ReadNextRecord(error): %v", err)
+	}
+	if parsed.ErrorCode != CodeConnRefused || parsed.ErrorMessage != "refused" {
+		t.Errorf("Error record: got %s %q", parsed.ErrorCode, parsed.ErrorMessage)
+	}
+	if parsed, err = reader.ReadNextRecord(); err != nil || parsed.Type != TypeFin {
+		t.Fatalf("ReadNextRecord(fin): %v", err)
+	}
+
+	plainFin, err := BuildFinRecord(ng)
+	if err != nil {
+		t.Fatalf("BuildFinRecord: %v", err)
+	}
+	plainErr, err := BuildErrorRecord(CodeStreamAbort, "abort", ng)
+	if err != nil {
+		t.Fatalf("BuildErrorRecord: %v", err)
+	}
+	for name, record := range map[string][]byte{"fin": plainFin, "error": plainErr} {
+		reader := NewRecordReader(bytes.NewReader(record))
+		reader.SetDataAEAD(aead)
+		if _, err := reader.ReadNextRecord(); err == nil {
+			t.Errorf("expected plaintext %s record to be rejected in AEAD mode", name)
+		}
+	}
+}
+
+// TestOptionsDataAEADRoundTrip verifies the DataAEAD TLV survives encoding.
+func TestOptionsDataAEADRoundTrip(t *testing.T) {
+	opts := parseOptions(buildOptions(Options{MaxPadding: 64, DataAEAD: true}))
+	if opts.MaxPadding != 64 || !opts.DataAEAD {
+		t.Errorf("Options: got %+v", opts)
+	}
+	opts = parseOptions(buildOptions(Options{}))
+	if opts.DataAEAD {
+		t.Error("DataAEAD should default to false")
+	}
+}
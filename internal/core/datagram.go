@@ -0,0 +1,180 @@
+package core
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Datagram record layout (one per WebTransport datagram, no length prefix):
+//
+//	Header(30B, Type=TypeDatagram) || AES-GCM(FlowID(4) || Address || Data)
+//
+// Address uses the same AddrType/Port/Address encoding as metadata. Datagrams
+// are unordered and unreliable, so every record is self-contained. Opened
+// datagrams pass a ReplayFilter, so a captured datagram is relayed only once.
+const (
+	// datagramKeyLabel separates datagram keys from metadata keys derived from
+	// the same SessionID.
+	datagramKeyLabel = "udp"
+	// maxDatagramKeyCache bounds the per-codec SessionID -> AEAD cache.
+	maxDatagramKeyCache = 32
+)
+
+// ErrDatagramTooShort is returned for datagram records smaller than a header.
+var ErrDatagramTooShort = errors.New("datagram record too short")
+
+// Datagram is a decoded UDP relay datagram.
+type Datagram struct {
+	FlowID  uint32
+	Host    string
+	Port    uint16
+	Payload []byte
+}
+
+// DatagramCodec seals and opens datagram records for one PSK.
+// Keys are derived per SessionID and cached, so the hot path avoids HKDF.
+type DatagramCodec struct {
+	psk    string
+	replay *ReplayFilter
+	userID string // replay filter key
+	mu     sync.Mutex
+	keys   map[[4]byte]cipher.AEAD
+}
+
+// NewDatagramCodec creates a codec bound to psk with its own replay filter.
+func NewDatagramCodec(psk string) *DatagramCodec {
+	return NewDatagramCodecWithReplay(psk, NewReplayFilter(DefaultReplayWindowSize, maxDatagramKeyCache), "")
+}
+
+// NewDatagramCodecWithReplay creates a codec bound to psk that checks opened
+// datagrams against replay under userID, so a filter shared across sessions
+// also catches datagrams replayed into another session.
+func NewDatagramCodecWithReplay(psk string, replay *ReplayFilter, userID string) *DatagramCodec {
+	return &DatagramCodec{
+		psk:    psk,
+		replay: replay,
+		userID: userID,
+		keys:   make(map[[4]byte]cipher.AEAD),
+	}
+}
+
+func (dc *DatagramCodec) aeadFor(sessionID []byte) (cipher.AEAD, error) {
+	var sid [4]byte
+	copy(sid[:], sessionID)
+
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	if aead, ok := dc.keys[sid]; ok {
+		return aead, nil
+	}
+
+	salt := make([]byte, 0, headerSessionIDLength+len(datagramKeyLabel))
+	salt = append(salt, sessionID...)
+	salt = append(salt, datagramKeyLabel...)
+	key, err := deriveKey(dc.psk, salt)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(dc.keys) >= maxDatagramKeyCache {
+		dc.keys = make(map[[4]byte]cipher.AEAD)
+	}
+	dc.keys[sid] = aead
+	return aead, nil
+}
+
+// Seal builds an encrypted datagram record using ng for the nonce.
+func (dc *DatagramCodec) Seal(d *Datagram, ng *NonceGenerator) ([]byte, error) {
+	address, err := encodeAddress(d.Host, d.Port)
+	if err != nil {
+		return nil, err
+	}
+	plaintext := make([]byte, 4+len(address)+len(d.Payload))
+	binary.BigEndian.PutUint32(plaintext[0:4], d.FlowID)
+	copy(plaintext[4:], address)
+	copy(plaintext[4+len(address):], d.Payload)
+
+	nonce, counter, err := ng.Next()
+	if err != nil {
+		return nil, err
+	}
+	sessionID := nonce[0:4]
+	aead, err := dc.aeadFor(sessionID)
+	if err != nil {
+		return nil, err
+	}
+
+	record := make([]byte, RecordHeaderLength, RecordHeaderLength+len(plaintext)+aead.Overhead())
+	if err := buildHeaderInto(record, TypeDatagram, len(plaintext)+aead.Overhead(), 0, sessionID, counter); err != nil {
+		return nil, err
+	}
+	return aead.Seal(record, nonce[:], plaintext, record[:RecordHeaderLength]), nil
+}
+
+// Open authenticates and decodes a datagram record.
+func (dc *DatagramCodec) Open(b []byte) (*Datagram, error) {
+	if len(b) < RecordHeaderLength {
+		return nil, ErrDatagramTooShort
+	}
+	header := b[:RecordHeaderLength]
+	if header[headerVersionOffset] != ProtocolVersion {
+		return nil, errors.New("unsupported protocol version")
+	}
+	if header[headerTypeOffset] != TypeDatagram {
+		return nil, fmt.Errorf("unexpected record type: %d", header[headerTypeOffset])
+	}
+	timestamp := binary.BigEndian.Uint64(header[headerTimestampOffset : headerTimestampOffset+headerTimestampSize])
+	if !IsTimestampValid(timestamp, time.Now(), DefaultReplayWindow) {
+		return nil, errors.New("timestamp outside allowed window")
+	}
+	payloadLength := binary.BigEndian.Uint32(header[headerPayloadLenOffset : headerPayloadLenOffset+4])
+	paddingLength := binary.BigEndian.Uint32(header[headerPaddingLenOffset : headerPaddingLenOffset+4])
+	if int(RecordHeaderLength+payloadLength+paddingLength) != len(b) {
+		return nil, errors.New("invalid payload length")
+	}
+
+	sessionID := header[headerSessionIDOffset : headerSessionIDOffset+headerSessionIDLength]
+	counter := header[headerCounterOffset : headerCounterOffset+headerCounterLength]
+	var nonce [12]byte
+	copy(nonce[0:4], sessionID)
+	copy(nonce[4:12], counter)
+
+	aead, err := dc.aeadFor(sessionID)
+	if err != nil {
+		return nil, err
+	}
+	ciphertext := b[RecordHeaderLength : RecordHeaderLength+int(payloadLength)]
+	plaintext, err := aead.Open(nil, nonce[:], ciphertext, header)
+	if err != nil {
+		return nil, fmt.Errorf("datagram authentication failed: %w", err)
+	}
+	if err := dc.replay.Check(dc.userID, sessionID, binary.BigEndian.Uint64(counter)); err != nil {
+		return nil, fmt.Errorf("datagram: %w", err)
+	}
+	if len(plaintext) < 4 {
+		return nil, ErrDatagramTooShort
+	}
+
+	host, port, n, err := decodeAddress(plaintext[4:])
+	if err != nil {
+		return nil, err
+	}
+	return &Datagram{
+		FlowID:  binary.BigEndian.Uint32(plaintext[0:4]),
+		Host:    host,
+		Port:    port,
+		Payload: plaintext[4+n:],
+	}, nil
+}
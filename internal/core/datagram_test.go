@@ -0,0 +1,140 @@
+package core
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+)
+
+// TestDatagramRoundTrip verifies that a sealed datagram opens to the same flow,
+// address and payload.
+func TestDatagramRoundTrip(t *testing.T) {
+	ng, err := NewNonceGenerator()
+	if err != nil {
+		t.Fatalf("NewNonceGenerator: %v", err)
+	}
+	codec := NewDatagramCodec("test-psk")
+	in := &Datagram{FlowID: 7, Host: "1.1.1.1", Port: 53, Payload: []byte("dns query")}
+
+	record, err := codec.Seal(in, ng)
+	if err != nil {
+		t.Fatalf("Seal: %v", err)
+	}
+	if bytes.Contains(record, in.Payload) {
+		t.Fatal("sealed datagram contains plaintext payload")
+	}
+
+	out, err := NewDatagramCodec("test-psk").Open(record)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if out.FlowID != in.FlowID || out.Host != in.Host || out.Port != in.Port {
+		t.Errorf("Datagram: got %+v, want %+v", out, in)
+	}
+	if !bytes.Equal(out.Payload, in.Payload) {
+		t.Errorf("Payload: got %q, want %q", out.Payload, in.Payload)
+	}
+}
+
+// TestDatagramRejects verifies tampered, truncated and wrong-key datagrams fail.
+func TestDatagramRejects(t *testing.T) {
+	ng, err := NewNonceGenerator()
+	if err != nil {
+		t.Fatalf("NewNonceGenerator: %v", err)
+	}
+	codec := NewDatagramCodec("test-psk")
+	record, err := codec.Seal(&Datagram{FlowID: 1, Host: "example.com", Port: 443, Payload: []byte("x")}, ng)
+	if err != nil {
+		t.Fatalf("Seal: %v", err)
+	}
+
+	tampered := append([]byte(nil), record...)
+	tampered[len(tampered)-1] ^= 0x01
+	if _, err := codec.Open(tampered); err == nil {
+		t.Error("expected error for tampered datagram")
+	}
+	if _, err := codec.Open(record[:RecordHeaderLength-1]); err != ErrDatagramTooShort {
+		t.Errorf("expected ErrDatagramTooShort, got %v", err)
+	}
+	if _, err := NewDatagramCodec("other-psk").Open(record); err == nil {
+		t.Error("expected error for wrong PSK")
+	}
+}
+
+// TestSocksUDPHeader verifies SOCKS5 UDP request headers round-trip and that
+// fragmented packets are refused.
+func TestSocksUDPHeader(t *testing.T) {
+	for _, host := range []string{"8.8.8.8", "2001:db8::1", "example.com"} {
+		header, err := buildSocksUDPHeader(host, 5353)
+		if err != nil {
+			t.Fatalf("buildSocksUDPHeader(%s): %v", host, err)
+		}
+		packet := append(header, "payload"...)
+		gotHost, gotPort, payload, err := parseSocksUDPPacket(packet)
+		if err != nil {
+			t.Fatalf("parseSocksUDPPacket(%s): %v", host, err)
+		}
+		if gotHost != host || gotPort != 5353 || string(payload) != "payload" {
+			t.Errorf("%s: got %s:%d %q", host, gotHost, gotPort, payload)
+		}
+	}
+
+	header, _ := buildSocksUDPHeader("8.8.8.8", 53)
+	header[2] = 1
+	if _, _, _, err := parseSocksUDPPacket(header); err == nil {
+		t.Error("expected error for fragmented packet")
+	}
+}
+
+// TestSocksUDPDirectSource verifies that only registered direct targets may
+// reply into a SOCKS5 UDP association.
+func TestSocksUDPDirectSource(t *testing.T) {
+	a := &socksUDPAssociation{
+		direct:    make(map[string]*net.UDPAddr),
+		directSrc: make(map[netip.AddrPort]bool),
+	}
+	if _, err := a.directAddr("127.0.0.1", 5353); err != nil {
+		t.Fatalf("directAddr: %v", err)
+	}
+	if !a.isDirectSource(&net.UDPAddr{IP: net.ParseIP("::ffff:127.0.0.1"), Port: 5353}) {
+		t.Error("registered target (IPv4-mapped) should be accepted")
+	}
+	if a.isDirectSource(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5354}) {
+		t.Error("unregistered port should be rejected")
+	}
+	if a.isDirectSource(&net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 5353}) {
+		t.Error("unregistered host should be rejected")
+	}
+}
+
+// TestDatagramReplay verifies a captured datagram opens once, and a filter
+// shared across sessions rejects it when replayed into another session of
+// the same user.
+func TestDatagramReplay(t *testing.T) {
+	ng, err := NewNonceGenerator()
+	if err != nil {
+		t.Fatalf("NewNonceGenerator: %v", err)
+	}
+	record, err := NewDatagramCodec("test-psk").Seal(&Datagram{FlowID: 3, Host: "1.1.1.1", Port: 53, Payload: []byte("q")}, ng)
+	if err != nil {
+		t.Fatalf("Seal: %v", err)
+	}
+
+	codec := NewDatagramCodec("test-psk")
+	if _, err := codec.Open(record); err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if _, err := codec.Open(record); !errors.Is(err, ErrReplay) {
+		t.Errorf("replayed datagram: got %v, want ErrReplay", err)
+	}
+
+	shared := NewReplayFilter(DefaultReplayWindowSize, DefaultReplaySessions)
+	if _, err := NewDatagramCodecWithReplay("test-psk", shared, "alice").Open(record); err != nil {
+		t.Fatalf("Open(session 1): %v", err)
+	}
+	if _, err := NewDatagramCodecWithReplay("test-psk", shared, "alice").Open(record); !errors.Is(err, ErrReplay) {
+		t.Errorf("datagram replayed into session 2: got %v, want ErrReplay", err)
+	}
+}
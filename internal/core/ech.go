@@ -0,0 +1,201 @@
+package core
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Encrypted Client Hello.
+//
+// The gateway holds an X25519 ECH key set and publishes its ECHConfigList
+// (base64); clients put the list in SessionConfig.ECHConfigList so the real
+// server name travels only in the encrypted inner ClientHello, while the
+// outer ClientHello carries the config's public name. Key sets are stored in
+// the PEM layout used by other TLS stacks: a PKCS#8 "PRIVATE KEY" block
+// followed by an "ECHCONFIG" block holding the ECHConfigList.
+const (
+	// ECHFallbackFailClosed aborts the dial when the gateway rejects ECH.
+	ECHFallbackFailClosed = "fail-closed"
+	// ECHFallbackRetryWithoutECH redials with a cleartext SNI after a rejection.
+	ECHFallbackRetryWithoutECH = "retry-without-ech"
+
+	echConfigVersion = 0xfe0d
+	echKEMX25519     = 0x0020
+	echKDFSHA256     = 0x0001
+	echAEADAES128GCM = 0x0001
+	echAEADChaCha20  = 0x0003
+	echPEMConfigType = "ECHCONFIG"
+	echPEMKeyType    = "PRIVATE KEY"
+)
+
+// ECHKeySet is one ECH key with its serialized ECHConfig.
+type ECHKeySet struct {
+	Config     []byte // one ECHConfig, including version and length
+	PrivateKey *ecdh.PrivateKey
+}
+
+// GenerateECHKeySet creates an X25519 key set whose outer ClientHello
+// carries publicName.
+func GenerateECHKeySet(publicName string) (*ECHKeySet, error) {
+	if publicName == "" || len(publicName) > 255 {
+		return nil, fmt.Errorf("invalid ECH public name %q", publicName)
+	}
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	var id [1]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return nil, err
+	}
+	pub := priv.PublicKey().Bytes()
+
+	var contents []byte
+	contents = append(contents, id[0])
+	contents = binary.BigEndian.AppendUint16(contents, echKEMX25519)
+	contents = binary.BigEndian.AppendUint16(contents, uint16(len(pub)))
+	contents = append(contents, pub...)
+	contents = binary.BigEndian.AppendUint16(contents, 8) // two cipher suites
+	contents = binary.BigEndian.AppendUint16(contents, echKDFSHA256)
+	contents = binary.BigEndian.AppendUint16(contents, echAEADAES128GCM)
+	contents = binary.BigEndian.AppendUint16(contents, echKDFSHA256)
+	contents = binary.BigEndian.AppendUint16(contents, echAEADChaCha20)
+	contents = append(contents, 0) // maximum_name_length: let clients pad
+	contents = append(contents, byte(len(publicName)))
+	contents = append(contents, publicName...)
+	contents = binary.BigEndian.AppendUint16(contents, 0) // no extensions
+
+	config := binary.BigEndian.AppendUint16(nil, echConfigVersion)
+	config = binary.BigEndian.AppendUint16(config, uint16(len(contents)))
+	return &ECHKeySet{Config: append(config, contents...), PrivateKey: priv}, nil
+}
+
+// ConfigList returns the ECHConfigList clients use.
+func (k *ECHKeySet) ConfigList() []byte {
+	list := binary.BigEndian.AppendUint16(nil, uint16(len(k.Config)))
+	return append(list, k.Config...)
+}
+
+// ServerKeys returns the key set in the form of tls.Config.EncryptedClientHelloKeys.
+func (k *ECHKeySet) ServerKeys() []tls.EncryptedClientHelloKey {
+	return []tls.EncryptedClientHelloKey{{
+		Config:      k.Config,
+		PrivateKey:  k.PrivateKey.Bytes(),
+		SendAsRetry: true,
+	}}
+}
+
+// MarshalPEM encodes the key set for storage.
+func (k *ECHKeySet) MarshalPEM() ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(k.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	out := pem.EncodeToMemory(&pem.Block{Type: echPEMKeyType, Bytes: der})
+	return append(out, pem.EncodeToMemory(&pem.Block{Type: echPEMConfigType, Bytes: k.ConfigList()})...), nil
+}
+
+// ParseECHKeySetPEM decodes a key set written by MarshalPEM.
+func ParseECHKeySetPEM(data []byte) (*ECHKeySet, error) {
+	k := &ECHKeySet{}
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		switch block.Type {
+		case echPEMKeyType:
+			key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("parse ECH private key: %w", err)
+			}
+			priv, ok := key.(*ecdh.PrivateKey)
+			if !ok || priv.Curve() != ecdh.X25519() {
+				return nil, errors.New("ECH private key is not X25519")
+			}
+			k.PrivateKey = priv
+		case echPEMConfigType:
+			config, err := firstECHConfig(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			k.Config = config
+		}
+	}
+	if k.PrivateKey == nil || k.Config == nil {
+		return nil, errors.New("ECH key file needs a PRIVATE KEY and an ECHCONFIG block")
+	}
+	return k, nil
+}
+
+// ParseECHConfigList decodes a base64 ECHConfigList as published by the
+// gateway.
+func ParseECHConfigList(s string) ([]byte, error) {
+	s = strings.TrimSpace(s)
+	list, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		if list, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "=")); err != nil {
+			return nil, fmt.Errorf("ech_config_list is not base64: %w", err)
+		}
+	}
+	if _, err := firstECHConfig(list); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// firstECHConfig returns the first ECHConfig of an ECHConfigList.
+func firstECHConfig(list []byte) ([]byte, error) {
+	if len(list) < 2 || int(binary.BigEndian.Uint16(list)) != len(list)-2 {
+		return nil, errors.New("malformed ECHConfigList")
+	}
+	configs := list[2:]
+	if len(configs) < 4 {
+		return nil, errors.New("empty ECHConfigList")
+	}
+	n := 4 + int(binary.BigEndian.Uint16(configs[2:]))
+	if n > len(configs) {
+		return nil, errors.New("truncated ECHConfig")
+	}
+	return configs[:n], nil
+}
+
+// normalizeECHFallback validates an ech_fallback value; "" selects fail-closed.
+func normalizeECHFallback(policy string) (string, error) {
+	switch policy {
+	case "", ECHFallbackFailClosed:
+		return ECHFallbackFailClosed, nil
+	case ECHFallbackRetryWithoutECH:
+		return policy, nil
+	}
+	return "", fmt.Errorf("invalid ech_fallback %q (want %s or %s)", policy, ECHFallbackFailClosed, ECHFallbackRetryWithoutECH)
+}
+
+// echRetryConfig returns the TLS config for a redial after the gateway
+// rejected ECH: with its retry configs if it sent any, else without ECH if
+// policy allows.
+func echRetryConfig(configured *tls.Config, rejection *tls.ECHRejectionError, policy string) (*tls.Config, error) {
+	retry := configured.Clone()
+	switch {
+	case len(rejection.RetryConfigList) > 0:
+		log.Printf("[WARNING] Gateway rejected ECH, retrying with its updated ECH config")
+		retry.EncryptedClientHelloConfigList = rejection.RetryConfigList
+	case policy == ECHFallbackRetryWithoutECH:
+		log.Printf("[WARNING] Gateway rejected ECH, retrying without ECH (SNI %s sent in cleartext)", retry.ServerName)
+		retry.EncryptedClientHelloConfigList = nil
+		retry.EncryptedClientHelloRejectionVerify = nil
+	default:
+		return nil, fmt.Errorf("gateway rejected ECH (ech_fallback=%s): %w", ECHFallbackFailClosed, rejection)
+	}
+	return retry, nil
+}
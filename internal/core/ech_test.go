@@ -0,0 +1,134 @@
+package core
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"errors"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+func echTestCertificate(t *testing.T, names ...string) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: names[0]},
+		DNSNames:              names,
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("CreateCertificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("ParseCertificate: %v", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+// echHandshake runs a TLS 1.3 handshake over a pipe and returns the client
+// state and error.
+func echHandshake(t *testing.T, server, client *tls.Config) (tls.ConnectionState, error) {
+	t.Helper()
+	c, s := net.Pipe()
+	defer c.Close()
+	defer s.Close()
+	go func() {
+		_ = tls.Server(s, server).Handshake()
+		s.Close()
+	}()
+	conn := tls.Client(c, client)
+	err := conn.Handshake()
+	return conn.ConnectionState(), err
+}
+
+// TestECHKeySet verifies a generated key set survives PEM storage, its
+// published list is accepted by crypto/tls, and rejections are reported.
+func TestECHKeySet(t *testing.T) {
+	keys, err := GenerateECHKeySet("public.test")
+	if err != nil {
+		t.Fatalf("GenerateECHKeySet: %v", err)
+	}
+	pemData, err := keys.MarshalPEM()
+	if err != nil {
+		t.Fatalf("MarshalPEM: %v", err)
+	}
+	loaded, err := ParseECHKeySetPEM(pemData)
+	if err != nil {
+		t.Fatalf("ParseECHKeySetPEM: %v", err)
+	}
+	if !bytes.Equal(loaded.Config, keys.Config) || !loaded.PrivateKey.Equal(keys.PrivateKey) {
+		t.Fatal("key set changed across PEM round trip")
+	}
+	list, err := ParseECHConfigList(base64.StdEncoding.EncodeToString(loaded.ConfigList()))
+	if err != nil {
+		t.Fatalf("ParseECHConfigList: %v", err)
+	}
+
+	cert, roots := echTestCertificate(t, "secret.test", "public.test")
+	server := &tls.Config{
+		Certificates:             []tls.Certificate{cert},
+		MinVersion:               tls.VersionTLS13,
+		EncryptedClientHelloKeys: loaded.ServerKeys(),
+	}
+	client := &tls.Config{
+		ServerName:                     "secret.test",
+		RootCAs:                        roots,
+		MinVersion:                     tls.VersionTLS13,
+		EncryptedClientHelloConfigList: list,
+	}
+	state, err := echHandshake(t, server, client)
+	if err != nil {
+		t.Fatalf("handshake: %v", err)
+	}
+	if !state.ECHAccepted {
+		t.Error("ECH not accepted")
+	}
+
+	// A gateway with a different key rejects ECH and offers its own list.
+	other, err := GenerateECHKeySet("public.test")
+	if err != nil {
+		t.Fatalf("GenerateECHKeySet: %v", err)
+	}
+	server.EncryptedClientHelloKeys = other.ServerKeys()
+	_, err = echHandshake(t, server, client)
+	var rejection *tls.ECHRejectionError
+	if !errors.As(err, &rejection) || !bytes.Equal(rejection.RetryConfigList, other.ConfigList()) {
+		t.Errorf("rejected ECH: got %v", err)
+	}
+}
+
+// TestECHFallbackPolicy verifies the accepted ech_fallback values.
+func TestECHFallbackPolicy(t *testing.T) {
+	for in, want := range map[string]string{"": ECHFallbackFailClosed, "retry-without-ech": ECHFallbackRetryWithoutECH} {
+		if got, err := normalizeECHFallback(in); err != nil || got != want {
+			t.Errorf("%q: got %q %v, want %q", in, got, err, want)
+		}
+	}
+	if _, err := normalizeECHFallback("open"); err == nil {
+		t.Error("invalid policy accepted")
+	}
+	if _, err := ParseECHConfigList("AAEC"); err == nil {
+		t.Error("malformed list accepted")
+	}
+}
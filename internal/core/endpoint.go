@@ -0,0 +1,152 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// Endpoint overrides.
+//
+// Behind a CDN the three names of a connection can differ: the address that
+// is dialed (DialAddr), the TLS server name (SNI) and the :authority of the
+// WebTransport CONNECT request (Host). Each defaults to the host of the URL.
+
+// Endpoint is where and under which names a session dials.
+type Endpoint struct {
+	URL       *url.URL // CONNECT URL; URL.Host is the :authority
+	DialAddr  string   // host:port dialed over UDP
+	SNI       string   // TLS server name
+	Authority string   // same as URL.Host
+}
+
+// ResolveEndpoint normalizes rawURL and applies the optional dial address,
+// SNI and Host overrides. A dial address without a port uses 443.
+func ResolveEndpoint(rawURL, dialAddr, sni, host string) (*Endpoint, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid config url: %w", err)
+	}
+	if u.Scheme != "https" {
+		return nil, fmt.Errorf("url must be https")
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("url has no host")
+	}
+
+	// Ensure port is present in the URL host (required by quic-go/webtransport)
+	if u.Port() == "" {
+		// Robustness: Check if port was accidentally appended to the path
+		// e.g., https://example.com/v1/api/sync:8080
+		if lastColon := strings.LastIndex(u.Path, ":"); lastColon != -1 {
+			possiblePort := u.Path[lastColon+1:]
+			if isNumeric(possiblePort) {
+				u.Path = u.Path[:lastColon]
+				u.Host = net.JoinHostPort(u.Hostname(), possiblePort)
+				log.Printf("[WARNING] Misplaced port detected in URL path. Auto-corrected to %s (Path: %s)", u.Host, u.Path)
+			}
+		}
+
+		// If still no port, use default
+		if u.Port() == "" {
+			u.Host = net.JoinHostPort(u.Hostname(), "443")
+		}
+	}
+
+	ep := &Endpoint{URL: u, DialAddr: u.Host, SNI: u.Hostname()}
+	if dialAddr = strings.TrimSpace(dialAddr); dialAddr != "" {
+		h, port, err := net.SplitHostPort(dialAddr)
+		if err != nil {
+			// Handle missing port error (common for raw IPs/domains)
+			if !strings.Contains(err.Error(), "missing port") && !strings.Contains(err.Error(), "too many colons") {
+				return nil, fmt.Errorf("invalid dial addr: %w", err)
+			}
+			h, port = strings.Trim(dialAddr, "[]"), "443"
+		}
+		if !validHost(h) || !isNumeric(port) {
+			return nil, fmt.Errorf("invalid dial addr %q", dialAddr)
+		}
+		ep.DialAddr = net.JoinHostPort(h, port)
+	}
+	if sni = strings.TrimSpace(sni); sni != "" {
+		if !validHostname(sni) {
+			return nil, fmt.Errorf("invalid sni %q: want a DNS name without port", sni)
+		}
+		ep.SNI = sni
+	}
+	if host = strings.TrimSpace(host); host != "" {
+		h := host
+		if sh, port, err := net.SplitHostPort(host); err == nil {
+			if !isNumeric(port) {
+				return nil, fmt.Errorf("invalid host %q", host)
+			}
+			h = sh
+		}
+		if !validHost(h) {
+			return nil, fmt.Errorf("invalid host %q: want host or host:port", host)
+		}
+		u.Host = host
+	}
+	ep.Authority = u.Host
+	return ep, nil
+}
+
+// String summarizes the endpoint for logs.
+func (e *Endpoint) String() string {
+	return fmt.Sprintf("dial=%s sni=%s host=%s", e.DialAddr, e.SNI, e.Authority)
+}
+
+// dialAddrKey carries the address to dial through Dialer.Dial, which would
+// otherwise dial the URL's host.
+type dialAddrKey struct{}
+
+func withDialAddr(ctx context.Context, addr string) context.Context {
+	return context.WithValue(ctx, dialAddrKey{}, addr)
+}
+
+// dialAddrFrom returns the address set by withDialAddr, or fallback.
+func dialAddrFrom(ctx context.Context, fallback string) string {
+	if addr, ok := ctx.Value(dialAddrKey{}).(string); ok && addr != "" {
+		return addr
+	}
+	return fallback
+}
+
+func isNumeric(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// validHost accepts an IP address or a DNS name.
+func validHost(h string) bool {
+	return net.ParseIP(h) != nil || validHostname(h)
+}
+
+// validHostname accepts DNS names made of letters, digits, '-' and '_'.
+func validHostname(h string) bool {
+	h = strings.TrimSuffix(h, ".")
+	if h == "" || len(h) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(h, ".") {
+		if label == "" || len(label) > 63 {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return false
+			}
+		}
+	}
+	return true
+}
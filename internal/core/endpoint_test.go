@@ -0,0 +1,70 @@
+package core
+
+import (
+	"context"
+	"testing"
+)
+
+// TestResolveEndpoint verifies the dial address, SNI and authority default to
+// the URL host and can each be overridden independently.
+func TestResolveEndpoint(t *testing.T) {
+	cases := []struct {
+		name                 string
+		url, dial, sni, host string
+		want                 Endpoint
+	}{
+		{
+			name: "defaults",
+			url:  "https://gw.example.com/v1/api/sync",
+			want: Endpoint{DialAddr: "gw.example.com:443", SNI: "gw.example.com", Authority: "gw.example.com:443"},
+		},
+		{
+			name: "misplaced port",
+			url:  "https://gw.example.com/v1/api/sync:8443",
+			want: Endpoint{DialAddr: "gw.example.com:8443", SNI: "gw.example.com", Authority: "gw.example.com:8443"},
+		},
+		{
+			name: "fronted",
+			url:  "https://front.cdn.net/sync", dial: "203.0.113.10", sni: "front.cdn.net", host: "origin.example.com",
+			want: Endpoint{DialAddr: "203.0.113.10:443", SNI: "front.cdn.net", Authority: "origin.example.com"},
+		},
+		{
+			name: "ipv6 dial",
+			url:  "https://gw.example.com:8443/sync", dial: "[2001:db8::1]:9443", sni: "cdn.example.net",
+			want: Endpoint{DialAddr: "[2001:db8::1]:9443", SNI: "cdn.example.net", Authority: "gw.example.com:8443"},
+		},
+	}
+	for _, tc := range cases {
+		ep, err := ResolveEndpoint(tc.url, tc.dial, tc.sni, tc.host)
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if ep.DialAddr != tc.want.DialAddr || ep.SNI != tc.want.SNI || ep.Authority != tc.want.Authority || ep.URL.Host != ep.Authority {
+			t.Errorf("%s: got %s (url host %s), want %s", tc.name, ep, ep.URL.Host, &tc.want)
+		}
+	}
+
+	invalid := map[string][4]string{
+		"http url":      {"http://gw.example.com/sync", "", "", ""},
+		"sni with port": {"https://gw.example.com/sync", "", "cdn.example.net:443", ""},
+		"sni url":       {"https://gw.example.com/sync", "", "https://cdn.example.net", ""},
+		"host path":     {"https://gw.example.com/sync", "", "", "origin.example.com/x"},
+		"dial port":     {"https://gw.example.com/sync", "1.2.3.4:http", "", ""},
+	}
+	for name, args := range invalid {
+		if _, err := ResolveEndpoint(args[0], args[1], args[2], args[3]); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+// TestDialAddrContext verifies the dial address travels through the context.
+func TestDialAddrContext(t *testing.T) {
+	if got := dialAddrFrom(context.Background(), "authority:443"); got != "authority:443" {
+		t.Errorf("without override: got %q", got)
+	}
+	if got := dialAddrFrom(withDialAddr(context.Background(), "203.0.113.10:443"), "authority:443"); got != "203.0.113.10:443" {
+		t.Errorf("with override: got %q", got)
+	}
+}
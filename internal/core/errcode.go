@@ -0,0 +1,151 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// ErrorCode is the code carried in Error records (first two payload bytes).
+// The same code drives the SOCKS5 reply, the HTTP proxy status and
+// StreamErrorEvent.Code, so every frontend reports a failure the same way.
+type ErrorCode uint16
+
+const (
+	CodeBadRecord       ErrorCode = 0x0001
+	CodeMetadataDecrypt ErrorCode = 0x0002
+	CodeUnsupported     ErrorCode = 0x0003
+	CodeTargetConnect   ErrorCode = 0x0004 // Connect failed for an unclassified reason
+	CodeStreamAbort     ErrorCode = 0x0005
+	CodeResourceLimit   ErrorCode = 0x0006
+	CodeTimeout         ErrorCode = 0x0007
+	CodeConnRefused     ErrorCode = 0x0008
+	CodeHostUnreachable ErrorCode = 0x0009
+	CodeNetUnreachable  ErrorCode = 0x000a
+	CodeDNSFailure      ErrorCode = 0x000b
+	CodeACLDenied       ErrorCode = 0x000c
+	CodeRateLimited     ErrorCode = 0x000d
+)
+
+// SOCKS5 reply codes (RFC 1928 section 6).
+const (
+	socks5RepNotAllowed     = 0x02
+	socks5RepNetUnreachable = 0x03
+	socks5RepHostUnreach    = 0x04
+	socks5RepConnRefused    = 0x05
+	socks5RepTTLExpired     = 0x06
+	socks5RepCmdNotSupp     = 0x07
+)
+
+type errorCodeInfo struct {
+	name       string // ERR_* name used in events
+	message    string
+	socks5     byte
+	httpStatus int
+}
+
+var errorCodes = map[ErrorCode]errorCodeInfo{
+	CodeBadRecord:       {ErrBadRecord, "bad record", socks5RepFailure, http.StatusBadGateway},
+	CodeMetadataDecrypt: {ErrMetadataDecrypt, "metadata decrypt failed", socks5RepFailure, http.StatusBadGateway},
+	CodeUnsupported:     {ErrUnsupported, "unsupported request", socks5RepAddrNotSupp, http.StatusBadGateway},
+	CodeTargetConnect:   {ErrTargetConnect, "connect failed", socks5RepFailure, http.StatusBadGateway},
+	CodeStreamAbort:     {ErrStreamAbort, "stream aborted", socks5RepFailure, http.StatusBadGateway},
+	CodeResourceLimit:   {ErrResourceLimit, "resource limit reached", socks5RepFailure, http.StatusServiceUnavailable},
+	CodeTimeout:         {ErrTimeout, "connection timed out", socks5RepTTLExpired, http.StatusGatewayTimeout},
+	CodeConnRefused:     {ErrConnRefused, "connection refused", socks5RepConnRefused, http.StatusBadGateway},
+	CodeHostUnreachable: {ErrHostUnreachable, "host unreachable", socks5RepHostUnreach, http.StatusBadGateway},
+	CodeNetUnreachable:  {ErrNetUnreachable, "network unreachable", socks5RepNetUnreachable, http.StatusBadGateway},
+	CodeDNSFailure:      {ErrDNSFailure, "name resolution failed", socks5RepHostUnreach, http.StatusBadGateway},
+	CodeACLDenied:       {ErrACLDenied, "denied by access rules", socks5RepNotAllowed, http.StatusForbidden},
+	CodeRateLimited:     {ErrRateLimited, "rate limited", socks5RepFailure, http.StatusTooManyRequests},
+}
+
+func (c ErrorCode) info() errorCodeInfo {
+	if info, ok := errorCodes[c]; ok {
+		return info
+	}
+	return errorCodeInfo{ErrNetwork, fmt.Sprintf("error 0x%04x", uint16(c)), socks5RepFailure, http.StatusBadGateway}
+}
+
+// String returns the ERR_* name of the code.
+func (c ErrorCode) String() string { return c.info().name }
+
+// Message returns a human-readable description of the code.
+func (c ErrorCode) Message() string { return c.info().message }
+
+// SOCKS5Reply returns the SOCKS5 REP field for the code.
+func (c ErrorCode) SOCKS5Reply() byte { return c.info().socks5 }
+
+// HTTPStatus returns the HTTP proxy status for the code.
+func (c ErrorCode) HTTPStatus() int { return c.info().httpStatus }
+
+// StreamError is a typed stream failure, either reported by the gateway in an
+// Error record or detected locally.
+type StreamError struct {
+	Code    ErrorCode
+	Message string
+}
+
+// NewStreamError creates a StreamError; msg defaults to the code's message.
+func NewStreamError(code ErrorCode, msg string) *StreamError {
+	if msg == "" {
+		msg = code.Message()
+	}
+	return &StreamError{Code: code, Message: msg}
+}
+
+func (e *StreamError) Error() string {
+	if e.Message == e.Code.Message() {
+		return "server error: " + e.Message
+	}
+	return fmt.Sprintf("server error: %s (%s)", e.Code.Message(), e.Message)
+}
+
+// ErrorCodeOf returns the code of a StreamError in err's chain, or classifies
+// err as a dial error.
+func ErrorCodeOf(err error) ErrorCode {
+	var se *StreamError
+	if errors.As(err, &se) {
+		return se.Code
+	}
+	return ClassifyDialError(err)
+}
+
+// ClassifyDialError maps a net.Dial error onto the error-code registry.
+func ClassifyDialError(err error) ErrorCode {
+	var dnsErr *net.DNSError
+	switch {
+	case err == nil:
+		return 0
+	case errors.As(err, &dnsErr):
+		return CodeDNSFailure
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, os.ErrDeadlineExceeded):
+		return CodeTimeout
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return CodeConnRefused
+	case errors.Is(err, syscall.EHOSTUNREACH):
+		return CodeHostUnreachable
+	case errors.Is(err, syscall.ENETUNREACH):
+		return CodeNetUnreachable
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return CodeTimeout
+	}
+	// Platforms whose errno values differ (Windows) only leave the message.
+	msg := strings.ToLower(err.Error())
+	switch {
+	case strings.Contains(msg, "refused"):
+		return CodeConnRefused
+	case strings.Contains(msg, "network is unreachable"):
+		return CodeNetUnreachable
+	case strings.Contains(msg, "unreachable"):
+		return CodeHostUnreachable
+	}
+	return CodeTargetConnect
+}
@@ -0,0 +1,65 @@
+package core
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// TestErrorRecordTypedError verifies an Error record surfaces as a
+// StreamError carrying the gateway's code.
+func TestErrorRecordTypedError(t *testing.T) {
+	ng, err := NewNonceGenerator()
+	if err != nil {
+		t.Fatalf("NewNonceGenerator: %v", err)
+	}
+	record, err := BuildErrorRecord(CodeConnRefused, CodeConnRefused.Message(), ng)
+	if err != nil {
+		t.Fatalf("BuildErrorRecord: %v", err)
+	}
+
+	_, err = NewRecordReader(bytes.NewReader(record)).Read(make([]byte, 16))
+	var se *StreamError
+	if !errors.As(err, &se) {
+		t.Fatalf("Read: got %v, want *StreamError", err)
+	}
+	if se.Code != CodeConnRefused {
+		t.Errorf("Code: got %s, want %s", se.Code, CodeConnRefused)
+	}
+	if got := ErrorCodeOf(err).SOCKS5Reply(); got != socks5RepConnRefused {
+		t.Errorf("SOCKS5Reply: got 0x%02x, want 0x%02x", got, socks5RepConnRefused)
+	}
+}
+
+// TestClassifyDialError verifies net.Dial failures map onto the registry.
+func TestClassifyDialError(t *testing.T) {
+	// Grab a free port and close it so the dial is refused.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	_, err = net.DialTimeout("tcp", addr, time.Second)
+	if code := ClassifyDialError(err); code != CodeConnRefused {
+		t.Errorf("refused dial: got %s (%v)", code, err)
+	}
+
+	dnsErr := &net.OpError{Op: "dial", Net: "tcp", Err: &net.DNSError{Err: "no such host", Name: "invalid.example", IsNotFound: true}}
+	if code := ClassifyDialError(dnsErr); code != CodeDNSFailure {
+		t.Errorf("dns error: got %s", code)
+	}
+	if code := ClassifyDialError(errors.New("connect: protocol error")); code != CodeTargetConnect {
+		t.Errorf("unclassified: got %s", code)
+	}
+
+	if got := ErrorCodeOf(NewStreamError(CodeACLDenied, "")).HTTPStatus(); got != http.StatusForbidden {
+		t.Errorf("ACL denied HTTP status: got %d", got)
+	}
+	if got := ErrorCode(0xbeef).String(); got != ErrNetwork {
+		t.Errorf("unknown code name: got %s", got)
+	}
+}
@@ -43,15 +43,23 @@ type SessionEstablishedEvent struct {
 	SessionID  string `json:"sessionId"`
 	LocalAddr  string `json:"localAddr"`
 	RemoteAddr string `json:"remoteAddr"`
+	// Endpoint overrides in effect (see endpoint.go).
+	DialAddr string `json:"dialAddr,omitempty"`
+	SNI      string `json:"sni,omitempty"`
+	Host     string `json:"host,omitempty"`
 }
 
-func NewSessionEstablishedEvent(id, local, remote string) Event {
-	return SessionEstablishedEvent{
+func NewSessionEstablishedEvent(id, local, remote string, ep *Endpoint) Event {
+	e := SessionEstablishedEvent{
 		baseEvent:  baseEvent{Type: "session.established", Timestamp: time.Now().UnixMilli()},
 		SessionID:  id,
 		LocalAddr:  local,
 		RemoteAddr: remote,
 	}
+	if ep != nil {
+		e.DialAddr, e.SNI, e.Host = ep.DialAddr, ep.SNI, ep.Authority
+	}
+	return e
 }
 
 // Event: session.rotating
@@ -68,6 +76,24 @@ func NewSessionRotatingEvent(oldID string) Event {
 	}
 }
 
+// Event: session.rekeyed
+// Fires when the session rolls to a new SessionID/key epoch in place.
+type SessionRekeyedEvent struct {
+	baseEvent
+	SessionID string `json:"sessionId"`
+	Epoch     uint32 `json:"epoch"`
+	Counter   uint64 `json:"counter"` // counter value at rollover
+}
+
+func NewSessionRekeyedEvent(id string, epoch uint32, counter uint64) Event {
+	return SessionRekeyedEvent{
+		baseEvent: baseEvent{Type: "session.rekeyed", Timestamp: time.Now().UnixMilli()},
+		SessionID: id,
+		Epoch:     epoch,
+		Counter:   counter,
+	}
+}
+
 // Event: session.closed
 // Fires when session is fully closed.
 type SessionClosedEvent struct {
@@ -86,6 +112,25 @@ func NewSessionClosedEvent(id string, reason, errCode *string) Event {
 	}
 }
 
+// Event: transport.changed
+// Fires when sessions move to another transport, e.g. to the WebSocket
+// fallback because QUIC is blocked, and for the first session.
+type TransportChangedEvent struct {
+	baseEvent
+	Transport string `json:"transport"`          // webtransport or websocket
+	Previous  string `json:"previous,omitempty"` // "" for the first session
+	Reason    string `json:"reason,omitempty"`
+}
+
+func NewTransportChangedEvent(transport, previous, reason string) Event {
+	return TransportChangedEvent{
+		baseEvent: baseEvent{Type: "transport.changed", Timestamp: time.Now().UnixMilli()},
+		Transport: transport,
+		Previous:  previous,
+		Reason:    reason,
+	}
+}
+
 // Event: stream.opened
 // Fires when a new stream is opened to a target.
 type StreamOpenedEvent struct {
@@ -246,7 +291,8 @@ func NewAppLogEvent(level, message, source string) Event {
 	}
 }
 
-// Error codes from Aether-Realist Protocol V3 Section 7.2
+// Error codes from Aether-Realist Protocol V3 Section 7.2, extended by the
+// ErrorCode registry (errcode.go).
 const (
 	ErrBadRecord      = "ERR_BAD_RECORD"
 	ErrMetadataDecrypt = "ERR_METADATA_DECRYPT"
@@ -256,4 +302,10 @@ const (
 	ErrResourceLimit  = "ERR_RESOURCE_LIMIT"
 	ErrTimeout        = "ERR_TIMEOUT"
 	ErrNetwork        = "ERR_NETWORK" // Transport layer aggregation
+	ErrConnRefused    = "ERR_CONN_REFUSED"
+	ErrHostUnreachable = "ERR_HOST_UNREACHABLE"
+	ErrNetUnreachable = "ERR_NET_UNREACHABLE"
+	ErrDNSFailure     = "ERR_DNS_FAILURE"
+	ErrACLDenied      = "ERR_ACL_DENIED"
+	ErrRateLimited    = "ERR_RATE_LIMITED"
 )
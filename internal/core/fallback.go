@@ -0,0 +1,588 @@
+package core
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// TCP fallback transport.
+//
+// When UDP is blocked, sessions run over WebSocket on the gateway's TCP+TLS
+// listener instead of WebTransport. CDNs and middleboxes that buffer request
+// bodies before forwarding them still tunnel WebSocket connections, so every
+// connection of a session is a WebSocket upgrade of the secret path carrying
+// its own auth token:
+//
+//   - the hello connection offers the wire versions (Aether-Protocols); the
+//     gateway accepts it with the chosen version (Aether-Protocol) and a
+//     session ID (Aether-Session), or answers with the decoy site. It then
+//     only carries pings, and the session ends with it
+//   - every stream is another connection naming the session in
+//     Aether-Session. Binary messages carry the stream's bytes in order; an
+//     empty message ends the sender's direction (half-close).
+//
+// Records, server proofs and key exchanges are unchanged; the TLS binding is
+// exported from the hello connection. Datagrams are unavailable, so UDP
+// relays need WebTransport.
+const (
+	// TransportAuto tries WebTransport and falls back to WebSocket.
+	TransportAuto = "auto"
+	// TransportWebTransport uses WebTransport over QUIC only.
+	TransportWebTransport = "webtransport"
+	// TransportWebSocket uses the WebSocket fallback only.
+	TransportWebSocket = "websocket"
+	// transportH2 is the former name of TransportWebSocket, still accepted
+	// in configs.
+	transportH2 = "h2"
+
+	// FallbackProtocolsHeader lists the wire versions offered in a hello.
+	FallbackProtocolsHeader = "Aether-Protocols"
+	// FallbackProtocolHeader carries the version chosen by the gateway.
+	FallbackProtocolHeader = "Aether-Protocol"
+	// FallbackSessionHeader carries the session ID from the hello response
+	// to every stream connection.
+	FallbackSessionHeader = "Aether-Session"
+	// FallbackIdleTimeout ends a session whose hello connection has been
+	// silent this long; clients ping at a third of it.
+	FallbackIdleTimeout = 45 * time.Second
+
+	// quicFallbackTimeout bounds a QUIC dial in auto mode before falling back.
+	quicFallbackTimeout = 8 * time.Second
+	// quicRetryInterval is how long auto mode stays on WebSocket before
+	// trying QUIC again.
+	quicRetryInterval = 5 * time.Minute
+
+	fallbackReadSize     = 64 * 1024
+	fallbackDialTimeout  = 30 * time.Second
+	fallbackCloseTimeout = 5 * time.Second
+)
+
+// ErrDatagramsUnsupported is returned for datagrams on the WebSocket fallback.
+var ErrDatagramsUnsupported = errors.New("datagrams are not available over the WebSocket fallback")
+
+// normalizeTransport validates a transport value; "" selects auto.
+func normalizeTransport(mode string) (string, error) {
+	switch mode {
+	case "", TransportAuto:
+		return TransportAuto, nil
+	case TransportWebTransport, TransportWebSocket:
+		return mode, nil
+	case transportH2:
+		return TransportWebSocket, nil
+	}
+	return "", fmt.Errorf("invalid transport %q (want %s, %s or %s)", mode, TransportAuto, TransportWebTransport, TransportWebSocket)
+}
+
+// ParseFallbackProtocols splits an Aether-Protocols header value.
+func ParseFallbackProtocols(value string) []string {
+	var protocols []string
+	for _, p := range strings.Split(value, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			protocols = append(protocols, p)
+		}
+	}
+	return protocols
+}
+
+// dialFallback opens a session over the WebSocket fallback.
+func (sm *sessionManager) dialFallback(ctx context.Context) (Session, error) {
+	ctx, cancel := context.WithTimeout(ctx, fallbackDialTimeout)
+	defer cancel()
+
+	ep, err := ResolveEndpoint(sm.config.URL, sm.config.DialAddr, sm.config.SNI, sm.config.Host)
+	if err != nil {
+		return nil, err
+	}
+	sm.endpoint = ep
+
+	log.Printf("[DEBUG] Dialing WebSocket fallback: %s (%s)", ep.URL, ep)
+	session, err := dialFallbackSession(ctx, ep, sm.dialer.TLSClientConfig, sm.config.ECHFallback, sm.config.PSK)
+	if err != nil {
+		return nil, fmt.Errorf("fallback dial to %s failed: %w", ep.DialAddr, err)
+	}
+	return session, nil
+}
+
+// fallbackSession is a session whose connections are WebSockets.
+type fallbackSession struct {
+	dialer   *websocket.Dialer
+	hello    *websocket.Conn
+	conn     *tls.Conn // under hello
+	url      string
+	path     string
+	psk      string
+	id       string
+	protocol string
+	ctx      context.Context
+	cancel   context.CancelFunc
+}
+
+// dialFallbackSession connects to ep and opens a session with the hello
+// connection. tlsConfig is the WebTransport config; only its ALPN is
+// replaced.
+func dialFallbackSession(ctx context.Context, ep *Endpoint, tlsConfig *tls.Config, echFallback, psk string) (*fallbackSession, error) {
+	tlsConfig = tlsConfig.Clone()
+	tlsConfig.NextProtos = []string{"http/1.1"}
+	var retryConfig atomic.Pointer[tls.Config]
+	dialTLS := func(ctx context.Context, cfg *tls.Config) (*tls.Conn, error) {
+		conn, err := (&tls.Dialer{Config: cfg}).DialContext(ctx, "tcp", ep.DialAddr)
+		if err != nil {
+			return nil, err
+		}
+		return conn.(*tls.Conn), nil
+	}
+
+	u := *ep.URL
+	u.Scheme = "wss"
+	path := ep.URL.Path
+	if path == "" {
+		path = "/"
+	}
+	sessCtx, cancel := context.WithCancel(context.Background())
+	s := &fallbackSession{
+		dialer: &websocket.Dialer{
+			// Every connection goes to the dial address; the URL only sets
+			// the Host header and path.
+			NetDialTLSContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				cfg := tlsConfig
+				if retry := retryConfig.Load(); retry != nil {
+					cfg = retry
+				}
+				c, err := dialTLS(ctx, cfg)
+				var echErr *tls.ECHRejectionError
+				if errors.As(err, &echErr) {
+					retry, rerr := echRetryConfig(tlsConfig, echErr, echFallback)
+					if rerr != nil {
+						return nil, rerr
+					}
+					retryConfig.Store(retry)
+					c, err = dialTLS(ctx, retry)
+				}
+				return c, err
+			},
+			HandshakeTimeout: fallbackDialTimeout,
+			ReadBufferSize:   fallbackReadSize,
+			WriteBufferSize:  fallbackReadSize,
+		},
+		url:    u.String(),
+		path:   path,
+		psk:    psk,
+		ctx:    sessCtx,
+		cancel: cancel,
+	}
+	if err := s.sayHello(ctx); err != nil {
+		cancel()
+		return nil, err
+	}
+	go s.keepAlive()
+	return s, nil
+}
+
+// dial opens an authenticated WebSocket to the secret path.
+func (s *fallbackSession) dial(ctx context.Context, header http.Header) (*websocket.Conn, *http.Response, error) {
+	if err := SetAuthToken(header, s.psk, s.path, time.Now()); err != nil {
+		return nil, nil, fmt.Errorf("auth token: %w", err)
+	}
+	return s.dialer.DialContext(ctx, s.url, header)
+}
+
+// sayHello opens the session and learns the wire version chosen by the
+// gateway.
+func (s *fallbackSession) sayHello(ctx context.Context) error {
+	header := http.Header{}
+	header.Set(FallbackProtocolsHeader, strings.Join(SupportedProtocols(), ", "))
+	conn, resp, err := s.dial(ctx, header)
+	if err != nil {
+		if resp == nil {
+			return err
+		}
+		if resp.StatusCode == http.StatusNotAcceptable {
+			return fmt.Errorf("%w: gateway speaks %s", ErrUnsupportedProtocol, resp.Header.Get(FallbackProtocolsHeader))
+		}
+		// Gateways without the fallback answer with the decoy site.
+		return fmt.Errorf("gateway does not offer the WebSocket fallback (%s)", resp.Status)
+	}
+
+	protocol, id := resp.Header.Get(FallbackProtocolHeader), resp.Header.Get(FallbackSessionHeader)
+	if protocol == "" || id == "" {
+		conn.Close()
+		return fmt.Errorf("gateway does not offer the WebSocket fallback (%s)", resp.Status)
+	}
+	if _, err := CodecForProtocol(protocol); err != nil {
+		conn.Close()
+		return err
+	}
+	tlsConn, ok := conn.NetConn().(*tls.Conn)
+	if !ok {
+		conn.Close()
+		return errors.New("fallback connection is not TLS")
+	}
+	s.hello, s.conn, s.protocol, s.id = conn, tlsConn, protocol, id
+	return nil
+}
+
+// keepAlive pings the hello connection and ends the session when it fails.
+func (s *fallbackSession) keepAlive() {
+	defer s.cancel()
+	go func() {
+		ticker := time.NewTicker(FallbackIdleTimeout / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.ctx.Done():
+				return
+			case <-ticker.C:
+				if err := s.hello.WriteControl(websocket.PingMessage, nil, time.Now().Add(FallbackIdleTimeout/3)); err != nil {
+					s.cancel()
+					return
+				}
+			}
+		}
+	}()
+	_ = s.hello.SetReadDeadline(time.Now().Add(FallbackIdleTimeout))
+	s.hello.SetPongHandler(func(string) error {
+		return s.hello.SetReadDeadline(time.Now().Add(FallbackIdleTimeout))
+	})
+	for {
+		if _, _, err := s.hello.NextReader(); err != nil {
+			return
+		}
+	}
+}
+
+// OpenStream starts a stream connection. It returns at once; reads and
+// writes wait until the connection is up.
+func (s *fallbackSession) OpenStream(ctx context.Context) (Stream, error) {
+	if s.ctx.Err() != nil {
+		return nil, net.ErrClosed
+	}
+	stream := &fallbackStream{
+		ready:         make(chan struct{}),
+		chunks:        make(chan []byte),
+		consumed:      make(chan struct{}, 1),
+		readDeadline:  makeStreamDeadline(),
+		writeDeadline: makeStreamDeadline(),
+	}
+	go stream.run(s)
+	return stream, nil
+}
+
+func (s *fallbackSession) SendDatagram([]byte) error { return ErrDatagramsUnsupported }
+
+func (s *fallbackSession) ReceiveDatagram(ctx context.Context) ([]byte, error) {
+	select {
+	case <-ctx.Done():
+	case <-s.ctx.Done():
+	}
+	return nil, ErrDatagramsUnsupported
+}
+
+// Close ends the session and every stream on it.
+func (s *fallbackSession) Close(reason string) error {
+	s.cancel()
+	_ = s.hello.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, reason), time.Now().Add(time.Second))
+	return s.hello.Close()
+}
+
+func (s *fallbackSession) LocalAddr() net.Addr  { return s.conn.LocalAddr() }
+func (s *fallbackSession) RemoteAddr() net.Addr { return s.conn.RemoteAddr() }
+
+func (s *fallbackSession) Protocol() string { return s.protocol }
+
+func (s *fallbackSession) Binding() ([]byte, error) { return TLSBinding(s.conn.ConnectionState()) }
+
+func (s *fallbackSession) Transport() string { return TransportWebSocket }
+
+// fallbackStream is one stream connection. run hands received messages to
+// Read, which honors read deadlines; an empty message is the peer's
+// half-close.
+type fallbackStream struct {
+	ready   chan struct{} // closed once conn is up or dialErr is set
+	conn    *websocket.Conn
+	dialErr error
+
+	chunks   chan []byte   // message chunks, closed at the end
+	consumed chan struct{} // Read finished the last chunk
+	readErr  error         // why chunks was closed
+
+	readMu       sync.Mutex
+	pending      []byte
+	readDeadline streamDeadline
+
+	writeMu       sync.Mutex
+	writeDeadline streamDeadline
+	writeBy       atomic.Int64 // write deadline in Unix nanoseconds, 0 if none
+	writeClosed   bool
+
+	halves    atomic.Int32 // directions finished; the connection closes at 2
+	closeOnce sync.Once
+}
+
+// run dials the stream connection and feeds its messages to Read.
+func (s *fallbackStream) run(sess *fallbackSession) {
+	defer close(s.chunks)
+	header := http.Header{}
+	header.Set(FallbackSessionHeader, sess.id)
+	conn, resp, err := sess.dial(sess.ctx, header)
+	if err != nil {
+		if resp != nil {
+			err = fmt.Errorf("gateway refused stream (%s)", resp.Status)
+		}
+		s.dialErr, s.readErr = err, err
+		close(s.ready)
+		return
+	}
+	s.conn = conn
+	close(s.ready)
+	// The session's end takes its streams down.
+	stop := context.AfterFunc(sess.ctx, s.closeConn)
+	defer stop()
+	defer s.finishHalf()
+
+	buf := make([]byte, fallbackReadSize)
+	for {
+		typ, r, err := conn.NextReader()
+		if err != nil {
+			s.readErr = err
+			s.closeConn()
+			return
+		}
+		if typ != websocket.BinaryMessage {
+			continue
+		}
+		empty := true
+		for {
+			n, err := r.Read(buf)
+			if n > 0 {
+				empty = false
+				if !s.deliver(sess.ctx, buf[:n]) {
+					s.readErr = net.ErrClosed
+					return
+				}
+			}
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				s.readErr = err
+				s.closeConn()
+				return
+			}
+		}
+		if empty {
+			s.readErr = io.EOF
+			return
+		}
+	}
+}
+
+// deliver hands chunk to Read and waits until it was copied, as buf is
+// reused.
+func (s *fallbackStream) deliver(ctx context.Context, chunk []byte) bool {
+	select {
+	case s.chunks <- chunk:
+	case <-ctx.Done():
+		return false
+	}
+	select {
+	case <-s.consumed:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (s *fallbackStream) Read(p []byte) (int, error) {
+	s.readMu.Lock()
+	defer s.readMu.Unlock()
+	if len(s.pending) == 0 {
+		select {
+		case chunk, ok := <-s.chunks:
+			if !ok {
+				return 0, s.readErr
+			}
+			s.pending = chunk
+		case <-s.readDeadline.wait():
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+	n := copy(p, s.pending)
+	s.pending = s.pending[n:]
+	if len(s.pending) == 0 {
+		s.consumed <- struct{}{}
+	}
+	return n, nil
+}
+
+// await waits for the connection or the write deadline.
+func (s *fallbackStream) await() error {
+	select {
+	case <-s.ready:
+		return s.dialErr
+	case <-s.writeDeadline.wait():
+		return os.ErrDeadlineExceeded
+	}
+}
+
+func (s *fallbackStream) Write(p []byte) (int, error) {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	if s.writeClosed {
+		return 0, net.ErrClosed
+	}
+	if err := s.await(); err != nil {
+		return 0, err
+	}
+	// An empty message would end the stream.
+	if len(p) == 0 {
+		return 0, nil
+	}
+	s.applyWriteDeadline()
+	if err := s.conn.WriteMessage(websocket.BinaryMessage, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close ends the sending side; the stream stays readable.
+func (s *fallbackStream) Close() error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	if s.writeClosed {
+		return nil
+	}
+	s.writeClosed = true
+	<-s.ready
+	if s.dialErr != nil {
+		return nil
+	}
+	s.applyWriteDeadline()
+	err := s.conn.WriteMessage(websocket.BinaryMessage, nil)
+	s.finishHalf()
+	return err
+}
+
+// finishHalf closes the connection once both directions have ended.
+func (s *fallbackStream) finishHalf() {
+	if s.halves.Add(1) == 2 {
+		s.closeConn()
+	}
+}
+
+func (s *fallbackStream) closeConn() {
+	s.closeOnce.Do(func() {
+		_ = s.conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(fallbackCloseTimeout))
+		_ = s.conn.Close()
+	})
+}
+
+// applyWriteDeadline hands the write deadline to conn, which sets it on the
+// network connection before every frame.
+func (s *fallbackStream) applyWriteDeadline() {
+	var t time.Time
+	if by := s.writeBy.Load(); by != 0 {
+		t = time.Unix(0, by)
+	}
+	_ = s.conn.SetWriteDeadline(t)
+}
+
+func (s *fallbackStream) SetReadDeadline(t time.Time) error {
+	s.readDeadline.set(t)
+	return nil
+}
+
+// SetWriteDeadline bounds the wait for the connection and the writes on it;
+// like net.Conn, it also aborts a write in progress.
+func (s *fallbackStream) SetWriteDeadline(t time.Time) error {
+	if t.IsZero() {
+		s.writeBy.Store(0)
+	} else {
+		s.writeBy.Store(t.UnixNano())
+	}
+	s.writeDeadline.set(t)
+	select {
+	case <-s.ready:
+		if s.conn != nil {
+			return s.conn.NetConn().SetWriteDeadline(t)
+		}
+	default:
+	}
+	return nil
+}
+
+func (s *fallbackStream) SetDeadline(t time.Time) error {
+	s.SetReadDeadline(t)
+	return s.SetWriteDeadline(t)
+}
+
+// streamDeadline is a resettable deadline whose channel closes when it
+// expires, as in net.Pipe.
+type streamDeadline struct {
+	mu     sync.Mutex
+	timer  *time.Timer
+	cancel chan struct{}
+}
+
+func makeStreamDeadline() streamDeadline {
+	return streamDeadline{cancel: make(chan struct{})}
+}
+
+// set arms the deadline; the zero time clears it.
+func (d *streamDeadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.timer != nil && !d.timer.Stop() {
+		<-d.cancel // wait for the timer callback to close cancel
+	}
+	d.timer = nil
+
+	closed := isClosedChan(d.cancel)
+	if t.IsZero() {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		return
+	}
+	if dur := time.Until(t); dur > 0 {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		d.timer = time.AfterFunc(dur, func() { close(d.cancel) })
+		return
+	}
+	if !closed {
+		close(d.cancel)
+	}
+}
+
+// wait returns a channel that closes when the deadline expires.
+func (d *streamDeadline) wait() chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.cancel
+}
+
+func isClosedChan(c <-chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
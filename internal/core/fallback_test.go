@@ -0,0 +1,198 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// fallbackTestGateway serves hellos and echoes stream connections like the
+// gateway's fallback handler; decoy makes it answer like an older gateway.
+func fallbackTestGateway(t *testing.T, decoy bool) *httptest.Server {
+	t.Helper()
+	var upgrader websocket.Upgrader
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !websocket.IsWebSocketUpgrade(r) || AuthTokenFromRequest(r) == "" || decoy {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		header := http.Header{}
+		if offered := r.Header.Get(FallbackProtocolsHeader); offered != "" {
+			header.Set(FallbackProtocolHeader, ParseFallbackProtocols(offered)[0])
+			header.Set(FallbackSessionHeader, "test-session")
+		} else if r.Header.Get(FallbackSessionHeader) != "test-session" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		conn, err := upgrader.Upgrade(w, r, header)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			typ, msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if header.Get(FallbackSessionHeader) == "" {
+				_ = conn.WriteMessage(typ, msg)
+			}
+		}
+	}))
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// fallbackTestEndpoint returns the endpoint and TLS config of srv's secret
+// path.
+func fallbackTestEndpoint(t *testing.T, srv *httptest.Server) (*Endpoint, *tls.Config) {
+	t.Helper()
+	ep, err := ResolveEndpoint(srv.URL+"/v1/api/sync", "", "", "")
+	if err != nil {
+		t.Fatalf("ResolveEndpoint: %v", err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+	return ep, &tls.Config{ServerName: ep.SNI, RootCAs: roots}
+}
+
+// bufferingProxy forwards requests to backend like a CDN that reads whole
+// request bodies before forwarding them; WebSocket upgrades are tunneled.
+func bufferingProxy(t *testing.T, backend *httptest.Server) *httptest.Server {
+	t.Helper()
+	target, _ := url.Parse(backend.URL)
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	tr := backend.Client().Transport.(*http.Transport).Clone()
+	tr.ForceAttemptHTTP2 = false
+	tr.TLSClientConfig.NextProtos = []string{"http/1.1"}
+	proxy.Transport = tr
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !websocket.IsWebSocketUpgrade(r) {
+			body, err := io.ReadAll(r.Body)
+			if err != nil {
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+		}
+		proxy.ServeHTTP(w, r)
+	}))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// testFallbackEcho writes to a new stream, reads the echo and half-closes.
+func testFallbackEcho(t *testing.T, sess *fallbackSession) {
+	t.Helper()
+	stream, err := sess.OpenStream(context.Background())
+	if err != nil {
+		t.Fatalf("OpenStream: %v", err)
+	}
+	if _, err := stream.Write([]byte("ping")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	buf := make([]byte, 4)
+	_ = stream.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(stream, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("echo: got %q %v", buf, err)
+	}
+	// Half-close: the gateway echoes the empty message that ends the stream.
+	if err := stream.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if _, err := stream.Read(buf); err != io.EOF {
+		t.Errorf("after half-close: got %v, want EOF", err)
+	}
+}
+
+// TestFallbackSession verifies the hello, a full-duplex stream with
+// half-close, read deadlines and the missing datagram support.
+func TestFallbackSession(t *testing.T) {
+	ep, tlsConfig := fallbackTestEndpoint(t, fallbackTestGateway(t, false))
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	sess, err := dialFallbackSession(ctx, ep, tlsConfig, "", "test-psk")
+	if err != nil {
+		t.Fatalf("dialFallbackSession: %v", err)
+	}
+	defer sess.Close("done")
+	if sess.Protocol() != SupportedProtocols()[0] || sess.Transport() != TransportWebSocket {
+		t.Errorf("got protocol %q transport %q", sess.Protocol(), sess.Transport())
+	}
+	if _, err := sess.Binding(); err != nil {
+		t.Errorf("Binding: %v", err)
+	}
+
+	testFallbackEcho(t, sess)
+
+	buf := make([]byte, 4)
+	idle, err := sess.OpenStream(ctx)
+	if err != nil {
+		t.Fatalf("OpenStream: %v", err)
+	}
+	_ = idle.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := idle.Read(buf); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("read past deadline: got %v", err)
+	}
+	idle.Close()
+
+	if err := sess.SendDatagram([]byte("x")); !errors.Is(err, ErrDatagramsUnsupported) {
+		t.Errorf("SendDatagram: got %v", err)
+	}
+}
+
+// TestFallbackBufferingProxy runs a session through an intermediary that
+// buffers request bodies, which stalls streams carried in request bodies.
+func TestFallbackBufferingProxy(t *testing.T) {
+	proxy := bufferingProxy(t, fallbackTestGateway(t, false))
+	ep, tlsConfig := fallbackTestEndpoint(t, proxy)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	sess, err := dialFallbackSession(ctx, ep, tlsConfig, "", "test-psk")
+	if err != nil {
+		t.Fatalf("dialFallbackSession: %v", err)
+	}
+	defer sess.Close("done")
+	testFallbackEcho(t, sess)
+}
+
+// TestFallbackDecoy verifies a gateway answering with its decoy site is not
+// mistaken for a fallback session.
+func TestFallbackDecoy(t *testing.T) {
+	ep, tlsConfig := fallbackTestEndpoint(t, fallbackTestGateway(t, true))
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if sess, err := dialFallbackSession(ctx, ep, tlsConfig, "", "test-psk"); err == nil {
+		sess.Close("done")
+		t.Fatal("decoy response accepted as a fallback session")
+	}
+}
+
+// TestNormalizeTransport verifies transport values and the auto default.
+func TestNormalizeTransport(t *testing.T) {
+	for in, want := range map[string]string{"": TransportAuto, "auto": TransportAuto, "webtransport": TransportWebTransport, "websocket": TransportWebSocket, "h2": TransportWebSocket} {
+		if got, err := normalizeTransport(in); err != nil || got != want {
+			t.Errorf("%q: got %q %v, want %q", in, got, err, want)
+		}
+	}
+	if _, err := normalizeTransport("quic"); err == nil {
+		t.Error("invalid transport accepted")
+	}
+}
@@ -0,0 +1,220 @@
+package core
+
+import (
+	"crypto/rand"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// UDP port hopping.
+//
+// The gateway listens on a range of UDP ports next to its main port
+// (UDP_HOP_PORTS). A client with port_hopping.ports set dials a random port
+// of the range and, on a jittered schedule driven by the rotation scheduler,
+// moves to a fresh session on another random port. The previous session keeps
+// serving its open streams and is closed once the last of them closes, so no
+// single 5-tuple carries new traffic for long and hops do not cut connections.
+const (
+	// MaxHopPorts bounds the size of a port range.
+	MaxHopPorts = 1024
+
+	// hopDrainTimeout bounds how long a previous session is kept for
+	// streams that are never closed locally.
+	hopDrainTimeout = 30 * time.Minute
+)
+
+// PortHoppingConfig is the JSON-serializable configuration for port hopping.
+type PortHoppingConfig struct {
+	// Ports lists the gateway's hop ports, e.g. "20000-20099,443".
+	// Empty disables hopping.
+	Ports string `json:"ports,omitempty"`
+
+	// MinIntervalMs is the minimum time on one port in milliseconds
+	// Default: 60000 (1 minute)
+	MinIntervalMs int `json:"min_interval_ms,omitempty"`
+
+	// MaxIntervalMs is the maximum time on one port in milliseconds
+	// Default: 180000 (3 minutes)
+	MaxIntervalMs int `json:"max_interval_ms,omitempty"`
+}
+
+// toPolicy converts PortHoppingConfig to a RotationPolicy without pre-warm.
+func (pc PortHoppingConfig) toPolicy() RotationPolicy {
+	policy := RotationPolicy{
+		MinInterval:   time.Minute,
+		MaxInterval:   3 * time.Minute,
+		JitterEnabled: true,
+	}
+	if pc.MinIntervalMs > 0 {
+		policy.MinInterval = time.Duration(pc.MinIntervalMs) * time.Millisecond
+	}
+	if pc.MaxIntervalMs > 0 {
+		policy.MaxInterval = time.Duration(pc.MaxIntervalMs) * time.Millisecond
+	}
+	if policy.MaxInterval < policy.MinInterval {
+		policy.MaxInterval = policy.MinInterval
+	}
+	return policy
+}
+
+// ParsePortRange parses a comma-separated list of ports and inclusive
+// "low-high" ranges. Duplicates are dropped; an empty spec yields no ports.
+func ParsePortRange(spec string) ([]int, error) {
+	var ports []int
+	seen := make(map[int]bool)
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		lowStr, highStr, isRange := strings.Cut(part, "-")
+		low, err := parseHopPort(lowStr)
+		if err != nil {
+			return nil, err
+		}
+		high := low
+		if isRange {
+			if high, err = parseHopPort(highStr); err != nil {
+				return nil, err
+			}
+			if high < low {
+				return nil, fmt.Errorf("invalid port range %q", part)
+			}
+		}
+		for p := low; p <= high; p++ {
+			if seen[p] {
+				continue
+			}
+			if len(ports) == MaxHopPorts {
+				return nil, fmt.Errorf("port range %q exceeds %d ports", spec, MaxHopPorts)
+			}
+			seen[p] = true
+			ports = append(ports, p)
+		}
+	}
+	return ports, nil
+}
+
+func parseHopPort(s string) (int, error) {
+	p, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil || p < 1 || p > 65535 {
+		return 0, fmt.Errorf("invalid port %q", s)
+	}
+	return p, nil
+}
+
+// hopDialAddr replaces the port of dialAddr with a random one of ports.
+func hopDialAddr(dialAddr string, ports []int) string {
+	host, _, err := net.SplitHostPort(dialAddr)
+	if err != nil || len(ports) == 0 {
+		return dialAddr
+	}
+	n, err := rand.Int(rand.Reader, big.NewInt(int64(len(ports))))
+	if err != nil {
+		return net.JoinHostPort(host, strconv.Itoa(ports[time.Now().UnixNano()%int64(len(ports))]))
+	}
+	return net.JoinHostPort(host, strconv.Itoa(ports[n.Int64()]))
+}
+
+// startPortHopping (re)schedules hops for the current port_hopping config.
+func (sm *sessionManager) startPortHopping() {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	if sm.hopper != nil {
+		sm.hopper.stop()
+		sm.hopper = nil
+	}
+	if sm.config.PortHopping.Ports == "" || sm.ctx.Err() != nil {
+		return
+	}
+	sm.hopper = newRotationScheduler(sm.config.PortHopping.toPolicy(), nil, func() {
+		if err := sm.hop(); err != nil {
+			log.Printf("[DEBUG] Port hop failed: %v", err)
+		}
+	}, nil)
+	sm.hopper.start()
+}
+
+// hop moves to a new session on a random hop port. Streams already open on
+// the previous session keep it alive until they close, or for at most
+// hopDrainTimeout.
+func (sm *sessionManager) hop() error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	old, oldID, streams := sm.session, sm.sessionID, sm.streams
+	if old == nil {
+		// Idle: the next stream dials a random port anyway.
+		return nil
+	}
+	sm.onEvent(NewSessionRotatingEvent(oldID))
+	sm.session = nil
+	closeOld := sync.OnceFunc(func() {
+		_ = old.Close("port hop")
+	})
+	timer := time.AfterFunc(hopDrainTimeout, closeOld)
+	streams.drain(func() {
+		timer.Stop()
+		closeOld()
+	})
+	return sm.connectLocked()
+}
+
+// streamGroup counts the open streams of one session, so that a session
+// replaced by a hop is closed as soon as nothing uses it.
+type streamGroup struct {
+	mu     sync.Mutex
+	active int
+	onIdle func() // set by drain, run once when active drops to zero
+}
+
+// add counts s until its first Close.
+func (g *streamGroup) add(s Stream) Stream {
+	g.mu.Lock()
+	g.active++
+	g.mu.Unlock()
+	return &groupStream{Stream: s, release: sync.OnceFunc(g.release)}
+}
+
+func (g *streamGroup) release() {
+	g.mu.Lock()
+	g.active--
+	var idle func()
+	if g.active == 0 {
+		idle, g.onIdle = g.onIdle, nil
+	}
+	g.mu.Unlock()
+	if idle != nil {
+		idle()
+	}
+}
+
+// drain runs idle once no stream of the group is open, immediately if none
+// is open now.
+func (g *streamGroup) drain(idle func()) {
+	g.mu.Lock()
+	if g.active > 0 {
+		g.onIdle = idle
+		g.mu.Unlock()
+		return
+	}
+	g.mu.Unlock()
+	idle()
+}
+
+// groupStream releases its streamGroup slot when closed.
+type groupStream struct {
+	Stream
+	release func()
+}
+
+func (s *groupStream) Close() error {
+	defer s.release()
+	return s.Stream.Close()
+}
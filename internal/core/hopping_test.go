@@ -0,0 +1,97 @@
+package core
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// TestParsePortRange verifies port lists and ranges, deduplication and the
+// size limit.
+func TestParsePortRange(t *testing.T) {
+	ports, err := ParsePortRange(" 20000-20003, 443,20001 ")
+	if err != nil {
+		t.Fatalf("ParsePortRange: %v", err)
+	}
+	want := []int{20000, 20001, 20002, 20003, 443}
+	if len(ports) != len(want) {
+		t.Fatalf("got %v, want %v", ports, want)
+	}
+	for i := range want {
+		if ports[i] != want[i] {
+			t.Fatalf("got %v, want %v", ports, want)
+		}
+	}
+	if ports, err := ParsePortRange(""); err != nil || len(ports) != 0 {
+		t.Errorf("empty spec: got %v %v", ports, err)
+	}
+	for _, spec := range []string{"0", "65536", "20010-20000", "a-b", "1-2000"} {
+		if _, err := ParsePortRange(spec); err == nil {
+			t.Errorf("%q: expected error", spec)
+		}
+	}
+}
+
+// TestHopDialAddr verifies hops keep the host and pick a port of the range.
+func TestHopDialAddr(t *testing.T) {
+	ports := []int{20000, 20001, 20002}
+	for _, addr := range []string{"gw.example.com:443", "[2001:db8::1]:443"} {
+		host, _, _ := net.SplitHostPort(addr)
+		for i := 0; i < 20; i++ {
+			h, p, err := net.SplitHostPort(hopDialAddr(addr, ports))
+			if err != nil || h != host {
+				t.Fatalf("%s: got host %q %v", addr, h, err)
+			}
+			if n, _ := strconv.Atoi(p); n < 20000 || n > 20002 {
+				t.Fatalf("%s: port %s outside range", addr, p)
+			}
+		}
+	}
+	if got := hopDialAddr("gw.example.com:443", nil); got != "gw.example.com:443" {
+		t.Errorf("without ports: got %q", got)
+	}
+}
+
+// TestPortHoppingPolicy verifies the default hop interval and that a
+// maximum below the minimum is raised.
+func TestPortHoppingPolicy(t *testing.T) {
+	policy := PortHoppingConfig{}.toPolicy()
+	if policy.MinInterval != time.Minute || policy.MaxInterval != 3*time.Minute || policy.PreWarmDuration != 0 {
+		t.Errorf("defaults: got %+v", policy)
+	}
+	policy = PortHoppingConfig{MinIntervalMs: 10000, MaxIntervalMs: 5000}.toPolicy()
+	if policy.MaxInterval != policy.MinInterval {
+		t.Errorf("max below min: got %+v", policy)
+	}
+}
+
+// TestStreamGroupDrain verifies a drained session is released only after
+// its last open stream closes, and only once.
+func TestStreamGroupDrain(t *testing.T) {
+	g := &streamGroup{}
+	var streams []Stream
+	for i := 0; i < 2; i++ {
+		c1, c2 := net.Pipe()
+		defer c2.Close()
+		streams = append(streams, g.add(c1))
+	}
+
+	idle := 0
+	g.drain(func() { idle++ })
+	streams[0].Close()
+	streams[0].Close()
+	if idle != 0 {
+		t.Fatalf("released with a stream still open")
+	}
+	streams[1].Close()
+	if idle != 1 {
+		t.Fatalf("idle ran %d times after the last close, want 1", idle)
+	}
+
+	empty := &streamGroup{}
+	empty.drain(func() { idle++ })
+	if idle != 2 {
+		t.Errorf("group without streams was not released immediately")
+	}
+}
@@ -95,7 +95,7 @@ func (s *HttpProxyServer) handleConnect(w http.ResponseWriter, r *http.Request)
 	log.Printf("[HTTP-CONNECT] %s -> %s:%d (action=%s)", r.Host, target.Host, target.Port, action)
 
 	if action == ActionBlock || action == ActionReject {
-		http.Error(w, "Blocked by rule", http.StatusForbidden)
+		http.Error(w, "Blocked by rule", CodeACLDenied.HTTPStatus())
 		return
 	}
 
@@ -104,14 +104,14 @@ func (s *HttpProxyServer) handleConnect(w http.ResponseWriter, r *http.Request)
 	if action == ActionDirect {
 		d, err := net.Dial("tcp", r.Host)
 		if err != nil {
-			http.Error(w, fmt.Sprintf("Dial failed: %v", err), http.StatusServiceUnavailable)
+			http.Error(w, fmt.Sprintf("Dial failed: %v", err), ErrorCodeOf(err).HTTPStatus())
 			return
 		}
 		destConn = d
 	} else {
 		handle, err := s.core.OpenStream(target, nil)
 		if err != nil {
-			http.Error(w, fmt.Sprintf("Upstream failed: %v", err), http.StatusBadGateway)
+			http.Error(w, fmt.Sprintf("Upstream failed: %v", err), ErrorCodeOf(err).HTTPStatus())
 			return
 		}
 		
@@ -120,7 +120,7 @@ func (s *HttpProxyServer) handleConnect(w http.ResponseWriter, r *http.Request)
 			handle: handle,
 			core:   s.core,
 			local:  dummyAddr("http-local"),
-			remote: dummyAddr(r.Host),
+			remote: streamRemoteAddr(handle, r.Host),
 		}
 	}
 	defer destConn.Close()
@@ -138,9 +138,26 @@ func (s *HttpProxyServer) handleConnect(w http.ResponseWriter, r *http.Request)
 	}
 	defer clientConn.Close()
 
-	// Transfer data
-	go io.Copy(destConn, clientConn)
-	io.Copy(clientConn, destConn)
+	// Transfer data. Each leg half-closes its destination on EOF so the other
+	// leg can drain; an error on either leg tears both down.
+	done := make(chan struct{}, 2)
+	pipe := func(dst, src io.ReadWriteCloser) {
+		defer func() { done <- struct{}{} }()
+		if _, err := io.Copy(dst, src); err != nil {
+			dst.Close()
+			src.Close()
+			return
+		}
+		if cw, ok := dst.(closeWriter); ok {
+			cw.CloseWrite()
+		} else {
+			dst.Close()
+		}
+	}
+	go pipe(destConn, clientConn)
+	go pipe(clientConn, destConn)
+	<-done
+	<-done
 }
 
 // handleHTTP handles plain HTTP requests.
@@ -171,10 +188,10 @@ func (s *HttpProxyServer) handleHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	log.Printf("[HTTP] %s -> %s (action=%s)", r.URL.String(), target, action)
+	log.Printf("[HTTP] %s -> %s:%d (action=%s)", r.URL.String(), target.Host, target.Port, action)
 
 	if action == ActionBlock || action == ActionReject {
-		http.Error(w, "Blocked by rule", http.StatusForbidden)
+		http.Error(w, "Blocked by rule", CodeACLDenied.HTTPStatus())
 		return
 	}
 
@@ -194,7 +211,7 @@ func (s *HttpProxyServer) handleHTTP(w http.ResponseWriter, r *http.Request) {
 					handle: handle,
 					core:   s.core,
 					local:  dummyAddr("http-local"),
-					remote: dummyAddr(addr),
+					remote: streamRemoteAddr(handle, addr),
 				}, nil
 			},
 		}
@@ -204,7 +221,7 @@ func (s *HttpProxyServer) handleHTTP(w http.ResponseWriter, r *http.Request) {
 	r.RequestURI = ""
 	resp, err := transport.RoundTrip(r)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadGateway)
+		http.Error(w, err.Error(), ErrorCodeOf(err).HTTPStatus())
 		return
 	}
 	defer resp.Body.Close()
@@ -0,0 +1,188 @@
+package core
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// Forward-secret session keys.
+//
+// Key exchange record layout (first stream of a session, before any metadata):
+//
+//	Header(30B, Type=TypeKeyExchange) || AES-GCM(EphemeralPub(32B)) || Padding
+//
+// The payload is sealed like metadata (salt = SessionID of the record), which
+// authenticates both ephemeral X25519 keys with the PSK. The client request
+// carries its key hint in the padding and uses the header as AAD; the gateway
+// reply uses Header || ClientPub as AAD, binding it to the request. For the
+// rest of the session both sides use
+//
+//	SessionKey = hex(HKDF-SHA256(PSK || X25519(a, B), salt = ClientPub || ServerPub, info = ProtocolLabel + " fs"))
+//
+// in place of the PSK, so every later key derivation mixes in the ephemeral
+// secret and a leaked PSK no longer decrypts recorded sessions.
+const (
+	kexPublicKeyLength = 32
+	kexSessionKeyLabel = " fs"
+	kexPaddingMin      = 16
+	kexPaddingMax      = 64
+)
+
+// ErrKeyExchange is returned when a key exchange record fails to authenticate.
+var ErrKeyExchange = errors.New("key exchange failed")
+
+// KeyExchange is the client side of one session's key exchange.
+type KeyExchange struct {
+	psk  string
+	priv *ecdh.PrivateKey
+}
+
+// NewKeyExchange creates an ephemeral X25519 key pair for psk.
+func NewKeyExchange(psk string) (*KeyExchange, error) {
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &KeyExchange{psk: psk, priv: priv}, nil
+}
+
+// BuildRequest builds the client's key exchange record.
+func (kx *KeyExchange) BuildRequest(ng *NonceGenerator) ([]byte, error) {
+	return buildKeyExchangeRecord(kx.psk, kx.priv.PublicKey().Bytes(), nil, true, ng)
+}
+
+// Finish authenticates the gateway's reply and returns the session key.
+func (kx *KeyExchange) Finish(reply *Record) (string, error) {
+	clientPub := kx.priv.PublicKey().Bytes()
+	serverPub, err := openKeyExchangeRecord(reply, kx.psk, clientPub)
+	if err != nil {
+		return "", err
+	}
+	return deriveSessionKey(kx.psk, kx.priv, serverPub, clientPub, serverPub)
+}
+
+// ParseKeyExchangeRequest authenticates a client's key exchange record with
+// psk and returns the client's ephemeral public key.
+func ParseKeyExchangeRequest(record *Record, psk string) ([]byte, error) {
+	return openKeyExchangeRecord(record, psk, nil)
+}
+
+// BuildKeyExchangeReply answers a client's ephemeral key and returns the
+// reply record and the session key.
+func BuildKeyExchangeReply(clientPub []byte, psk string, ng *NonceGenerator) ([]byte, string, error) {
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, "", err
+	}
+	serverPub := priv.PublicKey().Bytes()
+	sessionKey, err := deriveSessionKey(psk, priv, clientPub, clientPub, serverPub)
+	if err != nil {
+		return nil, "", err
+	}
+	reply, err := buildKeyExchangeRecord(psk, serverPub, clientPub, false, ng)
+	if err != nil {
+		return nil, "", err
+	}
+	return reply, sessionKey, nil
+}
+
+func buildKeyExchangeRecord(psk string, pub, aadSuffix []byte, hinted bool, ng *NonceGenerator) ([]byte, error) {
+	return buildSealedControlRecord(TypeKeyExchange, psk, pub, aadSuffix, hinted, ng)
+}
+
+func openKeyExchangeRecord(record *Record, psk string, aadSuffix []byte) ([]byte, error) {
+	pub, err := openSealedControlRecord(record, TypeKeyExchange, psk, aadSuffix)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrKeyExchange, err)
+	}
+	if len(pub) != kexPublicKeyLength {
+		return nil, fmt.Errorf("%w: invalid public key length %d", ErrKeyExchange, len(pub))
+	}
+	return pub, nil
+}
+
+// buildSealedControlRecord seals payload like metadata, with Header ||
+// aadSuffix as AAD and, if hinted, the key hint of psk at the start of 16-64
+// bytes of padding.
+func buildSealedControlRecord(recordType byte, psk string, payload, aadSuffix []byte, hinted bool, ng *NonceGenerator) ([]byte, error) {
+	nonce, counter, err := ng.Next()
+	if err != nil {
+		return nil, err
+	}
+	sessionID := nonce[0:4]
+	gcm, err := newSessionKeyAEAD(psk, sessionID)
+	if err != nil {
+		return nil, err
+	}
+
+	paddingLen, err := randomPaddingRange(kexPaddingMin, kexPaddingMax)
+	if err != nil {
+		return nil, err
+	}
+	padding := make([]byte, paddingLen)
+	if _, err := rand.Read(padding); err != nil {
+		return nil, err
+	}
+	if hinted {
+		hint := KeyHintFor(psk, nonce[:])
+		copy(padding, hint[:])
+	}
+
+	header, err := buildHeader(recordType, len(payload)+gcm.Overhead(), paddingLen, sessionID, counter)
+	if err != nil {
+		return nil, err
+	}
+	aad := append(header[:len(header):len(header)], aadSuffix...)
+	return buildRecord(header, gcm.Seal(nil, nonce[:], payload, aad), padding), nil
+}
+
+// openSealedControlRecord authenticates and opens a record built by
+// buildSealedControlRecord.
+func openSealedControlRecord(record *Record, recordType byte, psk string, aadSuffix []byte) ([]byte, error) {
+	if record.Type != recordType {
+		return nil, fmt.Errorf("unexpected record type: %d", record.Type)
+	}
+	if len(record.SessionID) != headerSessionIDLength {
+		return nil, fmt.Errorf("invalid SessionID length: %d", len(record.SessionID))
+	}
+	gcm, err := newSessionKeyAEAD(psk, record.SessionID)
+	if err != nil {
+		return nil, err
+	}
+
+	var nonce [12]byte
+	copy(nonce[0:4], record.SessionID)
+	binary.BigEndian.PutUint64(nonce[4:12], record.Counter)
+	aad := append(append([]byte(nil), record.Header...), aadSuffix...)
+	return gcm.Open(nil, nonce[:], record.Payload, aad)
+}
+
+// deriveSessionKey mixes the X25519 shared secret with peerPub into the PSK.
+func deriveSessionKey(psk string, priv *ecdh.PrivateKey, peerPub, clientPub, serverPub []byte) (string, error) {
+	peerKey, err := ecdh.X25519().NewPublicKey(peerPub)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrKeyExchange, err)
+	}
+	shared, err := priv.ECDH(peerKey)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrKeyExchange, err)
+	}
+
+	ikm := append([]byte(strings.TrimSpace(psk)), shared...)
+	salt := append(append([]byte(nil), clientPub...), serverPub...)
+	reader := hkdf.New(sha256.New, ikm, salt, []byte(ProtocolLabel+kexSessionKeyLabel))
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(reader, key); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(key), nil
+}
@@ -0,0 +1,96 @@
+package core
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+func readRecord(t *testing.T, raw []byte) *Record {
+	t.Helper()
+	record, err := NewRecordReader(bytes.NewReader(raw)).ReadNextRecord()
+	if err != nil {
+		t.Fatalf("ReadNextRecord: %v", err)
+	}
+	return record
+}
+
+// TestKeyExchangeRoundTrip verifies both sides derive the same session key,
+// the gateway finds the user by key hint, and the session key replaces the PSK.
+func TestKeyExchangeRoundTrip(t *testing.T) {
+	clientNG, _ := NewNonceGenerator()
+	gatewayNG, _ := NewNonceGenerator()
+	table, err := NewUserTable([]User{{ID: "alice", PSK: "alice-psk", Enabled: true}}, "")
+	if err != nil {
+		t.Fatalf("NewUserTable: %v", err)
+	}
+
+	kx, err := NewKeyExchange("alice-psk")
+	if err != nil {
+		t.Fatalf("NewKeyExchange: %v", err)
+	}
+	raw, err := kx.BuildRequest(clientNG)
+	if err != nil {
+		t.Fatalf("BuildRequest: %v", err)
+	}
+	request := readRecord(t, raw)
+
+	var clientPub []byte
+	cred, err := table.Authenticate(request, time.Now(), func(psk string) error {
+		clientPub, err = ParseKeyExchangeRequest(request, psk)
+		return err
+	})
+	if err != nil || cred.User.ID != "alice" {
+		t.Fatalf("Authenticate: cred=%+v err=%v", cred, err)
+	}
+	rawReply, gatewayKey, err := BuildKeyExchangeReply(clientPub, cred.PSK, gatewayNG)
+	if err != nil {
+		t.Fatalf("BuildKeyExchangeReply: %v", err)
+	}
+	clientKey, err := kx.Finish(readRecord(t, rawReply))
+	if err != nil {
+		t.Fatalf("Finish: %v", err)
+	}
+	if clientKey != gatewayKey || clientKey == "alice-psk" {
+		t.Fatalf("session keys differ or equal the PSK: %q vs %q", clientKey, gatewayKey)
+	}
+
+	meta, err := BuildMetadataRecordWithOptions("example.com", 443, Options{}, clientKey, clientNG)
+	if err != nil {
+		t.Fatalf("BuildMetadataRecordWithOptions: %v", err)
+	}
+	record := readRecord(t, meta)
+	if _, err := DecryptMetadata(record, gatewayKey); err != nil {
+		t.Errorf("DecryptMetadata with session key: %v", err)
+	}
+	if _, err := DecryptMetadata(record, "alice-psk"); err == nil {
+		t.Error("metadata decrypted with the PSK alone")
+	}
+}
+
+// TestKeyExchangeRejects verifies requests need the PSK and replies are bound
+// to the client's ephemeral key.
+func TestKeyExchangeRejects(t *testing.T) {
+	ng, _ := NewNonceGenerator()
+	kx, _ := NewKeyExchange("right-psk")
+	raw, _ := kx.BuildRequest(ng)
+	if _, err := ParseKeyExchangeRequest(readRecord(t, raw), "wrong-psk"); !errors.Is(err, ErrKeyExchange) {
+		t.Errorf("wrong PSK: got %v, want ErrKeyExchange", err)
+	}
+
+	// A reply to another client's key must not complete this exchange.
+	other, _ := NewKeyExchange("right-psk")
+	otherRaw, _ := other.BuildRequest(ng)
+	otherPub, err := ParseKeyExchangeRequest(readRecord(t, otherRaw), "right-psk")
+	if err != nil {
+		t.Fatalf("ParseKeyExchangeRequest: %v", err)
+	}
+	reply, _, err := BuildKeyExchangeReply(otherPub, "right-psk", ng)
+	if err != nil {
+		t.Fatalf("BuildKeyExchangeReply: %v", err)
+	}
+	if _, err := kx.Finish(readRecord(t, reply)); !errors.Is(err, ErrKeyExchange) {
+		t.Errorf("foreign reply: got %v, want ErrKeyExchange", err)
+	}
+}
@@ -0,0 +1,148 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// PSK rotation.
+//
+// The gateway accepts a primary PSK plus secondary keys that stay valid until
+// their expiry, so a new secret can be rolled out while clients still use the
+// old one. Clients hold the next PSK in SessionConfig and switch to it at
+// NextPSKAt, re-dialing every session with the new key.
+
+// ErrNoMatchingKey is returned when no valid key authenticates a record.
+var ErrNoMatchingKey = errors.New("no matching key")
+
+// ErrKeyExpired is returned for records hinting at an expired key.
+var ErrKeyExpired = errors.New("key expired")
+
+// PSKKey is an accepted PSK with an optional expiry.
+type PSKKey struct {
+	PSK     string    `json:"psk"`
+	Expires time.Time `json:"expires,omitempty"` // zero = never
+}
+
+// Valid reports whether the key is accepted at now.
+func (k PSKKey) Valid(now time.Time) bool {
+	return k.Expires.IsZero() || now.Before(k.Expires)
+}
+
+// KeyName names key index i for logs: the primary is 0, secondaries follow.
+func KeyName(i int) string {
+	if i == 0 {
+		return "primary"
+	}
+	return fmt.Sprintf("secondary#%d", i)
+}
+
+// DecryptMetadataWithKeys tries keys in order, skipping expired ones, and
+// returns the metadata with the index of the key that authenticated it.
+func DecryptMetadataWithKeys(record *Record, keys []PSKKey, now time.Time) (*Metadata, int, error) {
+	var meta *Metadata
+	k, err := tryKeys(keys, now, func(psk string) error {
+		var err error
+		meta, err = DecryptMetadata(record, psk)
+		return err
+	})
+	if err != nil {
+		return nil, -1, err
+	}
+	return meta, k, nil
+}
+
+// tryKeys returns the index of the first valid key that open accepts.
+func tryKeys(keys []PSKKey, now time.Time, open func(psk string) error) (int, error) {
+	for i, k := range keys {
+		if k.Valid(now) && open(k.PSK) == nil {
+			return i, nil
+		}
+	}
+	return -1, ErrNoMatchingKey
+}
+
+// nextPSKSwitch returns when the config's next PSK takes over.
+func (c *SessionConfig) nextPSKSwitch() (time.Time, bool, error) {
+	if c.NextPSK == "" || c.NextPSKAt == "" {
+		return time.Time{}, false, nil
+	}
+	at, err := time.Parse(time.RFC3339, c.NextPSKAt)
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("invalid next_psk_at: %w", err)
+	}
+	return at, true, nil
+}
+
+// promoteNextPSK makes NextPSK the active PSK.
+func (c *SessionConfig) promoteNextPSK() {
+	c.PSK = c.NextPSK
+	c.NextPSK = ""
+	c.NextPSKAt = ""
+}
+
+// applyDuePSKSwitch promotes the next PSK if its switch time has passed.
+func (c *SessionConfig) applyDuePSKSwitch(now time.Time) (bool, error) {
+	at, ok, err := c.nextPSKSwitch()
+	if err != nil || !ok || now.Before(at) {
+		return false, err
+	}
+	c.promoteNextPSK()
+	return true, nil
+}
+
+// schedulePSKSwitch arms the timer that switches to the next PSK, replacing
+// any previous schedule. A switch time in the past applies immediately.
+func (c *Core) schedulePSKSwitch() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.pskTimer != nil {
+		c.pskTimer.Stop()
+		c.pskTimer = nil
+	}
+	if c.config == nil {
+		return nil
+	}
+	at, ok, err := c.config.nextPSKSwitch()
+	if err != nil || !ok {
+		return err
+	}
+	delay := time.Until(at)
+	if delay < 0 {
+		delay = 0
+	}
+	log.Printf("[INFO] PSK switch scheduled at %s", at.Format(time.RFC3339))
+	c.pskTimer = time.AfterFunc(delay, c.switchPSK)
+	return nil
+}
+
+// switchPSK promotes the next PSK, persists the config and rotates every
+// session so datagrams and rekeys also move to the new key.
+func (c *Core) switchPSK() {
+	c.mu.Lock()
+	if c.config == nil || c.config.NextPSK == "" {
+		c.mu.Unlock()
+		return
+	}
+	cfg := *c.config
+	cfg.promoteNextPSK()
+	c.config = &cfg
+	if c.configManager != nil {
+		if err := c.configManager.Save(&cfg); err != nil {
+			log.Printf("[ERROR] Failed to save config after PSK switch: %v", err)
+		}
+	}
+	pool := append([]*sessionManager(nil), c.sessionPool...)
+	c.pskTimer = nil
+	c.mu.Unlock()
+
+	log.Printf("[INFO] Switched to next PSK, rotating %d session(s)", len(pool))
+	for _, sm := range pool {
+		sm.updateConfig(&cfg)
+		if err := sm.rotate(); err != nil {
+			log.Printf("[ERROR] Session rotation after PSK switch failed: %v", err)
+		}
+	}
+}
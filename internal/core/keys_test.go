@@ -0,0 +1,72 @@
+package core
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// TestDecryptMetadataWithKeys verifies keys are tried in order, expired keys
+// are skipped and the matching index is reported.
+func TestDecryptMetadataWithKeys(t *testing.T) {
+	now := time.Now()
+	record := readMetadataRecord(t, "old-psk")
+
+	keys := []PSKKey{{PSK: "new-psk"}, {PSK: "old-psk", Expires: now.Add(time.Hour)}}
+	if _, k, err := DecryptMetadataWithKeys(record, keys, now); err != nil || k != 1 {
+		t.Errorf("valid secondary: got key %d err %v, want 1", k, err)
+	}
+
+	keys[1].Expires = now.Add(-time.Second)
+	if _, _, err := DecryptMetadataWithKeys(record, keys, now); !errors.Is(err, ErrNoMatchingKey) {
+		t.Errorf("expired secondary: got %v, want ErrNoMatchingKey", err)
+	}
+}
+
+// TestUserTableSecondaryKey verifies a hinted secondary key authenticates
+// until it expires.
+func TestUserTableSecondaryKey(t *testing.T) {
+	now := time.Now()
+	table, err := NewUserTable([]User{{
+		ID:        "alice",
+		PSK:       "new-psk",
+		Enabled:   true,
+		Secondary: []PSKKey{{PSK: "old-psk", Expires: now.Add(time.Hour)}},
+	}}, "")
+	if err != nil {
+		t.Fatalf("NewUserTable: %v", err)
+	}
+
+	record := readMetadataRecord(t, "old-psk")
+	cred, _, err := table.DecryptMetadata(record, now)
+	if err != nil {
+		t.Fatalf("DecryptMetadata: %v", err)
+	}
+	if cred.User.ID != "alice" || cred.KeyName() != "secondary#1" || cred.PSK != "old-psk" {
+		t.Errorf("got %s/%s, want alice/secondary#1", cred.User.ID, cred.KeyName())
+	}
+	if _, _, err := table.DecryptMetadata(record, now.Add(2*time.Hour)); !errors.Is(err, ErrKeyExpired) {
+		t.Errorf("after expiry: got %v, want ErrKeyExpired", err)
+	}
+}
+
+// TestApplyDuePSKSwitch verifies the next PSK takes over at its switch time.
+func TestApplyDuePSKSwitch(t *testing.T) {
+	at := time.Date(2026, 11, 1, 0, 0, 0, 0, time.UTC)
+	cfg := SessionConfig{PSK: "old", NextPSK: "new", NextPSKAt: at.Format(time.RFC3339)}
+
+	if switched, err := cfg.applyDuePSKSwitch(at.Add(-time.Minute)); err != nil || switched || cfg.PSK != "old" {
+		t.Fatalf("before switch: switched=%v err=%v psk=%q", switched, err, cfg.PSK)
+	}
+	if switched, err := cfg.applyDuePSKSwitch(at); err != nil || !switched {
+		t.Fatalf("at switch: switched=%v err=%v", switched, err)
+	}
+	if cfg.PSK != "new" || cfg.NextPSK != "" || cfg.NextPSKAt != "" {
+		t.Errorf("after switch: %+v", cfg)
+	}
+
+	bad := SessionConfig{PSK: "old", NextPSK: "new", NextPSKAt: "tomorrow"}
+	if _, err := bad.applyDuePSKSwitch(at); err == nil {
+		t.Error("expected error for invalid next_psk_at")
+	}
+}
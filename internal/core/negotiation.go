@@ -0,0 +1,282 @@
+package core
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Per-stream option negotiation.
+//
+// The client proposes record payload size, padding scheme and compression in
+// the metadata Options TLVs. The gateway clamps the proposal to its own limits
+// and, once the target is connected, answers with an Accept record before
+// relaying data:
+//
+//	Header(30B, Type=TypeAccept) || AES-GCM(Options TLVs [|| RemoteAddr TLV])
+//
+// The key is derived like metadata (salt = SessionID of the Accept record).
+// Both sides then use the accepted values for this stream only. The Accept
+// record doubles as the "connected" reply: a failed dial is answered with an
+// Error record instead.
+
+// acceptRemoteAddr is the Accept-only TLV carrying the target address the
+// gateway connected to: IP(4 or 16 bytes) || Port(u16).
+const acceptRemoteAddr = 0x07
+
+// PaddingScheme selects how data records are padded.
+type PaddingScheme uint8
+
+const (
+	// PaddingNone sends data records without padding.
+	PaddingNone PaddingScheme = 0x00
+	// PaddingRandom adds 0..MaxPadding random bytes to every record.
+	PaddingRandom PaddingScheme = 0x01
+	// PaddingBucketed pads records up to fixed size classes.
+	PaddingBucketed PaddingScheme = 0x02
+	// PaddingTLS shapes records like TLS 1.3 application data records.
+	PaddingTLS PaddingScheme = 0x03
+)
+
+// ParsePaddingScheme parses a config value ("", "none", "random", "bucketed" or "tls").
+func ParsePaddingScheme(s string) (PaddingScheme, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "none":
+		return PaddingNone, nil
+	case "random":
+		return PaddingRandom, nil
+	case "bucketed":
+		return PaddingBucketed, nil
+	case "tls":
+		return PaddingTLS, nil
+	default:
+		return PaddingNone, fmt.Errorf("unknown padding scheme: %s", s)
+	}
+}
+
+func (p PaddingScheme) String() string {
+	switch p {
+	case PaddingNone:
+		return "none"
+	case PaddingRandom:
+		return "random"
+	case PaddingBucketed:
+		return "bucketed"
+	case PaddingTLS:
+		return "tls"
+	default:
+		return fmt.Sprintf("padding(%d)", uint8(p))
+	}
+}
+
+// Compression selects the data record compression algorithm.
+type Compression uint8
+
+const (
+	// CompressionNone sends data records uncompressed.
+	CompressionNone Compression = 0x00
+	// CompressionDeflate compresses each data record independently with DEFLATE.
+	CompressionDeflate Compression = 0x01
+)
+
+// ParseCompression parses a config value ("", "none" or "deflate").
+func ParseCompression(s string) (Compression, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "none":
+		return CompressionNone, nil
+	case "deflate":
+		return CompressionDeflate, nil
+	default:
+		return CompressionNone, fmt.Errorf("unknown compression: %s", s)
+	}
+}
+
+func (c Compression) String() string {
+	switch c {
+	case CompressionNone:
+		return "none"
+	case CompressionDeflate:
+		return "deflate"
+	default:
+		return fmt.Sprintf("compression(%d)", uint8(c))
+	}
+}
+
+// NegotiationLimits bounds what a gateway accepts from a client proposal.
+type NegotiationLimits struct {
+	// DefaultRecordPayload is used when the client proposes no size.
+	DefaultRecordPayload int
+	// MaxRecordPayload is the largest record payload the gateway will use.
+	MaxRecordPayload int
+	// DisableCompression refuses every compression proposal.
+	DisableCompression bool
+	// DisablePadding refuses every padding scheme.
+	DisablePadding bool
+	// MaxPaddingBudget caps the padding overhead budget in percent (0 = no cap).
+	MaxPaddingBudget int
+}
+
+// DefaultNegotiationLimits returns limits based on the process defaults.
+// Records are capped at the pooled payload size so that receiving a
+// maximum-size record never allocates.
+func DefaultNegotiationLimits() NegotiationLimits {
+	return NegotiationLimits{
+		DefaultRecordPayload: GetMaxRecordPayload(),
+		MaxRecordPayload:     GetMaxRecordPayload(),
+	}
+}
+
+// NegotiateOptions returns the subset of proposed that the gateway accepts.
+// Unknown padding schemes and compression algorithms fall back to none.
+func NegotiateOptions(proposed Options, limits NegotiationLimits) Options {
+	accepted := proposed
+
+	payload := int(proposed.RecordPayload)
+	if payload == 0 {
+		payload = limits.DefaultRecordPayload
+	}
+	payload = clampRecordPayload(payload)
+	if limits.MaxRecordPayload > 0 && payload > limits.MaxRecordPayload {
+		payload = limits.MaxRecordPayload
+	}
+	accepted.RecordPayload = uint32(payload)
+
+	if limits.DisablePadding || !paddingSupported(proposed.Padding) {
+		accepted.Padding = PaddingNone
+	}
+	if accepted.Padding == PaddingNone {
+		accepted.PaddingBudget = 0
+	} else {
+		budget := accepted.paddingBudget()
+		if limits.MaxPaddingBudget > 0 && budget > limits.MaxPaddingBudget {
+			budget = limits.MaxPaddingBudget
+		}
+		accepted.PaddingBudget = uint8(budget)
+	}
+	if limits.DisableCompression || !compressionSupported(proposed.Compression) {
+		accepted.Compression = CompressionNone
+	}
+	return accepted
+}
+
+func paddingSupported(p PaddingScheme) bool {
+	switch p {
+	case PaddingNone, PaddingRandom, PaddingBucketed, PaddingTLS:
+		return true
+	default:
+		return false
+	}
+}
+
+func compressionSupported(c Compression) bool {
+	return c == CompressionNone || c == CompressionDeflate
+}
+
+// recordPayloadSize returns the per-stream data payload size, falling back to
+// the process default when none was negotiated.
+func (o Options) recordPayloadSize() int {
+	if o.RecordPayload == 0 {
+		return GetMaxRecordPayload()
+	}
+	return int(o.RecordPayload)
+}
+
+// BuildAcceptRecord builds the gateway's Accept record for the accepted
+// options. remote is the connected target address and may be nil.
+// metadataHeader is the 30-byte header of the stream's metadata record; it
+// binds the Accept to that stream (see acceptAAD).
+func BuildAcceptRecord(accepted Options, remote *net.TCPAddr, metadataHeader []byte, psk string, ng *NonceGenerator) ([]byte, error) {
+	nonce, counter, err := ng.Next()
+	if err != nil {
+		return nil, err
+	}
+	sessionID := nonce[0:4]
+	gcm, err := newSessionKeyAEAD(psk, sessionID)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext := buildOptions(accepted)
+	if remote != nil {
+		ip := remote.IP.To4()
+		if ip == nil {
+			ip = remote.IP.To16()
+		}
+		if ip != nil {
+			plaintext = append(plaintext, acceptRemoteAddr, byte(len(ip)+2))
+			plaintext = append(plaintext, ip...)
+			plaintext = binary.BigEndian.AppendUint16(plaintext, uint16(remote.Port))
+		}
+	}
+	header, err := buildHeader(TypeAccept, len(plaintext)+gcm.Overhead(), 0, sessionID, counter)
+	if err != nil {
+		return nil, err
+	}
+	aad, err := acceptAAD(header, metadataHeader)
+	if err != nil {
+		return nil, err
+	}
+	return buildRecord(header, gcm.Seal(nil, nonce[:], plaintext, aad), nil), nil
+}
+
+// acceptAAD returns the additional data of an Accept record: its own header
+// followed by the SessionID and Counter of the metadata record it answers,
+// so a captured Accept cannot be replayed onto another stream.
+func acceptAAD(header, metadataHeader []byte) ([]byte, error) {
+	if len(metadataHeader) != RecordHeaderLength {
+		return nil, fmt.Errorf("invalid metadata header length: %d", len(metadataHeader))
+	}
+	aad := make([]byte, 0, len(header)+nonceLength)
+	aad = append(aad, header...)
+	return append(aad, metadataHeader[headerSessionIDOffset:headerCounterOffset+headerCounterLength]...), nil
+}
+
+// ParseAcceptRecord authenticates an Accept record against the stream whose
+// metadata record had metadataHeader and returns the accepted options and,
+// when reported, the connected target address.
+func ParseAcceptRecord(record *Record, metadataHeader []byte, psk string) (Options, *net.TCPAddr, error) {
+	if record.Type != TypeAccept {
+		return Options{}, nil, fmt.Errorf("unexpected record type: %d", record.Type)
+	}
+	if len(record.SessionID) != headerSessionIDLength {
+		return Options{}, nil, fmt.Errorf("invalid SessionID length: %d", len(record.SessionID))
+	}
+	gcm, err := newSessionKeyAEAD(psk, record.SessionID)
+	if err != nil {
+		return Options{}, nil, err
+	}
+
+	var nonce [12]byte
+	copy(nonce[0:4], record.SessionID)
+	binary.BigEndian.PutUint64(nonce[4:12], record.Counter)
+	aad, err := acceptAAD(record.Header, metadataHeader)
+	if err != nil {
+		return Options{}, nil, err
+	}
+	plaintext, err := gcm.Open(nil, nonce[:], record.Payload, aad)
+	if err != nil {
+		return Options{}, nil, errors.New("accept record authentication failed")
+	}
+	return parseOptions(plaintext), parseAcceptRemoteAddr(plaintext), nil
+}
+
+// parseAcceptRemoteAddr returns the RemoteAddr TLV of an Accept payload, if any.
+func parseAcceptRemoteAddr(buffer []byte) *net.TCPAddr {
+	for offset := 0; offset+2 <= len(buffer); {
+		typ, length := buffer[offset], int(buffer[offset+1])
+		offset += 2
+		if offset+length > len(buffer) {
+			return nil
+		}
+		value := buffer[offset : offset+length]
+		offset += length
+		if typ == acceptRemoteAddr && (length == 6 || length == 18) {
+			ip := make(net.IP, length-2)
+			copy(ip, value)
+			return &net.TCPAddr{IP: ip, Port: int(binary.BigEndian.Uint16(value[length-2:]))}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+package core
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+// TestNegotiateOptions verifies proposals are clamped to gateway limits and
+// unknown schemes fall back to none.
+func TestNegotiateOptions(t *testing.T) {
+	limits := NegotiationLimits{DefaultRecordPayload: 16384, MaxRecordPayload: 65536}
+
+	cases := []struct {
+		name     string
+		proposed Options
+		want     uint32
+	}{
+		{"default", Options{}, 16384},
+		{"within", Options{RecordPayload: 32768}, 32768},
+		{"above max", Options{RecordPayload: 512 * 1024}, 65536},
+		{"below min", Options{RecordPayload: 100}, 1024},
+	}
+	for _, tc := range cases {
+		accepted := NegotiateOptions(tc.proposed, limits)
+		if accepted.RecordPayload != tc.want {
+			t.Errorf("%s: RecordPayload got %d, want %d", tc.name, accepted.RecordPayload, tc.want)
+		}
+	}
+
+	accepted := NegotiateOptions(Options{Padding: PaddingScheme(0xee), Compression: Compression(0xee)}, limits)
+	if accepted.Padding != PaddingNone || accepted.Compression != CompressionNone {
+		t.Errorf("unknown schemes: got padding=%s compression=%s", accepted.Padding, accepted.Compression)
+	}
+}
+
+// TestOptionsNegotiationTLVRoundTrip verifies the negotiation TLVs survive encoding.
+func TestOptionsNegotiationTLVRoundTrip(t *testing.T) {
+	in := Options{MaxPadding: 32, RecordPayload: 65536, Padding: PaddingBucketed, PaddingBudget: 20, Compression: Compression(1)}
+	if out := parseOptions(buildOptions(in)); out != in {
+		t.Errorf("Options: got %+v, want %+v", out, in)
+	}
+}
+
+// TestAcceptRecordAppliesToWriter verifies that reading the gateway's Accept
+// record switches the writer to the accepted options.
+func TestAcceptRecordAppliesToWriter(t *testing.T) {
+	ng, err := NewNonceGenerator()
+	if err != nil {
+		t.Fatalf("NewNonceGenerator: %v", err)
+	}
+
+	metaHdr := testMetadataHeader(t, ng)
+	var stream bufferStream
+	accepted := Options{RecordPayload: 4096}
+	acceptRecord, err := BuildAcceptRecord(accepted, nil, metaHdr, "test-psk", ng)
+	if err != nil {
+		t.Fatalf("BuildAcceptRecord: %v", err)
+	}
+	stream.Write(acceptRecord)
+	data, err := BuildDataRecord([]byte("response"), 0, ng)
+	if err != nil {
+		t.Fatalf("BuildDataRecord: %v", err)
+	}
+	stream.Write(data)
+	PutBuffer(data)
+
+	rw := NewRecordReadWriter(&stream, 0, ng)
+	rw.Negotiate(Options{RecordPayload: 65536}, "test-psk", metaHdr)
+	if got := rw.Options().RecordPayload; got != 65536 {
+		t.Fatalf("proposed RecordPayload: got %d, want 65536", got)
+	}
+
+	buf := make([]byte, 64)
+	n, err := io.ReadAtLeast(rw, buf, len("response"))
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if !bytes.Equal(buf[:n], []byte("response")) {
+		t.Errorf("Read: got %q", buf[:n])
+	}
+	if got := rw.Options().RecordPayload; got != 4096 {
+		t.Errorf("accepted RecordPayload: got %d, want 4096", got)
+	}
+
+	// A forged Accept (wrong PSK) must fail the read.
+	var forged bufferStream
+	bad, _ := BuildAcceptRecord(accepted, nil, metaHdr, "other-psk", ng)
+	forged.Write(bad)
+	rw = NewRecordReadWriter(&forged, 0, ng)
+	rw.Negotiate(Options{}, "test-psk", metaHdr)
+	if _, err := rw.Read(buf); err == nil {
+		t.Error("expected error for forged Accept record")
+	}
+
+	// An Accept captured from one stream must not apply to another.
+	var replayed bufferStream
+	replayed.Write(acceptRecord)
+	rw = NewRecordReadWriter(&replayed, 0, ng)
+	rw.Negotiate(Options{}, "test-psk", testMetadataHeader(t, ng))
+	if _, err := rw.Read(buf); err == nil {
+		t.Error("expected error for Accept record replayed onto another stream")
+	}
+}
+
+// testMetadataHeader returns the header of a fresh metadata record.
+func testMetadataHeader(t *testing.T, ng *NonceGenerator) []byte {
+	t.Helper()
+	meta, err := BuildMetadataRecord("example.com", 443, 0, "test-psk", ng)
+	if err != nil {
+		t.Fatalf("BuildMetadataRecord: %v", err)
+	}
+	return meta[4 : 4+RecordHeaderLength]
+}
+
+// TestWaitConnected verifies the connected reply reports the target address
+// and a failed connect surfaces the gateway's error code.
+func TestWaitConnected(t *testing.T) {
+	ng, err := NewNonceGenerator()
+	if err != nil {
+		t.Fatalf("NewNonceGenerator: %v", err)
+	}
+
+	metaHdr := testMetadataHeader(t, ng)
+	var stream bufferStream
+	remote := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 443}
+	acceptRecord, err := BuildAcceptRecord(Options{RecordPayload: 4096}, remote, metaHdr, "test-psk", ng)
+	if err != nil {
+		t.Fatalf("BuildAcceptRecord: %v", err)
+	}
+	stream.Write(acceptRecord)
+	rw := NewRecordReadWriter(&stream, 0, ng)
+	rw.Negotiate(Options{RecordPayload: 65536}, "test-psk", metaHdr)
+	got, err := rw.WaitConnected()
+	if err != nil {
+		t.Fatalf("WaitConnected: %v", err)
+	}
+	if got == nil || got.String() != remote.String() {
+		t.Errorf("remote: got %v, want %v", got, remote)
+	}
+	if rw.Options().RecordPayload != 4096 {
+		t.Errorf("accepted RecordPayload: got %d, want 4096", rw.Options().RecordPayload)
+	}
+
+	var failed bufferStream
+	errRecord, err := BuildErrorRecord(CodeDNSFailure, CodeDNSFailure.Message(), ng)
+	if err != nil {
+		t.Fatalf("BuildErrorRecord: %v", err)
+	}
+	failed.Write(errRecord)
+	rw = NewRecordReadWriter(&failed, 0, ng)
+	rw.Negotiate(Options{}, "test-psk", metaHdr)
+	if _, err := rw.WaitConnected(); ErrorCodeOf(err) != CodeDNSFailure {
+		t.Errorf("WaitConnected: got %v, want %s", err, CodeDNSFailure)
+	}
+}
@@ -0,0 +1,135 @@
+package core
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+)
+
+// QUIC packet obfuscation.
+//
+// With quic_obfs (QUIC_OBFS on the gateway) both ends wrap their UDP sockets
+// in an ObfsPacketConn, so no QUIC header, version or SNI is visible on the
+// wire. Each datagram is
+//
+//	IV (16) ‖ AES-128-CTR(key, IV)( padLen (1) ‖ padding ‖ QUIC packet )
+//
+// with key = deriveKey(obfs key, "packet-obfs") and padLen random in
+// [0, obfsMaxPadding]. QUIC still authenticates every packet; a peer with the
+// wrong key only produces undecryptable packets. Browsers cannot reach an
+// obfuscated gateway.
+const (
+	obfsLabel       = "packet-obfs"
+	obfsIVSize      = aes.BlockSize
+	obfsOverhead    = obfsIVSize + 1
+	obfsMaxPadding  = 64
+	obfsMaxDatagram = 1400 // padding never grows a datagram beyond this
+	obfsBufferSize  = 2048
+)
+
+var obfsBufferPool = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, obfsBufferSize)
+		return &buf
+	},
+}
+
+// ObfsPacketConn obfuscates every datagram sent and received through a
+// net.PacketConn. It deliberately hides the optimized UDP interfaces of the
+// wrapped socket so quic-go reads through ReadFrom.
+type ObfsPacketConn struct {
+	net.PacketConn
+	block cipher.Block
+}
+
+// NewObfsPacketConn wraps conn with a key derived from obfsKey.
+func NewObfsPacketConn(conn net.PacketConn, obfsKey string) (*ObfsPacketConn, error) {
+	if strings.TrimSpace(obfsKey) == "" {
+		return nil, errors.New("obfuscation key is empty")
+	}
+	key, err := deriveKey(obfsKey, []byte(obfsLabel))
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return &ObfsPacketConn{PacketConn: conn, block: block}, nil
+}
+
+// quicObfsKey returns the obfuscation key, or "" when quic_obfs is off.
+func (c *SessionConfig) quicObfsKey() string {
+	switch {
+	case !c.QUICObfs:
+		return ""
+	case c.QUICObfsKey != "":
+		return c.QUICObfsKey
+	}
+	return c.PSK
+}
+
+// ReadFrom reads the next datagram and returns the QUIC packet it carries.
+// Datagrams too short for the header or with a bad padding length are dropped.
+func (c *ObfsPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	bufp := obfsBufferPool.Get().(*[]byte)
+	defer obfsBufferPool.Put(bufp)
+	buf := *bufp
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(buf)
+		if err != nil {
+			return 0, addr, err
+		}
+		if n < obfsOverhead {
+			continue
+		}
+		body := buf[obfsIVSize:n]
+		cipher.NewCTR(c.block, buf[:obfsIVSize]).XORKeyStream(body, body)
+		padLen := int(body[0])
+		if 1+padLen > len(body) {
+			continue
+		}
+		return copy(p, body[1+padLen:]), addr, nil
+	}
+}
+
+// WriteTo obfuscates p, adds random padding and sends it to addr.
+func (c *ObfsPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	bufp := obfsBufferPool.Get().(*[]byte)
+	defer obfsBufferPool.Put(bufp)
+	buf := *bufp
+	if obfsOverhead+len(p) > len(buf) {
+		return 0, fmt.Errorf("packet of %d bytes too large to obfuscate", len(p))
+	}
+
+	// One random read supplies the IV and the padding length.
+	if _, err := rand.Read(buf[:obfsOverhead]); err != nil {
+		return 0, err
+	}
+	padLen := int(buf[obfsIVSize]) % (obfsMaxPadding + 1)
+	if room := obfsMaxDatagram - obfsOverhead - len(p); padLen > room {
+		padLen = max(room, 0)
+	}
+
+	body := buf[obfsIVSize : obfsOverhead+padLen+len(p)]
+	body[0] = byte(padLen)
+	clear(body[1 : 1+padLen])
+	copy(body[1+padLen:], p)
+	cipher.NewCTR(c.block, buf[:obfsIVSize]).XORKeyStream(body, body)
+	if _, err := c.PacketConn.WriteTo(buf[:obfsIVSize+len(body)], addr); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// SetReadBuffer is a no-op: the owner of the wrapped socket sizes its
+// buffers, and quic-go would otherwise warn or shrink them.
+func (c *ObfsPacketConn) SetReadBuffer(int) error { return nil }
+
+// SetWriteBuffer is a no-op, see SetReadBuffer.
+func (c *ObfsPacketConn) SetWriteBuffer(int) error { return nil }
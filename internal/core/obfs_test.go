@@ -0,0 +1,123 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+func obfsTestPair(t *testing.T, clientKey, serverKey string) (client, server *ObfsPacketConn, rawServer net.PacketConn) {
+	t.Helper()
+	rawClient, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket: %v", err)
+	}
+	rawServer, err = net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket: %v", err)
+	}
+	t.Cleanup(func() {
+		rawClient.Close()
+		rawServer.Close()
+	})
+	if client, err = NewObfsPacketConn(rawClient, clientKey); err != nil {
+		t.Fatalf("NewObfsPacketConn: %v", err)
+	}
+	if server, err = NewObfsPacketConn(rawServer, serverKey); err != nil {
+		t.Fatalf("NewObfsPacketConn: %v", err)
+	}
+	return client, server, rawServer
+}
+
+// TestObfsPacketConn verifies datagrams round-trip, are padded and hide the
+// payload on the wire, and that runt datagrams are dropped.
+func TestObfsPacketConn(t *testing.T) {
+	client, server, rawServer := obfsTestPair(t, "secret", "secret")
+	_ = server.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	payload := bytes.Repeat([]byte("QUIC"), 300)
+	buf := make([]byte, 2048)
+	for i := 0; i < 20; i++ {
+		if _, err := client.WriteTo(payload, rawServer.LocalAddr()); err != nil {
+			t.Fatalf("WriteTo: %v", err)
+		}
+		n, _, err := server.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("ReadFrom: %v", err)
+		}
+		if !bytes.Equal(buf[:n], payload) {
+			t.Fatalf("payload changed in transit")
+		}
+	}
+
+	// On the wire: padded, and no trace of the payload.
+	if _, err := client.WriteTo(payload, rawServer.LocalAddr()); err != nil {
+		t.Fatalf("WriteTo: %v", err)
+	}
+	n, _, err := rawServer.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("raw ReadFrom: %v", err)
+	}
+	if n < len(payload)+obfsOverhead || n > obfsMaxDatagram || bytes.Contains(buf[:n], []byte("QUICQUIC")) {
+		t.Errorf("wire datagram of %d bytes not obfuscated as expected", n)
+	}
+
+	// A runt datagram is skipped.
+	if _, err := client.PacketConn.WriteTo([]byte{1, 2, 3}, rawServer.LocalAddr()); err != nil {
+		t.Fatalf("raw WriteTo: %v", err)
+	}
+	if _, err := client.WriteTo([]byte("ok"), rawServer.LocalAddr()); err != nil {
+		t.Fatalf("WriteTo: %v", err)
+	}
+	if n, _, err := server.ReadFrom(buf); err != nil || string(buf[:n]) != "ok" {
+		t.Errorf("after runt: got %q %v", buf[:n], err)
+	}
+
+	if _, err := NewObfsPacketConn(rawServer, " "); err == nil {
+		t.Error("empty key accepted")
+	}
+}
+
+// TestObfsQUICHandshake runs a QUIC handshake through obfuscated sockets and
+// verifies a mismatched key cannot connect.
+func TestObfsQUICHandshake(t *testing.T) {
+	cert, roots := echTestCertificate(t, "gw.test")
+	serverTLS := &tls.Config{Certificates: []tls.Certificate{cert}, NextProtos: []string{"aether-test"}}
+	clientTLS := &tls.Config{ServerName: "gw.test", RootCAs: roots, NextProtos: []string{"aether-test"}}
+
+	dial := func(clientKey string, timeout time.Duration) error {
+		client, server, rawServer := obfsTestPair(t, clientKey, "secret")
+		ln, err := (&quic.Transport{Conn: server}).Listen(serverTLS, nil)
+		if err != nil {
+			t.Fatalf("Listen: %v", err)
+		}
+		defer ln.Close()
+		go func() {
+			if conn, err := ln.Accept(context.Background()); err == nil {
+				<-conn.Context().Done()
+			}
+		}()
+
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		tr := &quic.Transport{Conn: client}
+		defer tr.Close()
+		conn, err := tr.Dial(ctx, rawServer.LocalAddr(), clientTLS, nil)
+		if err != nil {
+			return err
+		}
+		return conn.CloseWithError(0, "")
+	}
+
+	if err := dial("secret", 5*time.Second); err != nil {
+		t.Fatalf("obfuscated handshake: %v", err)
+	}
+	if err := dial("other", 500*time.Millisecond); err == nil {
+		t.Error("handshake with a mismatched key succeeded")
+	}
+}
@@ -0,0 +1,145 @@
+package core
+
+import (
+	"encoding/binary"
+	"math/rand/v2"
+)
+
+// Data record padding schemes shape the record length distribution of a
+// stream. Padding is zero bytes appended after the (sealed) payload and
+// counted in the header's PaddingLength, so receivers simply skip it.
+//
+// Every scheme runs under an overhead budget: the padding bytes of a stream
+// never exceed PaddingBudget percent of its payload bytes. A record whose
+// padding would overshoot the budget is sent unpadded, so the worst-case
+// throughput cost is known up front.
+const (
+	// defaultRandomPadding is N for PaddingRandom when MaxPadding is 0.
+	defaultRandomPadding = 255
+	// tlsRecordPlaintext and tlsRecordOverhead describe a TLS 1.3 AES-GCM
+	// record: 5B header + 1B inner content type + 16B tag.
+	tlsRecordPlaintext = 16 * 1024
+	tlsRecordOverhead  = 22
+	tlsFullRecord      = tlsRecordPlaintext + tlsRecordOverhead
+	// tlsSmallRecordJitter is the random padding added to short records,
+	// like TLS 1.3 record padding.
+	tlsSmallRecordJitter = 64
+)
+
+// paddingBuckets are the on-wire record size classes of PaddingBucketed.
+// Records above the largest class are padded to a multiple of it.
+var paddingBuckets = []int{256, 512, 1024, 2048, 4096, 8192, 16384}
+
+// DefaultBudget returns the default overhead budget of the scheme in percent.
+func (p PaddingScheme) DefaultBudget() int {
+	switch p {
+	case PaddingRandom:
+		return 10
+	case PaddingBucketed:
+		return 25
+	case PaddingTLS:
+		return 15
+	default:
+		return 0
+	}
+}
+
+// paddingBudget returns the effective overhead budget in percent.
+func (o Options) paddingBudget() int {
+	if o.PaddingBudget != 0 {
+		return int(o.PaddingBudget)
+	}
+	return o.Padding.DefaultBudget()
+}
+
+// RecordPaddingLength returns the PaddingLength of a framed record
+// (4-byte length prefix followed by the header).
+func RecordPaddingLength(record []byte) int {
+	if len(record) < 4+RecordHeaderLength {
+		return 0
+	}
+	header := record[4 : 4+RecordHeaderLength]
+	return int(binary.BigEndian.Uint32(header[headerPaddingLenOffset : headerPaddingLenOffset+4]))
+}
+
+// dataPadder picks padding lengths for one stream direction and tracks its
+// overhead against the budget.
+type dataPadder struct {
+	scheme       PaddingScheme
+	maxPadding   int
+	budget       uint64 // percent
+	payloadBytes uint64
+	paddingBytes uint64
+}
+
+// newDataPadder returns nil when opts select no padding.
+func newDataPadder(opts Options) *dataPadder {
+	if opts.Padding == PaddingNone || !paddingSupported(opts.Padding) {
+		return nil
+	}
+	p := &dataPadder{
+		scheme:     opts.Padding,
+		maxPadding: int(opts.MaxPadding),
+		budget:     uint64(opts.paddingBudget()),
+	}
+	if p.maxPadding == 0 {
+		p.maxPadding = defaultRandomPadding
+	}
+	return p
+}
+
+// padding returns the padding length for a record carrying n payload bytes
+// on the wire (after compression and sealing).
+func (p *dataPadder) padding(n int) int {
+	if p == nil {
+		return 0
+	}
+	p.payloadBytes += uint64(n)
+
+	pad := p.target(4 + RecordHeaderLength + n)
+	if limit := MaxRecordSize - RecordHeaderLength - n; pad > limit {
+		pad = limit
+	}
+	if pad <= 0 || (p.paddingBytes+uint64(pad))*100 > p.payloadBytes*p.budget {
+		return 0
+	}
+	p.paddingBytes += uint64(pad)
+	return pad
+}
+
+// target returns the scheme's padding for a record of recordLen bytes
+// (length prefix and header included), ignoring the budget.
+func (p *dataPadder) target(recordLen int) int {
+	switch p.scheme {
+	case PaddingRandom:
+		return rand.IntN(p.maxPadding + 1)
+	case PaddingBucketed:
+		for _, bucket := range paddingBuckets {
+			if recordLen <= bucket {
+				return bucket - recordLen
+			}
+		}
+		return roundUp(recordLen, paddingBuckets[len(paddingBuckets)-1]) - recordLen
+	case PaddingTLS:
+		// Bulk transfers look like a run of full-size TLS records; short
+		// records get TLS 1.3 style jitter.
+		if recordLen >= tlsFullRecord/2 {
+			return roundUp(recordLen, tlsFullRecord) - recordLen
+		}
+		return rand.IntN(tlsSmallRecordJitter + 1)
+	default:
+		return 0
+	}
+}
+
+// overhead returns padding bytes as a fraction of payload bytes so far.
+func (p *dataPadder) overhead() float64 {
+	if p == nil || p.payloadBytes == 0 {
+		return 0
+	}
+	return float64(p.paddingBytes) / float64(p.payloadBytes)
+}
+
+func roundUp(n, multiple int) int {
+	return (n + multiple - 1) / multiple * multiple
+}
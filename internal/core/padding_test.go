@@ -0,0 +1,117 @@
+package core
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"io"
+	"testing"
+)
+
+// TestPaddedRecordRoundTrip verifies padding is skipped by the reader, with
+// and without AEAD, and that bucketed records land on a size class.
+func TestPaddedRecordRoundTrip(t *testing.T) {
+	ng, err := NewNonceGenerator()
+	if err != nil {
+		t.Fatalf("NewNonceGenerator: %v", err)
+	}
+	sid := ng.SessionID()
+	aead, err := NewDataAEAD("test-psk", sid[:], 0, DataDirUpstream)
+	if err != nil {
+		t.Fatalf("NewDataAEAD: %v", err)
+	}
+	payload := bytes.Repeat([]byte("x"), 900)
+
+	for _, tc := range []struct {
+		name string
+		seal cipher.AEAD
+	}{{"plain", nil}, {"aead", aead}} {
+		encoder := NewDataRecordEncoder(Options{Padding: PaddingBucketed, PaddingBudget: 100}, tc.seal)
+		record, err := encoder.Build(payload, ng)
+		if err != nil {
+			t.Fatalf("%s: Build: %v", tc.name, err)
+		}
+		if len(record) != 1024 {
+			t.Errorf("%s: record length %d, want bucket 1024", tc.name, len(record))
+		}
+		if RecordPaddingLength(record) == 0 {
+			t.Errorf("%s: record not padded", tc.name)
+		}
+
+		reader := NewRecordReader(bytes.NewReader(record))
+		reader.SetDataAEAD(tc.seal)
+		got, err := io.ReadAll(reader)
+		if err != nil {
+			t.Fatalf("%s: ReadAll: %v", tc.name, err)
+		}
+		if !bytes.Equal(got, payload) {
+			t.Errorf("%s: payload mismatch (got %d bytes)", tc.name, len(got))
+		}
+		PutBuffer(record)
+	}
+}
+
+// TestPaddingSchemeTargets verifies the per-scheme record lengths.
+func TestPaddingSchemeTargets(t *testing.T) {
+	p := &dataPadder{scheme: PaddingBucketed}
+	for recordLen, want := range map[int]int{100: 156, 256: 0, 3000: 1096, 20000: 12768} {
+		if got := p.target(recordLen); got != want {
+			t.Errorf("bucketed(%d): got %d, want %d", recordLen, got, want)
+		}
+	}
+
+	p = &dataPadder{scheme: PaddingTLS}
+	if got := p.target(16000); got != tlsFullRecord-16000 {
+		t.Errorf("tls(16000): got %d, want %d", got, tlsFullRecord-16000)
+	}
+	for i := 0; i < 100; i++ {
+		if got := p.target(200); got > tlsSmallRecordJitter {
+			t.Fatalf("tls(200): got %d, want <= %d", got, tlsSmallRecordJitter)
+		}
+	}
+
+	p = &dataPadder{scheme: PaddingRandom, maxPadding: 16}
+	for i := 0; i < 100; i++ {
+		if got := p.target(200); got > 16 {
+			t.Fatalf("random(200): got %d, want <= 16", got)
+		}
+	}
+}
+
+// TestPaddingBudget verifies padding overhead never exceeds the budget.
+func TestPaddingBudget(t *testing.T) {
+	for _, scheme := range []PaddingScheme{PaddingRandom, PaddingBucketed, PaddingTLS} {
+		p := newDataPadder(Options{Padding: scheme, PaddingBudget: 5})
+		padded := 0
+		for i := 0; i < 1000; i++ {
+			if p.padding(300+i*37%9000) > 0 {
+				padded++
+			}
+		}
+		if overhead := p.overhead(); overhead > 0.05 {
+			t.Errorf("%s: overhead %.3f exceeds 5%% budget", scheme, overhead)
+		}
+		if padded == 0 {
+			t.Errorf("%s: no record padded within budget", scheme)
+		}
+	}
+}
+
+// TestNegotiatePaddingBudget verifies the gateway caps the budget and fills in
+// the scheme default.
+func TestNegotiatePaddingBudget(t *testing.T) {
+	limits := NegotiationLimits{DefaultRecordPayload: 16384, MaxPaddingBudget: 20}
+
+	accepted := NegotiateOptions(Options{Padding: PaddingBucketed, PaddingBudget: 50}, limits)
+	if accepted.PaddingBudget != 20 {
+		t.Errorf("capped budget: got %d, want 20", accepted.PaddingBudget)
+	}
+	accepted = NegotiateOptions(Options{Padding: PaddingTLS}, limits)
+	if int(accepted.PaddingBudget) != PaddingTLS.DefaultBudget() {
+		t.Errorf("default budget: got %d, want %d", accepted.PaddingBudget, PaddingTLS.DefaultBudget())
+	}
+	limits.DisablePadding = true
+	accepted = NegotiateOptions(Options{Padding: PaddingRandom, PaddingBudget: 10}, limits)
+	if accepted.Padding != PaddingNone || accepted.PaddingBudget != 0 {
+		t.Errorf("disabled: got padding=%s budget=%d", accepted.Padding, accepted.PaddingBudget)
+	}
+}
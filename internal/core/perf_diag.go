@@ -31,6 +31,16 @@ var (
 
 	upBuildCount atomic.Uint64
 	upBuildNanos atomic.Uint64
+
+	// Compression: raw vs. on-wire payload bytes per direction.
+	upCompressRawBytes    atomic.Uint64
+	upCompressWireBytes   atomic.Uint64
+	downCompressWireBytes atomic.Uint64
+	downCompressRawBytes  atomic.Uint64
+
+	// Padding: on-wire payload vs. padding bytes of padded upstream records.
+	upPadPayloadBytes atomic.Uint64
+	upPaddingBytes    atomic.Uint64
 )
 
 type perfSnapshot struct {
@@ -48,6 +58,12 @@ type perfSnapshot struct {
 	upWriteNanos     uint64
 	upBuildCount     uint64
 	upBuildNanos     uint64
+	upCompressRawBytes    uint64
+	upCompressWireBytes   uint64
+	downCompressWireBytes uint64
+	downCompressRawBytes  uint64
+	upPadPayloadBytes     uint64
+	upPaddingBytes        uint64
 }
 
 func init() {
@@ -98,6 +114,12 @@ func currentPerfSnapshot() perfSnapshot {
 		upWriteNanos:     upWriteNanos.Load(),
 		upBuildCount:     upBuildCount.Load(),
 		upBuildNanos:     upBuildNanos.Load(),
+		upCompressRawBytes:    upCompressRawBytes.Load(),
+		upCompressWireBytes:   upCompressWireBytes.Load(),
+		downCompressWireBytes: downCompressWireBytes.Load(),
+		downCompressRawBytes:  downCompressRawBytes.Load(),
+		upPadPayloadBytes:     upPadPayloadBytes.Load(),
+		upPaddingBytes:        upPaddingBytes.Load(),
 	}
 }
 
@@ -117,6 +139,9 @@ func logPerfDelta(interval time.Duration, prev, cur perfSnapshot) {
 	upWriteNs := cur.upWriteNanos - prev.upWriteNanos
 	upBuildCalls := cur.upBuildCount - prev.upBuildCount
 	upBuildNs := cur.upBuildNanos - prev.upBuildNanos
+	upCompRatio := compressionRatio(cur.upCompressWireBytes-prev.upCompressWireBytes, cur.upCompressRawBytes-prev.upCompressRawBytes)
+	downCompRatio := compressionRatio(cur.downCompressWireBytes-prev.downCompressWireBytes, cur.downCompressRawBytes-prev.downCompressRawBytes)
+	upPadPct := paddingPercent(cur.upPaddingBytes-prev.upPaddingBytes, cur.upPadPayloadBytes-prev.upPadPayloadBytes)
 
 	intervalSec := interval.Seconds()
 	downMbps := float64(downBytes*8) / 1_000_000.0 / intervalSec
@@ -130,13 +155,29 @@ func logPerfDelta(interval time.Duration, prev, cur perfSnapshot) {
 	upBuildAvgUs := avgMicros(upBuildNs, upBuildCalls)
 
 	log.Printf(
-		"[PERF] window=%s down{mbps=%.2f rps=%d read_us=%.1f parse_us=%.1f dec_us=%.1f pull_gap_us=%.1f} up{mbps=%.2f wps=%d build_us=%.1f write_us=%.1f}",
+		"[PERF] window=%s down{mbps=%.2f rps=%d read_us=%.1f parse_us=%.1f dec_us=%.1f pull_gap_us=%.1f comp_ratio=%.3f} up{mbps=%.2f wps=%d build_us=%.1f write_us=%.1f comp_ratio=%.3f pad_pct=%.1f}",
 		interval,
-		downMbps, downReads, downReadAvgUs, downParseAvgUs, downDecAvgUs, downConsumerGapAvgUs,
-		upMbps, upWrites, upBuildAvgUs, upWriteAvgUs,
+		downMbps, downReads, downReadAvgUs, downParseAvgUs, downDecAvgUs, downConsumerGapAvgUs, downCompRatio,
+		upMbps, upWrites, upBuildAvgUs, upWriteAvgUs, upCompRatio, upPadPct,
 	)
 }
 
+// compressionRatio returns wire/raw bytes, or 1 when nothing was compressed.
+func compressionRatio(wire, raw uint64) float64 {
+	if raw == 0 {
+		return 1
+	}
+	return float64(wire) / float64(raw)
+}
+
+// paddingPercent returns padding as a percentage of payload bytes.
+func paddingPercent(padding, payload uint64) float64 {
+	if payload == 0 {
+		return 0
+	}
+	return float64(padding) * 100 / float64(payload)
+}
+
 func avgMicros(totalNs, calls uint64) float64 {
 	if calls == 0 {
 		return 0
@@ -196,3 +237,27 @@ func perfObserveUpWrite(bytes int, d time.Duration) {
 	upWriteBytes.Add(uint64(bytes))
 	upWriteNanos.Add(uint64(d.Nanoseconds()))
 }
+
+func perfObserveUpCompress(raw, wire int) {
+	if !perfDiagEnabled.Load() {
+		return
+	}
+	upCompressRawBytes.Add(uint64(raw))
+	upCompressWireBytes.Add(uint64(wire))
+}
+
+func perfObserveDownDecompress(wire, raw int) {
+	if !perfDiagEnabled.Load() {
+		return
+	}
+	downCompressWireBytes.Add(uint64(wire))
+	downCompressRawBytes.Add(uint64(raw))
+}
+
+func perfObserveUpPadding(payload, padding int) {
+	if !perfDiagEnabled.Load() {
+		return
+	}
+	upPadPayloadBytes.Add(uint64(payload))
+	upPaddingBytes.Add(uint64(padding))
+}
@@ -0,0 +1,93 @@
+package core
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Certificate pinning.
+//
+// A pin is the SHA-256 of the gateway's leaf certificate (DER) or of its
+// SubjectPublicKeyInfo, written as hex (colons allowed) or base64. Pins
+// replace CA validation, so self-signed gateways can be used without
+// AllowInsecure. Only the leaf is matched: without chain validation the other
+// presented certificates are not proven to belong to the gateway.
+
+// ErrPinMismatch is returned when the gateway's certificate matches no pin.
+var ErrPinMismatch = errors.New("certificate matches no pinned sha256")
+
+// CertificateFingerprints returns the hex SHA-256 of a DER certificate and of
+// its SubjectPublicKeyInfo, the two forms accepted as pins.
+func CertificateFingerprints(der []byte) (leaf, spki string, err error) {
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return "", "", err
+	}
+	leafSum := sha256.Sum256(der)
+	spkiSum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return hex.EncodeToString(leafSum[:]), hex.EncodeToString(spkiSum[:]), nil
+}
+
+// ParsePins decodes pinned SHA-256 values.
+func ParsePins(pins []string) ([][sha256.Size]byte, error) {
+	parsed := make([][sha256.Size]byte, 0, len(pins))
+	for i, pin := range pins {
+		pin = strings.TrimSpace(pin)
+		if pin == "" {
+			continue
+		}
+		sum, err := parsePin(pin)
+		if err != nil {
+			return nil, fmt.Errorf("pinned_sha256[%d]: %w", i, err)
+		}
+		parsed = append(parsed, sum)
+	}
+	return parsed, nil
+}
+
+func parsePin(pin string) ([sha256.Size]byte, error) {
+	var sum [sha256.Size]byte
+	var raw []byte
+	if h, err := hex.DecodeString(strings.ReplaceAll(pin, ":", "")); err == nil {
+		raw = h
+	} else if b, err := base64.StdEncoding.DecodeString(pin); err == nil {
+		raw = b
+	} else if b, err := base64.RawURLEncoding.DecodeString(pin); err == nil {
+		raw = b
+	} else {
+		return sum, errors.New("not hex or base64")
+	}
+	if len(raw) != sha256.Size {
+		return sum, fmt.Errorf("got %d bytes, want %d", len(raw), sha256.Size)
+	}
+	copy(sum[:], raw)
+	return sum, nil
+}
+
+// verifyPinnedCertificate returns a tls.Config.VerifyPeerCertificate hook
+// accepting a leaf whose certificate or SPKI hash is pinned.
+func verifyPinnedCertificate(pins [][sha256.Size]byte) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return errors.New("gateway presented no certificate")
+		}
+		cert, err := x509.ParseCertificate(rawCerts[0])
+		if err != nil {
+			return fmt.Errorf("parse gateway certificate: %w", err)
+		}
+		leafSum := sha256.Sum256(rawCerts[0])
+		spkiSum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		for _, pin := range pins {
+			if bytes.Equal(pin[:], leafSum[:]) || bytes.Equal(pin[:], spkiSum[:]) {
+				return nil
+			}
+		}
+		return fmt.Errorf("%w (leaf %x, spki %x)", ErrPinMismatch, leafSum, spkiSum)
+	}
+}
@@ -0,0 +1,78 @@
+package core
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+func selfSignedDER(t *testing.T) []byte {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "gateway.test"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("CreateCertificate: %v", err)
+	}
+	return der
+}
+
+// TestPinnedCertificate verifies leaf and SPKI pins in hex, colon-separated
+// hex and base64 accept the gateway's certificate and reject others.
+func TestPinnedCertificate(t *testing.T) {
+	der := selfSignedDER(t)
+	leaf, spki, err := CertificateFingerprints(der)
+	if err != nil {
+		t.Fatalf("CertificateFingerprints: %v", err)
+	}
+	spkiRaw, _ := hex.DecodeString(spki)
+
+	var colonLeaf []string
+	for i := 0; i < len(leaf); i += 2 {
+		colonLeaf = append(colonLeaf, strings.ToUpper(leaf[i:i+2]))
+	}
+	for name, pin := range map[string]string{
+		"leaf hex":    leaf,
+		"leaf colons": strings.Join(colonLeaf, ":"),
+		"spki base64": base64.StdEncoding.EncodeToString(spkiRaw),
+	} {
+		pins, err := ParsePins([]string{pin})
+		if err != nil {
+			t.Fatalf("%s: ParsePins: %v", name, err)
+		}
+		if err := verifyPinnedCertificate(pins)([][]byte{der}, nil); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+
+	other := sha256.Sum256([]byte("other"))
+	pins, err := ParsePins([]string{hex.EncodeToString(other[:])})
+	if err != nil {
+		t.Fatalf("ParsePins: %v", err)
+	}
+	if err := verifyPinnedCertificate(pins)([][]byte{der}, nil); !errors.Is(err, ErrPinMismatch) {
+		t.Errorf("unpinned certificate: got %v, want ErrPinMismatch", err)
+	}
+
+	if _, err := ParsePins([]string{"abcd"}); err == nil {
+		t.Error("short pin accepted")
+	}
+}
@@ -0,0 +1,361 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	webtransport "github.com/quic-go/webtransport-go"
+)
+
+// In-memory transport.
+//
+// A PipeTransport connects Core to a gateway in the same process without
+// sockets: every Dial creates a pair of PipeSessions, returns the client end
+// and hands the gateway end to Accept. Streams buffer up to pipeWindow bytes
+// per direction and support half-close and deadlines; a datagram is dropped
+// when the peer's queue is full, as on a network.
+const (
+	// TransportPipe names the in-memory transport.
+	TransportPipe = "pipe"
+
+	pipeWindow        = 1 << 20
+	pipeStreamQueue   = 64
+	pipeDatagramQueue = 256
+	pipeBindingLength = 32
+)
+
+var errPipeStreamCanceled = errors.New("pipe stream canceled by peer")
+
+// PipeTransport dials in-memory sessions to a gateway calling Accept.
+type PipeTransport struct {
+	protocol  string
+	sessions  chan *PipeSession
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewPipeTransport creates a transport whose sessions use protocol, or the
+// newest supported wire version if protocol is "".
+func NewPipeTransport(protocol string) *PipeTransport {
+	if protocol == "" {
+		protocol = SupportedProtocols()[0]
+	}
+	return &PipeTransport{
+		protocol: protocol,
+		sessions: make(chan *PipeSession),
+		done:     make(chan struct{}),
+	}
+}
+
+// Dial creates a session and waits until the gateway accepts it.
+func (t *PipeTransport) Dial(ctx context.Context) (Session, error) {
+	client, gateway, err := newPipeSessionPair(t.protocol)
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case t.sessions <- gateway:
+		return client, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-t.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Accept returns the gateway end of the next dialed session.
+func (t *PipeTransport) Accept(ctx context.Context) (*PipeSession, error) {
+	select {
+	case s := <-t.sessions:
+		return s, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-t.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops Dial and Accept; established sessions stay open.
+func (t *PipeTransport) Close() error {
+	t.closeOnce.Do(func() { close(t.done) })
+	return nil
+}
+
+// PipeSession is one end of an in-memory session. Either end can open
+// streams, which the other end accepts.
+type PipeSession struct {
+	peer      *PipeSession
+	protocol  string
+	binding   []byte
+	local     pipeAddr
+	streams   chan *PipeStream
+	datagrams chan []byte
+	ctx       context.Context // shared by both ends
+	cancel    context.CancelFunc
+}
+
+func newPipeSessionPair(protocol string) (client, gateway *PipeSession, err error) {
+	binding := make([]byte, pipeBindingLength)
+	if _, err := rand.Read(binding); err != nil {
+		return nil, nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	newEnd := func(name string) *PipeSession {
+		return &PipeSession{
+			protocol:  protocol,
+			binding:   binding,
+			local:     pipeAddr(name),
+			streams:   make(chan *PipeStream, pipeStreamQueue),
+			datagrams: make(chan []byte, pipeDatagramQueue),
+			ctx:       ctx,
+			cancel:    cancel,
+		}
+	}
+	client, gateway = newEnd("pipe-client"), newEnd("pipe-gateway")
+	client.peer, gateway.peer = gateway, client
+	return client, gateway, nil
+}
+
+// OpenStream opens a stream the peer receives from AcceptStream.
+func (s *PipeSession) OpenStream(ctx context.Context) (Stream, error) {
+	if s.ctx.Err() != nil {
+		return nil, net.ErrClosed
+	}
+	local, remote := newPipeStreamPair(s.ctx.Done())
+	select {
+	case s.peer.streams <- remote:
+		return local, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-s.ctx.Done():
+		return nil, net.ErrClosed
+	}
+}
+
+// AcceptStream returns the next stream opened by the peer.
+func (s *PipeSession) AcceptStream(ctx context.Context) (*PipeStream, error) {
+	select {
+	case stream := <-s.streams:
+		return stream, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-s.ctx.Done():
+		return nil, net.ErrClosed
+	}
+}
+
+// SendDatagram queues a copy of b for the peer, dropping it if the queue is
+// full.
+func (s *PipeSession) SendDatagram(b []byte) error {
+	select {
+	case <-s.ctx.Done():
+		return net.ErrClosed
+	default:
+	}
+	select {
+	case s.peer.datagrams <- bytes.Clone(b):
+	default:
+	}
+	return nil
+}
+
+func (s *PipeSession) ReceiveDatagram(ctx context.Context) ([]byte, error) {
+	select {
+	case b := <-s.datagrams:
+		return b, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-s.ctx.Done():
+		return nil, net.ErrClosed
+	}
+}
+
+// Context is done once either end closed the session.
+func (s *PipeSession) Context() context.Context { return s.ctx }
+
+// Close ends the session for both ends; reads and writes on its streams
+// fail with net.ErrClosed, discarding buffered data.
+func (s *PipeSession) Close(string) error {
+	s.cancel()
+	return nil
+}
+
+func (s *PipeSession) LocalAddr() net.Addr  { return s.local }
+func (s *PipeSession) RemoteAddr() net.Addr { return s.peer.local }
+
+func (s *PipeSession) Protocol() string { return s.protocol }
+
+// Binding returns random keying material shared by both ends.
+func (s *PipeSession) Binding() ([]byte, error) { return s.binding, nil }
+
+func (s *PipeSession) Transport() string { return TransportPipe }
+
+type pipeAddr string
+
+func (a pipeAddr) Network() string { return TransportPipe }
+func (a pipeAddr) String() string  { return string(a) }
+
+// PipeStream is one end of an in-memory stream.
+type PipeStream struct {
+	in, out       *pipeBuffer
+	done          <-chan struct{}
+	readDeadline  streamDeadline
+	writeDeadline streamDeadline
+}
+
+func newPipeStreamPair(done <-chan struct{}) (*PipeStream, *PipeStream) {
+	ab, ba := newPipeBuffer(), newPipeBuffer()
+	a := &PipeStream{in: ba, out: ab, done: done, readDeadline: makeStreamDeadline(), writeDeadline: makeStreamDeadline()}
+	b := &PipeStream{in: ab, out: ba, done: done, readDeadline: makeStreamDeadline(), writeDeadline: makeStreamDeadline()}
+	return a, b
+}
+
+func (s *PipeStream) Read(p []byte) (int, error) {
+	return s.in.read(p, &s.readDeadline, s.done)
+}
+
+func (s *PipeStream) Write(p []byte) (int, error) {
+	return s.out.write(p, &s.writeDeadline, s.done)
+}
+
+// Close ends the sending side; the peer reads io.EOF once it drained it.
+func (s *PipeStream) Close() error {
+	s.out.closeWrite()
+	return nil
+}
+
+// CancelRead discards unread data; the peer's writes fail from now on.
+func (s *PipeStream) CancelRead(code webtransport.StreamErrorCode) {
+	s.in.cancel(fmt.Errorf("%w (code %d)", errPipeStreamCanceled, code))
+}
+
+func (s *PipeStream) SetDeadline(t time.Time) error {
+	s.readDeadline.set(t)
+	s.writeDeadline.set(t)
+	return nil
+}
+
+func (s *PipeStream) SetReadDeadline(t time.Time) error {
+	s.readDeadline.set(t)
+	return nil
+}
+
+func (s *PipeStream) SetWriteDeadline(t time.Time) error {
+	s.writeDeadline.set(t)
+	return nil
+}
+
+// pipeBuffer is one direction of a PipeStream, bounded by pipeWindow.
+type pipeBuffer struct {
+	mu       sync.Mutex
+	buf      bytes.Buffer
+	eof      bool          // the writer closed
+	err      error         // the reader canceled
+	readable chan struct{} // signaled on data, EOF or cancel
+	writable chan struct{} // signaled when room frees up or on cancel
+}
+
+func newPipeBuffer() *pipeBuffer {
+	return &pipeBuffer{readable: make(chan struct{}, 1), writable: make(chan struct{}, 1)}
+}
+
+func pipeSignal(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
+
+func (b *pipeBuffer) read(p []byte, deadline *streamDeadline, done <-chan struct{}) (int, error) {
+	for {
+		if isClosedChan(done) {
+			return 0, net.ErrClosed
+		}
+		b.mu.Lock()
+		switch {
+		case b.err != nil:
+			b.mu.Unlock()
+			return 0, b.err
+		case b.buf.Len() > 0:
+			n, _ := b.buf.Read(p)
+			b.mu.Unlock()
+			pipeSignal(b.writable)
+			return n, nil
+		case b.eof:
+			b.mu.Unlock()
+			return 0, io.EOF
+		}
+		b.mu.Unlock()
+
+		select {
+		case <-b.readable:
+		case <-deadline.wait():
+			return 0, os.ErrDeadlineExceeded
+		case <-done:
+			return 0, net.ErrClosed
+		}
+	}
+}
+
+func (b *pipeBuffer) write(p []byte, deadline *streamDeadline, done <-chan struct{}) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		if isClosedChan(done) {
+			return n, net.ErrClosed
+		}
+		b.mu.Lock()
+		switch {
+		case b.err != nil:
+			b.mu.Unlock()
+			return n, b.err
+		case b.eof:
+			b.mu.Unlock()
+			return n, io.ErrClosedPipe
+		}
+		if room := pipeWindow - b.buf.Len(); room > 0 {
+			chunk := min(room, len(p))
+			b.buf.Write(p[:chunk])
+			b.mu.Unlock()
+			pipeSignal(b.readable)
+			p = p[chunk:]
+			n += chunk
+			continue
+		}
+		b.mu.Unlock()
+
+		select {
+		case <-b.writable:
+		case <-deadline.wait():
+			return n, os.ErrDeadlineExceeded
+		case <-done:
+			return n, net.ErrClosed
+		}
+	}
+	return n, nil
+}
+
+func (b *pipeBuffer) closeWrite() {
+	b.mu.Lock()
+	b.eof = true
+	b.mu.Unlock()
+	pipeSignal(b.readable)
+}
+
+func (b *pipeBuffer) cancel(err error) {
+	b.mu.Lock()
+	if b.err == nil {
+		b.err = err
+	}
+	b.buf.Reset()
+	b.mu.Unlock()
+	pipeSignal(b.readable)
+	pipeSignal(b.writable)
+}
@@ -0,0 +1,244 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// TestPipeStream verifies echo, half-close, deadlines, read cancellation,
+// datagrams and session close on a pipe session.
+func TestPipeStream(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	tr := NewPipeTransport("")
+	defer tr.Close()
+
+	accepted := make(chan *PipeSession, 1)
+	go func() {
+		s, err := tr.Accept(ctx)
+		if err == nil {
+			accepted <- s
+		}
+	}()
+	client, err := tr.Dial(ctx)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	gateway := <-accepted
+	if client.Protocol() != SupportedProtocols()[0] || client.Transport() != TransportPipe {
+		t.Errorf("got protocol %q transport %q", client.Protocol(), client.Transport())
+	}
+	cb, _ := client.Binding()
+	gb, _ := gateway.Binding()
+	if len(cb) != pipeBindingLength || string(cb) != string(gb) {
+		t.Error("ends do not share a binding")
+	}
+
+	stream, err := client.OpenStream(ctx)
+	if err != nil {
+		t.Fatalf("OpenStream: %v", err)
+	}
+	peer, err := gateway.AcceptStream(ctx)
+	if err != nil {
+		t.Fatalf("AcceptStream: %v", err)
+	}
+	if _, err := stream.Write([]byte("ping")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(peer, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("read: got %q %v", buf, err)
+	}
+	// Half-close: the peer reads EOF but can still answer.
+	stream.Close()
+	if _, err := peer.Read(buf); err != io.EOF {
+		t.Errorf("after half-close: got %v, want EOF", err)
+	}
+	if _, err := peer.Write([]byte("pong")); err != nil {
+		t.Fatalf("Write after peer half-close: %v", err)
+	}
+	if _, err := io.ReadFull(stream, buf); err != nil || string(buf) != "pong" {
+		t.Fatalf("read: got %q %v", buf, err)
+	}
+
+	_ = stream.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	if _, err := stream.Read(buf); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("read past deadline: got %v", err)
+	}
+	stream.(*PipeStream).CancelRead(1)
+	if _, err := peer.Write([]byte("x")); !errors.Is(err, errPipeStreamCanceled) {
+		t.Errorf("write after CancelRead: got %v", err)
+	}
+
+	if err := client.SendDatagram([]byte("dgram")); err != nil {
+		t.Fatalf("SendDatagram: %v", err)
+	}
+	if b, err := gateway.ReceiveDatagram(ctx); err != nil || string(b) != "dgram" {
+		t.Errorf("ReceiveDatagram: got %q %v", b, err)
+	}
+
+	gateway.Close("done")
+	if _, err := client.OpenStream(ctx); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("OpenStream after close: got %v", err)
+	}
+	if _, err := peer.Read(buf); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Read after close: got %v", err)
+	}
+}
+
+// TestPipeTransportCore runs Core against an echo gateway in memory: a
+// proxied SOCKS5 connection is echoed and a blocked one is refused.
+func TestPipeTransportCore(t *testing.T) {
+	const psk = "pipe-test-psk"
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	tr := NewPipeTransport("")
+	defer tr.Close()
+	go pipeEchoGateway(ctx, tr, psk)
+
+	c := New()
+	c.SetTransport(tr)
+	err := c.Start(SessionConfig{
+		URL:           "https://pipe.test/v1/api/sync",
+		PSK:           psk,
+		ListenAddr:    "127.0.0.1:0",
+		HttpProxyAddr: "127.0.0.1:0",
+	})
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer c.Close()
+	if err := c.UpdateRules([]*Rule{{
+		ID:      "block",
+		Name:    "Block test domain",
+		Enabled: true,
+		Action:  ActionBlock,
+		Matches: []MatchCondition{{Type: MatchDomain, Value: "blocked.test"}},
+	}}); err != nil {
+		t.Fatalf("UpdateRules: %v", err)
+	}
+	socksAddr := c.socksServer.listener.Addr().String()
+
+	conn, reply := socks5Connect(t, socksAddr, "echo.test")
+	defer conn.Close()
+	if reply != socks5RepSuccess {
+		t.Fatalf("CONNECT echo.test: reply %#x", reply)
+	}
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	buf := make([]byte, 5)
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("echo: got %q %v", buf, err)
+	}
+
+	blocked, reply := socks5Connect(t, socksAddr, "blocked.test")
+	blocked.Close()
+	if reply == socks5RepSuccess {
+		t.Error("blocked domain was proxied")
+	}
+}
+
+// socks5Connect sends a CONNECT to host:80 and returns the reply code.
+func socks5Connect(t *testing.T, addr, host string) (net.Conn, byte) {
+	t.Helper()
+	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		t.Fatalf("dial SOCKS5: %v", err)
+	}
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	defer conn.SetDeadline(time.Time{})
+	request := []byte{socks5Version, 1, 0, socks5Version, socks5CmdConnect, 0, 3, byte(len(host))}
+	request = append(append(request, host...), 0, 80)
+	if _, err := conn.Write(request); err != nil {
+		t.Fatalf("SOCKS5 request: %v", err)
+	}
+	reply := make([]byte, 12) // method selection + IPv4 reply
+	if _, err := io.ReadFull(conn, reply[:2]); err != nil {
+		t.Fatalf("SOCKS5 greeting: %v", err)
+	}
+	if _, err := io.ReadFull(conn, reply[2:]); err != nil {
+		t.Fatalf("SOCKS5 reply: %v", err)
+	}
+	return conn, reply[3]
+}
+
+// pipeEchoGateway answers pings and echoes proxied streams like a gateway
+// whose targets echo their input.
+func pipeEchoGateway(ctx context.Context, tr *PipeTransport, psk string) {
+	for {
+		session, err := tr.Accept(ctx)
+		if err != nil {
+			return
+		}
+		ng, err := NewNonceGenerator()
+		if err != nil {
+			return
+		}
+		go func() {
+			for {
+				stream, err := session.AcceptStream(ctx)
+				if err != nil {
+					return
+				}
+				go pipeEchoStream(stream, psk, ng)
+			}
+		}()
+	}
+}
+
+func pipeEchoStream(stream *PipeStream, psk string, ng *NonceGenerator) {
+	defer stream.Close()
+	reader := NewRecordReader(stream)
+	record, err := reader.ReadNextRecord()
+	if err != nil {
+		return
+	}
+	if record.Type == TypePing {
+		if pong, err := BuildPongRecord(ng); err == nil {
+			_, _ = stream.Write(pong)
+		}
+		return
+	}
+	meta, err := DecryptMetadata(record, psk)
+	if err != nil {
+		stream.CancelRead(0)
+		return
+	}
+	accepted := NegotiateOptions(meta.Options, NegotiationLimits{})
+	remote := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: int(meta.Port)}
+	reply, err := BuildAcceptRecord(accepted, remote, record.Header, psk, ng)
+	if err != nil {
+		return
+	}
+	if _, err := stream.Write(reply); err != nil {
+		return
+	}
+
+	encoder := NewDataRecordEncoder(accepted, nil)
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := reader.Read(buf)
+		if n > 0 {
+			data, bErr := encoder.Build(buf[:n], ng)
+			if bErr != nil {
+				return
+			}
+			if _, wErr := stream.Write(data); wErr != nil {
+				return
+			}
+		}
+		if err != nil {
+			if fin, fErr := BuildFinRecord(ng); fErr == nil {
+				_, _ = stream.Write(fin)
+			}
+			return
+		}
+	}
+}
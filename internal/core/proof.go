@@ -0,0 +1,112 @@
+package core
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"errors"
+	"fmt"
+)
+
+// Server proof.
+//
+// With a self-signed certificate and AllowInsecure the TLS handshake does not
+// authenticate the gateway. Before sending any metadata the client therefore
+// asks the gateway to prove it knows the PSK on this very TLS connection:
+//
+//	Request: Header(Type=TypeServerProof) || AES-GCM(ClientNonce(32B)) || Padding(KeyHint...)
+//	Reply:   Header(Type=TypeServerProof) || AES-GCM(Proof(32B)) || Padding, AAD = Header || ClientNonce
+//	Proof  = HMAC-SHA256(HKDF(PSK, "server-proof"), ClientNonce || TLSExporter)
+//
+// Records are sealed like key exchange records. TLSExporter is keying
+// material exported from the TLS session, which differs on both legs of a
+// man-in-the-middle, so a relayed proof fails.
+const (
+	serverProofLabel         = "server-proof"
+	serverProofExporterLabel = "EXPORTER-" + ProtocolLabel + " server-proof"
+	serverProofNonceLength   = 32
+	serverProofLength        = sha256.Size
+	serverProofBindingLength = 32
+)
+
+// ErrServerProof is returned when the gateway fails to prove the PSK.
+var ErrServerProof = errors.New("server proof failed")
+
+// TLSBinding exports the keying material that binds a server proof to the
+// TLS connection described by state.
+func TLSBinding(state tls.ConnectionState) ([]byte, error) {
+	return state.ExportKeyingMaterial(serverProofExporterLabel, nil, serverProofBindingLength)
+}
+
+// ServerProofChallenge is the client side of one server proof.
+type ServerProofChallenge struct {
+	psk     string
+	nonce   []byte
+	binding []byte
+}
+
+// NewServerProofChallenge creates a fresh client nonce for psk on the TLS
+// connection identified by binding (see TLSBinding).
+func NewServerProofChallenge(psk string, binding []byte) (*ServerProofChallenge, error) {
+	nonce := make([]byte, serverProofNonceLength)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return &ServerProofChallenge{psk: psk, nonce: nonce, binding: binding}, nil
+}
+
+// BuildRequest builds the client's server proof request record.
+func (c *ServerProofChallenge) BuildRequest(ng *NonceGenerator) ([]byte, error) {
+	return buildSealedControlRecord(TypeServerProof, c.psk, c.nonce, nil, true, ng)
+}
+
+// Verify checks the gateway's reply against the expected proof.
+func (c *ServerProofChallenge) Verify(reply *Record) error {
+	proof, err := openSealedControlRecord(reply, TypeServerProof, c.psk, c.nonce)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrServerProof, err)
+	}
+	want, err := serverProof(c.psk, c.nonce, c.binding)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(proof, want) {
+		return fmt.Errorf("%w: proof does not match this TLS connection", ErrServerProof)
+	}
+	return nil
+}
+
+// ParseServerProofRequest authenticates a client's server proof request with
+// psk and returns the client nonce.
+func ParseServerProofRequest(record *Record, psk string) ([]byte, error) {
+	nonce, err := openSealedControlRecord(record, TypeServerProof, psk, nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrServerProof, err)
+	}
+	if len(nonce) != serverProofNonceLength {
+		return nil, fmt.Errorf("%w: invalid nonce length %d", ErrServerProof, len(nonce))
+	}
+	return nonce, nil
+}
+
+// BuildServerProofReply answers a client nonce on the TLS connection
+// identified by binding.
+func BuildServerProofReply(nonce []byte, psk string, binding []byte, ng *NonceGenerator) ([]byte, error) {
+	proof, err := serverProof(psk, nonce, binding)
+	if err != nil {
+		return nil, err
+	}
+	return buildSealedControlRecord(TypeServerProof, psk, proof, nonce, false, ng)
+}
+
+func serverProof(psk string, nonce, binding []byte) ([]byte, error) {
+	key, err := deriveKey(psk, []byte(serverProofLabel))
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(nonce)
+	mac.Write(binding)
+	return mac.Sum(nil), nil
+}
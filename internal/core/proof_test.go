@@ -0,0 +1,66 @@
+package core
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func serverProofReply(t *testing.T, psk string, request []byte, binding []byte) *Record {
+	t.Helper()
+	ng, err := NewNonceGenerator()
+	if err != nil {
+		t.Fatalf("NewNonceGenerator: %v", err)
+	}
+	nonce, err := ParseServerProofRequest(readRecord(t, request), psk)
+	if err != nil {
+		t.Fatalf("ParseServerProofRequest: %v", err)
+	}
+	reply, err := BuildServerProofReply(nonce, psk, binding, ng)
+	if err != nil {
+		t.Fatalf("BuildServerProofReply: %v", err)
+	}
+	return readRecord(t, reply)
+}
+
+// TestServerProof verifies the gateway's proof is accepted on the same TLS
+// binding and rejected when relayed across connections or made without the PSK.
+func TestServerProof(t *testing.T) {
+	ng, err := NewNonceGenerator()
+	if err != nil {
+		t.Fatalf("NewNonceGenerator: %v", err)
+	}
+	binding := bytes.Repeat([]byte{1}, serverProofBindingLength)
+	challenge, err := NewServerProofChallenge("psk", binding)
+	if err != nil {
+		t.Fatalf("NewServerProofChallenge: %v", err)
+	}
+	request, err := challenge.BuildRequest(ng)
+	if err != nil {
+		t.Fatalf("BuildRequest: %v", err)
+	}
+	if hint, seed, ok := RecordKeyHint(readRecord(t, request)); !ok || hint != KeyHintFor("psk", seed) {
+		t.Errorf("request hint: got %x ok=%v", hint, ok)
+	}
+
+	if err := challenge.Verify(serverProofReply(t, "psk", request, binding)); err != nil {
+		t.Errorf("Verify: %v", err)
+	}
+
+	// A man-in-the-middle relays the request over its own TLS connection.
+	relayed := bytes.Repeat([]byte{2}, serverProofBindingLength)
+	if err := challenge.Verify(serverProofReply(t, "psk", request, relayed)); !errors.Is(err, ErrServerProof) {
+		t.Errorf("relayed proof: got %v, want ErrServerProof", err)
+	}
+
+	if _, err := ParseServerProofRequest(readRecord(t, request), "other"); !errors.Is(err, ErrServerProof) {
+		t.Errorf("wrong psk request: got %v, want ErrServerProof", err)
+	}
+	forged, err := BuildServerProofReply(challenge.nonce, "other", binding, ng)
+	if err != nil {
+		t.Fatalf("BuildServerProofReply: %v", err)
+	}
+	if err := challenge.Verify(readRecord(t, forged)); !errors.Is(err, ErrServerProof) {
+		t.Errorf("wrong psk reply: got %v, want ErrServerProof", err)
+	}
+}
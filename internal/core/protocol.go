@@ -29,9 +29,18 @@ const (
 	TypeData           = 0x02
 	TypePing           = 0x03
 	TypePong           = 0x04
+	TypeDatagram       = 0x05
+	TypeFin            = 0x06
+	TypeRekey          = 0x07
+	TypeAccept         = 0x08
+	TypeDataCompressed = 0x09
+	TypeKeyExchange    = 0x0a
+	TypeServerProof    = 0x0b
 	TypeError          = 0x7f
 	MaxRecordSize      = 1 * 1024 * 1024
 	MaxCounterValue    = uint64(1 << 32) // 2^32 rekey threshold
+	// DefaultRekeyThreshold triggers a proactive rekey well before exhaustion.
+	DefaultRekeyThreshold = MaxCounterValue / 4 * 3
 	// DefaultMaxRecordPayload is the default data record chunk size.
 	DefaultMaxRecordPayload = 16 * 1024
 )
@@ -95,9 +104,11 @@ func GetBuffer() []byte {
 	return buf[:0] // Reset length while keeping capacity
 }
 
-// PutBuffer returns a buffer to the pool.
+// PutBuffer returns a buffer to the pool. Buffers whose capacity no longer
+// matches the pool size (grown for a large record, or allocated outside the
+// pool) are left to the GC so the pool does not fill with oversized buffers.
 func PutBuffer(buf []byte) {
-	if cap(buf) < GetPoolBufferSize() {
+	if cap(buf) != GetPoolBufferSize() {
 		return // Protection against resizing
 	}
 	recordPool.Put(buf[:0])
@@ -130,7 +141,27 @@ type Metadata struct {
 // Options represents the connection options
 type Options struct {
 	MaxPadding uint16
-}
+	// DataAEAD requests AES-GCM protection for data records in both directions.
+	DataAEAD bool
+	// RecordPayload is the per-stream data record payload size (0 = peer default).
+	RecordPayload uint32
+	// Padding is the data record padding scheme.
+	Padding PaddingScheme
+	// PaddingBudget caps padding overhead in percent of payload (0 = scheme default).
+	PaddingBudget uint8
+	// Compression is the data record compression algorithm.
+	Compression Compression
+}
+
+// Option TLV types carried in the metadata Options field.
+const (
+	optionMaxPadding    = 0x01
+	optionDataAEAD      = 0x02
+	optionRecordPayload = 0x03
+	optionPadding       = 0x04
+	optionCompression   = 0x05
+	optionPaddingBudget = 0x06
+)
 
 // Record represents a parsed record
 type Record struct {
@@ -140,55 +171,88 @@ type Record struct {
 	PayloadLength uint32
 	PaddingLength uint32
 	Payload       []byte
+	Padding       []byte
 	Header        []byte
 	SessionID     []byte
 	Counter       uint64
+	ErrorCode     ErrorCode // Error records only
 	ErrorMessage  string
 	RawBuffer     []byte // Original pooled buffer for later release
 }
 
 // NonceGenerator generates unique nonces using SessionID + monotonic counter.
+// Keys are derived from the SessionID carried in each header, so rolling to a
+// fresh SessionID (Rekey) starts a new key epoch without a new session.
 type NonceGenerator struct {
+	current atomic.Pointer[nonceEpoch]
+}
+
+// nonceEpoch is one SessionID and its counter.
+type nonceEpoch struct {
 	sessionID [4]byte
 	counter   atomic.Uint64
+	epoch     uint32
 }
 
 // NewNonceGenerator creates a new NonceGenerator with a random SessionID.
 func NewNonceGenerator() (*NonceGenerator, error) {
-	ng := &NonceGenerator{}
-	if _, err := rand.Read(ng.sessionID[:]); err != nil {
+	e := &nonceEpoch{}
+	if _, err := rand.Read(e.sessionID[:]); err != nil {
 		return nil, err
 	}
+	ng := &NonceGenerator{}
+	ng.current.Store(e)
 	return ng, nil
 }
 
 // Next returns the next nonce (12 bytes) and the current counter value.
 // Returns ErrCounterExhausted if the counter reaches MaxCounterValue.
 func (ng *NonceGenerator) Next() ([12]byte, uint64, error) {
+	e := ng.current.Load()
 	for {
-		current := ng.counter.Load()
+		current := e.counter.Load()
 		if current >= MaxCounterValue {
 			return [12]byte{}, 0, ErrCounterExhausted
 		}
-		if !ng.counter.CompareAndSwap(current, current+1) {
+		if !e.counter.CompareAndSwap(current, current+1) {
 			continue
 		}
 
 		var nonce [12]byte
-		copy(nonce[0:4], ng.sessionID[:])
+		copy(nonce[0:4], e.sessionID[:])
 		binary.BigEndian.PutUint64(nonce[4:12], current)
 		return nonce, current, nil
 	}
 }
 
+// Rekey rolls to a fresh random SessionID with the counter reset to zero.
+// Nonces already handed out stay unique because the SessionID changes.
+func (ng *NonceGenerator) Rekey() error {
+	old := ng.current.Load()
+	e := &nonceEpoch{epoch: old.epoch + 1}
+	for e.sessionID == [4]byte{} || e.sessionID == old.sessionID {
+		if _, err := rand.Read(e.sessionID[:]); err != nil {
+			return err
+		}
+	}
+	// A concurrent Rekey that won the race already rolled the epoch.
+	ng.current.CompareAndSwap(old, e)
+	return nil
+}
+
 // SessionID returns the session ID.
 func (ng *NonceGenerator) SessionID() [4]byte {
-	return ng.sessionID
+	return ng.current.Load().sessionID
 }
 
 // Counter returns the current counter value (for monitoring).
 func (ng *NonceGenerator) Counter() uint64 {
-	return ng.counter.Load()
+	return ng.current.Load().counter.Load()
+}
+
+// Epoch returns the number of rekeys performed.
+func (ng *NonceGenerator) Epoch() uint32 {
+	return ng.current.Load().epoch
 }
 
 const (
@@ -201,7 +265,13 @@ const (
 // BuildMetadataRecord creates an encrypted metadata record.
 // V5: Requires NonceGenerator for counter-based nonce.
 func BuildMetadataRecord(host string, port uint16, maxPadding uint16, psk string, ng *NonceGenerator) ([]byte, error) {
-	plaintext, err := buildMetadataPayload(host, port, maxPadding)
+	return BuildMetadataRecordWithOptions(host, port, Options{MaxPadding: maxPadding}, psk, ng)
+}
+
+// BuildMetadataRecordWithOptions creates an encrypted metadata record carrying
+// the full Options TLV set.
+func BuildMetadataRecordWithOptions(host string, port uint16, opts Options, psk string, ng *NonceGenerator) ([]byte, error) {
+	plaintext, err := buildMetadataPayload(host, port, opts)
 	if err != nil {
 		return nil, err
 	}
@@ -238,6 +308,9 @@ func BuildMetadataRecord(host string, port uint16, maxPadding uint16, psk string
 	if _, err := rand.Read(padding); err != nil {
 		return nil, err
 	}
+	// Multi-user gateways select our PSK by the key hint (see users.go).
+	hint := KeyHintFor(psk, nonce[:])
+	copy(padding, hint[:])
 	header, err := buildHeader(TypeMetadata, ciphertextLen, paddingLen, sessionID, counter)
 	if err != nil {
 		return nil, err
@@ -249,13 +322,16 @@ func BuildMetadataRecord(host string, port uint16, maxPadding uint16, psk string
 	return buildRecord(header, ciphertext, padding), nil
 }
 
-// BuildDataRecord creates a data record with optional padding using pooled buffers.
-// V5.1: Automatically forces padding to 0 for TypeData to maximize throughput.
+// BuildDataRecord creates an unpadded data record using pooled buffers.
+// V5.1: Padding is applied per stream by DataRecordEncoder (see padding.go).
 // V5: Requires NonceGenerator for counter-based nonce.
 func BuildDataRecord(payload []byte, _ uint16, ng *NonceGenerator) ([]byte, error) {
-	// V5.1 Optimization: Data records MUST NOT have padding.
-	const paddingLength = 0
-	
+	return buildDataRecord(TypeData, payload, 0, ng)
+}
+
+// buildDataRecord builds an unsealed data-phase record of recordType followed
+// by paddingLength zero bytes.
+func buildDataRecord(recordType byte, payload []byte, paddingLength int, ng *NonceGenerator) ([]byte, error) {
 	// V5.1: Get nonce from generator
 	nonce, counter, err := ng.Next()
 	if err != nil {
@@ -263,7 +339,7 @@ func BuildDataRecord(payload []byte, _ uint16, ng *NonceGenerator) ([]byte, erro
 	}
 	sessionID := nonce[0:4]
 
-	totalLength := RecordHeaderLength + len(payload)
+	totalLength := RecordHeaderLength + len(payload) + paddingLength
 	// Use pool for data records which are the bulk of traffic
 	buf := GetBuffer()
 	
@@ -276,11 +352,12 @@ func BuildDataRecord(payload []byte, _ uint16, ng *NonceGenerator) ([]byte, erro
 
 	binary.BigEndian.PutUint32(buf[0:4], uint32(totalLength))
 	// Zero-alloc: build header directly into pool buffer
-	if err := buildHeaderInto(buf[4:4+RecordHeaderLength], TypeData, len(payload), paddingLength, sessionID, counter); err != nil {
+	if err := buildHeaderInto(buf[4:4+RecordHeaderLength], recordType, len(payload), paddingLength, sessionID, counter); err != nil {
 		PutBuffer(buf)
 		return nil, err
 	}
 	copy(buf[4+RecordHeaderLength:], payload)
+	clear(buf[4+RecordHeaderLength+len(payload):])
 	
 	return buf, nil
 }
@@ -297,6 +374,12 @@ func BuildPongRecord(ng *NonceGenerator) ([]byte, error) {
 	return buildControlRecord(TypePong, ng)
 }
 
+// BuildFinRecord creates a FIN record, signalling that the sender will write
+// no more data on the stream while still reading (TCP half-close).
+func BuildFinRecord(ng *NonceGenerator) ([]byte, error) {
+	return buildControlRecord(TypeFin, ng)
+}
+
 // buildRecord assembles a complete record.
 func buildRecord(header, payload, padding []byte) []byte {
 	totalLength := RecordHeaderLength + len(payload) + len(padding)
@@ -357,7 +440,26 @@ func buildControlRecord(recordType byte, ng *NonceGenerator) ([]byte, error) {
 }
 
 // buildMetadataPayload creates the plaintext metadata.
-func buildMetadataPayload(host string, port uint16, maxPadding uint16) ([]byte, error) {
+func buildMetadataPayload(host string, port uint16, opts Options) ([]byte, error) {
+	address, err := encodeAddress(host, port)
+	if err != nil {
+		return nil, err
+	}
+
+	options := buildOptions(opts)
+	payload := make([]byte, 0, len(address)+2+len(options))
+	payload = append(payload, address...)
+
+	optionsLen := make([]byte, 2)
+	binary.BigEndian.PutUint16(optionsLen, uint16(len(options)))
+	payload = append(payload, optionsLen...)
+	payload = append(payload, options...)
+	return payload, nil
+}
+
+// encodeAddress encodes AddrType(1) || Port(2) || Address, shared by metadata
+// and datagram payloads.
+func encodeAddress(host string, port uint16) ([]byte, error) {
 	var addrType byte
 	var addrBytes []byte
 
@@ -377,32 +479,42 @@ func buildMetadataPayload(host string, port uint16, maxPadding uint16) ([]byte,
 		addrBytes = append([]byte{byte(len(host))}, []byte(host)...)
 	}
 
-	options := buildOptions(maxPadding)
-	payload := make([]byte, 0, 1+2+len(addrBytes)+2+len(options))
-	payload = append(payload, addrType)
-
+	encoded := make([]byte, 0, 1+2+len(addrBytes))
+	encoded = append(encoded, addrType)
 	portBytes := make([]byte, 2)
 	binary.BigEndian.PutUint16(portBytes, port)
-	payload = append(payload, portBytes...)
-	payload = append(payload, addrBytes...)
-
-	optionsLen := make([]byte, 2)
-	binary.BigEndian.PutUint16(optionsLen, uint16(len(options)))
-	payload = append(payload, optionsLen...)
-	payload = append(payload, options...)
-	return payload, nil
+	encoded = append(encoded, portBytes...)
+	encoded = append(encoded, addrBytes...)
+	return encoded, nil
 }
 
 // buildOptions creates the options TLV.
-func buildOptions(maxPadding uint16) []byte {
-	if maxPadding == 0 {
-		return nil
+func buildOptions(opts Options) []byte {
+	var options []byte
+	if opts.MaxPadding != 0 {
+		option := make([]byte, 4)
+		option[0] = optionMaxPadding
+		option[1] = 0x02
+		binary.BigEndian.PutUint16(option[2:4], opts.MaxPadding)
+		options = append(options, option...)
+	}
+	if opts.DataAEAD {
+		options = append(options, optionDataAEAD, 0x01, 0x01)
 	}
-	option := make([]byte, 4)
-	option[0] = 0x01
-	option[1] = 0x02
-	binary.BigEndian.PutUint16(option[2:4], maxPadding)
-	return option
+	if opts.RecordPayload != 0 {
+		options = append(options, optionRecordPayload, 0x04)
+		options = binary.BigEndian.AppendUint32(options, opts.RecordPayload)
+	}
+	if opts.Padding != PaddingNone {
+		options = append(options, optionPadding, 0x01, byte(opts.Padding))
+	}
+	if opts.Compression != CompressionNone {
+		options = append(options, optionCompression, 0x01, byte(opts.Compression))
+	}
+	if opts.PaddingBudget != 0 {
+		options = append(options, optionPaddingBudget, 0x01, opts.PaddingBudget)
+	}
+	return options
 }
 
 // deriveKey derives AES key from PSK using HKDF.
@@ -520,6 +632,37 @@ func ParseMetadata(buffer []byte) (*Metadata, error) {
 	if len(buffer) < 3 {
 		return nil, fmt.Errorf("metadata too short")
 	}
+	host, port, offset, err := decodeAddress(buffer)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(buffer) < offset+2 {
+		return nil, fmt.Errorf("missing options length")
+	}
+	optionsLength := binary.BigEndian.Uint16(buffer[offset : offset+2])
+	offset += 2
+
+	if len(buffer) < offset+int(optionsLength) {
+		return nil, fmt.Errorf("missing options payload")
+	}
+	optionsPayload := buffer[offset : offset+int(optionsLength)]
+
+	options := parseOptions(optionsPayload)
+
+	return &Metadata{
+		Host:    host,
+		Port:    port,
+		Options: options,
+	}, nil
+}
+
+// decodeAddress parses AddrType(1) || Port(2) || Address and returns the number
+// of bytes consumed.
+func decodeAddress(buffer []byte) (string, uint16, int, error) {
+	if len(buffer) < 3 {
+		return "", 0, 0, fmt.Errorf("address too short")
+	}
 	addressType := buffer[0]
 	port := binary.BigEndian.Uint16(buffer[1:3])
 	offset := 3
@@ -527,49 +670,31 @@ func ParseMetadata(buffer []byte) (*Metadata, error) {
 	var host string
 	if addressType == 0x01 { // IPv4
 		if len(buffer) < offset+4 {
-			return nil, fmt.Errorf("invalid ipv4 length")
+			return "", 0, 0, fmt.Errorf("invalid ipv4 length")
 		}
 		host = net.IP(buffer[offset : offset+4]).String()
 		offset += 4
 	} else if addressType == 0x02 { // IPv6
 		if len(buffer) < offset+16 {
-			return nil, fmt.Errorf("invalid ipv6 length")
+			return "", 0, 0, fmt.Errorf("invalid ipv6 length")
 		}
 		host = net.IP(buffer[offset : offset+16]).String()
 		offset += 16
 	} else if addressType == 0x03 { // Domain
 		if len(buffer) < offset+1 {
-			return nil, fmt.Errorf("invalid domain length")
+			return "", 0, 0, fmt.Errorf("invalid domain length")
 		}
 		domainLen := int(buffer[offset])
 		offset += 1
 		if len(buffer) < offset+domainLen {
-			return nil, fmt.Errorf("invalid domain content length")
+			return "", 0, 0, fmt.Errorf("invalid domain content length")
 		}
 		host = string(buffer[offset : offset+domainLen])
 		offset += domainLen
 	} else {
-		return nil, fmt.Errorf("unsupported address type: %d", addressType)
-	}
-
-	if len(buffer) < offset+2 {
-		return nil, fmt.Errorf("missing options length")
-	}
-	optionsLength := binary.BigEndian.Uint16(buffer[offset : offset+2])
-	offset += 2
-
-	if len(buffer) < offset+int(optionsLength) {
-		return nil, fmt.Errorf("missing options payload")
+		return "", 0, 0, fmt.Errorf("unsupported address type: %d", addressType)
 	}
-	optionsPayload := buffer[offset : offset+int(optionsLength)]
-
-	options := parseOptions(optionsPayload)
-
-	return &Metadata{
-		Host:    host,
-		Port:    port,
-		Options: options,
-	}, nil
+	return host, port, offset, nil
 }
 
 func parseOptions(buffer []byte) Options {
@@ -585,8 +710,19 @@ func parseOptions(buffer []byte) Options {
 		value := buffer[offset : offset+length]
 		offset += length
 
-		if typ == 0x01 && len(value) == 2 {
+		switch {
+		case typ == optionMaxPadding && len(value) == 2:
 			opts.MaxPadding = binary.BigEndian.Uint16(value)
+		case typ == optionDataAEAD && len(value) == 1:
+			opts.DataAEAD = value[0] == 0x01
+		case typ == optionRecordPayload && len(value) == 4:
+			opts.RecordPayload = binary.BigEndian.Uint32(value)
+		case typ == optionPadding && len(value) == 1:
+			opts.Padding = PaddingScheme(value[0])
+		case typ == optionCompression && len(value) == 1:
+			opts.Compression = Compression(value[0])
+		case typ == optionPaddingBudget && len(value) == 1:
+			opts.PaddingBudget = value[0]
 		}
 	}
 	return opts
@@ -594,11 +730,8 @@ func parseOptions(buffer []byte) Options {
 
 // BuildErrorRecord creates an error record
 // V5: Requires NonceGenerator for counter-based nonce.
-func BuildErrorRecord(code uint16, message string, ng *NonceGenerator) ([]byte, error) {
-	messageBytes := []byte(message)
-	payload := make([]byte, 4+len(messageBytes))
-	binary.BigEndian.PutUint16(payload[0:2], code)
-	copy(payload[4:], messageBytes)
+func BuildErrorRecord(code ErrorCode, message string, ng *NonceGenerator) ([]byte, error) {
+	payload := buildErrorPayload(code, message)
 
 	// V5: Get nonce from generator
 	nonce, counter, err := ng.Next()
@@ -615,3 +748,11 @@ func BuildErrorRecord(code uint16, message string, ng *NonceGenerator) ([]byte,
 	return buildRecord(header, payload, nil), nil
 }
 
+
+// buildErrorPayload encodes Code(u16) || Reserved(2B) || Message.
+func buildErrorPayload(code ErrorCode, message string) []byte {
+	payload := make([]byte, 4+len(message))
+	binary.BigEndian.PutUint16(payload[0:2], uint16(code))
+	copy(payload[4:], message)
+	return payload
+}
@@ -2,35 +2,81 @@ package core
 
 import (
 	"bufio"
+	"crypto/cipher"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
+	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // RecordReader reads records from a stream.
 type RecordReader struct {
 	reader        io.Reader
+	codec         Codec // Wire format of the session (default V5)
 	stash         []byte
 	currentRecord *Record // Keep track of pooled buffer
 	lengthBuf     [4]byte // Reusable buffer for reading record length prefix
+	dataAEAD      cipher.AEAD // Optional: opens sealed data records
+	sealedSeq     sealedSequence // Counter order of sealed records
+	compression   Compression    // Negotiated compression; none rejects compressed records
+	finReceived   bool        // Peer half-closed; Read reports io.EOF
+	onAccept      func(*Record) error // Optional: applies the gateway's Accept record
 }
 
 // NewRecordReader creates a new record reader with a 1MB buffer.
 func NewRecordReader(reader io.Reader) *RecordReader {
 	// Wrap in a large 1MB buffer to reduce syscall overhead
-	return &RecordReader{reader: bufio.NewReaderSize(reader, 1*1024*1024)}
+	return &RecordReader{reader: bufio.NewReaderSize(reader, 1*1024*1024), codec: V5Codec{}}
+}
+
+// SetCodec selects the wire format negotiated for the session; nil keeps V5.
+func (r *RecordReader) SetCodec(codec Codec) {
+	if codec != nil {
+		r.codec = codec
+	}
+}
+
+// SetDataAEAD enables AEAD data mode for incoming records.
+// Once set, every data, Fin and Error record must authenticate; plaintext
+// records of those types are rejected.
+func (r *RecordReader) SetDataAEAD(aead cipher.AEAD) {
+	r.dataAEAD = aead
+}
+
+// SetCompression sets the compression the stream negotiated. Compressed
+// records are rejected unless it is enabled, so the inflater is only exposed
+// to peers the stream agreed to decompress for.
+func (r *RecordReader) SetCompression(c Compression) {
+	r.compression = c
 }
 
 // Read implements io.Reader, reassembling records into continuous data.
 func (r *RecordReader) Read(p []byte) (int, error) {
 	for len(r.stash) == 0 {
+		if r.finReceived {
+			return 0, io.EOF
+		}
 		record, err := r.ReadNextRecord()
 		if err != nil {
 			return 0, err
 		}
 		if record.Type == TypeError {
-			return 0, errors.New("server error: " + record.ErrorMessage)
+			return 0, NewStreamError(record.ErrorCode, record.ErrorMessage)
+		}
+		if record.Type == TypeFin {
+			r.finReceived = true
+		}
+		if record.Type == TypeAccept && r.onAccept != nil {
+			if err := r.onAccept(record); err != nil {
+				if record.RawBuffer != nil {
+					PutBuffer(record.RawBuffer)
+				}
+				return 0, err
+			}
 		}
 		if record.Type != TypeData {
 			// Non-data records: put buffer back immediately as we won't stash it
@@ -65,7 +111,7 @@ func (r *RecordReader) ReadNextRecord() (*Record, error) {
 	}
 
 	totalLength := binary.BigEndian.Uint32(r.lengthBuf[:])
-	if totalLength < RecordHeaderLength {
+	if totalLength < uint32(r.codec.HeaderLength()) {
 		return nil, errors.New("invalid record length")
 	}
 	if totalLength > MaxRecordSize {
@@ -92,53 +138,56 @@ func (r *RecordReader) ReadNextRecord() (*Record, error) {
 	perfObserveDownRead(int(totalLength)+4, time.Since(readStart))
 
 	parseStart := time.Now()
-	version := recordBytes[headerVersionOffset]
-	if version != ProtocolVersion {
-		return nil, errors.New("unsupported protocol version")
+	result := &Record{RawBuffer: recordBytes} // Store for later release
+	if err := r.codec.DecodeRecord(recordBytes, result); err != nil {
+		if isPooled {
+			PutBuffer(recordBytes)
+		}
+		return nil, err
 	}
-
-	recordType := recordBytes[headerTypeOffset]
-	timestamp := binary.BigEndian.Uint64(recordBytes[headerTimestampOffset : headerTimestampOffset+headerTimestampSize])
-	payloadLength := binary.BigEndian.Uint32(recordBytes[headerPayloadLenOffset : headerPayloadLenOffset+4])
-	paddingLength := binary.BigEndian.Uint32(recordBytes[headerPaddingLenOffset : headerPaddingLenOffset+4])
-	// V5: Parse SessionID and Counter instead of IV
-	sessionID := recordBytes[headerSessionIDOffset : headerSessionIDOffset+headerSessionIDLength]
-	counter := binary.BigEndian.Uint64(recordBytes[headerCounterOffset : headerCounterOffset+headerCounterLength])
-
-	if !IsTimestampValid(timestamp, time.Now(), DefaultReplayWindow) {
+	if !IsTimestampValid(result.TimestampNano, time.Now(), DefaultReplayWindow) {
+		if isPooled {
+			PutBuffer(recordBytes)
+		}
 		return nil, errors.New("timestamp outside allowed window")
 	}
-
-	if int(RecordHeaderLength+payloadLength+paddingLength) != len(recordBytes) {
-		return nil, errors.New("invalid payload length")
-	}
-
-	header := recordBytes[:RecordHeaderLength]
-	payloadStart := RecordHeaderLength
-	payloadEnd := payloadStart + int(payloadLength)
-	payload := recordBytes[payloadStart:payloadEnd]
-
-	result := &Record{
-		Version:       version,
-		Type:          recordType,
-		TimestampNano: timestamp,
-		PayloadLength: payloadLength,
-		PaddingLength: paddingLength,
-		Payload:       payload,
-		Header:        header,
-		SessionID:     sessionID,
-		Counter:       counter,
-		RawBuffer:     recordBytes, // Store for later release
-	}
 	if !isPooled {
 		// If not pooled, RawBuffer is nil to prevent putting non-pool items
 		result.RawBuffer = nil
 	}
+	recordType := result.Type
+	if recordType == TypeDataCompressed && r.compression == CompressionNone {
+		if isPooled {
+			PutBuffer(recordBytes)
+		}
+		return nil, errors.New("compressed record without negotiated compression")
+	}
+	if r.dataAEAD != nil && isSealedType(recordType) {
+		err := openDataRecord(result, r.dataAEAD)
+		if err == nil {
+			err = r.sealedSeq.accept(result.SessionID, result.Counter)
+		}
+		if err != nil {
+			if isPooled {
+				PutBuffer(recordBytes)
+			}
+			return nil, err
+		}
+	}
 	if recordType == TypeError {
-		if len(payload) >= 4 {
+		if payload := result.Payload; len(payload) >= 4 {
+			result.ErrorCode = ErrorCode(binary.BigEndian.Uint16(payload[0:2]))
 			result.ErrorMessage = string(payload[4:])
 		}
 	}
+	if recordType == TypeDataCompressed {
+		if err := inflateDataRecord(result); err != nil {
+			if isPooled {
+				PutBuffer(recordBytes)
+			}
+			return nil, err
+		}
+	}
 	perfObserveDownParse(time.Since(parseStart))
 	return result, nil
 }
@@ -150,35 +199,125 @@ type RecordReadWriter struct {
 	*RecordReader
 	writer     io.Writer
 	closer     io.Closer
-	maxPadding uint16
 	nonceGen   *NonceGenerator
+	finSent    atomic.Bool // CloseWrite called; further writes fail
+
+	// encoder builds outgoing data records; rebuilt from writeOpts/sealAEAD
+	// under encoderMu whenever either changes.
+	encoder   atomic.Pointer[DataRecordEncoder]
+	encoderMu sync.Mutex
+	writeOpts Options
+	sealAEAD  cipher.AEAD // Optional: seals outgoing data records
+	psk       string      // Authenticates Accept records (set by Negotiate)
+	metaHdr   []byte      // Metadata header the Accept record is bound to
 }
 
+// ErrWriteClosed is returned by Write after CloseWrite.
+var ErrWriteClosed = errors.New("write side closed")
+
 // NewRecordReadWriter creates a new RecordReadWriter.
 // V5: Requires NonceGenerator for counter-based nonce.
 func NewRecordReadWriter(rw io.ReadWriteCloser, maxPadding uint16, ng *NonceGenerator) *RecordReadWriter {
-	return &RecordReadWriter{
+	rrw := &RecordReadWriter{
 		RecordReader: NewRecordReader(rw),
 		writer:       rw,
 		closer:       rw,
-		maxPadding:   maxPadding,
 		nonceGen:     ng,
 	}
+	rrw.setWriteOptions(Options{MaxPadding: maxPadding})
+	return rrw
+}
+
+// setWriteOptions swaps in a new encoder for opts.
+func (rw *RecordReadWriter) setWriteOptions(opts Options) {
+	rw.encoderMu.Lock()
+	defer rw.encoderMu.Unlock()
+	rw.writeOpts = opts
+	rw.encoder.Store(NewDataRecordEncoder(opts, rw.sealAEAD))
+}
+
+// Negotiate proposes per-stream options. Record size and padding apply to
+// writes immediately (receivers accept any size up to MaxRecordSize);
+// compression waits until the gateway confirms it in an Accept record.
+// metadataHeader is the header of the metadata record that opened the stream.
+func (rw *RecordReadWriter) Negotiate(proposed Options, psk string, metadataHeader []byte) {
+	upstream := proposed
+	upstream.Compression = CompressionNone
+	rw.setWriteOptions(upstream)
+	rw.psk = psk
+	rw.metaHdr = metadataHeader
+	rw.RecordReader.onAccept = func(record *Record) error {
+		_, err := rw.applyAccept(record)
+		return err
+	}
+}
+
+// applyAccept switches writes to the options of an Accept record and returns
+// the reported target address.
+func (rw *RecordReadWriter) applyAccept(record *Record) (*net.TCPAddr, error) {
+	accepted, remote, err := ParseAcceptRecord(record, rw.metaHdr, rw.psk)
+	if err != nil {
+		return nil, err
+	}
+	rw.setWriteOptions(accepted)
+	rw.RecordReader.SetCompression(accepted.Compression)
+	return remote, nil
+}
+
+// WaitConnected reads the gateway's reply to the metadata record: an Accept
+// record once the target is connected, or an Error record as a *StreamError.
+// Call it after Negotiate and before any Read; the caller bounds the wait
+// with a read deadline on the underlying stream.
+func (rw *RecordReadWriter) WaitConnected() (*net.TCPAddr, error) {
+	record, err := rw.RecordReader.ReadNextRecord()
+	if err != nil {
+		return nil, err
+	}
+	if record.RawBuffer != nil {
+		defer PutBuffer(record.RawBuffer)
+	}
+	switch record.Type {
+	case TypeAccept:
+		return rw.applyAccept(record)
+	case TypeError:
+		return nil, NewStreamError(record.ErrorCode, record.ErrorMessage)
+	default:
+		return nil, NewStreamError(CodeBadRecord, fmt.Sprintf("unexpected record type %d before connect reply", record.Type))
+	}
+}
+
+// Options returns the options currently applied to writes.
+func (rw *RecordReadWriter) Options() Options {
+	return rw.encoder.Load().Options()
+}
+
+// SetDataAEAD enables AEAD data mode: seal protects outgoing data records and
+// open authenticates incoming ones.
+func (rw *RecordReadWriter) SetDataAEAD(seal, open cipher.AEAD) {
+	rw.encoderMu.Lock()
+	rw.sealAEAD = seal
+	rw.encoder.Store(NewDataRecordEncoder(rw.writeOpts, seal))
+	rw.encoderMu.Unlock()
+	rw.RecordReader.SetDataAEAD(open)
 }
 
 // Write wraps data into core.Records before writing to the underlying stream.
 // V5: Uses NonceGenerator for counter-based nonce.
 func (rw *RecordReadWriter) Write(p []byte) (n int, err error) {
+	if rw.finSent.Load() {
+		return 0, ErrWriteClosed
+	}
 	if len(p) == 0 {
 		return 0, nil
 	}
 
 	totalWritten := 0
 	src := p
+	encoder := rw.encoder.Load()
+	maxPayload := encoder.Options().recordPayloadSize()
 
 	for len(src) > 0 {
 		chunkSize := len(src)
-		maxPayload := GetMaxRecordPayload()
 		if chunkSize > maxPayload {
 			chunkSize = maxPayload
 		}
@@ -186,9 +325,8 @@ func (rw *RecordReadWriter) Write(p []byte) (n int, err error) {
 		chunk := src[:chunkSize]
 
 		// V5.1: Build record with NonceGenerator and Buffer Pool
-		// Data records now have 0 padding for maximum throughput
 		buildStart := time.Now()
-		record, err := BuildDataRecord(chunk, rw.maxPadding, rw.nonceGen)
+		record, err := encoder.Build(chunk, rw.nonceGen)
 		if err != nil {
 			return totalWritten, err
 		}
@@ -211,6 +349,30 @@ func (rw *RecordReadWriter) Write(p []byte) (n int, err error) {
 	return totalWritten, nil
 }
 
+// CloseWrite sends a FIN record and keeps the read side open, so the peer can
+// finish sending its response (TCP half-close).
+func (rw *RecordReadWriter) CloseWrite() error {
+	if rw.finSent.Swap(true) {
+		return nil
+	}
+	rw.encoderMu.Lock()
+	seal := rw.sealAEAD
+	rw.encoderMu.Unlock()
+	var record []byte
+	var err error
+	if seal != nil {
+		record, err = BuildSealedFinRecord(seal, rw.nonceGen)
+	} else {
+		record, err = BuildFinRecord(rw.nonceGen)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = rw.writer.Write(record)
+	PutBuffer(record)
+	return err
+}
+
 // Close closes the underlying stream.
 func (rw *RecordReadWriter) Close() error {
 	return rw.closer.Close()
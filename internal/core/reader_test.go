@@ -2,6 +2,7 @@ package core
 
 import (
 	"bytes"
+	"io"
 	"testing"
 )
 
@@ -88,3 +89,46 @@ func TestRecordReaderReadInterface(t *testing.T) {
 		t.Errorf("Reassembled data: got %q, want %q", result, fullPayload)
 	}
 }
+
+// bufferStream adapts a bytes.Buffer to io.ReadWriteCloser for tests.
+type bufferStream struct {
+	bytes.Buffer
+}
+
+func (b *bufferStream) Close() error { return nil }
+
+// TestRecordReadWriterCloseWrite verifies that a FIN record ends the reader's
+// data with io.EOF and that writes fail once the write side is closed.
+func TestRecordReadWriterCloseWrite(t *testing.T) {
+	ng, err := NewNonceGenerator()
+	if err != nil {
+		t.Fatalf("NewNonceGenerator: %v", err)
+	}
+
+	var stream bufferStream
+	rw := NewRecordReadWriter(&stream, 0, ng)
+	if _, err := rw.Write([]byte("request")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := rw.CloseWrite(); err != nil {
+		t.Fatalf("CloseWrite: %v", err)
+	}
+	if _, err := rw.Write([]byte("late")); err != ErrWriteClosed {
+		t.Errorf("Write after CloseWrite: got %v, want ErrWriteClosed", err)
+	}
+	// Anything after the FIN must not be surfaced to the reader.
+	trailing, err := BuildDataRecord([]byte("after-fin"), 0, ng)
+	if err != nil {
+		t.Fatalf("BuildDataRecord: %v", err)
+	}
+	stream.Write(trailing)
+	PutBuffer(trailing)
+
+	data, err := io.ReadAll(NewRecordReader(&stream))
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if string(data) != "request" {
+		t.Errorf("Data: got %q, want %q", data, "request")
+	}
+}
@@ -0,0 +1,84 @@
+package core
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Rekey record layout:
+//
+//	Header(30B, Type=TypeRekey, SessionID=new epoch) || AES-GCM(Epoch(u32))
+//
+// The key is derived like metadata (salt = SessionID), so the record proves
+// PSK possession for the new SessionID. The client sends it after rolling its
+// generator; the gateway rolls its per-session generator and answers with its
+// own rekey record.
+const rekeyPayloadLength = 4
+
+// BuildRekeyRecord builds a rekey record announcing ng's current epoch.
+// Call ng.Rekey first so the record already carries the new SessionID.
+func BuildRekeyRecord(psk string, ng *NonceGenerator) ([]byte, error) {
+	nonce, counter, err := ng.Next()
+	if err != nil {
+		return nil, err
+	}
+	sessionID := nonce[0:4]
+	gcm, err := newSessionKeyAEAD(psk, sessionID)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext := make([]byte, rekeyPayloadLength)
+	binary.BigEndian.PutUint32(plaintext, ng.Epoch())
+	header, err := buildHeader(TypeRekey, rekeyPayloadLength+gcm.Overhead(), 0, sessionID, counter)
+	if err != nil {
+		return nil, err
+	}
+	return buildRecord(header, gcm.Seal(nil, nonce[:], plaintext, header), nil), nil
+}
+
+// ParseRekeyRecord authenticates a rekey record and returns the sender's epoch.
+func ParseRekeyRecord(record *Record, psk string) (uint32, error) {
+	if record.Type != TypeRekey {
+		return 0, fmt.Errorf("unexpected record type: %d", record.Type)
+	}
+	if len(record.SessionID) != headerSessionIDLength {
+		return 0, fmt.Errorf("invalid SessionID length: %d", len(record.SessionID))
+	}
+	gcm, err := newSessionKeyAEAD(psk, record.SessionID)
+	if err != nil {
+		return 0, err
+	}
+
+	var nonce [12]byte
+	copy(nonce[0:4], record.SessionID)
+	binary.BigEndian.PutUint64(nonce[4:12], record.Counter)
+	plaintext, err := gcm.Open(nil, nonce[:], record.Payload, record.Header)
+	if err != nil {
+		return 0, fmt.Errorf("rekey authentication failed: %w", err)
+	}
+	if len(plaintext) != rekeyPayloadLength {
+		return 0, errors.New("invalid rekey payload")
+	}
+	return binary.BigEndian.Uint32(plaintext), nil
+}
+
+// newSessionKeyAEAD returns the metadata-style AEAD for a SessionID
+// (salt = SessionID), shared by control records that carry a sealed payload.
+func newSessionKeyAEAD(psk string, sessionID []byte) (cipher.AEAD, error) {
+	if psk == "" {
+		return nil, fmt.Errorf("missing psk")
+	}
+	key, err := deriveKey(psk, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
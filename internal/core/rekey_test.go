@@ -0,0 +1,73 @@
+package core
+
+import (
+	"bytes"
+	"testing"
+)
+
+// TestNonceGeneratorRekey verifies that Rekey rolls to a new SessionID with a
+// fresh counter and bumps the epoch.
+func TestNonceGeneratorRekey(t *testing.T) {
+	ng, err := NewNonceGenerator()
+	if err != nil {
+		t.Fatalf("NewNonceGenerator: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, _, err := ng.Next(); err != nil {
+			t.Fatalf("Next: %v", err)
+		}
+	}
+	oldID := ng.SessionID()
+
+	if err := ng.Rekey(); err != nil {
+		t.Fatalf("Rekey: %v", err)
+	}
+	if ng.SessionID() == oldID {
+		t.Error("SessionID unchanged after Rekey")
+	}
+	if ng.Counter() != 0 {
+		t.Errorf("Counter: got %d, want 0", ng.Counter())
+	}
+	if ng.Epoch() != 1 {
+		t.Errorf("Epoch: got %d, want 1", ng.Epoch())
+	}
+	nonce, counter, err := ng.Next()
+	if err != nil {
+		t.Fatalf("Next after Rekey: %v", err)
+	}
+	newID := ng.SessionID()
+	if counter != 0 || !bytes.Equal(nonce[0:4], newID[:]) {
+		t.Errorf("Next after Rekey: counter=%d sid=%x, want 0 and %x", counter, nonce[0:4], newID)
+	}
+}
+
+// TestRekeyRecordRoundTrip verifies rekey records authenticate with the PSK
+// and carry the sender's epoch.
+func TestRekeyRecordRoundTrip(t *testing.T) {
+	ng, err := NewNonceGenerator()
+	if err != nil {
+		t.Fatalf("NewNonceGenerator: %v", err)
+	}
+	if err := ng.Rekey(); err != nil {
+		t.Fatalf("Rekey: %v", err)
+	}
+	raw, err := BuildRekeyRecord("test-psk", ng)
+	if err != nil {
+		t.Fatalf("BuildRekeyRecord: %v", err)
+	}
+
+	record, err := NewRecordReader(bytes.NewReader(raw)).ReadNextRecord()
+	if err != nil {
+		t.Fatalf("ReadNextRecord: %v", err)
+	}
+	epoch, err := ParseRekeyRecord(record, "test-psk")
+	if err != nil {
+		t.Fatalf("ParseRekeyRecord: %v", err)
+	}
+	if epoch != 1 {
+		t.Errorf("Epoch: got %d, want 1", epoch)
+	}
+	if _, err := ParseRekeyRecord(record, "other-psk"); err == nil {
+		t.Error("expected error for wrong PSK")
+	}
+}
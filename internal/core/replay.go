@@ -0,0 +1,152 @@
+package core
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// Counter-based anti-replay.
+//
+// Every record nonce is SessionID || Counter, and a sender never reuses a
+// counter under one SessionID, so a repeated pair is a replay. SessionIDs
+// are only 4 random bytes and every user picks its own, so the filter keys
+// its windows by (user ID, SessionID): two users that happen to share a
+// SessionID do not reject each other's records.
+//
+// Each window is a fixed-size bitmap sliding over counter space, as in
+// RFC 6479: the highest accepted counter marks its top, counters up to
+// windowSize below it are tracked bit by bit, and anything older is
+// rejected as too old. Only control records (metadata, rekey, key exchange,
+// server proof) pass the filter, but data records draw from the same
+// counter sequence, so a metadata record overtaken by a later control
+// record and more than windowSize counters of data is rejected. Windows are
+// kept in a bounded LRU across sessions, so records replayed into a new
+// WebTransport session are caught as long as their window has not been
+// evicted; IsTimestampValid bounds how long a captured record stays usable.
+//
+// Records must be authenticated before Check, or forged counters could push
+// a victim's window forward.
+const (
+	// DefaultReplayWindowSize is the number of counters below the highest
+	// accepted one that each window tracks.
+	DefaultReplayWindowSize = 8192
+	// DefaultReplaySessions bounds the windows tracked at once.
+	DefaultReplaySessions = 4096
+)
+
+var (
+	// ErrReplay is returned for a (SessionID, Counter) pair seen before.
+	ErrReplay = errors.New("replayed record")
+	// ErrReplayTooOld is returned for counters that fell out of the window.
+	ErrReplayTooOld = errors.New("record counter behind replay window")
+)
+
+// ReplayFilter rejects repeated (SessionID, Counter) pairs per user. It is
+// safe for concurrent use.
+type ReplayFilter struct {
+	mu         sync.Mutex
+	windowSize uint64
+	capacity   int
+	windows    map[replayKey]*list.Element
+	lru        *list.List // front = most recently used *replayWindow
+}
+
+// replayKey identifies one window.
+type replayKey struct {
+	userID    string
+	sessionID [4]byte
+}
+
+// replayWindow is the bitmap of one (user ID, SessionID). Bit c%64 of word
+// (c/64)%len(bits) stands for counter c.
+type replayWindow struct {
+	key  replayKey
+	top  uint64 // highest accepted counter
+	bits []uint64
+}
+
+// NewReplayFilter creates a filter tracking windowSize counters, rounded up
+// to a multiple of 64, for each of up to sessions (user ID, SessionID)
+// pairs. Non-positive values select the defaults.
+func NewReplayFilter(windowSize, sessions int) *ReplayFilter {
+	if windowSize <= 0 {
+		windowSize = DefaultReplayWindowSize
+	}
+	if sessions <= 0 {
+		sessions = DefaultReplaySessions
+	}
+	return &ReplayFilter{
+		windowSize: (uint64(windowSize) + 63) &^ 63,
+		capacity:   sessions,
+		windows:    make(map[replayKey]*list.Element),
+		lru:        list.New(),
+	}
+}
+
+// Check records (sessionID, counter) for userID and returns an error if the
+// pair was seen before or is too old to tell.
+func (f *ReplayFilter) Check(userID string, sessionID []byte, counter uint64) error {
+	if len(sessionID) != headerSessionIDLength {
+		return fmt.Errorf("invalid SessionID length: %d", len(sessionID))
+	}
+	key := replayKey{userID: userID}
+	copy(key.sessionID[:], sessionID)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if elem, ok := f.windows[key]; ok {
+		f.lru.MoveToFront(elem)
+		return f.advance(elem.Value.(*replayWindow), counter)
+	}
+
+	// One extra word keeps windowSize counters below top tracked when top
+	// sits at the start of its word.
+	w := &replayWindow{key: key, top: counter, bits: make([]uint64, f.windowSize/64+1)}
+	w.set(counter)
+	f.windows[key] = f.lru.PushFront(w)
+	if f.lru.Len() > f.capacity {
+		oldest := f.lru.Back()
+		f.lru.Remove(oldest)
+		delete(f.windows, oldest.Value.(*replayWindow).key)
+	}
+	return nil
+}
+
+// Sessions returns the number of (user ID, SessionID) windows tracked.
+func (f *ReplayFilter) Sessions() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.lru.Len()
+}
+
+func (f *ReplayFilter) advance(w *replayWindow, counter uint64) error {
+	if counter <= w.top {
+		if w.top-counter >= f.windowSize {
+			return ErrReplayTooOld
+		}
+		if w.has(counter) {
+			return ErrReplay
+		}
+		w.set(counter)
+		return nil
+	}
+	// Slide forward, clearing the words the window moves into.
+	words := uint64(len(w.bits))
+	for i, n := uint64(1), min(counter/64-w.top/64, words); i <= n; i++ {
+		w.bits[(w.top/64+i)%words] = 0
+	}
+	w.top = counter
+	w.set(counter)
+	return nil
+}
+
+func (w *replayWindow) has(counter uint64) bool {
+	return w.bits[(counter/64)%uint64(len(w.bits))]&(1<<(counter%64)) != 0
+}
+
+func (w *replayWindow) set(counter uint64) {
+	w.bits[(counter/64)%uint64(len(w.bits))] |= 1 << (counter % 64)
+}
@@ -1,6 +1,6 @@
 // Package core provides protocol primitives for Aether-Realist.
 //
-// Deprecated: ReplayCache is deprecated in V5. Use counter-based anti-replay instead.
+// Deprecated: ReplayCache is deprecated in V5. Use ReplayFilter (replay.go) instead.
 // This file is retained for V4 compatibility only.
 package core
 
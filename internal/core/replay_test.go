@@ -0,0 +1,211 @@
+package core
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// TestReplayFilterWindow verifies in-order and reordered counters pass while
+// duplicates and counters behind the window are rejected.
+func TestReplayFilterWindow(t *testing.T) {
+	f := NewReplayFilter(64, 16)
+	sid := []byte{1, 2, 3, 4}
+
+	for _, c := range []uint64{0, 1, 5, 3} {
+		if err := f.Check("alice", sid, c); err != nil {
+			t.Fatalf("Check(%d): %v", c, err)
+		}
+	}
+	if err := f.Check("alice", sid, 3); !errors.Is(err, ErrReplay) {
+		t.Errorf("duplicate 3: got %v, want ErrReplay", err)
+	}
+	// Sliding to 100 leaves 36 and below behind the window.
+	if err := f.Check("alice", sid, 100); err != nil {
+		t.Fatalf("Check(100): %v", err)
+	}
+	if err := f.Check("alice", sid, 5); !errors.Is(err, ErrReplayTooOld) {
+		t.Errorf("counter 5 behind window: got %v, want ErrReplayTooOld", err)
+	}
+	if err := f.Check("alice", sid, 37); err != nil {
+		t.Errorf("Check(37) at the window edge: %v", err)
+	}
+	if err := f.Check("alice", sid, 37); !errors.Is(err, ErrReplay) {
+		t.Errorf("duplicate 37: got %v, want ErrReplay", err)
+	}
+	// A jump past the whole window clears every bit.
+	if err := f.Check("alice", sid, 1_000_000); err != nil {
+		t.Fatalf("Check(1000000): %v", err)
+	}
+	if err := f.Check("alice", sid, 999_999); err != nil {
+		t.Errorf("Check(999999) after a large jump: %v", err)
+	}
+	if err := f.Check("alice", sid, 1_000_000); !errors.Is(err, ErrReplay) {
+		t.Errorf("duplicate highest: got %v, want ErrReplay", err)
+	}
+	if err := f.Check("alice", []byte{9, 9, 9, 9}, 3); err != nil {
+		t.Errorf("other SessionID: %v", err)
+	}
+}
+
+// TestReplayFilterUsers verifies two users with colliding SessionIDs keep
+// separate windows, while each user's replays are still caught.
+func TestReplayFilterUsers(t *testing.T) {
+	f := NewReplayFilter(DefaultReplayWindowSize, DefaultReplaySessions)
+	sid := []byte{4, 3, 2, 1}
+
+	for _, user := range []string{"alice", "bob"} {
+		for c := uint64(0); c < 3; c++ {
+			if err := f.Check(user, sid, c); err != nil {
+				t.Fatalf("Check(%s, %d): %v", user, c, err)
+			}
+		}
+	}
+	// Bob's window moving far ahead leaves Alice's untouched.
+	if err := f.Check("bob", sid, 1_000_000); err != nil {
+		t.Fatalf("Check(bob, 1000000): %v", err)
+	}
+	if err := f.Check("alice", sid, 3); err != nil {
+		t.Errorf("Check(alice, 3): %v", err)
+	}
+	for _, user := range []string{"alice", "bob"} {
+		if err := f.Check(user, sid, 2); !errors.Is(err, ErrReplay) && !errors.Is(err, ErrReplayTooOld) {
+			t.Errorf("replay for %s: got %v, want rejection", user, err)
+		}
+	}
+	if f.Sessions() != 2 {
+		t.Errorf("Sessions: got %d, want 2", f.Sessions())
+	}
+}
+
+// TestReplayLateMetadataAfterBulkData verifies that a metadata record
+// overtaken by a later metadata record is accepted while the data between
+// them fits the window, and rejected once it does not.
+func TestReplayLateMetadataAfterBulkData(t *testing.T) {
+	for _, tc := range []struct {
+		data int
+		want error
+	}{
+		{DefaultReplayWindowSize / 2, nil},
+		{DefaultReplayWindowSize * 2, ErrReplayTooOld},
+	} {
+		f := NewReplayFilter(DefaultReplayWindowSize, DefaultReplaySessions)
+		ng, err := NewNonceGenerator()
+		if err != nil {
+			t.Fatalf("NewNonceGenerator: %v", err)
+		}
+		late, err := BuildMetadataRecord("example.com", 443, 0, "test-psk", ng)
+		if err != nil {
+			t.Fatalf("BuildMetadataRecord: %v", err)
+		}
+		for i := 0; i < tc.data; i++ {
+			record, err := BuildDataRecord([]byte("bulk upload"), 0, ng)
+			if err != nil {
+				t.Fatalf("BuildDataRecord: %v", err)
+			}
+			PutBuffer(record)
+		}
+		early, err := BuildMetadataRecord("example.com", 443, 0, "test-psk", ng)
+		if err != nil {
+			t.Fatalf("BuildMetadataRecord: %v", err)
+		}
+
+		record := readRecord(t, early)
+		if err := f.Check("alice", record.SessionID, record.Counter); err != nil {
+			t.Fatalf("Check(counter %d): %v", record.Counter, err)
+		}
+		record = readRecord(t, late)
+		if err := f.Check("alice", record.SessionID, record.Counter); !errors.Is(err, tc.want) {
+			t.Fatalf("late metadata after %d data records: got %v, want %v", tc.data, err, tc.want)
+		}
+		if tc.want == nil {
+			if err := f.Check("alice", record.SessionID, record.Counter); !errors.Is(err, ErrReplay) {
+				t.Errorf("replayed late metadata: got %v, want ErrReplay", err)
+			}
+		}
+	}
+}
+
+// TestReplayFilterLRU verifies the filter forgets the least recently used
+// SessionID once it reaches capacity.
+func TestReplayFilterLRU(t *testing.T) {
+	f := NewReplayFilter(64, 2)
+	a, b, c := []byte{0, 0, 0, 1}, []byte{0, 0, 0, 2}, []byte{0, 0, 0, 3}
+	_ = f.Check("alice", a, 0)
+	_ = f.Check("alice", b, 0)
+	_ = f.Check("alice", a, 1) // a is now most recent
+	_ = f.Check("alice", c, 0) // evicts b
+
+	if f.Sessions() != 2 {
+		t.Errorf("Sessions: got %d, want 2", f.Sessions())
+	}
+	if err := f.Check("alice", a, 0); !errors.Is(err, ErrReplay) {
+		t.Errorf("a kept: got %v, want ErrReplay", err)
+	}
+	if err := f.Check("alice", b, 0); err != nil {
+		t.Errorf("b evicted: got %v, want nil", err)
+	}
+}
+
+// TestReplayFilterConcurrent verifies that under concurrent streams every
+// fresh counter is accepted once and every duplicate is rejected.
+func TestReplayFilterConcurrent(t *testing.T) {
+	f := NewReplayFilter(DefaultReplayWindowSize, DefaultReplaySessions)
+	sid := []byte{7, 7, 7, 7}
+	const workers, perWorker = 8, 500
+
+	var accepted atomic.Int64
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// Every worker submits the same counters: each must win exactly once.
+			for c := uint64(0); c < perWorker; c++ {
+				if f.Check("alice", sid, c) == nil {
+					accepted.Add(1)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if accepted.Load() != perWorker {
+		t.Errorf("accepted %d, want %d", accepted.Load(), perWorker)
+	}
+}
+
+// TestReplayCapturedMetadata replays captured metadata records the way the
+// gateway checks them: authenticate, then filter.
+func TestReplayCapturedMetadata(t *testing.T) {
+	f := NewReplayFilter(DefaultReplayWindowSize, DefaultReplaySessions)
+	ng, _ := NewNonceGenerator()
+
+	var captured [][]byte
+	for i := 0; i < 3; i++ {
+		raw, err := BuildMetadataRecordWithOptions("example.com", 443, Options{}, "test-psk", ng)
+		if err != nil {
+			t.Fatalf("BuildMetadataRecordWithOptions: %v", err)
+		}
+		captured = append(captured, raw)
+	}
+
+	check := func(raw []byte) error {
+		record := readRecord(t, raw)
+		if _, err := DecryptMetadata(record, "test-psk"); err != nil {
+			t.Fatalf("DecryptMetadata: %v", err)
+		}
+		return f.Check("alice", record.SessionID, record.Counter)
+	}
+	// Streams may deliver metadata out of order.
+	for _, i := range []int{1, 0, 2} {
+		if err := check(captured[i]); err != nil {
+			t.Fatalf("first delivery of record %d: %v", i, err)
+		}
+	}
+	for i, raw := range captured {
+		if err := check(raw); !errors.Is(err, ErrReplay) {
+			t.Errorf("replay of record %d: got %v, want ErrReplay", i, err)
+		}
+	}
+}
@@ -3,13 +3,13 @@ package core
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"math/rand"
 	"net"
-	"net/url"
-	"strings"
+	"net/http"
 	"sync"
 	"time"
 
@@ -18,11 +18,11 @@ import (
 	webtransport "github.com/quic-go/webtransport-go"
 )
 
-// sessionManager manages WebTransport sessions and their lifecycle.
+// sessionManager manages sessions and their lifecycle.
 type sessionManager struct {
 	config    *SessionConfig
 	dialer    *webtransport.Dialer
-	session   *webtransport.Session
+	session   Session
 	sessionID string
 	mu        sync.RWMutex
 	ctx       context.Context
@@ -30,7 +30,32 @@ type sessionManager struct {
 	onEvent   func(Event)
 	metrics   *Metrics
 	nonceGen  *NonceGenerator // V5: Counter-based nonce generator
+	codec     Codec           // Wire format negotiated for the current session
+	// awaitConnect is set when the gateway confirmed a protocol version and
+	// therefore answers every stream with a connected or error reply.
+	awaitConnect bool
+	// sessionKey replaces the PSK for this session after a forward-secret
+	// key exchange (see kex.go); empty otherwise.
+	sessionKey string
+	// endpoint is the dial address, SNI and authority of the last dial.
+	endpoint  *Endpoint
 	streamSeq uint64
+	// streams counts the open streams of session (see hopping.go).
+	streams *streamGroup
+	// hopper schedules port hops when port_hopping is set (see hopping.go).
+	hopper *rotationScheduler
+	// transport, if set, dials every session instead of the configured
+	// transports (see Core.SetTransport).
+	transport Transport
+	// activeTransport names the transport of the last session; in auto mode
+	// QUIC is skipped until quicRetryAt after it failed (see fallback.go).
+	activeTransport string
+	quicRetryAt     time.Time
+
+	// UDP relay: datagram codec for the current session and the Core-side
+	// dispatcher for datagrams received from the gateway.
+	datagrams  *DatagramCodec
+	onDatagram func(*Datagram)
 }
 
 // newSessionManager creates a new session manager.
@@ -53,17 +78,26 @@ func init() {
 func (sm *sessionManager) updateConfig(config *SessionConfig) {
 	sm.mu.Lock()
 	oldProfile := ""
+	dialerChanged := false
+	hoppingChanged := false
 	if sm.config != nil {
 		oldProfile = sm.config.WindowProfile
+		dialerChanged = sm.config.URL != config.URL || sm.config.SNI != config.SNI ||
+			sm.config.quicObfsKey() != config.quicObfsKey()
+		hoppingChanged = sm.config.PortHopping != config.PortHopping
 	}
 	sm.config = config
 	newProfile := config.WindowProfile
 	sm.mu.Unlock()
 
-	// If window profile changed, we need to recreate the dialer
-	// so that the next session (after rotation) uses the new window settings.
-	if oldProfile != newProfile {
-		log.Printf("[DEBUG] Window profile changed from '%s' to '%s', reinitializing dialer", oldProfile, newProfile)
+	if hoppingChanged {
+		sm.startPortHopping()
+	}
+
+	// If window profile, the TLS server name or obfuscation changed, we need to
+	// recreate the dialer so that the next session (after rotation) uses the new settings.
+	if oldProfile != newProfile || dialerChanged {
+		log.Printf("[DEBUG] Window profile '%s' -> '%s' (server name or obfuscation changed: %v), reinitializing dialer", oldProfile, newProfile, dialerChanged)
 		if err := sm.initialize(); err != nil {
 			log.Printf("[ERROR] Failed to reinitialize dialer after config change: %v", err)
 		}
@@ -75,17 +109,20 @@ func (sm *sessionManager) initialize() error {
 	if sm.config.URL == "" {
 		return nil
 	}
-	if sm.config.RecordPayloadBytes > 0 {
-		applied := SetRecordPayloadBytes(sm.config.RecordPayloadBytes)
-		log.Printf("[DEBUG] V5.1 Config: record payload bytes=%d", applied)
-	}
 
-	parsed, err := url.Parse(sm.config.URL)
+	ep, err := ResolveEndpoint(sm.config.URL, sm.config.DialAddr, sm.config.SNI, sm.config.Host)
 	if err != nil {
-		return fmt.Errorf("invalid url: %w", err)
+		return err
 	}
-	if parsed.Scheme != "https" {
-		return fmt.Errorf("url must be https")
+	if _, err := ParsePortRange(sm.config.PortHopping.Ports); err != nil {
+		return fmt.Errorf("invalid port_hopping.ports: %w", err)
+	}
+	if _, err := normalizeTransport(sm.config.Transport); err != nil {
+		return err
+	}
+	if sm.transport != nil {
+		// The installed transport dials on its own.
+		return nil
 	}
 
 	// V5.2: Profile defaults + optional explicit QUIC window overrides.
@@ -146,21 +183,74 @@ func (sm *sessionManager) initialize() error {
 		log.Printf("Warning: Failed to set client UDP write buffer: %v", err)
 	}
 
+	// Optionally hide the QUIC fingerprint (see obfs.go).
+	var packetConn net.PacketConn = udpConn
+	if obfsKey := sm.config.quicObfsKey(); obfsKey != "" {
+		obfs, err := NewObfsPacketConn(udpConn, obfsKey)
+		if err != nil {
+			udpConn.Close()
+			return fmt.Errorf("quic obfuscation: %w", err)
+		}
+		packetConn = obfs
+		log.Printf("[DEBUG] QUIC packet obfuscation enabled")
+	}
+
 	// Create a transport that uses this optimized connection
 	tr := &quic.Transport{
-		Conn: udpConn,
+		Conn: packetConn,
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName:         ep.SNI,
+		NextProtos:         []string{http3.NextProtoH3},
+		InsecureSkipVerify: sm.config.AllowInsecure,
+	}
+	// Pinned certificates replace CA validation (see pinning.go).
+	pins, err := ParsePins(sm.config.PinnedSHA256)
+	if err != nil {
+		return err
+	}
+	if len(pins) > 0 {
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyPeerCertificate = verifyPinnedCertificate(pins)
+		log.Printf("[DEBUG] TLS certificate pinning enabled (%d pin(s))", len(pins))
+	}
+	if sm.config.ECHConfigList != "" {
+		list, err := ParseECHConfigList(sm.config.ECHConfigList)
+		if err != nil {
+			return err
+		}
+		policy, err := normalizeECHFallback(sm.config.ECHFallback)
+		if err != nil {
+			return err
+		}
+		tlsConfig.EncryptedClientHelloConfigList = list
+		// A rejection is only trusted once the outer certificate checks out;
+		// pinned and insecure gateways verify it like the inner handshake.
+		if len(pins) > 0 {
+			verify := verifyPinnedCertificate(pins)
+			tlsConfig.EncryptedClientHelloRejectionVerify = func(cs tls.ConnectionState) error {
+				raw := make([][]byte, 0, len(cs.PeerCertificates))
+				for _, cert := range cs.PeerCertificates {
+					raw = append(raw, cert.Raw)
+				}
+				return verify(raw, nil)
+			}
+		} else if sm.config.AllowInsecure {
+			tlsConfig.EncryptedClientHelloRejectionVerify = func(tls.ConnectionState) error { return nil }
+		}
+		log.Printf("[DEBUG] Encrypted Client Hello enabled (fallback: %s)", policy)
 	}
 
 	sm.dialer = &webtransport.Dialer{
-		TLSClientConfig: &tls.Config{
-			ServerName:         parsed.Hostname(),
-			NextProtos:         []string{http3.NextProtoH3},
-			InsecureSkipVerify: sm.config.AllowInsecure,
-		},
+		TLSClientConfig: tlsConfig,
 		QUICConfig: quicConfig,
+		// Offer every wire version we speak; the gateway picks one.
+		ApplicationProtocols: SupportedProtocols(),
 		DialAddr: func(ctx context.Context, addr string, tlsCfg *tls.Config, cfg *quic.Config) (*quic.Conn, error) {
 			// Resolve the target address manually to ensure we dial correctly.
-			udpAddr, err := net.ResolveUDPAddr("udp", addr)
+			// addr is the URL's authority; dialSession passes the dial address.
+			udpAddr, err := net.ResolveUDPAddr("udp", dialAddrFrom(ctx, addr))
 			if err != nil {
 				return nil, err
 			}
@@ -171,7 +261,7 @@ func (sm *sessionManager) initialize() error {
 	if sm.config.AllowInsecure {
 		log.Printf("[WARNING] TLS InsecureSkipVerify is ENABLED. This is intended for debugging or private gateways ONLY.")
 	}
-	log.Printf("[DEBUG] WebTransport dialer initialized for %s", parsed.Hostname())
+	log.Printf("[DEBUG] WebTransport dialer initialized for %s (%s)", ep.URL.Hostname(), ep)
 
 	return nil
 }
@@ -190,7 +280,7 @@ func (sm *sessionManager) connectLocked() error {
 		return nil
 	}
 
-	if sm.dialer == nil {
+	if sm.dialer == nil && sm.transport == nil {
 		// Try to initialize if needed (e.g. config updated)
 		if err := sm.initialize(); err != nil {
 			return err
@@ -204,34 +294,171 @@ func (sm *sessionManager) connectLocked() error {
 		return fmt.Errorf("session already exists")
 	}
 
-	session, err := sm.dialSession(sm.ctx)
+	session, reason, err := sm.dialCarrier(sm.ctx)
 	if err != nil {
 		return fmt.Errorf("dial failed: %w", err)
 	}
 
+	protocol := session.Protocol()
+	codec, err := CodecForProtocol(protocol)
+	if err != nil {
+		_ = session.Close("unsupported protocol")
+		return err
+	}
+	if protocol == "" {
+		log.Printf("[DEBUG] Gateway did not confirm a protocol version, assuming %s", codec.Protocol())
+	}
+
 	sm.session = session
+	sm.streams = &streamGroup{}
+	sm.codec = codec
+	sm.awaitConnect = protocol != ""
 	sm.sessionID = generateSessionID()
 
 	// V5: Initialize NonceGenerator for counter-based nonce
 	sm.nonceGen, err = NewNonceGenerator()
 	if err != nil {
-		_ = session.CloseWithError(0, "nonce generator failed")
+		_ = session.Close("nonce generator failed")
 		return fmt.Errorf("nonce generator failed: %w", err)
 	}
 
+	// Without certificate verification only the server proof authenticates
+	// the gateway, so it must succeed before any metadata is sent.
+	if sm.config.ServerProof || sm.config.AllowInsecure {
+		if !sm.awaitConnect {
+			sm.session = nil
+			_ = session.Close("server proof unsupported")
+			return fmt.Errorf("%w: gateway does not support server proofs", ErrServerProof)
+		}
+		if err := sm.verifyServer(session); err != nil {
+			sm.session = nil
+			_ = session.Close("server proof failed")
+			return fmt.Errorf("gateway authentication failed (possible man-in-the-middle): %w", err)
+		}
+	}
+
+	sm.sessionKey = ""
+	if sm.config.ForwardSecrecy {
+		if !sm.awaitConnect {
+			sm.session = nil
+			_ = session.Close("forward secrecy unsupported")
+			return fmt.Errorf("gateway does not support forward secrecy")
+		}
+		key, err := sm.exchangeKeys(session)
+		if err != nil {
+			sm.session = nil
+			_ = session.Close("key exchange failed")
+			return fmt.Errorf("key exchange failed: %w", err)
+		}
+		sm.sessionKey = key
+	}
+
+	sm.datagrams = NewDatagramCodec(sm.pskLocked())
+	go sm.receiveDatagrams(session, sm.datagrams)
+
 	sm.metrics.RecordSessionStart()
 
 	// Emit event
-	localAddr := ""
-	remoteAddr := ""
-	sm.onEvent(NewSessionEstablishedEvent(sm.sessionID, localAddr, remoteAddr))
+	localAddr := session.LocalAddr().String()
+	remoteAddr := session.RemoteAddr().String()
+	sm.onEvent(NewSessionEstablishedEvent(sm.sessionID, localAddr, remoteAddr, sm.endpoint))
+	if transport := session.Transport(); transport != sm.activeTransport {
+		log.Printf("[INFO] Transport: %s (previous: %q)", transport, sm.activeTransport)
+		sm.onEvent(NewTransportChangedEvent(transport, sm.activeTransport, reason))
+		sm.activeTransport = transport
+	}
 
 	// Start session monitor
-	go sm.monitorSession()
+	go sm.monitorSession(session)
 
 	return nil
 }
 
+// verifyServer has the gateway prove the PSK on this TLS connection. Called
+// with sm.mu held, before any other stream.
+func (sm *sessionManager) verifyServer(session Session) error {
+	binding, err := session.Binding()
+	if err != nil {
+		return err
+	}
+	challenge, err := NewServerProofChallenge(sm.config.PSK, binding)
+	if err != nil {
+		return err
+	}
+	request, err := challenge.BuildRequest(sm.nonceGen)
+	if err != nil {
+		return err
+	}
+	return sm.controlRoundTrip(session, request, challenge.Verify)
+}
+
+// exchangeKeys runs the forward-secret key exchange on a fresh session and
+// returns the session key. Called with sm.mu held, before any other stream.
+func (sm *sessionManager) exchangeKeys(session Session) (string, error) {
+	kx, err := NewKeyExchange(sm.config.PSK)
+	if err != nil {
+		return "", err
+	}
+	request, err := kx.BuildRequest(sm.nonceGen)
+	if err != nil {
+		return "", err
+	}
+	var key string
+	err = sm.controlRoundTrip(session, request, func(reply *Record) error {
+		var err error
+		key, err = kx.Finish(reply)
+		return err
+	})
+	return key, err
+}
+
+// controlRoundTrip sends request on a new stream and passes the gateway's
+// reply record to handle before its buffer is released.
+func (sm *sessionManager) controlRoundTrip(session Session, request []byte, handle func(*Record) error) error {
+	ctx, cancel := context.WithTimeout(sm.ctx, 10*time.Second)
+	defer cancel()
+	stream, err := session.OpenStream(ctx)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = stream.SetDeadline(deadline)
+	}
+	if _, err := stream.Write(request); err != nil {
+		return err
+	}
+
+	reader := NewRecordReader(stream)
+	reader.SetCodec(sm.codec)
+	reply, err := reader.ReadNextRecord()
+	if err != nil {
+		return err
+	}
+	if reply.RawBuffer != nil {
+		defer PutBuffer(reply.RawBuffer)
+	}
+	if reply.Type == TypeError {
+		return NewStreamError(reply.ErrorCode, reply.ErrorMessage)
+	}
+	return handle(reply)
+}
+
+// psk returns the key material of the current session: the forward-secret
+// session key if one was negotiated, else the configured PSK.
+func (sm *sessionManager) psk() string {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	return sm.pskLocked()
+}
+
+func (sm *sessionManager) pskLocked() string {
+	if sm.sessionKey != "" {
+		return sm.sessionKey
+	}
+	return sm.config.PSK
+}
+
 // rotate closes current session and establishes a new one.
 func (sm *sessionManager) rotate() error {
 	sm.mu.Lock()
@@ -241,7 +468,7 @@ func (sm *sessionManager) rotate() error {
 
 	if oldSession != nil {
 		sm.onEvent(NewSessionRotatingEvent(oldID))
-		_ = oldSession.CloseWithError(0, "rotation")
+		_ = oldSession.Close("rotation")
 	}
 
 	// Clear session state
@@ -260,8 +487,13 @@ func (sm *sessionManager) close(reason string) error {
 	sm.mu.Lock()
 	defer sm.mu.Unlock()
 
+	if sm.hopper != nil {
+		sm.hopper.stop()
+		sm.hopper = nil
+	}
+
 	if sm.session != nil {
-		_ = sm.session.CloseWithError(0, reason)
+		_ = sm.session.Close(reason)
 		sm.onEvent(NewSessionClosedEvent(sm.sessionID, &reason, nil))
 		sm.session = nil
 	}
@@ -271,7 +503,7 @@ func (sm *sessionManager) close(reason string) error {
 }
 
 // OpenStream opens a new stream and returns it with a synchronized counter.
-func (sm *sessionManager) OpenStream(ctx context.Context) (*webtransport.Stream, uint64, error) {
+func (sm *sessionManager) OpenStream(ctx context.Context) (Stream, uint64, error) {
 	sm.mu.Lock()
 	defer sm.mu.Unlock()
 
@@ -281,7 +513,7 @@ func (sm *sessionManager) OpenStream(ctx context.Context) (*webtransport.Stream,
 		}
 	}
 
-	stream, err := sm.session.OpenStreamSync(ctx)
+	stream, err := sm.session.OpenStream(ctx)
 	if err != nil {
 		// If session error, try to reconnect and retry once
 		log.Printf("[DEBUG] Open stream failed (session might be dead), retrying: %v", err)
@@ -289,14 +521,63 @@ func (sm *sessionManager) OpenStream(ctx context.Context) (*webtransport.Stream,
 		if err := sm.connectLocked(); err != nil {
 			return nil, 0, err
 		}
-		stream, err = sm.session.OpenStreamSync(ctx)
+		stream, err = sm.session.OpenStream(ctx)
 		if err != nil {
 			return nil, 0, err
 		}
 	}
 
 	sm.streamSeq++
-	return stream, sm.streamSeq, nil
+	return sm.streams.add(stream), sm.streamSeq, nil
+}
+
+// setDatagramHandler registers the callback for datagrams received from the gateway.
+func (sm *sessionManager) setDatagramHandler(handler func(*Datagram)) {
+	sm.mu.Lock()
+	sm.onDatagram = handler
+	sm.mu.Unlock()
+}
+
+// SendDatagram seals d and sends it as a datagram on the current session.
+func (sm *sessionManager) SendDatagram(d *Datagram) error {
+	sm.mu.Lock()
+	if sm.session == nil {
+		if err := sm.connectLocked(); err != nil {
+			sm.mu.Unlock()
+			return err
+		}
+	}
+	sess := sm.session
+	ng := sm.nonceGen
+	codec := sm.datagrams
+	sm.mu.Unlock()
+
+	record, err := codec.Seal(d, ng)
+	if err != nil {
+		return err
+	}
+	return sess.SendDatagram(record)
+}
+
+// receiveDatagrams dispatches datagrams of one session until it closes.
+func (sm *sessionManager) receiveDatagrams(sess Session, codec *DatagramCodec) {
+	for {
+		b, err := sess.ReceiveDatagram(sm.ctx)
+		if err != nil {
+			return
+		}
+		d, err := codec.Open(b)
+		if err != nil {
+			log.Printf("[DEBUG] Dropping invalid datagram: %v", err)
+			continue
+		}
+		sm.mu.RLock()
+		handler := sm.onDatagram
+		sm.mu.RUnlock()
+		if handler != nil {
+			handler(d)
+		}
+	}
 }
 
 // dialSession creates a new WebTransport session.
@@ -304,95 +585,88 @@ func (sm *sessionManager) dialSession(ctx context.Context) (*webtransport.Sessio
 	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
 	defer cancel()
 
-	// Parse and normalize base URL
-	u, err := url.Parse(sm.config.URL)
+	ep, err := ResolveEndpoint(sm.config.URL, sm.config.DialAddr, sm.config.SNI, sm.config.Host)
 	if err != nil {
-		return nil, fmt.Errorf("invalid config url: %w", err)
-	}
-
-	// Ensure port is present in the URL host (required by quic-go/webtransport)
-	if u.Port() == "" {
-		// Robustness: Check if port was accidentally appended to the path
-		// e.g., https://example.com/v1/api/sync:8080
-		if lastColon := strings.LastIndex(u.Path, ":"); lastColon != -1 {
-			possiblePort := u.Path[lastColon+1:]
-			// Check if it's a numeric port
-			isPort := true
-			for _, c := range possiblePort {
-				if c < '0' || c > '9' {
-					isPort = false
-					break
-				}
-			}
-			if isPort && possiblePort != "" {
-				newPort := possiblePort
-				u.Path = u.Path[:lastColon]
-				u.Host = net.JoinHostPort(u.Hostname(), newPort)
-				log.Printf("[WARNING] Misplaced port detected in URL path. Auto-corrected to %s (Path: %s)", u.Host, u.Path)
-			}
-		}
-
-		// If still no port, use default
-		if u.Port() == "" {
-			defaultPort := "443"
-			if u.Scheme == "http" {
-				defaultPort = "80"
-			}
-			u.Host = net.JoinHostPort(u.Hostname(), defaultPort)
-		}
+		return nil, err
 	}
+	hopPorts, err := ParsePortRange(sm.config.PortHopping.Ports)
+	if err != nil {
+		return nil, err
+	}
+	ep.DialAddr = hopDialAddr(ep.DialAddr, hopPorts)
+	u := ep.URL
+	sm.endpoint = ep
 
-	// Handle DialAddr override (e.g. for IP optimization)
-	finalAddr := u.Host
-	if sm.config.DialAddr != "" {
-		host, port, err := net.SplitHostPort(sm.config.DialAddr)
-		if err != nil {
-			// Handle missing port error (common for raw IPs/domains)
-			if strings.Contains(err.Error(), "missing port") || strings.Contains(err.Error(), "too many colons") {
-				host = sm.config.DialAddr
-				port = "443"
-			} else {
-				return nil, fmt.Errorf("invalid dial addr: %w", err)
-			}
-		}
-		u.Host = net.JoinHostPort(host, port)
-		finalAddr = u.Host
+	// The gateway only upgrades CONNECT requests carrying a valid auth token.
+	tokenPath := u.Path
+	if tokenPath == "" {
+		tokenPath = "/"
+	}
+	header := http.Header{}
+	if err := SetAuthToken(header, sm.config.PSK, tokenPath, time.Now()); err != nil {
+		return nil, fmt.Errorf("auth token: %w", err)
 	}
 
-	log.Printf("[DEBUG] Dialing WebTransport: %s (Target Host: %s)", u.String(), finalAddr)
-	_, sess, err := sm.dialer.Dial(ctx, u.String(), nil)
+	log.Printf("[DEBUG] Dialing WebTransport: %s (%s)", u.String(), ep)
+	ctx = withDialAddr(ctx, ep.DialAddr)
+	_, sess, err := sm.dialer.Dial(ctx, u.String(), header)
+	var echErr *tls.ECHRejectionError
+	if errors.As(err, &echErr) {
+		sess, err = sm.redialAfterECHRejection(ctx, u.String(), header, echErr)
+	}
 	if err != nil {
 		log.Printf("[DEBUG] Dial failed: %v", err)
-		return nil, fmt.Errorf("dial to %s failed: %w", u.Host, err)
+		return nil, fmt.Errorf("dial to %s failed: %w", ep.DialAddr, err)
 	}
 
 	return sess, nil
 }
 
-func (sm *sessionManager) monitorSession() {
-	if sm.session == nil {
-		return
+// redialAfterECHRejection applies the ECH fallback policy once the gateway
+// rejected ECH. Retry configs sent by the gateway are kept for later dials; a
+// cleartext retry applies to this dial only.
+func (sm *sessionManager) redialAfterECHRejection(ctx context.Context, dialURL string, header http.Header, rejection *tls.ECHRejectionError) (*webtransport.Session, error) {
+	configured := sm.dialer.TLSClientConfig
+	retry, err := echRetryConfig(configured, rejection, sm.config.ECHFallback)
+	if err != nil {
+		return nil, err
 	}
-	// Wait for context cancellation or session close in background
-	go func() {
-		<-sm.ctx.Done()
-		sm.mu.Lock()
-		if sm.session != nil {
-			reason := "closed"
-			log.Printf("[DEBUG] Session %s closed (reason: context done)", sm.sessionID)
-			sm.onEvent(NewSessionClosedEvent(sm.sessionID, &reason, nil))
-			sm.session = nil
-		}
-		sm.mu.Unlock()
-		sm.metrics.RecordSessionEnd()
-	}()
+	if len(rejection.RetryConfigList) == 0 {
+		defer func() { sm.dialer.TLSClientConfig = configured }()
+	}
+	sm.dialer.TLSClientConfig = retry
+	_, sess, err := sm.dialer.Dial(ctx, dialURL, header)
+	return sess, err
+}
 
+// monitorSession pings session until the manager closes or the session is
+// replaced by a rotation, hop or reconnect.
+func (sm *sessionManager) monitorSession(session Session) {
 	// Periodic ping loop with jitter
 	for {
 		select {
 		case <-sm.ctx.Done():
+			sm.mu.Lock()
+			current := sm.session == session
+			if current {
+				reason := "closed"
+				log.Printf("[DEBUG] Session %s closed (reason: context done)", sm.sessionID)
+				sm.onEvent(NewSessionClosedEvent(sm.sessionID, &reason, nil))
+				sm.session = nil
+			}
+			sm.mu.Unlock()
+			if current {
+				sm.metrics.RecordSessionEnd()
+			}
 			return
 		case <-time.After(jitterDuration(4*time.Second, 7*time.Second)):
+			sm.mu.RLock()
+			current := sm.session == session
+			sm.mu.RUnlock()
+			if !current {
+				return
+			}
+			sm.maybeRekey()
 			sm.pingOnce()
 		}
 	}
@@ -440,6 +714,86 @@ func (sm *sessionManager) pingOnce() {
 	sm.metrics.RecordLatency(latency)
 }
 
+// rekeyThreshold returns the counter value at which the session rekeys.
+func (sm *sessionManager) rekeyThreshold() uint64 {
+	threshold := sm.config.RekeyThreshold
+	if threshold == 0 || threshold > MaxCounterValue {
+		threshold = DefaultRekeyThreshold
+	}
+	return threshold
+}
+
+// maybeRekey rekeys the session once its counter passes the threshold.
+func (sm *sessionManager) maybeRekey() {
+	sm.mu.RLock()
+	ng := sm.nonceGen
+	sm.mu.RUnlock()
+	if ng == nil || ng.Counter() < sm.rekeyThreshold() {
+		return
+	}
+	if err := sm.rekey(); err != nil {
+		log.Printf("[DEBUG] Session rekey failed: %v", err)
+	}
+}
+
+// rekey rolls the session to a fresh SessionID and tells the gateway to roll
+// its generator too, keeping the WebTransport session and its streams alive.
+func (sm *sessionManager) rekey() error {
+	sm.mu.RLock()
+	ng := sm.nonceGen
+	codec := sm.codec
+	id := sm.sessionID
+	sm.mu.RUnlock()
+	if ng == nil {
+		return fmt.Errorf("no active session")
+	}
+
+	counter := ng.Counter()
+	if err := ng.Rekey(); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(sm.ctx, 5*time.Second)
+	defer cancel()
+	stream, _, err := sm.OpenStream(ctx)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = stream.SetDeadline(deadline)
+	}
+
+	psk := sm.psk()
+	record, err := BuildRekeyRecord(psk, ng)
+	if err != nil {
+		return err
+	}
+	if _, err := stream.Write(record); err != nil {
+		return err
+	}
+
+	reader := NewRecordReader(stream)
+	reader.SetCodec(codec)
+	reply, err := reader.ReadNextRecord()
+	if err != nil {
+		return err
+	}
+	if reply.RawBuffer != nil {
+		defer PutBuffer(reply.RawBuffer)
+	}
+	if reply.Type == TypeError {
+		return fmt.Errorf("gateway rejected rekey: %s", reply.ErrorMessage)
+	}
+	if _, err := ParseRekeyRecord(reply, psk); err != nil {
+		return err
+	}
+
+	log.Printf("[DEBUG] Session %s rekeyed to epoch %d at counter %d", id, ng.Epoch(), counter)
+	sm.onEvent(NewSessionRekeyedEvent(id, ng.Epoch(), counter))
+	return nil
+}
+
 // generateSessionID creates a unique session identifier.
 func generateSessionID() string {
 	return fmt.Sprintf("sess-%d", time.Now().UnixNano())
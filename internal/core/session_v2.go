@@ -263,7 +263,7 @@ func (sm *sessionManagerV2) emitSessionEstablished(s *sessionV2) {
 	localAddr := ""
 	remoteAddr := ""
 	// webtransport.Session doesn't have Connection() method
-	sm.onEvent(NewSessionEstablishedEvent(s.id, localAddr, remoteAddr))
+	sm.onEvent(NewSessionEstablishedEvent(s.id, localAddr, remoteAddr, nil))
 }
 
 // Helper functions
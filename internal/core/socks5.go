@@ -1,21 +1,23 @@
 package core
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
+	"strconv"
 	"sync/atomic"
 	"time"
-
-	"github.com/armon/go-socks5"
 )
 
-// socks5Server wraps the SOCKS5 server for Core integration.
+// socks5Server serves SOCKS5 CONNECT and UDP ASSOCIATE for Core.
 type socks5Server struct {
 	addr     string
 	core     *Core
-	server   *socks5.Server
 	listener net.Listener
 	cancel   context.CancelFunc
 }
@@ -30,81 +32,6 @@ func newSocks5Server(addr string, core *Core) *socks5Server {
 
 // start starts the SOCKS5 server.
 func (s *socks5Server) start() error {
-	conf := &socks5.Config{
-		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
-			host, portStr, err := net.SplitHostPort(addr)
-			if err != nil {
-				return nil, err
-			}
-			
-			port, err := parsePort(portStr)
-			if err != nil {
-				return nil, err
-			}
-			
-			// Rule matching
-			target := TargetAddress{Host: host, Port: int(port)}
-			var action ActionType = ActionProxy
-			var ruleID string
-			
-			if s.core.ruleEngine != nil {
-				req := &MatchRequest{
-					Domain: host,
-					Port:   int(port),
-				}
-				
-				// Optional: Resolve IP if needed for IP matching
-				if ip := net.ParseIP(host); ip != nil {
-					req.IP = ip
-				}
-				
-				res, err := s.core.ruleEngine.Match(req)
-				if err == nil {
-					action = res.Action
-					ruleID = res.RuleID
-				}
-			}
-			
-			log.Printf("[SOCKS5] %s -> %s (action=%s, rule=%s)", host, addr, action, ruleID)
-			s.core.emit(NewCoreErrorEvent("socks5.info", fmt.Sprintf("Proxying to %s:%d (%s)", host, port, action), false))
-
-			switch action {
-			case ActionDirect:
-				return net.Dial(network, addr)
-				
-			case ActionBlock, ActionReject:
-				return nil, fmt.Errorf("blocked by rule: %s", ruleID)
-				
-			case ActionProxy:
-				fallthrough
-			default:
-				// Open stream through Core
-				log.Printf("[SOCKS5] Opening stream to %s:%d", target.Host, target.Port)
-				handle, err := s.core.OpenStream(target, nil)
-				if err != nil {
-					log.Printf("[SOCKS5] OpenStream failed: %v", err)
-					s.core.emit(NewCoreErrorEvent(ErrTargetConnect, err.Error(), false))
-					return nil, err
-				}
-				log.Printf("[SOCKS5] Stream opened: %s", handle.ID)
-				
-				return &streamConn{
-					handle:  handle,
-					core:    s.core,
-					local:   dummyAddr("socks-local"),
-					remote:  dummyAddr(fmt.Sprintf("%s:%d", host, port)),
-				}, nil
-			}
-		},
-	}
-
-	server, err := socks5.New(conf)
-	if err != nil {
-		return err
-	}
-
-	s.server = server
-
 	// Start listening in background
 	ctx, cancel := context.WithCancel(context.Background())
 	s.cancel = cancel
@@ -116,20 +43,184 @@ func (s *socks5Server) start() error {
 	s.listener = listener
 
 	go func() {
-		if err := s.server.Serve(listener); err != nil {
-			// Log error but don't crash
-			select {
-			case <-ctx.Done():
-				// Expected shutdown
-			default:
-				s.core.emit(NewCoreErrorEvent(ErrNetwork, err.Error(), false))
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				// Log error but don't crash
+				select {
+				case <-ctx.Done():
+					// Expected shutdown
+				default:
+					s.core.emit(NewCoreErrorEvent(ErrNetwork, err.Error(), false))
+				}
+				return
 			}
+			go s.serveConn(conn)
 		}
 	}()
 
 	return nil
 }
 
+// dial connects to host:port according to the routing rules: directly, via a
+// Core stream, or not at all. Failures carry an ErrorCode (see ErrorCodeOf).
+func (s *socks5Server) dial(host string, port uint16) (net.Conn, error) {
+	addr := net.JoinHostPort(host, strconv.Itoa(int(port)))
+
+	// Rule matching
+	target := TargetAddress{Host: host, Port: int(port)}
+	var action ActionType = ActionProxy
+	var ruleID string
+	
+	if s.core.ruleEngine != nil {
+		req := &MatchRequest{
+			Domain: host,
+			Port:   int(port),
+		}
+		
+		// Optional: Resolve IP if needed for IP matching
+		if ip := net.ParseIP(host); ip != nil {
+			req.IP = ip
+		}
+		
+		res, err := s.core.ruleEngine.Match(req)
+		if err == nil {
+			action = res.Action
+			ruleID = res.RuleID
+		}
+	}
+	
+	log.Printf("[SOCKS5] %s -> %s (action=%s, rule=%s)", host, addr, action, ruleID)
+	s.core.emit(NewCoreErrorEvent("socks5.info", fmt.Sprintf("Proxying to %s:%d (%s)", host, port, action), false))
+
+	switch action {
+	case ActionDirect:
+		return net.Dial("tcp", addr)
+		
+	case ActionBlock, ActionReject:
+		return nil, NewStreamError(CodeACLDenied, fmt.Sprintf("blocked by rule: %s", ruleID))
+		
+	case ActionProxy:
+		fallthrough
+	default:
+		// Open stream through Core
+		log.Printf("[SOCKS5] Opening stream to %s:%d", target.Host, target.Port)
+		handle, err := s.core.OpenStream(target, nil)
+		if err != nil {
+			log.Printf("[SOCKS5] OpenStream failed: %v", err)
+			s.core.emit(NewCoreErrorEvent(ErrTargetConnect, err.Error(), false))
+			return nil, err
+		}
+		log.Printf("[SOCKS5] Stream opened: %s", handle.ID)
+		
+		return &streamConn{
+			handle:  handle,
+			core:    s.core,
+			local:   dummyAddr("socks-local"),
+			remote:  streamRemoteAddr(handle, addr),
+		}, nil
+	}
+}
+
+// serveConn negotiates the SOCKS5 greeting and dispatches the request.
+// Only CONNECT and UDP ASSOCIATE are supported.
+func (s *socks5Server) serveConn(conn net.Conn) {
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+
+	greeting := make([]byte, 2)
+	if _, err := io.ReadFull(br, greeting); err != nil || greeting[0] != socks5Version {
+		return
+	}
+	methods := make([]byte, int(greeting[1]))
+	if _, err := io.ReadFull(br, methods); err != nil {
+		return
+	}
+	if bytes.IndexByte(methods, 0x00) < 0 {
+		_, _ = conn.Write([]byte{socks5Version, 0xff})
+		return
+	}
+	if _, err := conn.Write([]byte{socks5Version, 0x00}); err != nil {
+		return
+	}
+
+	request, err := br.Peek(2)
+	if err != nil {
+		return
+	}
+	switch request[1] {
+	case socks5CmdConnect:
+		if err := s.handleConnect(conn, br); err != nil {
+			log.Printf("[SOCKS5] Connect failed: %v", err)
+		}
+	case socks5CmdAssociate:
+		if err := s.handleUDPAssociate(conn, br); err != nil {
+			log.Printf("[SOCKS5-UDP] Associate failed: %v", err)
+		}
+	default:
+		_ = writeSocksReply(conn, socks5RepCmdNotSupp, "0.0.0.0", 0)
+	}
+}
+
+// handleConnect serves a SOCKS5 CONNECT request. br is positioned at the start
+// of the request (VER CMD RSV ATYP ...). The reply code follows the ErrorCode
+// of a failed dial.
+func (s *socks5Server) handleConnect(conn net.Conn, br *bufio.Reader) error {
+	header := make([]byte, 3)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return err
+	}
+	host, port, err := readSocksAddr(br)
+	if err != nil {
+		_ = writeSocksReply(conn, socks5RepAddrNotSupp, "0.0.0.0", 0)
+		return err
+	}
+
+	target, err := s.dial(host, port)
+	if err != nil {
+		code := ErrorCodeOf(err)
+		_ = writeSocksReply(conn, code.SOCKS5Reply(), "0.0.0.0", 0)
+		return fmt.Errorf("%s:%d: %w", host, port, err)
+	}
+	defer target.Close()
+
+	// BND.ADDR: our local address for direct connections, the target address
+	// resolved by the gateway for proxied streams.
+	bindHost, bindPort := "0.0.0.0", uint16(0)
+	bound := target.LocalAddr()
+	if _, ok := target.(*streamConn); ok {
+		bound = target.RemoteAddr()
+	}
+	if tcpAddr, ok := bound.(*net.TCPAddr); ok {
+		bindHost, bindPort = tcpAddr.IP.String(), uint16(tcpAddr.Port)
+	}
+	if err := writeSocksReply(conn, socks5RepSuccess, bindHost, bindPort); err != nil {
+		return err
+	}
+
+	// Each leg half-closes its destination on EOF so the other leg can drain;
+	// an error on either leg tears both down.
+	done := make(chan struct{}, 2)
+	pipe := func(dst net.Conn, src io.Reader) {
+		defer func() { done <- struct{}{} }()
+		if _, err := io.Copy(dst, src); err != nil {
+			dst.Close()
+			conn.Close()
+			return
+		}
+		if cw, ok := dst.(closeWriter); ok {
+			cw.CloseWrite()
+		} else {
+			dst.Close()
+		}
+	}
+	go pipe(target, br)
+	go pipe(conn, target)
+	<-done
+	<-done
+	return nil
+}
+
 // stop stops the SOCKS5 server.
 func (s *socks5Server) stop() error {
 	if s.cancel != nil {
@@ -180,6 +271,10 @@ func (c *streamConn) Read(p []byte) (int, error) {
 	if n > 0 && c.core.metrics != nil {
 		c.core.metrics.RecordBytesReceived(uint64(n))
 	}
+	var se *StreamError
+	if errors.As(err, &se) {
+		c.core.emit(NewStreamErrorEvent(c.handle.ID, se.Code.String()))
+	}
 	return n, err
 }
 
@@ -209,12 +304,41 @@ func (c *streamConn) Close() error {
 	return c.core.CloseStream(c.handle)
 }
 
+// CloseWrite half-closes the stream: the gateway half-closes the target while
+// responses keep flowing back. handleConnect calls it when the client finishes.
+func (c *streamConn) CloseWrite() error {
+	stream, ok := c.core.GetUnderlyingStream(c.handle)
+	if !ok {
+		return fmt.Errorf("stream not found")
+	}
+	if cw, ok := stream.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return c.Close()
+}
+
+// closeWriter is implemented by connections that support half-close.
+type closeWriter interface {
+	CloseWrite() error
+}
+
 func (c *streamConn) LocalAddr() net.Addr  { return c.local }
 func (c *streamConn) RemoteAddr() net.Addr { return c.remote }
 func (c *streamConn) SetDeadline(t time.Time) error       { return nil }
 func (c *streamConn) SetReadDeadline(t time.Time) error   { return nil }
 func (c *streamConn) SetWriteDeadline(t time.Time) error  { return nil }
 
+// streamRemoteAddr returns the gateway-reported target address of a stream,
+// falling back to the requested address.
+func streamRemoteAddr(handle StreamHandle, requested string) net.Addr {
+	if handle.RemoteAddr != "" {
+		if addr, err := net.ResolveTCPAddr("tcp", handle.RemoteAddr); err == nil {
+			return addr
+		}
+	}
+	return dummyAddr(requested)
+}
+
 type dummyAddr string
 
 func (d dummyAddr) Network() string { return string(d) }
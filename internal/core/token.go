@@ -0,0 +1,194 @@
+package core
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Pre-upgrade authentication.
+//
+// The client proves knowledge of its PSK in the WebTransport CONNECT request,
+// so the gateway can answer unauthenticated requests on the secret path with
+// the decoy site instead of a session. The token is
+//
+//	base64url(KeyHint(8B) || UnixSeconds(8B) || Nonce(8B) || Tag(16B))
+//	KeyHint = HMAC-SHA256(HKDF(PSK, "key-hint"), UnixSeconds || Nonce)[:8]
+//	Tag = HMAC-SHA256(HKDF(PSK, "auth-token"), KeyHint || UnixSeconds || Nonce || Path)[:16]
+//
+// and is sent as "Authorization: Bearer <token>" (or the "token" query
+// parameter). It is accepted within DefaultReplayWindow of the gateway clock,
+// and an AuthTokenGuard rejects a second use of its (KeyHint, Nonce) pair
+// while it is still fresh.
+const (
+	// AuthTokenQuery is the query parameter accepted in place of the header.
+	AuthTokenQuery = "token"
+
+	authTokenLabel  = "auth-token"
+	authTokenScheme = "Bearer "
+	authTokenNonce  = 8
+	authTokenTag    = 16
+	authTokenLength = KeyHintLength + 8 + authTokenNonce + authTokenTag
+)
+
+var (
+	// ErrAuthTokenMissing is returned for requests without a token.
+	ErrAuthTokenMissing = errors.New("missing auth token")
+	// ErrAuthTokenInvalid is returned for malformed or forged tokens.
+	ErrAuthTokenInvalid = errors.New("invalid auth token")
+	// ErrAuthTokenExpired is returned for tokens outside the time window.
+	ErrAuthTokenExpired = errors.New("auth token outside allowed window")
+	// ErrAuthTokenReplayed is returned for a token that was already used.
+	ErrAuthTokenReplayed = errors.New("auth token replayed")
+)
+
+// BuildAuthToken creates the token for a CONNECT request to path.
+func BuildAuthToken(psk, path string, now time.Time) (string, error) {
+	token := make([]byte, authTokenLength)
+	binary.BigEndian.PutUint64(token[KeyHintLength:], uint64(now.Unix()))
+	if _, err := rand.Read(token[KeyHintLength+8 : authTokenLength-authTokenTag]); err != nil {
+		return "", err
+	}
+	hint := KeyHintFor(psk, token[KeyHintLength:authTokenLength-authTokenTag])
+	copy(token, hint[:])
+	tag, err := authTokenMAC(psk, token[:authTokenLength-authTokenTag], path)
+	if err != nil {
+		return "", err
+	}
+	copy(token[authTokenLength-authTokenTag:], tag)
+	return base64.RawURLEncoding.EncodeToString(token), nil
+}
+
+// SetAuthToken adds the token for psk to a CONNECT request header.
+func SetAuthToken(header http.Header, psk, path string, now time.Time) error {
+	token, err := BuildAuthToken(psk, path, now)
+	if err != nil {
+		return err
+	}
+	header.Set("Authorization", authTokenScheme+token)
+	return nil
+}
+
+// AuthTokenFromRequest extracts the token from the Authorization header or
+// the query string; it returns "" if neither carries one.
+func AuthTokenFromRequest(r *http.Request) string {
+	if v := r.Header.Get("Authorization"); strings.HasPrefix(v, authTokenScheme) {
+		return strings.TrimSpace(v[len(authTokenScheme):])
+	}
+	return r.URL.Query().Get(AuthTokenQuery)
+}
+
+// VerifyAuthToken resolves the user and key whose PSK produced token for
+// path. Like records, a known key hint selects one key; otherwise the
+// fallback user's valid keys are tried.
+func (t *UserTable) VerifyAuthToken(token, path string, now time.Time) (*Credential, error) {
+	if token == "" {
+		return nil, ErrAuthTokenMissing
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || len(raw) != authTokenLength {
+		return nil, ErrAuthTokenInvalid
+	}
+	skew := now.Unix() - int64(binary.BigEndian.Uint64(raw[KeyHintLength:]))
+	if skew < 0 {
+		skew = -skew
+	}
+	if skew > int64(DefaultReplayWindow/time.Second) {
+		return nil, ErrAuthTokenExpired
+	}
+
+	var hint KeyHint
+	copy(hint[:], raw)
+	signed, tag := raw[:authTokenLength-authTokenTag], raw[authTokenLength-authTokenTag:]
+	return t.authenticate(hint, raw[KeyHintLength:authTokenLength-authTokenTag], true, now, func(psk string) error {
+		want, err := authTokenMAC(psk, signed, path)
+		if err != nil {
+			return err
+		}
+		if !hmac.Equal(tag, want) {
+			return ErrAuthTokenInvalid
+		}
+		return nil
+	})
+}
+
+func authTokenMAC(psk string, signed []byte, path string) ([]byte, error) {
+	key, err := deriveKey(psk, []byte(authTokenLabel))
+	if err != nil {
+		return nil, fmt.Errorf("derive token key: %w", err)
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(signed)
+	mac.Write([]byte(path))
+	return mac.Sum(nil)[:authTokenTag], nil
+}
+
+// AuthTokenGuard remembers the (KeyHint, Nonce) pairs of accepted tokens
+// until they expire. A token is fresh for at most 2*DefaultReplayWindow of
+// gateway time (its timestamp may lead or trail the clock), so pairs are kept
+// in two buckets of that width: new pairs go into the current bucket, and a
+// pair is forgotten once its bucket is two buckets old. It is safe for
+// concurrent use.
+type AuthTokenGuard struct {
+	mu       sync.Mutex
+	epoch    int64
+	current  map[authTokenID]struct{}
+	previous map[authTokenID]struct{}
+}
+
+// authTokenID identifies a token by KeyHint || Nonce.
+type authTokenID [KeyHintLength + authTokenNonce]byte
+
+// NewAuthTokenGuard creates an empty guard.
+func NewAuthTokenGuard() *AuthTokenGuard {
+	return &AuthTokenGuard{
+		current:  make(map[authTokenID]struct{}),
+		previous: make(map[authTokenID]struct{}),
+	}
+}
+
+// Check records the pair of token, which must have passed VerifyAuthToken,
+// and returns ErrAuthTokenReplayed if it was recorded before.
+func (g *AuthTokenGuard) Check(token string, now time.Time) error {
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || len(raw) != authTokenLength {
+		return ErrAuthTokenInvalid
+	}
+	var id authTokenID
+	copy(id[:KeyHintLength], raw)
+	copy(id[KeyHintLength:], raw[KeyHintLength+8:])
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.rotate(now.UnixNano() / int64(2*DefaultReplayWindow))
+	if _, ok := g.current[id]; ok {
+		return ErrAuthTokenReplayed
+	}
+	if _, ok := g.previous[id]; ok {
+		return ErrAuthTokenReplayed
+	}
+	g.current[id] = struct{}{}
+	return nil
+}
+
+// rotate advances the buckets to epoch.
+func (g *AuthTokenGuard) rotate(epoch int64) {
+	if epoch <= g.epoch {
+		return
+	}
+	if epoch == g.epoch+1 {
+		g.previous = g.current
+	} else {
+		g.previous = make(map[authTokenID]struct{})
+	}
+	g.current = make(map[authTokenID]struct{})
+	g.epoch = epoch
+}
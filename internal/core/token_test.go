@@ -0,0 +1,98 @@
+package core
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// TestAuthTokenVerify verifies tokens resolve to their user and fail for the
+// wrong path, a forged tag, an unknown key or an old timestamp.
+func TestAuthTokenVerify(t *testing.T) {
+	table, err := NewUserTable([]User{
+		{ID: "alice", PSK: "alice-psk", Enabled: true},
+		{ID: "default", PSK: "shared-psk", Enabled: true},
+	}, "default")
+	if err != nil {
+		t.Fatalf("NewUserTable: %v", err)
+	}
+	now := time.Now()
+	const path = "/v1/api/sync"
+
+	token, err := BuildAuthToken("alice-psk", path, now)
+	if err != nil {
+		t.Fatalf("BuildAuthToken: %v", err)
+	}
+	cred, err := table.VerifyAuthToken(token, path, now.Add(5*time.Second))
+	if err != nil || cred.User.ID != "alice" {
+		t.Fatalf("VerifyAuthToken: got %+v err %v, want alice", cred, err)
+	}
+
+	if _, err := table.VerifyAuthToken(token, "/other", now); !errors.Is(err, ErrAuthTokenInvalid) {
+		t.Errorf("wrong path: got %v, want ErrAuthTokenInvalid", err)
+	}
+	raw, _ := base64.RawURLEncoding.DecodeString(token)
+	raw[len(raw)-1] ^= 1
+	if _, err := table.VerifyAuthToken(base64.RawURLEncoding.EncodeToString(raw), path, now); !errors.Is(err, ErrAuthTokenInvalid) {
+		t.Error("forged tag accepted")
+	}
+	stranger, _ := BuildAuthToken("stranger-psk", path, now)
+	if _, err := table.VerifyAuthToken(stranger, path, now); err == nil {
+		t.Error("unknown psk accepted")
+	}
+	if _, err := table.VerifyAuthToken(token, path, now.Add(DefaultReplayWindow+time.Second)); !errors.Is(err, ErrAuthTokenExpired) {
+		t.Errorf("stale token: got %v, want ErrAuthTokenExpired", err)
+	}
+	if _, err := table.VerifyAuthToken("", path, now); !errors.Is(err, ErrAuthTokenMissing) {
+		t.Errorf("empty token: got %v, want ErrAuthTokenMissing", err)
+	}
+}
+
+// TestAuthTokenFromRequest verifies the header takes precedence over the
+// query parameter.
+func TestAuthTokenFromRequest(t *testing.T) {
+	r := httptest.NewRequest(http.MethodConnect, "https://example.com/sync?token=query", nil)
+	if got := AuthTokenFromRequest(r); got != "query" {
+		t.Errorf("query token: got %q", got)
+	}
+	if err := SetAuthToken(r.Header, "psk", "/sync", time.Now()); err != nil {
+		t.Fatalf("SetAuthToken: %v", err)
+	}
+	if got := AuthTokenFromRequest(r); got == "query" || got == "" {
+		t.Errorf("header token: got %q", got)
+	}
+}
+
+// TestAuthTokenGuard verifies a token is accepted once and its pair is kept
+// for as long as the token can be fresh.
+func TestAuthTokenGuard(t *testing.T) {
+	now := time.Now()
+	token, err := BuildAuthToken("alice-psk", "/v1/api/sync", now)
+	if err != nil {
+		t.Fatalf("BuildAuthToken: %v", err)
+	}
+	other, err := BuildAuthToken("alice-psk", "/v1/api/sync", now)
+	if err != nil {
+		t.Fatalf("BuildAuthToken: %v", err)
+	}
+
+	g := NewAuthTokenGuard()
+	if err := g.Check(token, now); err != nil {
+		t.Fatalf("Check: %v", err)
+	}
+	if err := g.Check(other, now); err != nil {
+		t.Errorf("fresh nonce: got %v", err)
+	}
+	for _, later := range []time.Duration{0, DefaultReplayWindow, 2 * DefaultReplayWindow} {
+		if err := g.Check(token, now.Add(later)); !errors.Is(err, ErrAuthTokenReplayed) {
+			t.Errorf("replay after %v: got %v, want ErrAuthTokenReplayed", later, err)
+		}
+	}
+	// Once the token can no longer pass VerifyAuthToken, its pair is dropped.
+	if err := g.Check(token, now.Add(6*DefaultReplayWindow)); err != nil {
+		t.Errorf("expired pair kept: %v", err)
+	}
+}
@@ -0,0 +1,127 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"time"
+
+	webtransport "github.com/quic-go/webtransport-go"
+)
+
+// Transports.
+//
+// A session carries the record stream over WebTransport (QUIC), over WebSocket
+// on the gateway's TCP listener when UDP is blocked (see fallback.go), or in
+// memory (see pipe.go). The session manager only sees the interfaces below.
+// By default it dials the transports selected by SessionConfig.Transport;
+// Core.SetTransport installs any other Transport.
+
+// Stream is one bidirectional record stream. Close ends the sending side;
+// the receiving side stays readable until the peer ends it.
+type Stream interface {
+	io.ReadWriteCloser
+	SetDeadline(t time.Time) error
+	SetReadDeadline(t time.Time) error
+}
+
+// Session is a session with the gateway on one transport.
+type Session interface {
+	OpenStream(ctx context.Context) (Stream, error)
+	SendDatagram(b []byte) error
+	ReceiveDatagram(ctx context.Context) ([]byte, error)
+	Close(reason string) error
+	LocalAddr() net.Addr
+	RemoteAddr() net.Addr
+	// Protocol is the wire version confirmed by the gateway, "" if none.
+	Protocol() string
+	// Binding returns the keying material that binds server proofs to the
+	// session's connection (see TLSBinding).
+	Binding() ([]byte, error)
+	// Transport names the transport, e.g. TransportWebTransport.
+	Transport() string
+}
+
+// Transport dials sessions with the gateway.
+type Transport interface {
+	Dial(ctx context.Context) (Session, error)
+}
+
+// dialCarrier dials a session on the installed or configured transport. In
+// auto mode a failed QUIC dial falls back to WebSocket, and QUIC is skipped for
+// quicRetryInterval; reason then says why QUIC was not used.
+func (sm *sessionManager) dialCarrier(ctx context.Context) (session Session, reason string, err error) {
+	if sm.transport != nil {
+		session, err = sm.transport.Dial(ctx)
+		return session, "", err
+	}
+	mode, err := normalizeTransport(sm.config.Transport)
+	if err != nil {
+		return nil, "", err
+	}
+	switch {
+	case mode == TransportWebSocket:
+		session, err = sm.dialFallback(ctx)
+		return session, "configured", err
+	case mode == TransportAuto && time.Now().Before(sm.quicRetryAt):
+		session, err = sm.dialFallback(ctx)
+		return session, "QUIC unavailable, retrying it at " + sm.quicRetryAt.Format(time.TimeOnly), err
+	}
+
+	quicCtx := ctx
+	if mode == TransportAuto {
+		var cancel context.CancelFunc
+		quicCtx, cancel = context.WithTimeout(ctx, quicFallbackTimeout)
+		defer cancel()
+	}
+	wt, err := sm.dialSession(quicCtx)
+	if err == nil {
+		return NewWebTransportSession(wt), "", nil
+	}
+	if mode != TransportAuto || ctx.Err() != nil {
+		return nil, "", err
+	}
+
+	log.Printf("[WARNING] QUIC dial failed, falling back to WebSocket over TCP: %v", err)
+	session, fbErr := sm.dialFallback(ctx)
+	if fbErr != nil {
+		return nil, "", fmt.Errorf("%w; WebSocket fallback: %v", err, fbErr)
+	}
+	sm.quicRetryAt = time.Now().Add(quicRetryInterval)
+	return session, fmt.Sprintf("QUIC failed: %v", err), nil
+}
+
+// NewWebTransportSession wraps an established WebTransport session.
+func NewWebTransportSession(session *webtransport.Session) Session {
+	return &wtSession{session: session}
+}
+
+// wtSession carries a session over WebTransport.
+type wtSession struct {
+	session *webtransport.Session
+}
+
+func (s *wtSession) OpenStream(ctx context.Context) (Stream, error) {
+	return s.session.OpenStreamSync(ctx)
+}
+
+func (s *wtSession) SendDatagram(b []byte) error { return s.session.SendDatagram(b) }
+
+func (s *wtSession) ReceiveDatagram(ctx context.Context) ([]byte, error) {
+	return s.session.ReceiveDatagram(ctx)
+}
+
+func (s *wtSession) Close(reason string) error { return s.session.CloseWithError(0, reason) }
+
+func (s *wtSession) LocalAddr() net.Addr  { return s.session.LocalAddr() }
+func (s *wtSession) RemoteAddr() net.Addr { return s.session.RemoteAddr() }
+
+func (s *wtSession) Protocol() string { return s.session.SessionState().ApplicationProtocol }
+
+func (s *wtSession) Binding() ([]byte, error) {
+	return TLSBinding(s.session.SessionState().ConnectionState.TLS)
+}
+
+func (s *wtSession) Transport() string { return TransportWebTransport }
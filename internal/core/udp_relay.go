@@ -0,0 +1,405 @@
+package core
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// udpRelay tracks client-side UDP flows carried over session datagrams.
+// A flow maps to one SOCKS5 UDP association; the gateway keeps one UDP socket
+// per flow, so replies come back tagged with the same FlowID.
+type udpRelay struct {
+	core   *Core
+	mu     sync.RWMutex
+	flows  map[uint32]*udpFlow
+	nextID atomic.Uint32
+}
+
+// udpFlow is one relayed UDP association.
+type udpFlow struct {
+	id      uint32
+	sm      *sessionManager
+	deliver func(host string, port uint16, payload []byte)
+}
+
+func newUDPRelay(c *Core) *udpRelay {
+	return &udpRelay{
+		core:  c,
+		flows: make(map[uint32]*udpFlow),
+	}
+}
+
+// openFlow registers a new flow; deliver is invoked for every datagram the
+// gateway relays back for it.
+func (r *udpRelay) openFlow(deliver func(host string, port uint16, payload []byte)) (*udpFlow, error) {
+	id := r.nextID.Add(1)
+	sm := r.core.pickSessionManager(TargetAddress{Host: "udp-flow", Port: int(id)})
+	if sm == nil {
+		return nil, fmt.Errorf("no available session manager")
+	}
+	sm.setDatagramHandler(r.dispatch)
+
+	flow := &udpFlow{id: id, sm: sm, deliver: deliver}
+	r.mu.Lock()
+	r.flows[id] = flow
+	r.mu.Unlock()
+	return flow, nil
+}
+
+// closeFlow unregisters a flow. The gateway side expires on idle.
+func (r *udpRelay) closeFlow(id uint32) {
+	r.mu.Lock()
+	delete(r.flows, id)
+	r.mu.Unlock()
+}
+
+// dispatch routes a datagram from the gateway to its flow.
+func (r *udpRelay) dispatch(d *Datagram) {
+	r.mu.RLock()
+	flow, ok := r.flows[d.FlowID]
+	r.mu.RUnlock()
+	if !ok {
+		return
+	}
+	if r.core.metrics != nil {
+		r.core.metrics.RecordBytesReceived(uint64(len(d.Payload)))
+	}
+	flow.deliver(d.Host, d.Port, d.Payload)
+}
+
+// send relays one UDP payload to host:port through the gateway.
+func (f *udpFlow) send(host string, port uint16, payload []byte) error {
+	return f.sm.SendDatagram(&Datagram{
+		FlowID:  f.id,
+		Host:    host,
+		Port:    port,
+		Payload: payload,
+	})
+}
+
+// SOCKS5 constants used by the UDP ASSOCIATE path.
+const (
+	socks5Version         = 0x05
+	socks5CmdConnect      = 0x01
+	socks5CmdAssociate    = 0x03
+	socks5AtypIPv4        = 0x01
+	socks5AtypDomain      = 0x03
+	socks5AtypIPv6        = 0x04
+	socks5RepSuccess      = 0x00
+	socks5RepFailure      = 0x01
+	socks5RepAddrNotSupp  = 0x08
+	socksUDPHeaderMinimum = 4
+)
+
+// handleUDPAssociate serves a SOCKS5 UDP ASSOCIATE request. br is positioned at
+// the start of the request (VER CMD RSV ATYP ...). The association lives until
+// the TCP control connection closes.
+func (s *socks5Server) handleUDPAssociate(conn net.Conn, br *bufio.Reader) error {
+	header := make([]byte, 3)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return err
+	}
+	if _, _, err := readSocksAddr(br); err != nil {
+		_ = writeSocksReply(conn, socks5RepAddrNotSupp, "0.0.0.0", 0)
+		return err
+	}
+
+	bindIP := net.IPv4(127, 0, 0, 1)
+	if tcpAddr, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		bindIP = tcpAddr.IP
+	}
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: bindIP})
+	if err != nil {
+		_ = writeSocksReply(conn, socks5RepFailure, "0.0.0.0", 0)
+		return err
+	}
+	defer udpConn.Close()
+
+	assoc := &socksUDPAssociation{
+		server:    s,
+		udpConn:   udpConn,
+		actions:   make(map[string]ActionType),
+		direct:    make(map[string]*net.UDPAddr),
+		directSrc: make(map[netip.AddrPort]bool),
+	}
+	if tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		assoc.clientIP = tcpAddr.IP
+	}
+	flow, err := s.core.udpRelay.openFlow(assoc.deliverFromGateway)
+	if err != nil {
+		_ = writeSocksReply(conn, socks5RepFailure, "0.0.0.0", 0)
+		return err
+	}
+	assoc.flow = flow
+	defer s.core.udpRelay.closeFlow(flow.id)
+
+	bound := udpConn.LocalAddr().(*net.UDPAddr)
+	if err := writeSocksReply(conn, socks5RepSuccess, bound.IP.String(), uint16(bound.Port)); err != nil {
+		return err
+	}
+	log.Printf("[SOCKS5-UDP] Association %d bound on %s", flow.id, udpConn.LocalAddr())
+
+	go assoc.serve()
+
+	// RFC 1928: the association terminates when the TCP connection closes.
+	_, _ = io.Copy(io.Discard, br)
+	log.Printf("[SOCKS5-UDP] Association %d closed", flow.id)
+	return nil
+}
+
+// socksUDPAssociation relays between one local SOCKS5 UDP client and either
+// the gateway flow or direct targets, depending on rule matching.
+type socksUDPAssociation struct {
+	server   *socks5Server
+	udpConn  *net.UDPConn
+	flow     *udpFlow
+	clientIP net.IP
+
+	mu         sync.Mutex
+	clientAddr *net.UDPAddr
+	actions    map[string]ActionType   // target -> cached rule action
+	direct     map[string]*net.UDPAddr // target -> resolved direct address
+	directSrc  map[netip.AddrPort]bool // resolved direct addresses allowed to reply
+}
+
+func (a *socksUDPAssociation) serve() {
+	buf := make([]byte, 64*1024)
+	for {
+		n, src, err := a.udpConn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+
+		a.mu.Lock()
+		if a.clientAddr == nil && (a.clientIP == nil || a.clientIP.Equal(src.IP)) {
+			a.clientAddr = src
+		}
+		clientAddr := a.clientAddr
+		a.mu.Unlock()
+
+		if clientAddr != nil && src.IP.Equal(clientAddr.IP) && src.Port == clientAddr.Port {
+			a.handleFromClient(buf[:n])
+			continue
+		}
+		// Only direct targets the client already sent to may reply; drop
+		// anything else so other hosts cannot inject into the association.
+		if !a.isDirectSource(src) {
+			continue
+		}
+		a.sendToClient(src.IP.String(), uint16(src.Port), buf[:n])
+	}
+}
+
+func (a *socksUDPAssociation) handleFromClient(packet []byte) {
+	host, port, payload, err := parseSocksUDPPacket(packet)
+	if err != nil {
+		return
+	}
+
+	switch a.actionFor(host, port) {
+	case ActionDirect:
+		addr, err := a.directAddr(host, port)
+		if err != nil {
+			return
+		}
+		_, _ = a.udpConn.WriteToUDP(payload, addr)
+	case ActionBlock, ActionReject:
+		return
+	default:
+		if err := a.flow.send(host, port, payload); err != nil {
+			log.Printf("[SOCKS5-UDP] Relay to %s:%d failed: %v", host, port, err)
+			return
+		}
+		if a.server.core.metrics != nil {
+			a.server.core.metrics.RecordBytesSent(uint64(len(payload)))
+		}
+	}
+}
+
+func (a *socksUDPAssociation) actionFor(host string, port uint16) ActionType {
+	key := net.JoinHostPort(host, strconv.Itoa(int(port)))
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if action, ok := a.actions[key]; ok {
+		return action
+	}
+
+	action := ActionProxy
+	if a.server.core.ruleEngine != nil {
+		req := &MatchRequest{Domain: host, Port: int(port)}
+		if ip := net.ParseIP(host); ip != nil {
+			req.IP = ip
+		}
+		if res, err := a.server.core.ruleEngine.Match(req); err == nil {
+			action = res.Action
+		}
+	}
+	a.actions[key] = action
+	return action
+}
+
+func (a *socksUDPAssociation) directAddr(host string, port uint16) (*net.UDPAddr, error) {
+	key := net.JoinHostPort(host, strconv.Itoa(int(port)))
+	a.mu.Lock()
+	addr, ok := a.direct[key]
+	a.mu.Unlock()
+	if ok {
+		return addr, nil
+	}
+	addr, err := net.ResolveUDPAddr("udp", key)
+	if err != nil {
+		return nil, err
+	}
+	a.mu.Lock()
+	a.direct[key] = addr
+	a.directSrc[udpAddrPort(addr)] = true
+	a.mu.Unlock()
+	return addr, nil
+}
+
+// isDirectSource reports whether src is a registered direct target.
+func (a *socksUDPAssociation) isDirectSource(src *net.UDPAddr) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.directSrc[udpAddrPort(src)]
+}
+
+// udpAddrPort normalizes addr so IPv4 and IPv4-mapped IPv6 forms compare equal.
+func udpAddrPort(addr *net.UDPAddr) netip.AddrPort {
+	ap := addr.AddrPort()
+	return netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port())
+}
+
+func (a *socksUDPAssociation) deliverFromGateway(host string, port uint16, payload []byte) {
+	a.sendToClient(host, port, payload)
+}
+
+func (a *socksUDPAssociation) sendToClient(host string, port uint16, payload []byte) {
+	a.mu.Lock()
+	clientAddr := a.clientAddr
+	a.mu.Unlock()
+	if clientAddr == nil {
+		return
+	}
+	header, err := buildSocksUDPHeader(host, port)
+	if err != nil {
+		return
+	}
+	_, _ = a.udpConn.WriteToUDP(append(header, payload...), clientAddr)
+}
+
+// readSocksAddr reads ATYP DST.ADDR DST.PORT from r.
+func readSocksAddr(r io.Reader) (string, uint16, error) {
+	atyp := make([]byte, 1)
+	if _, err := io.ReadFull(r, atyp); err != nil {
+		return "", 0, err
+	}
+	var host string
+	switch atyp[0] {
+	case socks5AtypIPv4:
+		ip := make([]byte, 4)
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", 0, err
+		}
+		host = net.IP(ip).String()
+	case socks5AtypIPv6:
+		ip := make([]byte, 16)
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", 0, err
+		}
+		host = net.IP(ip).String()
+	case socks5AtypDomain:
+		l := make([]byte, 1)
+		if _, err := io.ReadFull(r, l); err != nil {
+			return "", 0, err
+		}
+		domain := make([]byte, int(l[0]))
+		if _, err := io.ReadFull(r, domain); err != nil {
+			return "", 0, err
+		}
+		host = string(domain)
+	default:
+		return "", 0, fmt.Errorf("unsupported address type: %d", atyp[0])
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, port); err != nil {
+		return "", 0, err
+	}
+	return host, binary.BigEndian.Uint16(port), nil
+}
+
+// appendSocksAddr appends ATYP ADDR PORT for host:port.
+func appendSocksAddr(dst []byte, host string, port uint16) ([]byte, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			dst = append(dst, socks5AtypIPv4)
+			dst = append(dst, ip4...)
+		} else {
+			dst = append(dst, socks5AtypIPv6)
+			dst = append(dst, ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return nil, errors.New("domain too long")
+		}
+		dst = append(dst, socks5AtypDomain, byte(len(host)))
+		dst = append(dst, host...)
+	}
+	return binary.BigEndian.AppendUint16(dst, port), nil
+}
+
+// parseSocksUDPPacket parses RSV(2) FRAG(1) ATYP DST.ADDR DST.PORT DATA.
+// Fragmented packets are not supported and are rejected.
+func parseSocksUDPPacket(packet []byte) (string, uint16, []byte, error) {
+	if len(packet) < socksUDPHeaderMinimum {
+		return "", 0, nil, errors.New("socks udp packet too short")
+	}
+	if packet[2] != 0 {
+		return "", 0, nil, errors.New("socks udp fragmentation not supported")
+	}
+	r := &countingReader{data: packet[3:]}
+	host, port, err := readSocksAddr(r)
+	if err != nil {
+		return "", 0, nil, err
+	}
+	return host, port, packet[3+r.offset:], nil
+}
+
+// buildSocksUDPHeader builds RSV(2) FRAG(1) ATYP ADDR PORT for a reply.
+func buildSocksUDPHeader(host string, port uint16) ([]byte, error) {
+	return appendSocksAddr([]byte{0, 0, 0}, host, port)
+}
+
+// writeSocksReply writes a SOCKS5 reply carrying BND.ADDR/BND.PORT.
+func writeSocksReply(w io.Writer, rep byte, bindHost string, bindPort uint16) error {
+	reply, err := appendSocksAddr([]byte{socks5Version, rep, 0}, bindHost, bindPort)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(reply)
+	return err
+}
+
+// countingReader reads from a byte slice and tracks the consumed offset.
+type countingReader struct {
+	data   []byte
+	offset int
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	if r.offset >= len(r.data) {
+		return 0, io.EOF
+	}
+	n := copy(p, r.data[r.offset:])
+	r.offset += n
+	return n, nil
+}
@@ -0,0 +1,286 @@
+package core
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Multi-user authentication.
+//
+// Every user has its own PSK. The client puts a key hint in the first
+// KeyHintLength bytes of the metadata padding, so the gateway picks the right
+// key by checking a truncated HMAC per key instead of trial-decrypting with
+// every PSK. The hint is keyed by the PSK and computed over the record's
+// SessionID || Counter, so it changes with every record and does not link a
+// user's streams. Gateways that predate users ignore padding, and metadata
+// without a known hint falls back to the table's default user.
+
+// KeyHintLength is the size of the key hint at the start of metadata padding.
+const KeyHintLength = 8
+
+// keyHintLabel separates the key hint from keys derived from the same PSK.
+const keyHintLabel = "key-hint"
+
+var (
+	// ErrUnknownUser is returned when a metadata record matches no user.
+	ErrUnknownUser = errors.New("unknown user")
+	// ErrUserDisabled is returned for metadata of a disabled user.
+	ErrUserDisabled = errors.New("user disabled")
+)
+
+// KeyHint identifies a PSK to its holder without revealing it.
+type KeyHint [KeyHintLength]byte
+
+// keyHintKey derives the key that hints of psk are computed with.
+func keyHintKey(psk string) ([]byte, error) {
+	return deriveKey(psk, []byte(keyHintLabel))
+}
+
+// keyHint computes the hint for seed with a key from keyHintKey.
+func keyHint(key, seed []byte) KeyHint {
+	var hint KeyHint
+	mac := hmac.New(sha256.New, key)
+	mac.Write(seed)
+	copy(hint[:], mac.Sum(nil))
+	return hint
+}
+
+// KeyHintFor computes the key hint of psk over seed: a record's
+// SessionID || Counter, or an auth token's UnixSeconds || Nonce.
+func KeyHintFor(psk string, seed []byte) KeyHint {
+	key, err := keyHintKey(psk)
+	if err != nil {
+		return KeyHint{}
+	}
+	return keyHint(key, seed)
+}
+
+// recordHintSeed returns the SessionID || Counter a record's hint covers.
+func recordHintSeed(sessionID []byte, counter uint64) []byte {
+	seed := make([]byte, 0, len(sessionID)+8)
+	seed = append(seed, sessionID...)
+	return binary.BigEndian.AppendUint64(seed, counter)
+}
+
+// RecordKeyHint returns the key hint carried in the padding of a metadata,
+// key exchange or server proof record, and the seed it was computed over.
+func RecordKeyHint(record *Record) (KeyHint, []byte, bool) {
+	var hint KeyHint
+	if (record.Type != TypeMetadata && record.Type != TypeKeyExchange && record.Type != TypeServerProof) || len(record.Padding) < KeyHintLength {
+		return hint, nil, false
+	}
+	copy(hint[:], record.Padding)
+	return hint, recordHintSeed(record.SessionID, record.Counter), true
+}
+
+// User is one gateway account.
+type User struct {
+	ID      string `json:"id"`
+	PSK     string `json:"psk"`
+	Enabled bool   `json:"enabled"`
+	// Secondary keys stay accepted until they expire (see keys.go).
+	Secondary []PSKKey `json:"secondary,omitempty"`
+	// MaxStreams caps the user's concurrent streams (0 = unlimited).
+	MaxStreams int `json:"max_streams,omitempty"`
+}
+
+// UnmarshalJSON decodes a user; Enabled defaults to true.
+func (u *User) UnmarshalJSON(data []byte) error {
+	type plain User
+	p := plain{Enabled: true}
+	if err := json.Unmarshal(data, &p); err != nil {
+		return err
+	}
+	*u = User(p)
+	return nil
+}
+
+// Keys returns the user's keys in match order: primary, then secondaries.
+func (u *User) Keys() []PSKKey {
+	keys := make([]PSKKey, 0, 1+len(u.Secondary))
+	keys = append(keys, PSKKey{PSK: u.PSK})
+	return append(keys, u.Secondary...)
+}
+
+// Credential is the user and key that authenticated a record.
+type Credential struct {
+	User *User
+	Key  int // index into User.Keys()
+	PSK  string
+	// Forward is set when PSK is a forward-secret session key (see kex.go).
+	Forward bool
+}
+
+// KeyName names the matched key for logs.
+func (c *Credential) KeyName() string {
+	return KeyName(c.Key)
+}
+
+// userKey locates one key of one user.
+type userKey struct {
+	user  *User
+	index int
+	hint  []byte // keyHintKey of the key
+}
+
+// UserTable resolves metadata records to users by key hint.
+type UserTable struct {
+	users    []*User
+	keys     []userKey
+	fallback *User
+}
+
+// NewUserTable indexes users by key hint. fallbackID names the user that
+// authenticates metadata without a known hint (legacy clients); "" disables
+// the fallback.
+func NewUserTable(users []User, fallbackID string) (*UserTable, error) {
+	t := &UserTable{}
+	ids := make(map[string]bool, len(users))
+	byKey := make(map[string]*User, len(users))
+	for i := range users {
+		u := users[i]
+		u.ID = strings.TrimSpace(u.ID)
+		u.PSK = strings.TrimSpace(u.PSK)
+		if u.ID == "" {
+			return nil, fmt.Errorf("user %d: missing id", i)
+		}
+		if u.PSK == "" {
+			return nil, fmt.Errorf("user %q: missing psk", u.ID)
+		}
+		if ids[u.ID] {
+			return nil, fmt.Errorf("user %q: duplicate id", u.ID)
+		}
+		ids[u.ID] = true
+		u.Secondary = append([]PSKKey(nil), u.Secondary...)
+		t.users = append(t.users, &u)
+		for k, key := range u.Keys() {
+			if key.PSK = strings.TrimSpace(key.PSK); key.PSK == "" {
+				return nil, fmt.Errorf("user %q: empty %s key", u.ID, KeyName(k))
+			}
+			if k > 0 {
+				u.Secondary[k-1].PSK = key.PSK
+			}
+			hint, err := keyHintKey(key.PSK)
+			if err != nil {
+				return nil, fmt.Errorf("user %q: %w", u.ID, err)
+			}
+			if other, ok := byKey[string(hint)]; ok {
+				return nil, fmt.Errorf("user %q: psk shared with %q", u.ID, other.ID)
+			}
+			byKey[string(hint)] = &u
+			t.keys = append(t.keys, userKey{user: &u, index: k, hint: hint})
+		}
+		if u.ID == fallbackID {
+			t.fallback = &u
+		}
+	}
+	if fallbackID != "" && t.fallback == nil {
+		return nil, fmt.Errorf("fallback user %q not found", fallbackID)
+	}
+	return t, nil
+}
+
+// LoadUsers reads a JSON array of users. Enabled defaults to true.
+func LoadUsers(path string) ([]User, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var raw []json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	users := make([]User, 0, len(raw))
+	for i, r := range raw {
+		var u User
+		if err := json.Unmarshal(r, &u); err != nil {
+			return nil, fmt.Errorf("parse %s: user %d: %w", path, i, err)
+		}
+		users = append(users, u)
+	}
+	return users, nil
+}
+
+// Users returns the users in table order.
+func (t *UserTable) Users() []*User {
+	return t.users
+}
+
+// Fallback returns the user for metadata without a known hint, or nil.
+func (t *UserTable) Fallback() *User {
+	return t.fallback
+}
+
+// DecryptMetadata resolves the record's user and key and decrypts it.
+func (t *UserTable) DecryptMetadata(record *Record, now time.Time) (*Credential, *Metadata, error) {
+	var meta *Metadata
+	cred, err := t.Authenticate(record, now, func(psk string) error {
+		var err error
+		meta, err = DecryptMetadata(record, psk)
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return cred, meta, nil
+}
+
+// Authenticate resolves the user and key of a hinted record. A known key
+// hint selects exactly one key; otherwise the fallback user's valid keys are
+// tried in order. open authenticates the record with a candidate PSK.
+func (t *UserTable) Authenticate(record *Record, now time.Time, open func(psk string) error) (*Credential, error) {
+	hint, seed, found := RecordKeyHint(record)
+	return t.authenticate(hint, seed, found, now, open)
+}
+
+func (t *UserTable) authenticate(hint KeyHint, seed []byte, found bool, now time.Time, open func(psk string) error) (*Credential, error) {
+	hinted, ok := userKey{}, false
+	if found {
+		hinted, ok = t.lookup(hint, seed)
+	}
+	u := t.fallback
+	if ok {
+		u = hinted.user
+	}
+	if u == nil {
+		return nil, ErrUnknownUser
+	}
+	if !u.Enabled {
+		return nil, fmt.Errorf("%w: %s", ErrUserDisabled, u.ID)
+	}
+
+	keys := u.Keys()
+	if !ok {
+		k, err := tryKeys(keys, now, open)
+		if err != nil {
+			return nil, err
+		}
+		return &Credential{User: u, Key: k, PSK: keys[k].PSK}, nil
+	}
+	key := keys[hinted.index]
+	if !key.Valid(now) {
+		return nil, fmt.Errorf("%w: %s of %s", ErrKeyExpired, KeyName(hinted.index), u.ID)
+	}
+	if err := open(key.PSK); err != nil {
+		return nil, err
+	}
+	return &Credential{User: u, Key: hinted.index, PSK: key.PSK}, nil
+}
+
+// lookup returns the key whose hint over seed is hint.
+func (t *UserTable) lookup(hint KeyHint, seed []byte) (userKey, bool) {
+	for _, k := range t.keys {
+		want := keyHint(k.hint, seed)
+		if hmac.Equal(hint[:], want[:]) {
+			return k, true
+		}
+	}
+	return userKey{}, false
+}
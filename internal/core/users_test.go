@@ -0,0 +1,133 @@
+package core
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func readMetadataRecord(t *testing.T, psk string) *Record {
+	t.Helper()
+	ng, err := NewNonceGenerator()
+	if err != nil {
+		t.Fatalf("NewNonceGenerator: %v", err)
+	}
+	raw, err := BuildMetadataRecordWithOptions("example.com", 443, Options{}, psk, ng)
+	if err != nil {
+		t.Fatalf("BuildMetadataRecordWithOptions: %v", err)
+	}
+	record, err := NewRecordReader(bytes.NewReader(raw)).ReadNextRecord()
+	if err != nil {
+		t.Fatalf("ReadNextRecord: %v", err)
+	}
+	return record
+}
+
+// TestUserTableKeyHint verifies metadata resolves to its user by key hint,
+// hintless metadata falls back to the default user, and disabled users fail.
+func TestUserTableKeyHint(t *testing.T) {
+	table, err := NewUserTable([]User{
+		{ID: "alice", PSK: "alice-psk", Enabled: true},
+		{ID: "bob", PSK: "bob-psk", Enabled: false},
+		{ID: "default", PSK: "shared-psk", Enabled: true},
+	}, "default")
+	if err != nil {
+		t.Fatalf("NewUserTable: %v", err)
+	}
+
+	now := time.Now()
+	cred, meta, err := table.DecryptMetadata(readMetadataRecord(t, "alice-psk"), now)
+	if err != nil {
+		t.Fatalf("DecryptMetadata(alice): %v", err)
+	}
+	if cred.User.ID != "alice" || meta.Host != "example.com" {
+		t.Errorf("got user %q host %q, want alice example.com", cred.User.ID, meta.Host)
+	}
+
+	if _, _, err := table.DecryptMetadata(readMetadataRecord(t, "bob-psk"), now); !errors.Is(err, ErrUserDisabled) {
+		t.Errorf("disabled user: got %v, want ErrUserDisabled", err)
+	}
+
+	// Legacy clients fill the padding with random bytes.
+	legacy := readMetadataRecord(t, "shared-psk")
+	clear(legacy.Padding)
+	if cred, _, err := table.DecryptMetadata(legacy, now); err != nil || cred.User.ID != "default" {
+		t.Errorf("hintless metadata: got %+v err %v, want default", cred, err)
+	}
+
+	noFallback, err := NewUserTable([]User{{ID: "alice", PSK: "alice-psk", Enabled: true}}, "")
+	if err != nil {
+		t.Fatalf("NewUserTable: %v", err)
+	}
+	if _, _, err := noFallback.DecryptMetadata(legacy, now); !errors.Is(err, ErrUnknownUser) {
+		t.Errorf("unknown hint without fallback: got %v, want ErrUnknownUser", err)
+	}
+}
+
+// TestKeyHintPerRecord verifies two records of one user carry different key
+// hints that both resolve to the user.
+func TestKeyHintPerRecord(t *testing.T) {
+	table, err := NewUserTable([]User{
+		{ID: "alice", PSK: "alice-psk", Enabled: true},
+		{ID: "carol", PSK: "carol-psk", Enabled: true},
+	}, "")
+	if err != nil {
+		t.Fatalf("NewUserTable: %v", err)
+	}
+	ng, err := NewNonceGenerator()
+	if err != nil {
+		t.Fatalf("NewNonceGenerator: %v", err)
+	}
+	var hints []KeyHint
+	for range 2 {
+		raw, err := BuildMetadataRecordWithOptions("example.com", 443, Options{}, "alice-psk", ng)
+		if err != nil {
+			t.Fatalf("BuildMetadataRecordWithOptions: %v", err)
+		}
+		record := readRecord(t, raw)
+		hint, _, ok := RecordKeyHint(record)
+		if !ok {
+			t.Fatalf("RecordKeyHint: no hint")
+		}
+		hints = append(hints, hint)
+		if cred, _, err := table.DecryptMetadata(record, time.Now()); err != nil || cred.User.ID != "alice" {
+			t.Errorf("DecryptMetadata: got %+v err %v, want alice", cred, err)
+		}
+	}
+	if hints[0] == hints[1] {
+		t.Errorf("two records share key hint %x", hints[0])
+	}
+}
+
+// TestUserTableValidation verifies duplicate IDs and shared PSKs are rejected.
+func TestUserTableValidation(t *testing.T) {
+	cases := map[string][]User{
+		"duplicate id": {{ID: "a", PSK: "p1"}, {ID: "a", PSK: "p2"}},
+		"shared psk":   {{ID: "a", PSK: "p1"}, {ID: "b", PSK: "p1"}},
+		"missing psk":  {{ID: "a"}},
+	}
+	for name, users := range cases {
+		if _, err := NewUserTable(users, ""); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+// TestLoadUsers verifies users are enabled unless the file says otherwise.
+func TestLoadUsers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.json")
+	data := `[{"id":"alice","psk":"p1","max_streams":8},{"id":"bob","psk":"p2","enabled":false}]`
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	users, err := LoadUsers(path)
+	if err != nil {
+		t.Fatalf("LoadUsers: %v", err)
+	}
+	if len(users) != 2 || !users[0].Enabled || users[0].MaxStreams != 8 || users[1].Enabled {
+		t.Errorf("got %+v", users)
+	}
+}
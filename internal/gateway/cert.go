@@ -0,0 +1,129 @@
+package gateway
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"log"
+	"math/big"
+	"sync"
+	"time"
+
+	"aether-rea/internal/core"
+)
+
+func generateSelfSignedCert(domain string) (tls.Certificate, error) {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	subject := pkix.Name{
+		Organization: []string{"Aether Edge Relay Self-Signed"},
+	}
+	if domain != "" {
+		subject.CommonName = domain
+	}
+
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      subject,
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour * 24 * 365 * 10), // V5: 10 Years Validity
+
+		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{domain},
+	}
+	if domain == "" {
+		template.DNSNames = []string{"localhost"}
+	}
+
+	derBytes, err := x509.CreateCertificate(rand.Reader, &template, &template, &priv.PublicKey, priv)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	certBuf := &bytes.Buffer{}
+	pem.Encode(certBuf, &pem.Block{Type: "CERTIFICATE", Bytes: derBytes})
+
+	keyBuf := &bytes.Buffer{}
+	pem.Encode(keyBuf, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(priv)})
+
+	return tls.X509KeyPair(certBuf.Bytes(), keyBuf.Bytes())
+}
+
+// CertificateLoader serves the TLS certificate and reloads it from disk on
+// demand.
+type CertificateLoader struct {
+	certFile string
+	keyFile  string
+	cert     *tls.Certificate
+	mu       sync.RWMutex
+}
+
+// NewCertificateLoader loads the key pair at certFile and keyFile.
+func NewCertificateLoader(certFile, keyFile string) (*CertificateLoader, error) {
+	loader := &CertificateLoader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	// Initial load
+	if err := loader.Reload(); err != nil {
+		return nil, err
+	}
+	return loader, nil
+}
+
+// NewSelfSignedCertificateLoader serves a fresh 10-year self-signed
+// certificate for domain until Reload finds a key pair at certFile and
+// keyFile.
+func NewSelfSignedCertificateLoader(domain, certFile, keyFile string) (*CertificateLoader, error) {
+	cert, err := generateSelfSignedCert(domain)
+	if err != nil {
+		return nil, err
+	}
+	logCertificateFingerprints(&cert)
+	return &CertificateLoader{cert: &cert, certFile: certFile, keyFile: keyFile}, nil
+}
+
+// Reload reads the key pair from disk again; on error the current
+// certificate stays in use.
+func (l *CertificateLoader) Reload() error {
+	kp, err := tls.LoadX509KeyPair(l.certFile, l.keyFile)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	l.cert = &kp
+	l.mu.Unlock()
+	log.Printf("[INFO] Reloaded TLS certificate from %s", l.certFile)
+	logCertificateFingerprints(&kp)
+	return nil
+}
+
+// logCertificateFingerprints prints the leaf certificate's hashes in the form
+// clients accept as pinned_sha256.
+func logCertificateFingerprints(cert *tls.Certificate) {
+	if len(cert.Certificate) == 0 {
+		return
+	}
+	leaf, spki, err := core.CertificateFingerprints(cert.Certificate[0])
+	if err != nil {
+		log.Printf("[WARNING] Failed to fingerprint TLS certificate: %v", err)
+		return
+	}
+	log.Printf("[INFO] TLS certificate SHA-256: leaf=%s spki=%s (usable as client pinned_sha256)", leaf, spki)
+}
+
+// GetCertificate implements tls.Config.GetCertificate
+func (l *CertificateLoader) GetCertificate(clientHello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.cert, nil
+}
@@ -0,0 +1,202 @@
+package gateway
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"aether-rea/internal/core"
+)
+
+// FileConfig is the gateway configuration file (JSON). Omitted fields keep
+// the value given by flags or environment variables.
+//
+// Some settings have no file key and are read from the environment only, at
+// startup: QUIC_OBFS and QUIC_OBFS_KEY, the QUIC_*_RECV_WINDOW overrides,
+// RECORD_PAYLOAD_MAX_BYTES, DATA_COMPRESSION, DATA_PADDING,
+// PADDING_MAX_BUDGET, REKEY_THRESHOLD, UDP_FLOW_IDLE_SEC, UDP_MAX_FLOWS,
+// REPLAY_WINDOW, REPLAY_SESSIONS, PERF_DIAG_ENABLE, PERF_DIAG_INTERVAL_SEC and
+// QLOG.
+type FileConfig struct {
+	// Listen is the UDP and TCP listen address, e.g. "0.0.0.0:443".
+	Listen string `json:"listen,omitempty"`
+	// HopPorts are extra UDP ports for client port hopping ("20000-20099").
+	HopPorts   string `json:"hop_ports,omitempty"`
+	SecretPath string `json:"secret_path,omitempty"`
+
+	TLS FileTLSConfig `json:"tls"`
+
+	PSK          string        `json:"psk,omitempty"`
+	PSKSecondary []core.PSKKey `json:"psk_secondary,omitempty"`
+	// UsersFile is a JSON user table; Users are added to it.
+	UsersFile string      `json:"users_file,omitempty"`
+	Users     []core.User `json:"users,omitempty"`
+	// AuthToken is "required" (the default) or "optional", which admits
+	// clients without a token during a migration (see
+	// Config.AuthTokenOptional).
+	AuthToken string `json:"auth_token,omitempty"`
+
+	DecoyRoot string `json:"decoy_root,omitempty"`
+	// WindowProfile selects the QUIC windows: conservative, normal or
+	// aggressive.
+	WindowProfile string `json:"window_profile,omitempty"`
+
+	Scheduler FileSchedulerConfig `json:"scheduler"`
+}
+
+// FileTLSConfig is the "tls" section of a FileConfig.
+type FileTLSConfig struct {
+	Cert string `json:"cert,omitempty"`
+	Key  string `json:"key,omitempty"`
+	// Domain names the generated self-signed certificate.
+	Domain        string `json:"domain,omitempty"`
+	ECHKey        string `json:"ech_key,omitempty"`
+	ECHPublicName string `json:"ech_public_name,omitempty"`
+}
+
+// FileSchedulerConfig is the "scheduler" section of a FileConfig; see
+// SchedulerConfig for the meaning of each field.
+type FileSchedulerConfig struct {
+	QueueSize      int   `json:"queue_size,omitempty"`
+	Adaptive       *bool `json:"adaptive,omitempty"`
+	MinChunk       int   `json:"min_chunk,omitempty"`
+	MaxChunk       int   `json:"max_chunk,omitempty"`
+	FlushThreshold int   `json:"flush_threshold,omitempty"`
+	CoalesceMs     *int  `json:"coalesce_ms,omitempty"`
+	TargetWriteUs  int   `json:"target_write_us,omitempty"`
+}
+
+// LoadFileConfig reads and validates a configuration file. Unknown fields
+// are rejected so that typos do not go unnoticed.
+func LoadFileConfig(path string) (*FileConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	var c FileConfig
+	if err := dec.Decode(&c); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, fmt.Errorf("parse %s: unexpected data after the config object", path)
+	}
+	if err := c.Validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &c, nil
+}
+
+// Validate reports every invalid field, named by its JSON key.
+func (c *FileConfig) Validate() error {
+	var errs []error
+	invalid := func(key, format string, args ...any) {
+		errs = append(errs, fmt.Errorf("%s: %s", key, fmt.Sprintf(format, args...)))
+	}
+
+	if c.Listen != "" {
+		if _, port, err := net.SplitHostPort(c.Listen); err != nil {
+			invalid("listen", "%v", err)
+		} else if _, err := net.LookupPort("udp", port); err != nil {
+			invalid("listen", "invalid port %q", port)
+		}
+	}
+	if c.HopPorts != "" {
+		if _, err := core.ParsePortRange(c.HopPorts); err != nil {
+			invalid("hop_ports", "%v", err)
+		}
+	}
+	if c.SecretPath != "" && !strings.HasPrefix(c.SecretPath, "/") {
+		invalid("secret_path", "%q must start with /", c.SecretPath)
+	}
+	if (c.TLS.Cert == "") != (c.TLS.Key == "") {
+		invalid("tls", "cert and key must be set together")
+	}
+
+	if c.PSK != "" && strings.TrimSpace(c.PSK) == "" {
+		invalid("psk", "is blank")
+	}
+	if len(c.PSKSecondary) > 0 && c.PSK == "" {
+		invalid("psk_secondary", "requires psk")
+	}
+	for i, k := range c.PSKSecondary {
+		if strings.TrimSpace(k.PSK) == "" {
+			invalid(fmt.Sprintf("psk_secondary[%d]", i), "missing psk")
+		}
+	}
+	if len(c.Users) > 0 {
+		if _, err := core.NewUserTable(c.Users, ""); err != nil {
+			invalid("users", "%v", err)
+		}
+	}
+	switch c.AuthToken {
+	case "", "required", "optional":
+	default:
+		invalid("auth_token", "%q is not required or optional", c.AuthToken)
+	}
+	switch c.WindowProfile {
+	case "", "conservative", "normal", "aggressive":
+	default:
+		invalid("window_profile", "%q is not conservative, normal or aggressive", c.WindowProfile)
+	}
+
+	s := c.Scheduler
+	if s.QueueSize != 0 && (s.QueueSize < 16 || s.QueueSize > 4096) {
+		invalid("scheduler.queue_size", "%d is outside 16-4096", s.QueueSize)
+	}
+	for _, f := range []struct {
+		key string
+		v   int
+	}{
+		{"scheduler.min_chunk", s.MinChunk},
+		{"scheduler.max_chunk", s.MaxChunk},
+		{"scheduler.flush_threshold", s.FlushThreshold},
+	} {
+		if f.v < 0 || f.v > core.MaxRecordSize {
+			invalid(f.key, "%d is outside 0-%d", f.v, core.MaxRecordSize)
+		}
+	}
+	if s.MinChunk > 0 && s.MaxChunk > 0 && s.MinChunk > s.MaxChunk {
+		invalid("scheduler.min_chunk", "%d exceeds max_chunk %d", s.MinChunk, s.MaxChunk)
+	}
+	if s.CoalesceMs != nil && (*s.CoalesceMs < 0 || *s.CoalesceMs > 200) {
+		invalid("scheduler.coalesce_ms", "%d is outside 0-200", *s.CoalesceMs)
+	}
+	if s.TargetWriteUs != 0 && (s.TargetWriteUs < 3000 || s.TargetWriteUs > 200000) {
+		invalid("scheduler.target_write_us", "%d is outside 3000-200000", s.TargetWriteUs)
+	}
+	return errors.Join(errs...)
+}
+
+// Apply overrides cfg with the fields set in the section.
+func (s FileSchedulerConfig) Apply(cfg SchedulerConfig) SchedulerConfig {
+	if s.QueueSize != 0 {
+		cfg.QueueSize = s.QueueSize
+	}
+	if s.Adaptive != nil {
+		cfg.DisableAdaptive = !*s.Adaptive
+	}
+	if s.MinChunk != 0 {
+		cfg.MinChunk = s.MinChunk
+	}
+	if s.MaxChunk != 0 {
+		cfg.MaxChunk = s.MaxChunk
+	}
+	if s.FlushThreshold != 0 {
+		cfg.FlushThreshold = s.FlushThreshold
+	}
+	if s.CoalesceMs != nil {
+		cfg.CoalesceWait = CoalesceWaitMs(*s.CoalesceMs)
+	}
+	if s.TargetWriteUs != 0 {
+		cfg.TargetWrite = time.Duration(s.TargetWriteUs) * time.Microsecond
+	}
+	return cfg
+}
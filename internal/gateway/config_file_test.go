@@ -0,0 +1,97 @@
+package gateway
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "gateway.json")
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	return path
+}
+
+// TestLoadFileConfig loads a full config and applies its scheduler section.
+func TestLoadFileConfig(t *testing.T) {
+	path := writeConfig(t, `{
+		"listen": "0.0.0.0:443",
+		"hop_ports": "20000-20009",
+		"tls": {"cert": "cert.pem", "key": "key.pem"},
+		"psk": "main-psk",
+		"users": [{"id": "alice", "psk": "alice-psk"}],
+		"auth_token": "optional",
+		"decoy_root": "/srv/www",
+		"window_profile": "aggressive",
+		"scheduler": {"queue_size": 512, "adaptive": false, "coalesce_ms": 0}
+	}`)
+	c, err := LoadFileConfig(path)
+	if err != nil {
+		t.Fatalf("LoadFileConfig: %v", err)
+	}
+	if c.Listen != "0.0.0.0:443" || c.TLS.Cert != "cert.pem" || c.WindowProfile != "aggressive" {
+		t.Errorf("got %+v", c)
+	}
+	if len(c.Users) != 1 || !c.Users[0].Enabled {
+		t.Errorf("users: got %+v, want alice enabled", c.Users)
+	}
+
+	s := c.Scheduler.Apply(DefaultSchedulerConfig())
+	want := DefaultSchedulerConfig()
+	want.QueueSize, want.DisableAdaptive, want.CoalesceWait = 512, true, NoCoalesce
+	if s != want {
+		t.Errorf("scheduler: got %+v, want %+v", s, want)
+	}
+	if s := (FileSchedulerConfig{}).Apply(DefaultSchedulerConfig()); s != DefaultSchedulerConfig() {
+		t.Errorf("empty section changed the scheduler: %+v", s)
+	}
+}
+
+// TestLoadFileConfigErrors checks that mistakes are reported by key.
+func TestLoadFileConfigErrors(t *testing.T) {
+	for _, tc := range []struct {
+		data string
+		want []string
+	}{
+		{`{"listn": ":443"}`, []string{`unknown field "listn"`}},
+		{`{"psk": "a"} {}`, []string{"unexpected data"}},
+		{`{"scheduler": {"queue_size": "big"}}`, []string{"scheduler.queue_size"}},
+		{`{
+			"listen": "443",
+			"secret_path": "api",
+			"tls": {"cert": "cert.pem"},
+			"auth_token": "maybe",
+			"window_profile": "fast",
+			"users": [{"id": "a", "psk": "x"}, {"id": "a", "psk": "y"}],
+			"scheduler": {"queue_size": 8, "min_chunk": 4096, "max_chunk": 1024, "coalesce_ms": 500, "target_write_us": 10}
+		}`, []string{
+			"listen:", "secret_path:", "tls:", "auth_token:", "window_profile:", `users: user "a": duplicate id`,
+			"scheduler.queue_size:", "scheduler.min_chunk:", "scheduler.coalesce_ms:", "scheduler.target_write_us:",
+		}},
+	} {
+		_, err := LoadFileConfig(writeConfig(t, tc.data))
+		if err == nil {
+			t.Errorf("%s: no error", tc.data)
+			continue
+		}
+		for _, want := range tc.want {
+			if !strings.Contains(err.Error(), want) {
+				t.Errorf("error %q does not mention %q", err, want)
+			}
+		}
+	}
+}
+
+// TestFileSchedulerDurations checks the units of the scheduler section.
+func TestFileSchedulerDurations(t *testing.T) {
+	ms := 5
+	s := FileSchedulerConfig{CoalesceMs: &ms, TargetWriteUs: 4000}.Apply(SchedulerConfig{})
+	if s.CoalesceWait != 5*time.Millisecond || s.TargetWrite != 4*time.Millisecond {
+		t.Errorf("got %+v", s)
+	}
+}
@@ -0,0 +1,35 @@
+package gateway
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// serveDecoy serves decoy content in a way that minimizes path-based
+// fingerprinting/oracles.
+//   - If DecoyRoot has index.html, serve static files (same behavior as "/").
+//   - Otherwise, serve an nginx-like 403 page with aligned headers.
+func (s *Server) serveDecoy(w http.ResponseWriter, r *http.Request) {
+	// If DecoyRoot is specified and index.html exists, serve static files.
+	if root := s.config().DecoyRoot; root != "" {
+		if _, err := os.Stat(filepath.Join(root, "index.html")); err == nil {
+			http.FileServer(http.Dir(root)).ServeHTTP(w, r)
+			return
+		}
+	}
+
+	// Fallback: Nginx 403 Forbidden Simulation
+	// CRITICAL: Align Status Code and Headers to prevent fingerprinting
+	w.Header().Set("Server", "nginx/1.18.0 (Ubuntu)")
+	w.Header().Set("Content-Type", "text/html")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusForbidden)
+	w.Write([]byte(`<html>
+<head><title>403 Forbidden</title></head>
+<body bgcolor="white">
+<center><h1>403 Forbidden</h1></center>
+<hr><center>nginx/1.18.0 (Ubuntu)</center>
+</body>
+</html>`))
+}
@@ -0,0 +1,243 @@
+package gateway
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"aether-rea/internal/core"
+
+	"github.com/gorilla/websocket"
+	"github.com/quic-go/webtransport-go"
+)
+
+// WebSocket fallback (see core/fallback.go).
+//
+// Clients that cannot reach the gateway over QUIC open a session on the TCP
+// listener with a hello WebSocket, then open one WebSocket per stream naming
+// the session. The session ends with its hello connection.
+
+// fallbackUpgrader upgrades authenticated fallback requests.
+var fallbackUpgrader = websocket.Upgrader{
+	ReadBufferSize:  64 * 1024,
+	WriteBufferSize: 64 * 1024,
+	// Clients are authenticated by their auth token, not their origin.
+	CheckOrigin: func(*http.Request) bool { return true },
+}
+
+// fallbackSession is the state shared by the connections of one session.
+type fallbackSession struct {
+	ctx      context.Context
+	cancel   context.CancelFunc
+	streamID atomic.Uint64
+	auth     *sessionAuth
+	ng       *core.NonceGenerator
+	codec    core.Codec
+}
+
+// serveFallback serves a hello or stream upgrade that carried a valid auth
+// token. It returns false without writing a response for requests the decoy
+// site should answer.
+func (s *Server) serveFallback(w http.ResponseWriter, r *http.Request, tokenCred *core.Credential) bool {
+	if tokenCred == nil || !websocket.IsWebSocketUpgrade(r) || r.TLS == nil || s.ctx.Err() != nil {
+		return false
+	}
+	if offered := r.Header.Get(core.FallbackProtocolsHeader); offered != "" {
+		return s.fallbackHello(w, r, tokenCred, offered)
+	}
+
+	v, ok := s.fallbackSessions.Load(r.Header.Get(core.FallbackSessionHeader))
+	if !ok {
+		return false
+	}
+	fs := v.(*fallbackSession)
+	if fs.auth.token.User.ID != tokenCred.User.ID {
+		return false
+	}
+	conn, err := fallbackUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return true // Upgrade answered with an HTTP error
+	}
+	stream := newFallbackStream(conn)
+	stop := context.AfterFunc(fs.ctx, func() { conn.Close() })
+	defer stop()
+	s.activeStreams.Add(1)
+	defer s.activeStreams.Add(-1)
+	s.handleStream(stream, fs.auth, fs.streamID.Add(1), fs.ng, fs.codec)
+	return true
+}
+
+// fallbackHello opens a session in the wire version chosen from offered and
+// serves its hello connection until it closes.
+func (s *Server) fallbackHello(w http.ResponseWriter, r *http.Request, tokenCred *core.Credential, offered string) bool {
+	protocol := ""
+	clientProtocols := core.ParseFallbackProtocols(offered)
+	for _, p := range core.SupportedProtocols() {
+		if slices.Contains(clientProtocols, p) {
+			protocol = p
+			break
+		}
+	}
+	if protocol == "" {
+		log.Printf("[INFO] Rejecting fallback session from %s: %v: client offered %s", r.RemoteAddr, core.ErrUnsupportedProtocol, offered)
+		w.Header().Set(core.FallbackProtocolsHeader, strings.Join(core.SupportedProtocols(), ", "))
+		w.WriteHeader(http.StatusNotAcceptable)
+		return true
+	}
+	codec, err := core.CodecForProtocol(protocol)
+	if err != nil {
+		return false
+	}
+	ng, err := core.NewNonceGenerator()
+	if err != nil {
+		log.Printf("[ERROR] Failed to create NonceGenerator: %v", err)
+		return false
+	}
+	// Server proofs are bound to the hello's TLS connection (see core/proof.go).
+	binding, err := core.TLSBinding(*r.TLS)
+	if err != nil {
+		log.Printf("[ERROR] Failed to export TLS binding: %v", err)
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return false
+	}
+	sessionID := hex.EncodeToString(id)
+
+	header := http.Header{}
+	header.Set(core.FallbackProtocolHeader, protocol)
+	header.Set(core.FallbackSessionHeader, sessionID)
+	conn, err := fallbackUpgrader.Upgrade(w, r, header)
+	if err != nil {
+		return true
+	}
+	fs := &fallbackSession{auth: s.newSessionAuth(tokenCred, binding), ng: ng, codec: codec}
+	fs.ctx, fs.cancel = context.WithCancel(s.ctx)
+	s.fallbackSessions.Store(sessionID, fs)
+	defer func() {
+		s.fallbackSessions.Delete(sessionID)
+		fs.cancel()
+		conn.Close()
+	}()
+	go s.rekeyOnThreshold(fs.ctx, ng)
+	stop := context.AfterFunc(fs.ctx, func() { conn.Close() })
+	defer stop()
+
+	log.Printf("[INFO] WebSocket fallback session opened for %s (protocol: %q)", r.RemoteAddr, protocol)
+	// The hello connection only carries the client's pings.
+	_ = conn.SetReadDeadline(time.Now().Add(core.FallbackIdleTimeout))
+	conn.SetPingHandler(func(data string) error {
+		_ = conn.SetReadDeadline(time.Now().Add(core.FallbackIdleTimeout))
+		err := conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(time.Second))
+		if err == websocket.ErrCloseSent {
+			return nil
+		}
+		return err
+	})
+	for {
+		if _, _, err := conn.NextReader(); err != nil {
+			log.Printf("[INFO] WebSocket fallback session from %s closed: %v", r.RemoteAddr, err)
+			return true
+		}
+	}
+}
+
+// fallbackCloseTimeout bounds how long a stream connection waits for the
+// client to close it after the gateway's side ended.
+const fallbackCloseTimeout = 5 * time.Second
+
+// fallbackStream is one stream connection. Binary messages carry the stream;
+// an empty message ends a direction.
+type fallbackStream struct {
+	conn *websocket.Conn
+
+	msg io.Reader // message being read
+	eof bool      // the client ended its direction
+
+	writeMu   sync.Mutex
+	closeOnce sync.Once
+}
+
+func newFallbackStream(conn *websocket.Conn) *fallbackStream {
+	return &fallbackStream{conn: conn}
+}
+
+func (s *fallbackStream) Read(p []byte) (int, error) {
+	for {
+		if s.eof {
+			return 0, io.EOF
+		}
+		if s.msg == nil {
+			typ, msg, err := s.conn.NextReader()
+			if err != nil {
+				return 0, err
+			}
+			if typ != websocket.BinaryMessage {
+				continue
+			}
+			n, err := msg.Read(p)
+			if n == 0 && err == io.EOF {
+				s.eof = true
+				continue
+			}
+			if err == nil {
+				s.msg = msg
+			} else if err != io.EOF {
+				return n, err
+			}
+			return n, nil
+		}
+		n, err := s.msg.Read(p)
+		if err == io.EOF {
+			s.msg = nil
+			if n == 0 {
+				continue
+			}
+			return n, nil
+		}
+		return n, err
+	}
+}
+
+func (s *fallbackStream) Write(p []byte) (int, error) {
+	// An empty message would end the stream.
+	if len(p) == 0 {
+		return 0, nil
+	}
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	if err := s.conn.WriteMessage(websocket.BinaryMessage, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close ends the gateway's direction and closes the connection once the
+// client closes it, or after fallbackCloseTimeout.
+func (s *fallbackStream) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		s.writeMu.Lock()
+		err = s.conn.WriteMessage(websocket.BinaryMessage, nil)
+		s.writeMu.Unlock()
+		_ = s.conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(fallbackCloseTimeout))
+		time.AfterFunc(fallbackCloseTimeout, func() { s.conn.Close() })
+	})
+	return err
+}
+
+func (s *fallbackStream) SetReadDeadline(t time.Time) error { return s.conn.SetReadDeadline(t) }
+
+// CancelRead fails pending and later reads.
+func (s *fallbackStream) CancelRead(webtransport.StreamErrorCode) {
+	_ = s.conn.SetReadDeadline(time.Unix(1, 0))
+}
@@ -0,0 +1,214 @@
+package gateway
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// perfStats accumulates relay timings for the [PERF-GW] logs.
+type perfStats struct {
+	wtToTCPBytes      atomic.Uint64
+	wtToTCPWrites     atomic.Uint64
+	wtToTCPWriteNanos atomic.Uint64
+
+	tcpToWTBytes      atomic.Uint64
+	tcpToWTWrites     atomic.Uint64
+	tcpToWTWriteNanos atomic.Uint64
+
+	tcpToWTReadWaitCalls      atomic.Uint64
+	tcpToWTReadWaitNanos      atomic.Uint64
+	tcpToWTBuildCalls         atomic.Uint64
+	tcpToWTBuildNanos         atomic.Uint64
+	tcpToWTFlushCalls         atomic.Uint64
+	tcpToWTFlushBytes         atomic.Uint64
+	tcpToWTChunkCapBytes      atomic.Uint64
+	tcpToWTCoalesceWaitMicros atomic.Uint64
+
+	tcpToWTCompressRawBytes  atomic.Uint64
+	tcpToWTCompressWireBytes atomic.Uint64
+
+	tcpToWTPadPayloadBytes atomic.Uint64
+	tcpToWTPaddingBytes    atomic.Uint64
+}
+
+func (s *perfStats) observeWTToTCP(bytes int, d time.Duration) {
+	if bytes <= 0 {
+		return
+	}
+	s.wtToTCPBytes.Add(uint64(bytes))
+	s.wtToTCPWrites.Add(1)
+	s.wtToTCPWriteNanos.Add(uint64(d.Nanoseconds()))
+}
+
+func (s *perfStats) observeTCPToWT(bytes int, d time.Duration) {
+	if bytes <= 0 {
+		return
+	}
+	s.tcpToWTBytes.Add(uint64(bytes))
+	s.tcpToWTWrites.Add(1)
+	s.tcpToWTWriteNanos.Add(uint64(d.Nanoseconds()))
+}
+
+func (s *perfStats) observeTCPReadWait(d time.Duration) {
+	s.tcpToWTReadWaitCalls.Add(1)
+	s.tcpToWTReadWaitNanos.Add(uint64(d.Nanoseconds()))
+}
+
+func (s *perfStats) observeTCPBuild(d time.Duration) {
+	s.tcpToWTBuildCalls.Add(1)
+	s.tcpToWTBuildNanos.Add(uint64(d.Nanoseconds()))
+}
+
+func (s *perfStats) observeTCPFlush(bytes int) {
+	if bytes <= 0 {
+		return
+	}
+	s.tcpToWTFlushCalls.Add(1)
+	s.tcpToWTFlushBytes.Add(uint64(bytes))
+}
+
+func (s *perfStats) observeTCPCompression(raw, wire int) {
+	s.tcpToWTCompressRawBytes.Add(uint64(raw))
+	s.tcpToWTCompressWireBytes.Add(uint64(wire))
+}
+
+func (s *perfStats) observeTCPPadding(payload, padding int) {
+	s.tcpToWTPadPayloadBytes.Add(uint64(payload))
+	s.tcpToWTPaddingBytes.Add(uint64(padding))
+}
+
+func (s *perfStats) observeTCPAdaptive(chunkCap int, coalesceWait time.Duration) {
+	if chunkCap > 0 {
+		s.tcpToWTChunkCapBytes.Add(uint64(chunkCap))
+	}
+	if coalesceWait > 0 {
+		s.tcpToWTCoalesceWaitMicros.Add(uint64(coalesceWait.Microseconds()))
+	}
+}
+
+// reportPerf logs relay throughput and per-user stats every interval until
+// the server shuts down.
+func (s *Server) reportPerf(interval time.Duration) {
+	log.Printf("[PERF-GW] enabled=true interval=%s", interval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var prevWTToTCPBytes, prevWTToTCPWrites, prevWTToTCPNanos uint64
+	var prevTCPToWTBytes, prevTCPToWTWrites, prevTCPToWTNanos uint64
+	var prevTCPReadWaitCalls, prevTCPReadWaitNanos uint64
+	var prevTCPBuildCalls, prevTCPBuildNanos uint64
+	var prevTCPFlushCalls, prevTCPFlushBytes uint64
+	var prevTCPChunkCapBytes, prevTCPCoalesceWaitMicros uint64
+	var prevTCPCompressRawBytes, prevTCPCompressWireBytes uint64
+	var prevTCPPadPayloadBytes, prevTCPPaddingBytes uint64
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		curWTToTCPBytes := s.perf.wtToTCPBytes.Load()
+		curWTToTCPWrites := s.perf.wtToTCPWrites.Load()
+		curWTToTCPNanos := s.perf.wtToTCPWriteNanos.Load()
+		curTCPToWTBytes := s.perf.tcpToWTBytes.Load()
+		curTCPToWTWrites := s.perf.tcpToWTWrites.Load()
+		curTCPToWTNanos := s.perf.tcpToWTWriteNanos.Load()
+		curTCPReadWaitCalls := s.perf.tcpToWTReadWaitCalls.Load()
+		curTCPReadWaitNanos := s.perf.tcpToWTReadWaitNanos.Load()
+		curTCPBuildCalls := s.perf.tcpToWTBuildCalls.Load()
+		curTCPBuildNanos := s.perf.tcpToWTBuildNanos.Load()
+		curTCPFlushCalls := s.perf.tcpToWTFlushCalls.Load()
+		curTCPFlushBytes := s.perf.tcpToWTFlushBytes.Load()
+		curTCPChunkCapBytes := s.perf.tcpToWTChunkCapBytes.Load()
+		curTCPCoalesceWaitMicros := s.perf.tcpToWTCoalesceWaitMicros.Load()
+		curTCPCompressRawBytes := s.perf.tcpToWTCompressRawBytes.Load()
+		curTCPCompressWireBytes := s.perf.tcpToWTCompressWireBytes.Load()
+		curTCPPadPayloadBytes := s.perf.tcpToWTPadPayloadBytes.Load()
+		curTCPPaddingBytes := s.perf.tcpToWTPaddingBytes.Load()
+
+		dWTToTCPBytes := curWTToTCPBytes - prevWTToTCPBytes
+		dWTToTCPWrites := curWTToTCPWrites - prevWTToTCPWrites
+		dWTToTCPNanos := curWTToTCPNanos - prevWTToTCPNanos
+		dTCPToWTBytes := curTCPToWTBytes - prevTCPToWTBytes
+		dTCPToWTWrites := curTCPToWTWrites - prevTCPToWTWrites
+		dTCPToWTNanos := curTCPToWTNanos - prevTCPToWTNanos
+		dTCPReadWaitCalls := curTCPReadWaitCalls - prevTCPReadWaitCalls
+		dTCPReadWaitNanos := curTCPReadWaitNanos - prevTCPReadWaitNanos
+		dTCPBuildCalls := curTCPBuildCalls - prevTCPBuildCalls
+		dTCPBuildNanos := curTCPBuildNanos - prevTCPBuildNanos
+		dTCPFlushCalls := curTCPFlushCalls - prevTCPFlushCalls
+		dTCPFlushBytes := curTCPFlushBytes - prevTCPFlushBytes
+		dTCPChunkCapBytes := curTCPChunkCapBytes - prevTCPChunkCapBytes
+		dTCPCoalesceWaitMicros := curTCPCoalesceWaitMicros - prevTCPCoalesceWaitMicros
+		dTCPCompressRawBytes := curTCPCompressRawBytes - prevTCPCompressRawBytes
+		dTCPCompressWireBytes := curTCPCompressWireBytes - prevTCPCompressWireBytes
+		dTCPPadPayloadBytes := curTCPPadPayloadBytes - prevTCPPadPayloadBytes
+		dTCPPaddingBytes := curTCPPaddingBytes - prevTCPPaddingBytes
+
+		prevWTToTCPBytes, prevWTToTCPWrites, prevWTToTCPNanos = curWTToTCPBytes, curWTToTCPWrites, curWTToTCPNanos
+		prevTCPToWTBytes, prevTCPToWTWrites, prevTCPToWTNanos = curTCPToWTBytes, curTCPToWTWrites, curTCPToWTNanos
+		prevTCPReadWaitCalls, prevTCPReadWaitNanos = curTCPReadWaitCalls, curTCPReadWaitNanos
+		prevTCPBuildCalls, prevTCPBuildNanos = curTCPBuildCalls, curTCPBuildNanos
+		prevTCPFlushCalls, prevTCPFlushBytes = curTCPFlushCalls, curTCPFlushBytes
+		prevTCPChunkCapBytes, prevTCPCoalesceWaitMicros = curTCPChunkCapBytes, curTCPCoalesceWaitMicros
+		prevTCPCompressRawBytes, prevTCPCompressWireBytes = curTCPCompressRawBytes, curTCPCompressWireBytes
+		prevTCPPadPayloadBytes, prevTCPPaddingBytes = curTCPPadPayloadBytes, curTCPPaddingBytes
+
+		sec := interval.Seconds()
+		ulMbps := float64(dWTToTCPBytes*8) / 1_000_000.0 / sec
+		dlMbps := float64(dTCPToWTBytes*8) / 1_000_000.0 / sec
+
+		ulWriteUs := 0.0
+		if dWTToTCPWrites > 0 {
+			ulWriteUs = (float64(dWTToTCPNanos) / float64(dWTToTCPWrites)) / 1000.0
+		}
+		dlWriteUs := 0.0
+		if dTCPToWTWrites > 0 {
+			dlWriteUs = (float64(dTCPToWTNanos) / float64(dTCPToWTWrites)) / 1000.0
+		}
+
+		log.Printf(
+			"[PERF-GW] window=%s dl{mbps=%.2f writes=%d write_us=%.1f} ul{mbps=%.2f writes=%d write_us=%.1f}",
+			interval, dlMbps, dTCPToWTWrites, dlWriteUs, ulMbps, dWTToTCPWrites, ulWriteUs,
+		)
+
+		readWaitUs := 0.0
+		if dTCPReadWaitCalls > 0 {
+			readWaitUs = (float64(dTCPReadWaitNanos) / float64(dTCPReadWaitCalls)) / 1000.0
+		}
+		buildUs := 0.0
+		if dTCPBuildCalls > 0 {
+			buildUs = (float64(dTCPBuildNanos) / float64(dTCPBuildCalls)) / 1000.0
+		}
+		flushAvgBytes := 0.0
+		if dTCPFlushCalls > 0 {
+			flushAvgBytes = float64(dTCPFlushBytes) / float64(dTCPFlushCalls)
+		}
+		chunkCapAvgBytes := 0.0
+		coalesceWaitAvgUs := 0.0
+		if dTCPFlushCalls > 0 {
+			chunkCapAvgBytes = float64(dTCPChunkCapBytes) / float64(dTCPFlushCalls)
+			coalesceWaitAvgUs = float64(dTCPCoalesceWaitMicros) / float64(dTCPFlushCalls)
+		}
+		compRatio := 1.0
+		if dTCPCompressRawBytes > 0 {
+			compRatio = float64(dTCPCompressWireBytes) / float64(dTCPCompressRawBytes)
+		}
+		padPct := 0.0
+		if dTCPPadPayloadBytes > 0 {
+			padPct = float64(dTCPPaddingBytes) * 100 / float64(dTCPPadPayloadBytes)
+		}
+		log.Printf(
+			"[PERF-GW2] window=%s dl_stage{read_wait_us=%.1f reads=%d build_us=%.1f builds=%d write_block_us=%.1f writes=%d flush_avg_bytes=%.1f flushes=%d chunk_cap_avg_bytes=%.1f coalesce_wait_avg_us=%.1f comp_ratio=%.3f pad_pct=%.1f}",
+			interval,
+			readWaitUs, dTCPReadWaitCalls,
+			buildUs, dTCPBuildCalls,
+			dlWriteUs, dTCPToWTWrites,
+			flushAvgBytes, dTCPFlushCalls,
+			chunkCapAvgBytes, coalesceWaitAvgUs, compRatio, padPct,
+		)
+		s.logUserStats()
+	}
+}
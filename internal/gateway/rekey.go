@@ -0,0 +1,32 @@
+package gateway
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"aether-rea/internal/core"
+)
+
+// rekeyOnThreshold rolls ng whenever its counter passes the configured
+// RekeyThreshold, until the session context ends. This covers
+// download-heavy sessions whose client counter stays low.
+// Clients derive keys from each record header, so no handshake is needed.
+func (s *Server) rekeyOnThreshold(ctx context.Context, ng *core.NonceGenerator) {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if counter := ng.Counter(); counter >= s.config().RekeyThreshold {
+				if err := ng.Rekey(); err != nil {
+					log.Printf("Session rekey failed: %v", err)
+					continue
+				}
+				log.Printf("Session rekeyed at counter %d (gateway epoch %d)", counter, ng.Epoch())
+			}
+		}
+	}
+}
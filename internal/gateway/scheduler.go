@@ -0,0 +1,111 @@
+package gateway
+
+import (
+	"time"
+
+	"aether-rea/internal/core"
+)
+
+// SchedulerConfig tunes how data read from targets is batched into records
+// for the client (the TCP→WT scheduler). Sizes are clamped per stream to its
+// negotiated record payload.
+type SchedulerConfig struct {
+	// QueueSize is the number of target reads buffered ahead of the sender
+	// (16-4096, 0 = 256).
+	QueueSize int
+	// DisableAdaptive turns off shrinking batches and coalescing while
+	// writes to the client are slower than TargetWrite (adaptive by default).
+	DisableAdaptive bool
+	// MinChunk and MaxChunk bound adaptive batches in bytes (0 = 16 KiB and
+	// the record payload).
+	MinChunk int
+	MaxChunk int
+	// FlushThreshold sends a batch once it holds this many bytes
+	// (0 = MaxChunk).
+	FlushThreshold int
+	// CoalesceWait is how long a partial batch waits for more data (up to
+	// 200ms, 0 = 3ms, NoCoalesce = flush immediately).
+	CoalesceWait time.Duration
+	// TargetWrite is the write latency the adaptive scheduler aims for
+	// (3-200ms, 0 = 20ms).
+	TargetWrite time.Duration
+}
+
+// NoCoalesce as CoalesceWait flushes partial batches without waiting.
+const NoCoalesce time.Duration = -1
+
+// CoalesceWaitMs converts a millisecond setting to a CoalesceWait; an
+// explicit 0 means NoCoalesce rather than the default.
+func CoalesceWaitMs(ms int) time.Duration {
+	if ms == 0 {
+		return NoCoalesce
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+// DefaultSchedulerConfig returns the scheduler defaults.
+func DefaultSchedulerConfig() SchedulerConfig {
+	var c SchedulerConfig
+	c.setDefaults()
+	return c
+}
+
+// setDefaults fills each zero field with its default on its own, so a
+// partially filled config keeps the defaults of the fields it leaves out.
+func (c *SchedulerConfig) setDefaults() {
+	if c.QueueSize == 0 {
+		c.QueueSize = 256
+	}
+	if c.CoalesceWait == 0 {
+		c.CoalesceWait = 3 * time.Millisecond
+	}
+	if c.TargetWrite == 0 {
+		c.TargetWrite = 20 * time.Millisecond
+	}
+}
+
+// streamTuning is a SchedulerConfig resolved for one stream.
+type streamTuning struct {
+	queueSize      int
+	adaptive       bool
+	minChunk       int
+	maxChunk       int
+	flushThreshold int
+	coalesceWait   time.Duration
+	targetWriteUs  float64
+}
+
+// forPayload resolves c for a stream whose records carry at most maxPayload
+// bytes.
+func (c SchedulerConfig) forPayload(maxPayload int) streamTuning {
+	t := streamTuning{
+		queueSize:    256,
+		adaptive:     !c.DisableAdaptive,
+		coalesceWait: clamp(c.CoalesceWait, 0, 200*time.Millisecond),
+	}
+	if c.QueueSize > 0 {
+		t.queueSize = clamp(c.QueueSize, 16, 4096)
+	}
+	t.minChunk = min(16384, maxPayload)
+	if c.MinChunk > 0 {
+		t.minChunk = clamp(c.MinChunk, min(8192, maxPayload), maxPayload)
+	}
+	t.maxChunk = maxPayload
+	if c.MaxChunk > 0 {
+		t.maxChunk = clamp(c.MaxChunk, t.minChunk, maxPayload)
+	}
+	t.flushThreshold = t.maxChunk
+	if c.FlushThreshold > 0 {
+		t.flushThreshold = min(clamp(c.FlushThreshold, t.minChunk, core.MaxRecordSize-core.RecordHeaderLength), t.maxChunk)
+	}
+	targetWrite := 20 * time.Millisecond
+	if c.TargetWrite > 0 {
+		targetWrite = clamp(c.TargetWrite, 3*time.Millisecond, 200*time.Millisecond)
+	}
+	t.targetWriteUs = float64(targetWrite.Microseconds())
+	return t
+}
+
+func clamp[T int | time.Duration](v, lo, hi T) T {
+	return max(lo, min(v, hi))
+}
@@ -0,0 +1,519 @@
+// Package gateway implements the Aether-Realist gateway: WebTransport
+// sessions over QUIC, the WebSocket fallback and decoy site on TCP, and
+// in-memory sessions for tests.
+package gateway
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"aether-rea/internal/core"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/quic-go/webtransport-go"
+)
+
+// DefaultSecretPath is the WebTransport endpoint when Config.SecretPath is "".
+const DefaultSecretPath = "/v1/api/sync"
+
+// sessionErrUnsupportedVersion closes sessions that share no wire version with us.
+const sessionErrUnsupportedVersion webtransport.SessionErrorCode = 0x01
+
+// Config configures a Server. Zero values select the defaults noted.
+type Config struct {
+	// Users authenticates clients. Required.
+	Users *core.UserTable
+	// AuthTokenOptional admits clients that predate CONNECT auth tokens;
+	// invalid tokens are rejected either way.
+	AuthTokenOptional bool
+	// SecretPath is the WebTransport endpoint (default DefaultSecretPath).
+	SecretPath string
+
+	// TLSConfig provides certificates and ECH keys; ALPN and the minimum
+	// version are set per listener. Required by Serve.
+	TLSConfig *tls.Config
+	// QUICConfig tunes the QUIC listener (default DefaultQUICConfig of the
+	// normal window profile).
+	QUICConfig *quic.Config
+	// ObfsKey obfuscates every UDP packet when set (see core/obfs.go);
+	// browsers cannot reach the gateway over HTTP/3 while it is on.
+	ObfsKey string
+
+	// DecoyRoot is a static site served to everything but clients; without
+	// an index.html it serves an nginx-like 403 page.
+	DecoyRoot string
+
+	// Negotiation bounds per-stream options accepted from clients (default
+	// core.DefaultNegotiationLimits).
+	Negotiation core.NegotiationLimits
+	// Scheduler tunes how target data is batched into records; each zero
+	// field takes its DefaultSchedulerConfig value.
+	Scheduler SchedulerConfig
+
+	// ReplayWindow is the number of counters the replay filter's bitmap
+	// covers per (user, SessionID), ReplaySessions the number of such
+	// windows it remembers.
+	ReplayWindow   int
+	ReplaySessions int
+	// RekeyThreshold is the counter value at which the gateway rolls a
+	// session's generator on its own (default core.DefaultRekeyThreshold).
+	RekeyThreshold uint64
+
+	// UDPFlowIdleTimeout and UDPMaxFlows bound per-session UDP relay state
+	// (default 60s and 256).
+	UDPFlowIdleTimeout time.Duration
+	UDPMaxFlows        int
+
+	// PerfInterval enables [PERF-GW] logs at this interval.
+	PerfInterval time.Duration
+}
+
+// DefaultQUICConfig returns the gateway's QUIC settings for window.
+func DefaultQUICConfig(window core.QUICWindowConfig) *quic.Config {
+	return &quic.Config{
+		EnableDatagrams:                  true,
+		EnableStreamResetPartialDelivery: true,
+		MaxIdleTimeout:                   30 * time.Second,
+		KeepAlivePeriod:                  10 * time.Second,
+		Allow0RTT:                        true,
+		MaxIncomingStreams:               2000,
+		InitialStreamReceiveWindow:       window.InitialStreamReceiveWindow,
+		InitialConnectionReceiveWindow:   window.InitialConnectionReceiveWindow,
+		MaxStreamReceiveWindow:           window.MaxStreamReceiveWindow,
+		MaxConnectionReceiveWindow:       window.MaxConnectionReceiveWindow,
+	}
+}
+
+// Server is a gateway. It serves QUIC and TCP listeners passed to Serve and
+// in-memory sessions passed to ServePipe.
+type Server struct {
+	cfg    atomic.Pointer[Config] // replaced by Reload
+	replay *core.ReplayFilter
+	// datagrams has its own filter so UDP traffic does not slide the
+	// windows of control records.
+	datagrams *core.ReplayFilter
+	tokens    *core.AuthTokenGuard
+	perf      perfStats
+	users     sync.Map // user ID -> *userStats
+
+	wt   *webtransport.Server
+	http *http.Server
+	mux  *http.ServeMux
+
+	fallbackSessions sync.Map // session ID -> *fallbackSession
+	pipeSessions     sync.Map // *core.PipeSession -> struct{}
+	activeStreams    atomic.Int64
+	altSvc           atomic.Pointer[string]
+
+	mu          sync.Mutex
+	packetConns []net.PacketConn
+
+	// ctx ends when Shutdown starts; no sessions or streams are accepted
+	// afterwards.
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// NewServer creates a gateway for cfg.
+func NewServer(cfg Config) (*Server, error) {
+	if err := cfg.setDefaults(); err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		replay:    core.NewReplayFilter(cfg.ReplayWindow, cfg.ReplaySessions),
+		datagrams: core.NewReplayFilter(cfg.ReplayWindow, cfg.ReplaySessions),
+		tokens:    core.NewAuthTokenGuard(),
+		mux:       http.NewServeMux(),
+	}
+	s.cfg.Store(&cfg)
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+
+	var tlsConfig *tls.Config
+	if cfg.TLSConfig != nil {
+		tlsConfig = cfg.TLSConfig.Clone()
+		// QUIC listener should advertise only HTTP/3 ALPN.
+		// Mixing legacy h3 drafts or HTTP/1.1 here can cause capability negotiation ambiguity.
+		tlsConfig.NextProtos = []string{http3.NextProtoH3}
+		tlsConfig.MinVersion = tls.VersionTLS13 // Enforce TLS 1.3 for security
+	}
+	s.wt = &webtransport.Server{
+		H3: &http3.Server{
+			TLSConfig:       tlsConfig,
+			QUICConfig:      cfg.QUICConfig,
+			EnableDatagrams: true,
+			Handler:         s.mux,
+		},
+		CheckOrigin: func(r *http.Request) bool { return true },
+		// Wire versions this gateway serves, newest first.
+		ApplicationProtocols: core.SupportedProtocols(),
+	}
+	// Ensure HTTP/3 SETTINGS always advertise WebTransport capabilities.
+	// This is required for clients that validate SETTINGS before sending CONNECT.
+	webtransport.ConfigureHTTP3Server(s.wt.H3)
+
+	// The TCP listener serves health checks, Alt-Svc and the WebSocket
+	// fallback.
+	s.http = &http.Server{
+		Handler: http.HandlerFunc(s.serveTCP),
+	}
+
+	s.mux.HandleFunc(cfg.SecretPath, s.serveSecretPath)
+	s.mux.HandleFunc("/", s.serveDecoy)
+	s.mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		// Health check must return 200 OK for load balancers
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("OK"))
+	})
+
+	if cfg.PerfInterval > 0 {
+		go s.reportPerf(cfg.PerfInterval)
+	}
+	return s, nil
+}
+
+// setDefaults validates c and fills in the defaults of zero fields.
+func (c *Config) setDefaults() error {
+	if c.Users == nil {
+		return errors.New("gateway: Config.Users is required")
+	}
+	if c.SecretPath == "" {
+		c.SecretPath = DefaultSecretPath
+	}
+	if !strings.HasPrefix(c.SecretPath, "/") {
+		return fmt.Errorf("gateway: secret path %q must start with /", c.SecretPath)
+	}
+	if c.QUICConfig == nil {
+		window, err := core.ResolveQUICWindowConfig("")
+		if err != nil {
+			return err
+		}
+		c.QUICConfig = DefaultQUICConfig(window)
+	}
+	if c.Negotiation == (core.NegotiationLimits{}) {
+		c.Negotiation = core.DefaultNegotiationLimits()
+	}
+	c.Scheduler.setDefaults()
+	if c.RekeyThreshold == 0 || c.RekeyThreshold > core.MaxCounterValue {
+		c.RekeyThreshold = core.DefaultRekeyThreshold
+	}
+	if c.UDPFlowIdleTimeout <= 0 {
+		c.UDPFlowIdleTimeout = 60 * time.Second
+	}
+	if c.UDPMaxFlows <= 0 {
+		c.UDPMaxFlows = 256
+	}
+	return nil
+}
+
+// config returns the current configuration.
+func (s *Server) config() *Config {
+	return s.cfg.Load()
+}
+
+// Reload replaces the settings that can change at runtime: Users,
+// AuthTokenOptional, DecoyRoot, Negotiation, Scheduler, RekeyThreshold and
+// the UDP relay limits. New sessions and streams use them; established
+// sessions keep their user table and UDP limits. The remaining fields are
+// fixed by NewServer and keep their values.
+func (s *Server) Reload(cfg Config) error {
+	cur := s.config()
+	cfg.SecretPath = cur.SecretPath
+	cfg.TLSConfig = cur.TLSConfig
+	cfg.QUICConfig = cur.QUICConfig
+	cfg.ObfsKey = cur.ObfsKey
+	cfg.ReplayWindow, cfg.ReplaySessions = cur.ReplayWindow, cur.ReplaySessions
+	cfg.PerfInterval = cur.PerfInterval
+	if err := cfg.setDefaults(); err != nil {
+		return err
+	}
+	s.cfg.Store(&cfg)
+	return nil
+}
+
+// Serve serves WebTransport on packetConn and TLS on tcpListener; either may
+// be nil. It returns http.ErrServerClosed after Shutdown, or the first error
+// of either listener after closing the server.
+func (s *Server) Serve(packetConn net.PacketConn, tcpListener net.Listener) error {
+	if s.config().TLSConfig == nil {
+		return errors.New("gateway: Serve requires Config.TLSConfig")
+	}
+	// Alt-Svc tells clients "I speak H3 on this port" (not while obfuscated:
+	// browsers cannot speak it).
+	if packetConn != nil && s.config().ObfsKey == "" {
+		if addr, ok := packetConn.LocalAddr().(*net.UDPAddr); ok {
+			altSvc := fmt.Sprintf(`h3=":%d"; ma=2592000`, addr.Port)
+			s.altSvc.Store(&altSvc)
+		}
+	}
+
+	errCh := make(chan error, 2)
+	listeners := 0
+	if packetConn != nil {
+		listeners++
+		go func() { errCh <- s.ServePacketConn(packetConn) }()
+	}
+	if tcpListener != nil {
+		listeners++
+		go func() {
+			tcpTLSConfig := s.config().TLSConfig.Clone()
+			tcpTLSConfig.NextProtos = []string{"h2", "http/1.1"}
+			tcpTLSConfig.MinVersion = tls.VersionTLS13
+			log.Printf("HTTP/1.1 (TCP+TLS) server listening on %s", tcpListener.Addr())
+			errCh <- s.http.Serve(tls.NewListener(tcpListener, tcpTLSConfig))
+		}()
+	}
+
+	// The first listener to return either saw Shutdown or failed; a failure
+	// takes the other listener down too.
+	var first error
+	for range listeners {
+		err := <-errCh
+		if first != nil {
+			continue
+		}
+		if s.ctx.Err() != nil {
+			first = http.ErrServerClosed
+		} else {
+			first = err
+			s.close()
+		}
+	}
+	return first
+}
+
+// ServePacketConn serves WebTransport on another UDP socket, e.g. a port
+// hopping port. Shutdown closes conn.
+func (s *Server) ServePacketConn(conn net.PacketConn) error {
+	if s.config().TLSConfig == nil {
+		return errors.New("gateway: Serve requires Config.TLSConfig")
+	}
+	s.mu.Lock()
+	s.packetConns = append(s.packetConns, conn)
+	s.mu.Unlock()
+	if key := s.config().ObfsKey; key != "" {
+		obfs, err := core.NewObfsPacketConn(conn, key)
+		if err != nil {
+			return fmt.Errorf("enable QUIC obfuscation: %w", err)
+		}
+		conn = obfs
+	}
+	log.Printf("Starting HTTP/3 (UDP) server on %s", conn.LocalAddr())
+	err := s.wt.Serve(conn)
+	if s.ctx.Err() != nil {
+		return http.ErrServerClosed
+	}
+	return err
+}
+
+// ServePipe serves sessions dialed on t, e.g. by a Core in the same process,
+// until t is closed or the server shuts down. Pipe sessions carry no auth
+// token, so streams authenticate through the user table alone.
+func (s *Server) ServePipe(t *core.PipeTransport) error {
+	for {
+		sess, err := t.Accept(s.ctx)
+		if err != nil {
+			if s.ctx.Err() != nil {
+				return http.ErrServerClosed
+			}
+			return err
+		}
+		codec, err := core.CodecForProtocol(sess.Protocol())
+		if err != nil {
+			log.Printf("[INFO] Rejecting pipe session: %v", err)
+			_ = sess.Close("unsupported protocol version")
+			continue
+		}
+		ng, err := core.NewNonceGenerator()
+		if err != nil {
+			log.Printf("[ERROR] Failed to create NonceGenerator: %v", err)
+			_ = sess.Close("internal error")
+			continue
+		}
+		binding, _ := sess.Binding()
+		s.pipeSessions.Store(sess, struct{}{})
+		go func() {
+			defer s.pipeSessions.Delete(sess)
+			s.handleSession(pipeSession{sess}, s.newSessionAuth(nil, binding), ng, codec)
+		}()
+	}
+}
+
+// Shutdown stops accepting sessions and streams, waits until active streams
+// end or ctx is done, then closes every listener and session.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.cancel()
+
+	var wg sync.WaitGroup
+	var httpErr, h3Err error
+	wg.Go(func() { httpErr = s.http.Shutdown(ctx) })
+	wg.Go(func() { h3Err = s.wt.H3.Shutdown(ctx) })
+	wg.Wait()
+
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for s.activeStreams.Load() > 0 && ctx.Err() == nil {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+		}
+	}
+	s.close()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return errors.Join(httpErr, h3Err)
+}
+
+// close tears everything down at once.
+func (s *Server) close() {
+	s.cancel()
+	_ = s.http.Close()
+	_ = s.wt.Close()
+	s.pipeSessions.Range(func(k, _ any) bool {
+		_ = k.(*core.PipeSession).Close("gateway shutdown")
+		return true
+	})
+	s.mu.Lock()
+	for _, conn := range s.packetConns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+}
+
+// serveTCP serves requests on the TCP listener through the shared mux.
+func (s *Server) serveTCP(w http.ResponseWriter, r *http.Request) {
+	if altSvc := s.altSvc.Load(); altSvc != nil {
+		w.Header().Set("Alt-Svc", *altSvc)
+	}
+	s.mux.ServeHTTP(w, r)
+}
+
+// serveSecretPath authenticates a client and upgrades it to a WebTransport
+// session, or hands requests on the TCP listener to the fallback.
+func (s *Server) serveSecretPath(w http.ResponseWriter, r *http.Request) {
+	// Log every attempt to the secret path
+	log.Printf("[DEBUG] connection attempt from %s to %s (Method: %s)", r.RemoteAddr, r.URL.Path, r.Method)
+
+	// Authenticate before upgrading: probes without a valid token only
+	// ever see the decoy site.
+	cfg := s.config()
+	token, now := core.AuthTokenFromRequest(r), time.Now()
+	tokenCred, err := cfg.Users.VerifyAuthToken(token, r.URL.Path, now)
+	if err == nil {
+		err = s.tokens.Check(token, now)
+	}
+	if err != nil && !(cfg.AuthTokenOptional && errors.Is(err, core.ErrAuthTokenMissing)) {
+		log.Printf("[SECURITY] Rejecting upgrade from %s: %v", r.RemoteAddr, err)
+		s.serveDecoy(w, r)
+		return
+	}
+
+	// WebSocket upgrades on the TCP listener carry fallback sessions for
+	// clients that cannot use QUIC (see fallback.go).
+	if r.ProtoMajor < 3 {
+		if !s.serveFallback(w, r, tokenCred) {
+			s.serveDecoy(w, r)
+		}
+		return
+	}
+
+	session, err := s.wt.Upgrade(w, r)
+	if err != nil {
+		log.Printf("[DEBUG] WebTransport upgrade failed (likely non-WT request): %v", err)
+		// Non-protocol requests must be indistinguishable from normal decoy traffic.
+		s.serveDecoy(w, r)
+		return
+	}
+
+	state := session.SessionState()
+	log.Printf("[INFO] WebTransport session upgraded for %s (ALPN: %s, protocol: %q)", r.RemoteAddr, state.ConnectionState.TLS.NegotiatedProtocol, state.ApplicationProtocol)
+	// Clients that offered versions but share none with us get a clear
+	// close reason instead of failing later on record decryption.
+	codec, err := core.CodecForProtocol(state.ApplicationProtocol)
+	if err == nil && state.ApplicationProtocol == "" && r.Header.Get("WT-Available-Protocols") != "" {
+		err = fmt.Errorf("%w: client offered %s", core.ErrUnsupportedProtocol, r.Header.Get("WT-Available-Protocols"))
+	}
+	if err != nil {
+		log.Printf("[INFO] Rejecting session from %s: %v", r.RemoteAddr, err)
+		_ = session.CloseWithError(sessionErrUnsupportedVersion,
+			fmt.Sprintf("unsupported protocol version; gateway speaks %s", strings.Join(core.SupportedProtocols(), ", ")))
+		return
+	}
+	// V5: Create NonceGenerator per session for counter-based nonce
+	ng, err := core.NewNonceGenerator()
+	if err != nil {
+		log.Printf("[ERROR] Failed to create NonceGenerator: %v", err)
+		return
+	}
+	// Server proofs are bound to this TLS connection (see core/proof.go).
+	binding, err := core.TLSBinding(state.ConnectionState.TLS)
+	if err != nil {
+		log.Printf("[ERROR] Failed to export TLS binding: %v", err)
+	}
+	s.handleSession(wtSession{session}, s.newSessionAuth(tokenCred, binding), ng, codec)
+}
+
+// session is the gateway end of a WebTransport or pipe session.
+type session interface {
+	acceptStream(ctx context.Context) (gatewayStream, error)
+	ReceiveDatagram(ctx context.Context) ([]byte, error)
+	SendDatagram(b []byte) error
+	Context() context.Context
+}
+
+type wtSession struct{ *webtransport.Session }
+
+func (s wtSession) acceptStream(ctx context.Context) (gatewayStream, error) {
+	stream, err := s.AcceptStream(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return stream, nil
+}
+
+type pipeSession struct{ *core.PipeSession }
+
+func (s pipeSession) acceptStream(ctx context.Context) (gatewayStream, error) {
+	stream, err := s.AcceptStream(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return stream, nil
+}
+
+// handleSession processes incoming streams of a session until it ends or the
+// server shuts down.
+// V5: Uses NonceGenerator for counter-based nonce instead of ReplayCache.
+func (s *Server) handleSession(sess session, auth *sessionAuth, ng *core.NonceGenerator, codec core.Codec) {
+	log.Println("New session established")
+	var streamID uint64
+
+	go s.runUDPRelay(sess, auth, ng)
+	go s.rekeyOnThreshold(sess.Context(), ng)
+
+	for {
+		stream, err := sess.acceptStream(s.ctx)
+		if err != nil {
+			log.Printf("AcceptStream failed: %v", err)
+			break
+		}
+
+		streamID++
+		s.activeStreams.Add(1)
+		go func(streamID uint64) {
+			defer s.activeStreams.Add(-1)
+			s.handleStream(stream, auth, streamID, ng, codec)
+		}(streamID)
+	}
+}
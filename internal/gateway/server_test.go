@@ -0,0 +1,265 @@
+package gateway
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"aether-rea/internal/core"
+)
+
+// TestServerPipe proxies a Core stream through a Server in memory to a local
+// echo target, then shuts the server down.
+func TestServerPipe(t *testing.T) {
+	const psk = "gateway-test-psk"
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	s, err := NewServer(Config{Users: testUsers(t, psk)})
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	tr := core.NewPipeTransport("")
+	defer tr.Close()
+	served := make(chan error, 1)
+	go func() { served <- s.ServePipe(tr) }()
+
+	c := core.New()
+	c.SetTransport(tr)
+	if err := c.Start(core.SessionConfig{
+		URL:           "https://pipe.test" + DefaultSecretPath,
+		PSK:           psk,
+		ListenAddr:    "127.0.0.1:0",
+		HttpProxyAddr: "127.0.0.1:0",
+	}); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer c.Close()
+
+	port := echo.Addr().(*net.TCPAddr).Port
+	handle, err := c.OpenStream(core.TargetAddress{Host: "127.0.0.1", Port: port}, nil)
+	if err != nil {
+		t.Fatalf("OpenStream: %v", err)
+	}
+	stream, _ := c.GetUnderlyingStream(handle)
+	if _, err := stream.Write([]byte("hello")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(stream, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("echo: got %q %v", buf, err)
+	}
+	if err := c.CloseStream(handle); err != nil {
+		t.Fatalf("CloseStream: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Errorf("Shutdown: %v", err)
+	}
+	select {
+	case err := <-served:
+		if !errors.Is(err, http.ErrServerClosed) {
+			t.Errorf("ServePipe: got %v, want ErrServerClosed", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ServePipe did not return after Shutdown")
+	}
+}
+
+// TestServerWebSocketFallback proxies a Core stream through the WebSocket
+// fallback on the TCP listener, with the server proof bound to the hello
+// connection.
+func TestServerWebSocketFallback(t *testing.T) {
+	const psk = "gateway-test-psk"
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	cert, err := generateSelfSignedCert("gateway.test")
+	if err != nil {
+		t.Fatalf("generateSelfSignedCert: %v", err)
+	}
+	s, err := NewServer(Config{
+		Users:     testUsers(t, psk),
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}},
+	})
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- s.Serve(nil, ln) }()
+
+	c := core.New()
+	if err := c.Start(core.SessionConfig{
+		URL:           "https://" + ln.Addr().String() + DefaultSecretPath,
+		PSK:           psk,
+		Transport:     core.TransportWebSocket,
+		AllowInsecure: true,
+		ListenAddr:    "127.0.0.1:0",
+		HttpProxyAddr: "127.0.0.1:0",
+	}); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer c.Close()
+
+	port := echo.Addr().(*net.TCPAddr).Port
+	handle, err := c.OpenStream(core.TargetAddress{Host: "127.0.0.1", Port: port}, nil)
+	if err != nil {
+		t.Fatalf("OpenStream: %v", err)
+	}
+	stream, _ := c.GetUnderlyingStream(handle)
+	if _, err := stream.Write([]byte("hello")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(stream, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("echo: got %q %v", buf, err)
+	}
+	if err := c.CloseStream(handle); err != nil {
+		t.Fatalf("CloseStream: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Errorf("Shutdown: %v", err)
+	}
+	if err := <-served; !errors.Is(err, http.ErrServerClosed) {
+		t.Errorf("Serve: got %v, want ErrServerClosed", err)
+	}
+}
+
+// TestServerDecoy checks that probes of the secret path see the decoy.
+func TestServerDecoy(t *testing.T) {
+	s, err := NewServer(Config{Users: testUsers(t, "psk")})
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	defer s.Shutdown(context.Background())
+
+	for path, want := range map[string]int{
+		"/health":         http.StatusOK,
+		"/":               http.StatusForbidden,
+		DefaultSecretPath: http.StatusForbidden,
+	} {
+		w := httptest.NewRecorder()
+		s.serveTCP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != want {
+			t.Errorf("GET %s: got %d, want %d", path, w.Code, want)
+		}
+	}
+}
+
+func testUsers(t *testing.T, psk string) *core.UserTable {
+	t.Helper()
+	users, err := core.NewUserTable([]core.User{{ID: "default", PSK: psk, Enabled: true}}, "default")
+	if err != nil {
+		t.Fatalf("NewUserTable: %v", err)
+	}
+	return users
+}
+
+// TestServerReload swaps runtime settings and keeps those fixed at start.
+func TestServerReload(t *testing.T) {
+	s, err := NewServer(Config{Users: testUsers(t, "psk")})
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	defer s.Shutdown(context.Background())
+
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "index.html"), []byte("welcome"), 0o600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if err := s.Reload(Config{Users: testUsers(t, "new-psk"), DecoyRoot: root, SecretPath: "/moved"}); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	w := httptest.NewRecorder()
+	s.serveTCP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "welcome" {
+		t.Errorf("decoy after reload: got %d %q", w.Code, w.Body)
+	}
+	cfg := s.config()
+	if cfg.SecretPath != DefaultSecretPath {
+		t.Errorf("secret path changed to %q", cfg.SecretPath)
+	}
+	if cfg.Users.Users()[0].PSK != "new-psk" || cfg.Scheduler != DefaultSchedulerConfig() {
+		t.Errorf("got %+v", cfg)
+	}
+
+	if err := s.Reload(Config{}); err == nil {
+		t.Error("Reload without users succeeded")
+	}
+	if s.config() != cfg {
+		t.Error("failed Reload replaced the config")
+	}
+}
+
+// TestSchedulerPartialDefaults checks that setting one scheduler field keeps
+// the defaults of the others.
+func TestSchedulerPartialDefaults(t *testing.T) {
+	cfg := Config{Users: testUsers(t, "psk"), Scheduler: SchedulerConfig{QueueSize: 512}}
+	if err := cfg.setDefaults(); err != nil {
+		t.Fatalf("setDefaults: %v", err)
+	}
+	want := DefaultSchedulerConfig()
+	want.QueueSize = 512
+	if cfg.Scheduler != want {
+		t.Errorf("scheduler: got %+v, want %+v", cfg.Scheduler, want)
+	}
+	tuning := cfg.Scheduler.forPayload(16 * 1024)
+	if !tuning.adaptive || tuning.coalesceWait != 3*time.Millisecond {
+		t.Errorf("tuning: got adaptive=%v coalesce=%s, want adaptive 3ms", tuning.adaptive, tuning.coalesceWait)
+	}
+
+	cfg.Scheduler = SchedulerConfig{CoalesceWait: NoCoalesce}
+	if err := cfg.setDefaults(); err != nil {
+		t.Fatalf("setDefaults: %v", err)
+	}
+	if got := cfg.Scheduler.forPayload(16 * 1024).coalesceWait; got != 0 {
+		t.Errorf("NoCoalesce: got %s, want 0", got)
+	}
+}
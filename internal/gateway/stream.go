@@ -0,0 +1,577 @@
+package gateway
+
+import (
+	"context"
+	"crypto/cipher"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	mathrand "math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"aether-rea/internal/core"
+
+	"github.com/quic-go/webtransport-go"
+)
+
+// gatewayStream is a bidirectional record stream: a WebTransport stream, an
+// WebSocket fallback stream (see fallback.go) or a pipe stream.
+type gatewayStream interface {
+	io.ReadWriteCloser
+	SetReadDeadline(t time.Time) error
+	CancelRead(code webtransport.StreamErrorCode)
+}
+
+// handleStream processes a single bidirectional stream.
+// V5: Authenticated records pass the session-wide (SessionID, Counter) replay filter.
+// The metadata key hint selects the user whose PSK authenticates the stream.
+func (s *Server) handleStream(stream gatewayStream, auth *sessionAuth, streamID uint64, ng *core.NonceGenerator, codec core.Codec) {
+	defer stream.Close()
+
+	reader := core.NewRecordReader(stream)
+	reader.SetCodec(codec)
+
+	// Read Metadata
+	readTimeout := jitterDuration(4*time.Second, 6*time.Second)
+	if err := stream.SetReadDeadline(time.Now().Add(readTimeout)); err != nil {
+		log.Printf("[SECURITY] [Stream %d] Failed to set metadata read deadline: %v", streamID, err)
+		return
+	}
+	record, err := reader.ReadNextRecord()
+	_ = stream.SetReadDeadline(time.Time{})
+	if err != nil {
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			handleHandshakeFailure(stream, streamID, "Metadata read timed out")
+			return
+		}
+		handleHandshakeFailure(stream, streamID, fmt.Sprintf("Failed to read metadata record: %v", err))
+		return
+	}
+
+	if record.Type == core.TypePing {
+		// V5: BuildPongRecord requires NonceGenerator
+		pongRecord, err := core.BuildPongRecord(ng)
+		if err != nil {
+			return
+		}
+		_, _ = stream.Write(pongRecord)
+		return
+	}
+
+	if record.Type == core.TypeServerProof {
+		// The client cannot verify our certificate: prove the PSK on this
+		// TLS connection before it sends any metadata.
+		cred, reply, err := auth.proveServer(record, ng)
+		if err != nil {
+			handleHandshakeFailure(stream, streamID, fmt.Sprintf("Server proof rejected: %v", err))
+			return
+		}
+		_, _ = stream.Write(reply)
+		log.Printf("[Stream %d] [user %s key=%s] Server proof sent", streamID, cred.User.ID, cred.KeyName())
+		return
+	}
+
+	if record.Type == core.TypeKeyExchange {
+		// Forward secrecy: every later record of the session is keyed by the
+		// ephemeral session key instead of the user's PSK.
+		cred, reply, err := auth.exchangeKeys(record, ng)
+		if err != nil {
+			handleHandshakeFailure(stream, streamID, fmt.Sprintf("Key exchange rejected: %v", err))
+			return
+		}
+		_, _ = stream.Write(reply)
+		log.Printf("[Stream %d] [user %s key=%s] Forward-secret session key established", streamID, cred.User.ID, cred.KeyName())
+		return
+	}
+
+	if record.Type == core.TypeRekey {
+		// Client rolled its key epoch: follow along with the per-session
+		// generator and confirm with our own rekey record.
+		cred := auth.credential()
+		if cred == nil {
+			handleHandshakeFailure(stream, streamID, "Rekey before authentication")
+			return
+		}
+		clientEpoch, err := core.ParseRekeyRecord(record, cred.PSK)
+		if err == nil {
+			err = s.replay.Check(cred.User.ID, record.SessionID, record.Counter)
+		}
+		if err != nil {
+			handleHandshakeFailure(stream, streamID, fmt.Sprintf("Rekey rejected: %v", err))
+			return
+		}
+		if err := ng.Rekey(); err != nil {
+			log.Printf("[Stream %d] Rekey failed: %v", streamID, err)
+			return
+		}
+		reply, err := core.BuildRekeyRecord(cred.PSK, ng)
+		if err != nil {
+			return
+		}
+		_, _ = stream.Write(reply)
+		log.Printf("[Stream %d] Session rekeyed (client epoch %d, gateway epoch %d)", streamID, clientEpoch, ng.Epoch())
+		return
+	}
+
+	if record.Type != core.TypeMetadata {
+		handleHandshakeFailure(stream, streamID, fmt.Sprintf("Invalid record type: %d", record.Type))
+		return
+	}
+
+	if !core.IsTimestampValid(record.TimestampNano, time.Now(), core.DefaultReplayWindow) {
+		handleHandshakeFailure(stream, streamID, "Timestamp outside allowed window")
+		return
+	}
+
+	cred, meta, err := auth.decryptMetadata(record)
+	if err != nil {
+		handleHandshakeFailure(stream, streamID, fmt.Sprintf("Decrypt failed: %v", err))
+		return
+	}
+	if err := s.replay.Check(cred.User.ID, record.SessionID, record.Counter); err != nil {
+		handleHandshakeFailure(stream, streamID, fmt.Sprintf("Metadata rejected: %v", err))
+		return
+	}
+	user := cred.User
+	if err := auth.bind(cred); err != nil {
+		handleHandshakeFailure(stream, streamID, fmt.Sprintf("User %s rejected: %v", user.ID, err))
+		return
+	}
+	psk := cred.PSK
+
+	// Optional AEAD data mode: upstream records must authenticate, downstream
+	// records are sealed with the stream's downstream key.
+	var downAEAD cipher.AEAD // nil unless DataAEAD
+	if meta.Options.DataAEAD {
+		upAEAD, dAEAD, err := core.NewStreamDataAEADs(psk, record.Header)
+		if err != nil {
+			handleHandshakeFailure(stream, streamID, fmt.Sprintf("Data key derivation failed: %v", err))
+			return
+		}
+		reader.SetDataAEAD(upAEAD)
+		downAEAD = dAEAD
+	}
+
+	// Per-stream negotiation: clamp the client's proposal to gateway limits.
+	accepted := core.NegotiateOptions(meta.Options, s.config().Negotiation)
+	reader.SetCompression(accepted.Compression)
+
+	stats := s.statsForUser(user.ID)
+	if !stats.acquireStream(user.MaxStreams) {
+		log.Printf("[Stream %d] [user %s] Stream limit %d reached", streamID, user.ID, user.MaxStreams)
+		writeError(stream, core.CodeResourceLimit, "stream limit reached", downAEAD, ng)
+		return
+	}
+	defer stats.releaseStream()
+	if cred.Key > 0 {
+		stats.secondary.Add(1)
+	}
+
+	targetAddr := net.JoinHostPort(meta.Host, strconv.Itoa(int(meta.Port)))
+	log.Printf("[Stream %d] [user %s key=%s] Connecting to %s (data_aead=%v, record=%d, padding=%s/%d%%, compression=%s)",
+		streamID, user.ID, cred.KeyName(), targetAddr, meta.Options.DataAEAD, accepted.RecordPayload, accepted.Padding, accepted.PaddingBudget, accepted.Compression)
+
+	conn, err := net.DialTimeout("tcp", targetAddr, 10*time.Second)
+	if err != nil {
+		code := core.ClassifyDialError(err)
+		log.Printf("[Stream %d] [user %s] Connect failed (%s): %v", streamID, user.ID, code, err)
+		// V5: writeError now requires NonceGenerator
+		writeError(stream, code, code.Message(), downAEAD, ng)
+		return
+	}
+	defer conn.Close()
+
+	// The Accept record doubles as the connected reply and reports the resolved
+	// target address. Clients that predate it skip it as an unknown record.
+	remoteAddr, _ := conn.RemoteAddr().(*net.TCPAddr)
+	acceptRecord, err := core.BuildAcceptRecord(accepted, remoteAddr, record.Header, psk, ng)
+	if err != nil {
+		log.Printf("[Stream %d] Build accept failed: %v", streamID, err)
+		return
+	}
+	if _, err := stream.Write(acceptRecord); err != nil {
+		return
+	}
+
+	encoder := core.NewDataRecordEncoder(accepted, downAEAD)
+	compressing := accepted.Compression != core.CompressionNone
+	padded := accepted.Padding != core.PaddingNone
+
+	// Bidirectional pipe
+	errCh := make(chan error, 2)
+
+	// WebTransport -> TCP
+	go func() {
+		buf := make([]byte, 512*1024)
+		for {
+			n, err := reader.Read(buf)
+			if n > 0 {
+				writeStart := time.Now()
+				if _, wErr := conn.Write(buf[:n]); wErr != nil {
+					errCh <- wErr
+					return
+				}
+				s.perf.observeWTToTCP(n, time.Since(writeStart))
+				stats.upBytes.Add(uint64(n))
+			}
+			if err != nil {
+				if err != io.EOF {
+					errCh <- err
+					return
+				}
+				// Client finished sending (FIN record or stream end):
+				// half-close the target and keep relaying its response.
+				if tcpConn, ok := conn.(*net.TCPConn); ok {
+					_ = tcpConn.CloseWrite()
+				}
+				errCh <- nil
+				return
+			}
+		}
+	}()
+
+	// TCP -> WebTransport
+	go func() {
+		type tcpToWTChunk struct {
+			data []byte
+			err  error
+		}
+		readBuf := make([]byte, 512*1024)
+		maxPayload := int(accepted.RecordPayload)
+		tuning := s.config().Scheduler.forPayload(maxPayload)
+		chunkCh := make(chan tcpToWTChunk, tuning.queueSize)
+		stageCtx, stageCancel := context.WithCancel(context.Background())
+		defer stageCancel()
+
+		// Stage A: read from TCP continuously and enqueue chunks.
+		go func() {
+			defer close(chunkCh)
+			for {
+				readStart := time.Now()
+				n, err := conn.Read(readBuf)
+				s.perf.observeTCPReadWait(time.Since(readStart))
+
+				if n > 0 {
+					chunk := make([]byte, n)
+					copy(chunk, readBuf[:n])
+					select {
+					case chunkCh <- tcpToWTChunk{data: chunk}:
+					case <-stageCtx.Done():
+						return
+					}
+				}
+
+				if err != nil {
+					select {
+					case chunkCh <- tcpToWTChunk{err: err}:
+					case <-stageCtx.Done():
+					}
+					return
+				}
+			}
+		}()
+
+		adaptiveEnabled := tuning.adaptive
+		minChunkCap, maxChunkCap := tuning.minChunk, tuning.maxChunk
+		baseCoalesceWait := tuning.coalesceWait
+		targetWriteUs := tuning.targetWriteUs
+		flushThreshold := tuning.flushThreshold
+		type schedState string
+		const (
+			schedNormal    schedState = "normal"
+			schedRecovery  schedState = "recovery"
+			schedCongested schedState = "congested"
+		)
+		type sendScheduler struct {
+			state        schedState
+			targetWrite  float64
+			ewmaWriteUs  float64
+			chunkCap     int
+			flushTarget  int
+			coalesceWait time.Duration
+		}
+		sched := &sendScheduler{
+			state:        schedNormal,
+			targetWrite:  targetWriteUs,
+			chunkCap:     flushThreshold,
+			flushTarget:  flushThreshold,
+			coalesceWait: baseCoalesceWait,
+		}
+		if !adaptiveEnabled {
+			sched.chunkCap = flushThreshold
+			sched.flushTarget = flushThreshold
+			sched.coalesceWait = baseCoalesceWait
+		}
+		clampChunk := func(v int) int {
+			if v < minChunkCap {
+				return minChunkCap
+			}
+			if v > maxChunkCap {
+				return maxChunkCap
+			}
+			return v
+		}
+		adjustScheduler := func(writeDur time.Duration, chunkSize int) {
+			writeUs := float64(writeDur.Nanoseconds()) / 1000.0
+			if sched.ewmaWriteUs == 0 {
+				sched.ewmaWriteUs = writeUs
+			} else {
+				const alpha = 0.20
+				sched.ewmaWriteUs = sched.ewmaWriteUs*(1-alpha) + writeUs*alpha
+			}
+			if !adaptiveEnabled {
+				return
+			}
+
+			switch {
+			case sched.ewmaWriteUs > sched.targetWrite*2.0:
+				sched.state = schedCongested
+				sched.chunkCap = clampChunk(sched.chunkCap - 2048)
+				sched.flushTarget = sched.chunkCap
+				sched.coalesceWait = 2 * time.Millisecond
+			case sched.ewmaWriteUs > sched.targetWrite*1.2:
+				sched.state = schedRecovery
+				sched.chunkCap = clampChunk(sched.chunkCap - 1024)
+				sched.flushTarget = sched.chunkCap
+				if sched.coalesceWait > 2*time.Millisecond {
+					sched.coalesceWait -= 1 * time.Millisecond
+				}
+			case sched.ewmaWriteUs < sched.targetWrite*0.7:
+				sched.state = schedNormal
+				if chunkSize >= sched.chunkCap/2 {
+					sched.chunkCap = clampChunk(sched.chunkCap + 512)
+				}
+				sched.flushTarget = sched.chunkCap
+				if sched.coalesceWait < baseCoalesceWait+2*time.Millisecond {
+					sched.coalesceWait += 1 * time.Millisecond
+				}
+			default:
+				// keep current state and tune
+			}
+			if sched.coalesceWait < 2*time.Millisecond {
+				sched.coalesceWait = 2 * time.Millisecond
+			}
+			if sched.coalesceWait > 20*time.Millisecond {
+				sched.coalesceWait = 20 * time.Millisecond
+			}
+		}
+		pending := make([]byte, 0, maxPayload*2)
+		flushTimer := time.NewTimer(time.Hour)
+		if !flushTimer.Stop() {
+			select {
+			case <-flushTimer.C:
+			default:
+			}
+		}
+		timerArmed := false
+		var readErr error
+
+		flushPending := func() error {
+			for len(pending) > 0 {
+				chunkSize := len(pending)
+				// Always use the negotiated maxPayload as the per-record limit.
+				// The adaptive scheduler controls WHEN to flush, not HOW BIG each record is.
+				chunkCap := maxPayload
+				if chunkSize > chunkCap {
+					chunkSize = chunkCap
+				}
+				chunk := pending[:chunkSize]
+				s.perf.observeTCPFlush(chunkSize)
+				s.perf.observeTCPAdaptive(chunkCap, sched.coalesceWait)
+				buildStart := time.Now()
+				recordBytes, buildErr := encoder.Build(chunk, ng)
+				if buildErr != nil {
+					return buildErr
+				}
+				s.perf.observeTCPBuild(time.Since(buildStart))
+				paddingLen := core.RecordPaddingLength(recordBytes)
+				wireLen := len(recordBytes) - 4 - core.RecordHeaderLength - paddingLen
+				if compressing {
+					s.perf.observeTCPCompression(chunkSize, wireLen)
+				}
+				if padded {
+					s.perf.observeTCPPadding(wireLen, paddingLen)
+				}
+				writeStart := time.Now()
+				if _, wErr := stream.Write(recordBytes); wErr != nil {
+					core.PutBuffer(recordBytes)
+					return wErr
+				}
+				writeDur := time.Since(writeStart)
+				s.perf.observeTCPToWT(len(recordBytes), writeDur)
+				stats.downBytes.Add(uint64(chunkSize))
+				adjustScheduler(writeDur, chunkSize)
+				core.PutBuffer(recordBytes)
+				pending = pending[chunkSize:]
+			}
+			pending = pending[:0]
+			return nil
+		}
+
+		resetFlushTimer := func() {
+			if timerArmed {
+				if !flushTimer.Stop() {
+					select {
+					case <-flushTimer.C:
+					default:
+					}
+				}
+			}
+			flushTimer.Reset(sched.coalesceWait)
+			timerArmed = true
+		}
+
+		stopFlushTimer := func() {
+			if !timerArmed {
+				return
+			}
+			if !flushTimer.Stop() {
+				select {
+				case <-flushTimer.C:
+				default:
+				}
+			}
+			timerArmed = false
+		}
+
+		for {
+			if len(pending) > 0 && !timerArmed {
+				resetFlushTimer()
+			}
+			select {
+			case item, ok := <-chunkCh:
+				if !ok {
+					stopFlushTimer()
+					if len(pending) > 0 {
+						if fErr := flushPending(); fErr != nil {
+							errCh <- fErr
+							return
+						}
+					}
+					if readErr != nil && readErr != io.EOF {
+						// Ignore "use of closed network connection" if caused by other side closing
+						if !strings.Contains(readErr.Error(), "closed network connection") {
+							errCh <- readErr
+						} else {
+							errCh <- nil
+						}
+						return
+					}
+					// Target finished sending: forward FIN and end our send side
+					// (the latter also signals EOF to clients without FIN support).
+					var finRecord []byte
+					var fErr error
+					if downAEAD != nil {
+						finRecord, fErr = core.BuildSealedFinRecord(downAEAD, ng)
+					} else {
+						finRecord, fErr = core.BuildFinRecord(ng)
+					}
+					if fErr == nil {
+						_, _ = stream.Write(finRecord)
+						core.PutBuffer(finRecord)
+					}
+					_ = stream.Close()
+					errCh <- nil
+					return
+				}
+
+				if item.err != nil {
+					readErr = item.err
+					continue
+				}
+				if len(item.data) == 0 {
+					continue
+				}
+
+				pending = append(pending, item.data...)
+				if len(pending) >= sched.flushTarget {
+					stopFlushTimer()
+					if fErr := flushPending(); fErr != nil {
+						errCh <- fErr
+						return
+					}
+				} else {
+					resetFlushTimer()
+				}
+			case <-flushTimer.C:
+				timerArmed = false
+				if len(pending) > 0 {
+					if fErr := flushPending(); fErr != nil {
+						errCh <- fErr
+						return
+					}
+				}
+			case <-stageCtx.Done():
+				return
+			}
+		}
+	}()
+
+	// Both legs drain independently after a half-close; an error on either
+	// leg tears the whole stream down.
+	for i := 0; i < 2; i++ {
+		if err := <-errCh; err != nil {
+			log.Printf("[Stream %d] Stream error: %v", streamID, err)
+			stream.CancelRead(0)
+			break
+		}
+	}
+	// Cleanup happens via defer stream.Close() and defer conn.Close()
+}
+
+// V5: writeError now requires NonceGenerator
+// In AEAD data mode (aead != nil) the record is sealed with the downstream key.
+func writeError(w io.Writer, code core.ErrorCode, msg string, aead cipher.AEAD, ng *core.NonceGenerator) {
+	var record []byte
+	var err error
+	if aead != nil {
+		record, err = core.BuildSealedErrorRecord(code, msg, aead, ng)
+	} else {
+		record, err = core.BuildErrorRecord(code, msg, ng)
+	}
+	if err != nil {
+		return
+	}
+	w.Write(record)
+	core.PutBuffer(record)
+}
+
+func handleHandshakeFailure(stream gatewayStream, streamID uint64, reason string) {
+	log.Printf("[SECURITY] [Stream %d] %s", streamID, reason)
+	time.Sleep(jitterDuration(100*time.Millisecond, 1000*time.Millisecond))
+	decoyLen, err := randomIntRange(32, 128)
+	if err != nil {
+		decoyLen = 64
+	}
+	decoy := make([]byte, decoyLen)
+	if _, err := rand.Read(decoy); err == nil {
+		_, _ = stream.Write(decoy)
+	}
+}
+
+func randomIntRange(min, max int) (int, error) {
+	if min < 0 || max < min {
+		return 0, fmt.Errorf("invalid range: %d-%d", min, max)
+	}
+	if min == max {
+		return min, nil
+	}
+	n, err := rand.Int(rand.Reader, big.NewInt(int64(max-min+1)))
+	if err != nil {
+		return 0, err
+	}
+	return min + int(n.Int64()), nil
+}
+
+func jitterDuration(min, max time.Duration) time.Duration {
+	if max <= min {
+		return min
+	}
+	diff := max - min
+	return min + time.Duration(mathrand.Int63n(int64(diff)+1))
+}
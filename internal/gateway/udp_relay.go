@@ -0,0 +1,272 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"aether-rea/internal/core"
+)
+
+// gatewayUDPFlow is the outbound socket backing one client FlowID.
+type gatewayUDPFlow struct {
+	id       uint32
+	conn     *net.UDPConn
+	mu       sync.Mutex
+	lastSeen time.Time
+	targets  map[string]*net.UDPAddr
+}
+
+func (f *gatewayUDPFlow) touch() {
+	f.mu.Lock()
+	f.lastSeen = time.Now()
+	f.mu.Unlock()
+}
+
+func (f *gatewayUDPFlow) idleSince(now time.Time) time.Duration {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return now.Sub(f.lastSeen)
+}
+
+// maxFlowTargets caps the resolved domain targets cached per flow.
+const maxFlowTargets = 64
+
+// resolve returns the address for host:port. IP literals need no lookup and
+// are never cached; resolved domains are cached up to maxFlowTargets, evicting
+// an arbitrary entry when full, so a flow spraying destinations stays bounded.
+func (f *gatewayUDPFlow) resolve(host string, port uint16) (*net.UDPAddr, error) {
+	if ip, err := netip.ParseAddr(host); err == nil {
+		return net.UDPAddrFromAddrPort(netip.AddrPortFrom(ip, port)), nil
+	}
+	key := net.JoinHostPort(host, strconv.Itoa(int(port)))
+	f.mu.Lock()
+	addr, ok := f.targets[key]
+	f.mu.Unlock()
+	if ok {
+		return addr, nil
+	}
+	addr, err := net.ResolveUDPAddr("udp", key)
+	if err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	if len(f.targets) >= maxFlowTargets {
+		for evict := range f.targets {
+			delete(f.targets, evict)
+			break
+		}
+	}
+	f.targets[key] = addr
+	f.mu.Unlock()
+	return addr, nil
+}
+
+// dropLogInterval is the minimum gap between dropped-datagram log lines.
+const dropLogInterval = 10 * time.Second
+
+// dropLogger rate-limits the per-packet "dropping datagram" log so a flood
+// of bad datagrams cannot flood the log; suppressed lines are counted.
+type dropLogger struct {
+	mu         sync.Mutex
+	last       time.Time
+	suppressed int
+}
+
+func (l *dropLogger) log(err error) {
+	l.mu.Lock()
+	now := time.Now()
+	if now.Sub(l.last) < dropLogInterval {
+		l.suppressed++
+		l.mu.Unlock()
+		return
+	}
+	suppressed := l.suppressed
+	l.last, l.suppressed = now, 0
+	l.mu.Unlock()
+	if suppressed > 0 {
+		log.Printf("[SECURITY] Dropping datagram: %v (%d more dropped since last report)", err, suppressed)
+		return
+	}
+	log.Printf("[SECURITY] Dropping datagram: %v", err)
+}
+
+// udpSessionRelay relays datagrams of one session.
+type udpSessionRelay struct {
+	session     session
+	auth        *sessionAuth
+	idleTimeout time.Duration
+	maxFlows    int
+	codec       atomic.Pointer[userDatagramCodec]
+	replay      *core.ReplayFilter
+	ng          *core.NonceGenerator
+	drops       dropLogger
+
+	mu    sync.Mutex
+	flows map[uint32]*gatewayUDPFlow
+}
+
+// userDatagramCodec is the datagram codec of the session's credential.
+type userDatagramCodec struct {
+	cred  *core.Credential
+	codec *core.DatagramCodec
+}
+
+// runUDPRelay serves session datagrams until the session closes.
+func (s *Server) runUDPRelay(sess session, auth *sessionAuth, ng *core.NonceGenerator) {
+	r := &udpSessionRelay{
+		session:     sess,
+		auth:        auth,
+		idleTimeout: s.config().UDPFlowIdleTimeout,
+		maxFlows:    s.config().UDPMaxFlows,
+		replay:      s.datagrams,
+		ng:          ng,
+		flows:       make(map[uint32]*gatewayUDPFlow),
+	}
+	ctx := sess.Context()
+	defer r.closeAll()
+	go r.expireIdle(ctx)
+
+	for {
+		b, err := sess.ReceiveDatagram(ctx)
+		if err != nil {
+			return
+		}
+		codec, err := r.codecFor()
+		if err != nil {
+			r.drops.log(err)
+			continue
+		}
+		d, err := codec.codec.Open(b)
+		if err == nil {
+			err = r.auth.bind(codec.cred)
+		}
+		if err != nil {
+			r.drops.log(err)
+			continue
+		}
+		flow, err := r.flowFor(d.FlowID)
+		if err != nil {
+			log.Printf("[UDP] Flow %d unavailable: %v", d.FlowID, err)
+			continue
+		}
+		addr, err := flow.resolve(d.Host, d.Port)
+		if err != nil {
+			log.Printf("[UDP] Flow %d resolve %s failed: %v", d.FlowID, d.Host, err)
+			continue
+		}
+		flow.touch()
+		if _, err := flow.conn.WriteToUDP(d.Payload, addr); err != nil {
+			log.Printf("[UDP] Flow %d write failed: %v", d.FlowID, err)
+		}
+	}
+}
+
+// codecFor returns the codec of the session's credential. Datagrams carry no
+// key hint, so before a stream authenticates only the default user can send them.
+func (r *udpSessionRelay) codecFor() (*userDatagramCodec, error) {
+	cred := r.auth.credential()
+	if cred == nil {
+		return nil, errUDPUnauthenticated
+	}
+	if c := r.codec.Load(); c != nil && c.cred.PSK == cred.PSK {
+		return c, nil
+	}
+	c := &userDatagramCodec{cred: cred, codec: core.NewDatagramCodecWithReplay(cred.PSK, r.replay, cred.User.ID)}
+	r.codec.Store(c)
+	return c, nil
+}
+
+func (r *udpSessionRelay) flowFor(id uint32) (*gatewayUDPFlow, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if flow, ok := r.flows[id]; ok {
+		return flow, nil
+	}
+	if len(r.flows) >= r.maxFlows {
+		return nil, errUDPFlowLimit
+	}
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, err
+	}
+	flow := &gatewayUDPFlow{
+		id:       id,
+		conn:     conn,
+		lastSeen: time.Now(),
+		targets:  make(map[string]*net.UDPAddr),
+	}
+	r.flows[id] = flow
+	go r.readFlow(flow)
+	return flow, nil
+}
+
+// readFlow relays replies from targets back to the client.
+func (r *udpSessionRelay) readFlow(flow *gatewayUDPFlow) {
+	buf := make([]byte, 64*1024)
+	for {
+		n, src, err := flow.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		flow.touch()
+		codec, err := r.codecFor()
+		if err != nil {
+			continue
+		}
+		record, err := codec.codec.Seal(&core.Datagram{
+			FlowID:  flow.id,
+			Host:    src.IP.String(),
+			Port:    uint16(src.Port),
+			Payload: buf[:n],
+		}, r.ng)
+		if err != nil {
+			log.Printf("[UDP] Flow %d seal failed: %v", flow.id, err)
+			continue
+		}
+		if err := r.session.SendDatagram(record); err != nil {
+			// Oversized or congested datagrams are dropped, as UDP would.
+			continue
+		}
+	}
+}
+
+func (r *udpSessionRelay) expireIdle(ctx context.Context) {
+	ticker := time.NewTicker(r.idleTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			r.mu.Lock()
+			for id, flow := range r.flows {
+				if flow.idleSince(now) > r.idleTimeout {
+					flow.conn.Close()
+					delete(r.flows, id)
+				}
+			}
+			r.mu.Unlock()
+		}
+	}
+}
+
+func (r *udpSessionRelay) closeAll() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for id, flow := range r.flows {
+		flow.conn.Close()
+		delete(r.flows, id)
+	}
+}
+
+var (
+	errUDPFlowLimit       = errors.New("udp flow limit reached")
+	errUDPUnauthenticated = errors.New("session not authenticated")
+)
@@ -0,0 +1,175 @@
+package gateway
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"aether-rea/internal/core"
+)
+
+// sessionAuth binds a session to the user of its first authenticated record.
+// Rekey and datagram records carry no key hint, so they use the key that
+// authenticated the session, or else the key of the CONNECT auth token.
+type sessionAuth struct {
+	users   *core.UserTable
+	replay  *core.ReplayFilter
+	token   *core.Credential // nil for legacy clients without a token
+	binding []byte           // TLS exporter for server proofs
+	bound   atomic.Pointer[core.Credential]
+}
+
+func (s *Server) newSessionAuth(token *core.Credential, binding []byte) *sessionAuth {
+	return &sessionAuth{users: s.config().Users, replay: s.replay, token: token, binding: binding}
+}
+
+// bind attaches cred to the session; a session never switches users.
+func (a *sessionAuth) bind(cred *core.Credential) error {
+	if a.token != nil && a.token.User.ID != cred.User.ID {
+		return fmt.Errorf("session belongs to user %q", a.token.User.ID)
+	}
+	if a.bound.CompareAndSwap(nil, cred) {
+		return nil
+	}
+	if current := a.bound.Load(); current.User.ID != cred.User.ID {
+		return fmt.Errorf("session belongs to user %q", current.User.ID)
+	}
+	return nil
+}
+
+// decryptMetadata authenticates a metadata record: with the session key once
+// a forward-secret key exchange bound the session, else via the user table.
+func (a *sessionAuth) decryptMetadata(record *core.Record) (*core.Credential, *core.Metadata, error) {
+	if cred := a.bound.Load(); cred != nil && cred.Forward {
+		meta, err := core.DecryptMetadata(record, cred.PSK)
+		if err != nil {
+			return nil, nil, err
+		}
+		return cred, meta, nil
+	}
+	return a.users.DecryptMetadata(record, time.Now())
+}
+
+// exchangeKeys answers a key exchange record and binds the session to the
+// resulting forward-secret session key. It must precede every other record
+// that authenticates the session.
+func (a *sessionAuth) exchangeKeys(record *core.Record, ng *core.NonceGenerator) (*core.Credential, []byte, error) {
+	var clientPub []byte
+	cred, err := a.users.Authenticate(record, time.Now(), func(psk string) error {
+		var err error
+		clientPub, err = core.ParseKeyExchangeRequest(record, psk)
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := a.replay.Check(cred.User.ID, record.SessionID, record.Counter); err != nil {
+		return nil, nil, err
+	}
+	reply, sessionKey, err := core.BuildKeyExchangeReply(clientPub, cred.PSK, ng)
+	if err != nil {
+		return nil, nil, err
+	}
+	forward := &core.Credential{User: cred.User, Key: cred.Key, PSK: sessionKey, Forward: true}
+	if a.token != nil && a.token.User.ID != cred.User.ID {
+		return nil, nil, fmt.Errorf("session belongs to user %q", a.token.User.ID)
+	}
+	if !a.bound.CompareAndSwap(nil, forward) {
+		return nil, nil, errors.New("session already authenticated")
+	}
+	return forward, reply, nil
+}
+
+// proveServer answers a server proof request with the key that authenticated
+// it. The request does not bind the session, so a key exchange may follow.
+func (a *sessionAuth) proveServer(record *core.Record, ng *core.NonceGenerator) (*core.Credential, []byte, error) {
+	if a.binding == nil {
+		return nil, nil, errors.New("no TLS binding")
+	}
+	var nonce []byte
+	cred, err := a.users.Authenticate(record, time.Now(), func(psk string) error {
+		var err error
+		nonce, err = core.ParseServerProofRequest(record, psk)
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	if a.token != nil && a.token.User.ID != cred.User.ID {
+		return nil, nil, fmt.Errorf("session belongs to user %q", a.token.User.ID)
+	}
+	if err := a.replay.Check(cred.User.ID, record.SessionID, record.Counter); err != nil {
+		return nil, nil, err
+	}
+	reply, err := core.BuildServerProofReply(nonce, cred.PSK, a.binding, ng)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cred, reply, nil
+}
+
+// credential returns the bound credential, or before binding the token's
+// credential or the default user's primary key.
+func (a *sessionAuth) credential() *core.Credential {
+	if cred := a.bound.Load(); cred != nil {
+		return cred
+	}
+	if a.token != nil {
+		return a.token
+	}
+	if u := a.users.Fallback(); u != nil && u.Enabled {
+		return &core.Credential{User: u, PSK: u.PSK}
+	}
+	return nil
+}
+
+// userStats tracks one user's streams and traffic for logs and limits.
+type userStats struct {
+	activeStreams atomic.Int64
+	totalStreams  atomic.Uint64
+	secondary     atomic.Uint64 // streams authenticated by a secondary key
+	rejected      atomic.Uint64
+	upBytes       atomic.Uint64 // client -> target
+	downBytes     atomic.Uint64 // target -> client
+}
+
+func (s *Server) statsForUser(id string) *userStats {
+	if stats, ok := s.users.Load(id); ok {
+		return stats.(*userStats)
+	}
+	stats, _ := s.users.LoadOrStore(id, &userStats{})
+	return stats.(*userStats)
+}
+
+// acquireStream reserves a stream slot under the user's MaxStreams limit.
+func (s *userStats) acquireStream(limit int) bool {
+	if n := s.activeStreams.Add(1); limit > 0 && n > int64(limit) {
+		s.activeStreams.Add(-1)
+		s.rejected.Add(1)
+		return false
+	}
+	s.totalStreams.Add(1)
+	return true
+}
+
+func (s *userStats) releaseStream() {
+	s.activeStreams.Add(-1)
+}
+
+// logUserStats prints one [PERF-GW-USER] line per user seen so far.
+func (s *Server) logUserStats() {
+	var ids []string
+	s.users.Range(func(k, _ any) bool {
+		ids = append(ids, k.(string))
+		return true
+	})
+	sort.Strings(ids)
+	for _, id := range ids {
+		stats := s.statsForUser(id)
+		log.Printf("[PERF-GW-USER] user=%s active=%d streams=%d secondary=%d rejected=%d up_bytes=%d down_bytes=%d",
+			id, stats.activeStreams.Load(), stats.totalStreams.Load(), stats.secondary.Load(), stats.rejected.Load(), stats.upBytes.Load(), stats.downBytes.Load())
+	}
+}